@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/gococo/gococo/internal/coverage"
+	"github.com/gococo/gococo/internal/server"
+)
+
+// runCheck compares the statement coverage of a server or a saved snapshot
+// with minimum percentages for the total, packages and files, for gating CI
+// jobs. It prints the violations and exits with status 1 if there are any.
+func runCheck() {
+	addr := "127.0.0.1:7778"
+	snapshotPath := ""
+	root := "."
+	var th coverage.Thresholds
+	var pkgArgs, fileArgs []string
+	args := os.Args[2:]
+	for i := 0; i < len(args); i++ {
+		name, value, hasValue := strings.Cut(args[i], "=")
+		if !hasValue && i+1 < len(args) {
+			value = args[i+1]
+		}
+		var err error
+		switch name {
+		case "--server", "-server":
+			addr = value
+		case "--snapshot", "-snapshot":
+			snapshotPath = value
+		case "--root", "-root":
+			root = value
+		case "--min", "-min":
+			th.Total, err = coverage.ParsePercent(value)
+		case "--min-pkg", "-min-pkg":
+			pkgArgs = append(pkgArgs, value)
+		case "--min-file", "-min-file":
+			fileArgs = append(fileArgs, value)
+		default:
+			fmt.Fprintf(os.Stderr, "check error: unknown flag %s\n", args[i])
+			os.Exit(2)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "check error: %s: %v\n", name, err)
+			os.Exit(2)
+		}
+		if !hasValue {
+			i++
+		}
+	}
+	if th.Total == 0 && len(pkgArgs) == 0 && len(fileArgs) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: gococo check [--min PERCENT] [--min-pkg [PATTERN=]PERCENT]... [--min-file [PATTERN=]PERCENT]... [--server HOST:PORT | --snapshot FILE] [--root DIR]")
+		os.Exit(2)
+	}
+
+	absRoot, _ := filepath.Abs(root)
+	importPath := server.ImportPathResolver(absRoot)
+	parse := func(flag string, values []string) []coverage.Threshold {
+		var ths []coverage.Threshold
+		for _, v := range values {
+			t, err := coverage.ParseThreshold(v)
+			if err == nil {
+				t.Pattern, err = resolvePattern(importPath, t.Pattern)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "check error: %s %s: %v\n", flag, v, err)
+				os.Exit(2)
+			}
+			ths = append(ths, t)
+		}
+		return ths
+	}
+	th.Packages = parse("--min-pkg", pkgArgs)
+	th.Files = parse("--min-file", fileArgs)
+
+	snap, err := loadSnapshot(addr, snapshotPath, false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "check error: %v\n", err)
+		os.Exit(1)
+	}
+	summary := coverage.Summarize(snap.Blocks)
+	violations, unmatched := th.Check(summary)
+	for _, t := range unmatched {
+		fmt.Fprintf(os.Stderr, "[gococo] warning: no package or file matches %s\n", t.Pattern)
+	}
+
+	total := fmt.Sprintf("%.1f%% (%d/%d stmts)", summary.Percentage(), summary.HitStmts, summary.TotalStmts)
+	if len(violations) == 0 {
+		fmt.Printf("[gococo] coverage check passed: %s\n", total)
+		return
+	}
+	fmt.Printf("[gococo] coverage check failed: %s, %d below threshold\n\n", total, len(violations))
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SCOPE\tNAME\tCOVERAGE\tSTMTS\tMIN")
+	for _, v := range violations {
+		name := v.Name
+		if name == "" {
+			name = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%.1f%%\t%d/%d\t%.1f%%\n", v.Scope, name, v.Percentage(), v.HitStmts, v.TotalStmts, v.Min)
+	}
+	tw.Flush()
+	os.Exit(1)
+}
+
+// resolvePattern turns a pattern relative to the current directory, like
+// "./internal/...", into an import path pattern, as the go command does.
+// Other patterns are returned unchanged.
+func resolvePattern(importPath func(dir string) (string, bool), pattern string) (string, error) {
+	if pattern != "." && pattern != ".." && !strings.HasPrefix(pattern, "./") && !strings.HasPrefix(pattern, "../") {
+		return pattern, nil
+	}
+	// Split off the elements from the first one with a wildcard.
+	elems := strings.Split(pattern, "/")
+	n := 0
+	for n < len(elems) && !strings.Contains(elems[n], "...") && !strings.ContainsAny(elems[n], "*?[") {
+		n++
+	}
+	dir, err := filepath.Abs(filepath.FromSlash(strings.Join(elems[:n], "/")))
+	if err != nil {
+		return "", err
+	}
+	p, ok := importPath(dir)
+	if !ok {
+		return "", fmt.Errorf("%s is not in a module under --root", dir)
+	}
+	if rest := strings.Join(elems[n:], "/"); rest != "" {
+		p += "/" + rest
+	}
+	return p, nil
+}
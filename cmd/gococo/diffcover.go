@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/gococo/gococo/internal/coverage"
+	"github.com/gococo/gococo/internal/diffcover"
+	"github.com/gococo/gococo/internal/server"
+)
+
+// runDiffcover reports the coverage of the statements changed in the git
+// repository of --root since a base revision, per file, with the lines of
+// the changed statements that never ran. With --min, it exits with status 1
+// when the changed statements are covered less.
+func runDiffcover() {
+	addr := "127.0.0.1:7778"
+	snapshotPath := ""
+	root := "."
+	base := ""
+	minPercent := -1.0
+	args := os.Args[2:]
+	for i := 0; i < len(args); i++ {
+		name, value, hasValue := strings.Cut(args[i], "=")
+		if !hasValue && i+1 < len(args) {
+			value = args[i+1]
+		}
+		switch name {
+		case "--base", "-base":
+			base = value
+		case "--server", "-server":
+			addr = value
+		case "--snapshot", "-snapshot":
+			snapshotPath = value
+		case "--root", "-root":
+			root = value
+		case "--min", "-min":
+			var err error
+			if minPercent, err = coverage.ParsePercent(value); err != nil {
+				fmt.Fprintf(os.Stderr, "diffcover error: --min: %v\n", err)
+				os.Exit(2)
+			}
+		default:
+			fmt.Fprintf(os.Stderr, "diffcover error: unknown flag %s\n", args[i])
+			os.Exit(2)
+		}
+		if !hasValue {
+			i++
+		}
+	}
+	if base == "" {
+		fmt.Fprintln(os.Stderr, "usage: gococo diffcover --base REV [--server HOST:PORT | --snapshot FILE] [--root DIR] [--min PERCENT]")
+		os.Exit(2)
+	}
+
+	snap, err := loadSnapshot(addr, snapshotPath, false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "diffcover error: %v\n", err)
+		os.Exit(1)
+	}
+	absRoot, _ := filepath.Abs(root)
+	res, err := diffcover.Compute(snap.Blocks, diffcover.Options{
+		Dir:        absRoot,
+		Base:       base,
+		ImportPath: server.ImportPathResolver(absRoot),
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "diffcover error: %v\n", err)
+		os.Exit(1)
+	}
+
+	mergeBase := res.MergeBase
+	if len(mergeBase) > 12 {
+		mergeBase = mergeBase[:12]
+	}
+	if res.TotalStmts == 0 {
+		fmt.Printf("[gococo] no changed statements since %s (merge base %s)\n", base, mergeBase)
+	} else {
+		fmt.Printf("[gococo] changed statements since %s (merge base %s): %.1f%% (%d/%d covered)\n\n",
+			base, mergeBase, res.Percentage(), res.HitStmts, res.TotalStmts)
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "FILE\tCOVERAGE\tSTMTS\tUNCOVERED LINES")
+		for _, f := range res.Files {
+			var lines []string
+			for _, r := range f.Uncovered() {
+				if r.Start == r.End {
+					lines = append(lines, fmt.Sprint(r.Start))
+				} else {
+					lines = append(lines, fmt.Sprintf("%d-%d", r.Start, r.End))
+				}
+			}
+			fmt.Fprintf(tw, "%s\t%.1f%%\t%d/%d\t%s\n", f.Path, f.Percentage(), f.HitStmts, f.TotalStmts, strings.Join(lines, ", "))
+		}
+		tw.Flush()
+	}
+	if len(res.Unmeasured) > 0 {
+		fmt.Printf("\nChanged files without coverage data: %s\n", strings.Join(res.Unmeasured, ", "))
+	}
+
+	if res.TotalStmts > 0 && res.Percentage() < minPercent {
+		fmt.Fprintf(os.Stderr, "[gococo] changed statements are %.1f%% covered, below --min %.1f%%\n", res.Percentage(), minPercent)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// exportFormats maps the formats of `gococo export` to the server endpoints
+// producing them.
+var exportFormats = map[string]string{
+	"json":         "/api/coverage/snapshot",
+	"coverprofile": "/api/coverage/profile",
+	"lcov":         "/api/coverage/lcov",
+	"cobertura":    "/api/coverage/cobertura",
+	"sarif":        "/api/coverage/sarif",
+}
+
+// sarifFlags maps the SARIF options of `gococo export` to the query
+// parameters of /api/coverage/sarif.
+var sarifFlags = map[string]string{
+	"--rule-id":  "rule",
+	"--level":    "level",
+	"--min-hits": "min_hits",
+}
+
+// runExport writes the coverage held by a server in one of exportFormats,
+// to -o or standard output. The json format is a coverage.Snapshot, which
+// --sources makes self-contained by embedding the covered source files. The
+// sarif format lists uncovered blocks, configured by sarifFlags.
+func runExport() {
+	addr := "127.0.0.1:7778"
+	format := "coverprofile"
+	output := ""
+	sources := false
+	query := url.Values{}
+	args := os.Args[2:]
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--sources" || args[i] == "-sources" {
+			sources = true
+			continue
+		}
+		name, value, hasValue := strings.Cut(args[i], "=")
+		if !hasValue && i+1 < len(args) {
+			value = args[i+1]
+		}
+		switch param, isSARIF := sarifFlags[name]; {
+		case isSARIF:
+			query.Set(param, value)
+		case name == "--server" || name == "-server":
+			addr = value
+		case name == "--format" || name == "-format":
+			format = value
+		case name == "-o" || name == "--output":
+			output = value
+		default:
+			fmt.Fprintf(os.Stderr, "export error: unknown flag %s\n", args[i])
+			os.Exit(2)
+		}
+		if !hasValue {
+			i++
+		}
+	}
+
+	path, ok := exportFormats[format]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "export error: unknown format %q\n", format)
+		os.Exit(2)
+	}
+	if len(query) > 0 && format != "sarif" {
+		fmt.Fprintln(os.Stderr, "export error: --rule-id, --level and --min-hits require --format=sarif")
+		os.Exit(2)
+	}
+	if sources {
+		if format != "json" {
+			fmt.Fprintln(os.Stderr, "export error: --sources requires --format=json")
+			os.Exit(2)
+		}
+		query.Set("sources", "1")
+	}
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	if err := export(addr, path, output); err != nil {
+		fmt.Fprintf(os.Stderr, "export error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func export(addr, path, output string) error {
+	resp, err := http.Get("http://" + addr + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	if output == "" {
+		_, err = io.Copy(os.Stdout, resp.Body)
+		return err
+	}
+	f, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
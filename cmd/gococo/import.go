@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// eventsHeader starts the event files written by agents in offline mode.
+// The rest of the line holds the agent's registration parameters.
+const eventsHeader = "# gococo events "
+
+// runImport uploads coverprofiles to a server, where their hits are shown
+// alongside live coverage under a label. Event files written by agents in
+// offline mode, recognized by their header, are replayed as the events of
+// a new agent.
+func runImport() {
+	addr := "127.0.0.1:7778"
+	label := ""
+	var files []string
+	args := os.Args[2:]
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		name, value, hasValue := strings.Cut(arg, "=")
+		if !strings.HasPrefix(name, "-") {
+			files = append(files, arg)
+			continue
+		}
+		if !hasValue && i+1 < len(args) {
+			value = args[i+1]
+			i++
+		}
+		switch name {
+		case "--server", "-server":
+			addr = value
+		case "--label", "-label":
+			label = value
+		default:
+			fmt.Fprintf(os.Stderr, "import error: unknown flag %s\n", arg)
+			os.Exit(2)
+		}
+	}
+	if len(files) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: gococo import [--server HOST:PORT] [--label NAME] FILE...")
+		os.Exit(2)
+	}
+
+	var profiles []string
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "import error: %v\n", err)
+			os.Exit(1)
+		}
+		isEvents := bytes.HasPrefix(data, []byte(eventsHeader))
+		if !isEvents && filepath.Ext(file) == ".events" {
+			// The agent writes the header first, so the file was cut short
+			// or is not an event file.
+			msg := "invalid event file: no \"# gococo events\" header"
+			if len(data) == 0 {
+				msg = "empty event file"
+			}
+			fmt.Fprintf(os.Stderr, "import error: %s: %s\n", file, msg)
+			os.Exit(1)
+		}
+		if !isEvents {
+			profiles = append(profiles, file)
+			continue
+		}
+		if err := replayEvents(addr, file, data); err != nil {
+			fmt.Fprintf(os.Stderr, "import error: %s: %v\n", file, err)
+			os.Exit(1)
+		}
+	}
+	if len(profiles) == 0 {
+		return
+	}
+
+	// Profiles go in one request: importing a label replaces its hits, and
+	// a concatenation of profiles is itself a profile.
+	if err := importProfiles(addr, label, profiles); err != nil {
+		fmt.Fprintf(os.Stderr, "import error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// replayEvents registers the agent described by the header of an event
+// file and sends the events that follow it, as the agent would have.
+func replayEvents(addr, file string, data []byte) error {
+	header, events, _ := bytes.Cut(data, []byte("\n"))
+	params := strings.TrimPrefix(string(header), eventsHeader)
+	if _, err := url.ParseQuery(params); err != nil {
+		return fmt.Errorf("invalid header: %v", err)
+	}
+
+	resp, err := http.Get("http://" + addr + "/api/internal/register?" + params)
+	if err != nil {
+		return err
+	}
+	id, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("register: %s: %s", resp.Status, strings.TrimSpace(string(id)))
+	}
+	agentID := strings.TrimSpace(string(id))
+
+	resp, err = http.Post("http://"+addr+"/api/internal/events?"+url.Values{"agent_id": {agentID}}.Encode(),
+		"text/plain", bytes.NewReader(events))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("events: %s", resp.Status)
+	}
+	n := 0
+	for _, line := range bytes.Split(events, []byte("\n")) {
+		// Skip control lines, such as the agent's dropped event counts.
+		if len(line) > 0 && line[0] != '#' {
+			n++
+		}
+	}
+	fmt.Printf("[gococo] replayed %d events from %s as agent %s\n", n, file, agentID)
+	return nil
+}
+
+func importProfiles(addr, label string, files []string) error {
+	var body bytes.Buffer
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		body.Write(data)
+		if len(data) > 0 && data[len(data)-1] != '\n' {
+			body.WriteByte('\n')
+		}
+	}
+
+	u := "http://" + addr + "/api/coverage/import"
+	if label != "" {
+		u += "?" + url.Values{"label": {label}}.Encode()
+	}
+	resp, err := http.Post(u, "text/plain", &body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var res struct {
+		Label   string `json:"label"`
+		Blocks  int    `json:"blocks"`
+		Matched int    `json:"matched"`
+		Created int    `json:"created"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return err
+	}
+	fmt.Printf("[gococo] imported %s as %q: %d blocks (%d matched live blocks, %d new)\n",
+		strings.Join(files, ", "), res.Label, res.Blocks, res.Matched, res.Created)
+	return nil
+}
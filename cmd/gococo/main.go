@@ -1,11 +1,14 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io/fs"
 	"net/http"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strings"
 
 	"github.com/gococo/gococo/internal/instrument"
 	"github.com/gococo/gococo/internal/server"
@@ -18,10 +21,54 @@ Usage:
   gococo server [--addr HOST:PORT]     Start the relay server
   gococo build  [--host HOST:PORT] [BUILD_FLAGS...] [PACKAGES]
                                        Instrument and build a Go project
+  gococo test   [--host HOST:PORT] [TEST_FLAGS...] [PACKAGES] [-args ...]
+                                       Instrument and run a project's tests
+  gococo run    [--host HOST:PORT] [--serve] [BUILD_FLAGS...] [PACKAGE]
+                [-- ARGS...]           Instrument, build and run a program
+  gococo export [--server HOST:PORT] [--format FORMAT] [-o FILE]
+                                       Write the server's coverage as a
+                                       snapshot (json), coverprofile, LCOV
+                                       or Cobertura XML
+  gococo report --html OUT.html [--server HOST:PORT | --snapshot FILE]
+                                       Render a self-contained HTML report
+  gococo import [--server HOST:PORT] [--label NAME] FILE...
+                                       Overlay coverprofiles from go test
+                                       on the server's coverage
+  gococo merge  [-o FILE] SNAPSHOT...  Sum the coverage of snapshots saved by
+                                       gococo export --format=json
+  gococo check  --min PERCENT [--min-pkg [PATTERN=]PERCENT]...
+                [--server HOST:PORT | --snapshot FILE]
+                                       Fail if coverage is below thresholds
+  gococo diffcover --base REV [--server HOST:PORT | --snapshot FILE]
+                                       Report coverage of the statements
+                                       changed since a git revision
   gococo version                       Show version
 
+Build flags:
+  --toolexec --instrument-pkgs PATTERNS
+                                       Also instrument the packages matching the
+                                       comma-separated import path patterns, in
+                                       other modules or the standard library
+  --include GLOBS, --exclude GLOBS     Only instrument / never instrument the
+                                       packages and files matching the
+                                       comma-separated globs
+  --include-generated                  Also instrument files marked
+                                       "// Code generated ... DO NOT EDIT."
+  --covermode set|count|atomic         Counter mode; defaults to atomic with
+                                       -race and to count otherwise
+  --agent-mode required|optional|disabled
+                                       Agent startup policy unless GOCOCO_MODE
+                                       is set (default: required)
+  --no-events                          Only count blocks; the agent sends
+                                       counter deltas instead of events
+
 Environment:
   GOCOCO_HOST   Override the server address in instrumented binaries
+  GOCOCO_OUTPUT Write coverage of instrumented binaries to files in this
+                directory instead of a server (offline mode)
+  GOCOCO_MODE   Agent startup policy of instrumented binaries:
+                required, optional or disabled
+  GOCOCO_EVENTS Set to "off" to report counter deltas instead of events
 `
 
 var version = "dev"
@@ -37,6 +84,24 @@ func main() {
 		runServer()
 	case "build":
 		runBuild()
+	case "test":
+		runTest()
+	case "run":
+		runRun()
+	case "export":
+		runExport()
+	case "report":
+		runReport()
+	case "import":
+		runImport()
+	case "merge":
+		runMerge()
+	case "check":
+		runCheck()
+	case "diffcover":
+		runDiffcover()
+	case "toolexec":
+		runToolexec()
 	case "version":
 		fmt.Printf("gococo %s\n", version)
 	case "help", "-h", "--help":
@@ -77,14 +142,115 @@ func runServer() {
 }
 
 func runBuild() {
+	opts := parseBuildArgs(os.Args[2:], buildBoolFlags)
+
+	if err := instrument.Run(opts); err != nil {
+		fmt.Fprintf(os.Stderr, "build error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func runTest() {
+	opts := parseBuildArgs(os.Args[2:], testBoolFlags)
+	opts.Test = true
+
+	if err := instrument.Run(opts); err != nil {
+		var ee *exec.ExitError
+		if errors.As(err, &ee) {
+			os.Exit(ee.ExitCode())
+		}
+		fmt.Fprintf(os.Stderr, "test error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// runToolexec is invoked by the go command for each tool of a
+// `gococo build --toolexec` build: gococo toolexec CONFIG TOOL ARGS...
+func runToolexec() {
+	if len(os.Args) < 4 {
+		fmt.Fprintln(os.Stderr, "usage: gococo toolexec CONFIG TOOL [ARGS...]")
+		os.Exit(2)
+	}
+	if err := instrument.Toolexec(os.Args[2], os.Args[3], os.Args[4:]); err != nil {
+		var ee *exec.ExitError
+		if errors.As(err, &ee) {
+			os.Exit(ee.ExitCode())
+		}
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// buildBoolFlags are `go build` flags that never take a separate value.
+var buildBoolFlags = map[string]bool{
+	"-a": true, "-n": true, "-v": true, "-x": true, "-race": true,
+	"-msan": true, "-asan": true, "-cover": true, "-work": true,
+	"-linkshared": true, "-trimpath": true, "-modcacherw": true,
+	"-buildvcs": true,
+}
+
+// testBoolFlags are `go test` flags that never take a separate value.
+var testBoolFlags = map[string]bool{
+	"-c": true, "-json": true, "-short": true, "-failfast": true,
+	"-benchmem": true, "-fullpath": true,
+}
+
+func init() {
+	for f := range buildBoolFlags {
+		testBoolFlags[f] = true
+	}
+}
+
+// parseBuildArgs splits the arguments of `gococo build` and `gococo test`
+// into gococo options, go flags and packages. Flags not listed in boolFlags
+// consume the following argument as their value unless it looks like a flag.
+func parseBuildArgs(args []string, boolFlags map[string]bool) instrument.Options {
 	host := "127.0.0.1:7778"
 	debug := false
 	var goFlags []string
 	var packages []string
+	var testArgs []string
+	var instrumentPkgs, include, exclude []string
+	toolexec := false
+	includeGenerated := false
+	noEvents := false
+	coverMode := ""
+	agentMode := ""
 	outputDir := ""
 
-	args := os.Args[2:]
+	// gococo's own list flags, given as "--name value" or "--name=value"
+	listFlags := map[string]*[]string{
+		"--instrument-pkgs": &instrumentPkgs,
+		"--include":         &include,
+		"--exclude":         &exclude,
+	}
+
 	for i := 0; i < len(args); i++ {
+		if name, value, ok := strings.Cut(args[i], "="); ok && listFlags[name] != nil {
+			*listFlags[name] = append(*listFlags[name], splitList(value)...)
+			continue
+		}
+		if v, ok := strings.CutPrefix(args[i], "--covermode="); ok {
+			coverMode = v
+			continue
+		}
+		if v, ok := strings.CutPrefix(args[i], "--agent-mode="); ok {
+			agentMode = v
+			continue
+		}
+		if name, v, ok := strings.Cut(args[i], "="); ok && (name == "-o" || name == "--o") {
+			outputDir = v
+			goFlags = append(goFlags, "-o", v)
+			continue
+		}
+		if list := listFlags[args[i]]; list != nil {
+			if i+1 < len(args) {
+				*list = append(*list, splitList(args[i+1])...)
+				i++
+			}
+			continue
+		}
+
 		switch args[i] {
 		case "--host", "-host":
 			if i+1 < len(args) {
@@ -93,16 +259,38 @@ func runBuild() {
 			}
 		case "--debug":
 			debug = true
-		case "-o":
+		case "--toolexec":
+			toolexec = true
+		case "--include-generated":
+			includeGenerated = true
+		case "--no-events":
+			noEvents = true
+		case "--covermode":
+			if i+1 < len(args) {
+				coverMode = args[i+1]
+				i++
+			}
+		case "--agent-mode":
+			if i+1 < len(args) {
+				agentMode = args[i+1]
+				i++
+			}
+		case "-o", "--o":
 			if i+1 < len(args) {
 				outputDir = args[i+1]
 				goFlags = append(goFlags, "-o", args[i+1])
 				i++
 			}
+		case "-args", "--args":
+			testArgs = append(testArgs, args[i+1:]...)
+			i = len(args)
 		default:
 			a := args[i]
 			if len(a) > 0 && a[0] == '-' {
 				goFlags = append(goFlags, a)
+				if boolFlags[a] || strings.Contains(a, "=") {
+					continue
+				}
 				// Check if this flag takes a value
 				if i+1 < len(args) && len(args[i+1]) > 0 && args[i+1][0] != '-' {
 					goFlags = append(goFlags, args[i+1])
@@ -114,16 +302,34 @@ func runBuild() {
 		}
 	}
 
-	opts := instrument.Options{
+	return instrument.Options{
 		Host:      host,
 		Packages:  packages,
 		GoFlags:   goFlags,
 		OutputDir: outputDir,
 		Debug:     debug,
+		TestArgs:  testArgs,
+
+		Toolexec:       toolexec,
+		InstrumentPkgs: instrumentPkgs,
+
+		Include:          include,
+		Exclude:          exclude,
+		IncludeGenerated: includeGenerated,
+
+		CoverMode: coverMode,
+		AgentMode: agentMode,
+		NoEvents:  noEvents,
 	}
+}
 
-	if err := instrument.Run(opts); err != nil {
-		fmt.Fprintf(os.Stderr, "build error: %v\n", err)
-		os.Exit(1)
+// splitList splits a comma-separated flag value, dropping empty elements.
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
 	}
+	return out
 }
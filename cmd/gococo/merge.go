@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gococo/gococo/internal/coverage"
+)
+
+// runMerge combines coverage snapshots saved from several runs into one, to
+// -o or standard output. Files whose blocks differ between snapshots are
+// merged from the first snapshot containing them only, and reported; the
+// exit status is then 1.
+func runMerge() {
+	output := ""
+	var files []string
+	args := os.Args[2:]
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		name, value, hasValue := strings.Cut(arg, "=")
+		if !strings.HasPrefix(name, "-") {
+			files = append(files, arg)
+			continue
+		}
+		if !hasValue && i+1 < len(args) {
+			value = args[i+1]
+			i++
+		}
+		switch name {
+		case "-o", "--output":
+			output = value
+		default:
+			fmt.Fprintf(os.Stderr, "merge error: unknown flag %s\n", arg)
+			os.Exit(2)
+		}
+	}
+	if len(files) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: gococo merge [-o FILE] SNAPSHOT...")
+		os.Exit(2)
+	}
+
+	snaps := make([]*coverage.Snapshot, len(files))
+	for i, file := range files {
+		snap, err := coverage.ReadSnapshot(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "merge error: %v\n", err)
+			os.Exit(1)
+		}
+		snaps[i] = snap
+	}
+	merged, conflicts := coverage.Merge(snaps...)
+
+	if err := writeSnapshot(output, merged); err != nil {
+		fmt.Fprintf(os.Stderr, "merge error: %v\n", err)
+		os.Exit(1)
+	}
+	for _, c := range conflicts {
+		fmt.Fprintf(os.Stderr, "[gococo] merge conflict: %s: blocks in %s differ from %s (%s); skipped\n",
+			c.File, files[c.Index], files[c.Base], c.Reason)
+	}
+	summary := coverage.Summarize(merged.Blocks)
+	fmt.Fprintf(os.Stderr, "[gococo] merged %d snapshots: %d files, %.1f%% (%d/%d stmts)\n",
+		len(files), len(summary.Files), summary.Percentage(), summary.HitStmts, summary.TotalStmts)
+	if len(conflicts) > 0 {
+		os.Exit(1)
+	}
+}
+
+// writeSnapshot writes snap to the file output, or to standard output if
+// output is empty.
+func writeSnapshot(output string, snap *coverage.Snapshot) error {
+	if output == "" {
+		return json.NewEncoder(os.Stdout).Encode(snap)
+	}
+	f, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(f).Encode(snap)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
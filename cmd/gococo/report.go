@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gococo/gococo/internal/coverage"
+	"github.com/gococo/gococo/internal/report"
+	"github.com/gococo/gococo/internal/server"
+)
+
+// runReport renders the coverage of a server or a saved snapshot as a
+// self-contained HTML file.
+func runReport() {
+	addr := "127.0.0.1:7778"
+	snapshotPath := ""
+	htmlPath := ""
+	root := "."
+	title := ""
+	args := os.Args[2:]
+	for i := 0; i < len(args); i++ {
+		name, value, hasValue := strings.Cut(args[i], "=")
+		if !hasValue && i+1 < len(args) {
+			value = args[i+1]
+		}
+		switch name {
+		case "--server", "-server":
+			addr = value
+		case "--snapshot", "-snapshot":
+			snapshotPath = value
+		case "--html", "-html":
+			htmlPath = value
+		case "--root", "-root":
+			root = value
+		case "--title", "-title":
+			title = value
+		default:
+			fmt.Fprintf(os.Stderr, "report error: unknown flag %s\n", args[i])
+			os.Exit(2)
+		}
+		if !hasValue {
+			i++
+		}
+	}
+	if htmlPath == "" {
+		fmt.Fprintln(os.Stderr, "usage: gococo report --html OUT.html [--server HOST:PORT | --snapshot FILE] [--root DIR] [--title TITLE]")
+		os.Exit(2)
+	}
+
+	snap, err := loadSnapshot(addr, snapshotPath, true)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "report error: %v\n", err)
+		os.Exit(1)
+	}
+	absRoot, _ := filepath.Abs(root)
+	resolve := server.SourceResolver(absRoot)
+	opts := report.HTMLOptions{
+		Title: title,
+		Source: func(file string) ([]byte, error) {
+			return os.ReadFile(resolve(file))
+		},
+	}
+
+	f, err := os.Create(htmlPath)
+	if err == nil {
+		err = report.WriteHTML(f, snap, opts)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "report error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("[gococo] wrote %s (%d files)\n", htmlPath, len(coverage.Summarize(snap.Blocks).Files))
+}
+
+// loadSnapshot reads the snapshot file at path, or if path is empty, takes
+// a snapshot of the server at addr, with the sources it can read embedded if
+// sources is set.
+func loadSnapshot(addr, path string, sources bool) (*coverage.Snapshot, error) {
+	if path != "" {
+		return coverage.ReadSnapshot(path)
+	}
+	u := "http://" + addr + "/api/coverage/snapshot"
+	if sources {
+		u += "?sources=1"
+	}
+	resp, err := http.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("snapshot from %s: %s", addr, resp.Status)
+	}
+	return coverage.DecodeSnapshot(resp.Body)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gococo/gococo/internal/instrument"
+	"github.com/gococo/gococo/internal/server"
+	"github.com/gococo/gococo/web"
+)
+
+// runRun instruments and builds a package into a temp directory, then runs
+// it with the arguments after "--" and exits with its exit code. If no
+// server is reachable at --host, an in-process server is started for the
+// program, and with --serve kept running after the program exits until
+// gococo is interrupted.
+func runRun() {
+	var args, progArgs []string
+	serve := false
+	for i, a := range os.Args[2:] {
+		if a == "--" {
+			progArgs = os.Args[2+i+1:]
+			break
+		}
+		if a == "--serve" || a == "-serve" {
+			serve = true
+			continue
+		}
+		args = append(args, a)
+	}
+
+	opts := parseBuildArgs(args, buildBoolFlags)
+	if len(opts.Packages) > 1 {
+		fmt.Fprintf(os.Stderr, "run error: gococo run takes a single package, got %d\n", len(opts.Packages))
+		os.Exit(1)
+	}
+
+	tmpDir, err := os.MkdirTemp("", "gococo-run-*")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "run error: %v\n", err)
+		os.Exit(1)
+	}
+	binary := filepath.Join(tmpDir, "app")
+	if opts.OutputDir == "" {
+		opts.OutputDir = binary
+		opts.GoFlags = append(opts.GoFlags, "-o", binary)
+	} else if binary, err = outputBinary(&opts); err != nil {
+		os.RemoveAll(tmpDir)
+		fmt.Fprintf(os.Stderr, "run error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := instrument.Run(opts); err != nil {
+		os.RemoveAll(tmpDir)
+		fmt.Fprintf(os.Stderr, "build error: %v\n", err)
+		os.Exit(1)
+	}
+
+	var srv net.Listener
+	if !serverReachable(opts.Host) {
+		srv, err = startLocalServer(opts.Host)
+		if err != nil {
+			os.RemoveAll(tmpDir)
+			fmt.Fprintf(os.Stderr, "run error: no server at %s and cannot start one: %v\n", opts.Host, err)
+			os.Exit(1)
+		}
+	}
+
+	code := execForwarding(binary, progArgs)
+	os.RemoveAll(tmpDir)
+
+	if srv != nil && serve {
+		fmt.Fprintf(os.Stderr, "[gococo] program exited with code %d; serving coverage at http://%s (Ctrl-C to stop)\n", code, opts.Host)
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		srv.Close()
+	}
+	os.Exit(code)
+}
+
+// outputBinary returns the absolute path of the binary built with -o. Like
+// go build, it writes the binary into the directory if -o names a directory
+// or ends in a path separator. -o is then made to name the binary itself.
+func outputBinary(opts *instrument.Options) (string, error) {
+	binary := opts.OutputDir
+	if fi, err := os.Stat(binary); (err == nil && fi.IsDir()) || os.IsPathSeparator(binary[len(binary)-1]) {
+		pkg := "."
+		if len(opts.Packages) > 0 {
+			pkg = opts.Packages[0]
+		}
+		name, err := execName(pkg)
+		if err != nil {
+			return "", err
+		}
+		binary = filepath.Join(binary, name)
+	}
+	// A relative path without a separator would be looked up in $PATH.
+	binary, err := filepath.Abs(binary)
+	if err != nil {
+		return "", err
+	}
+	opts.OutputDir = binary
+	for i := range opts.GoFlags {
+		if opts.GoFlags[i] == "-o" && i+1 < len(opts.GoFlags) {
+			opts.GoFlags[i+1] = binary
+		}
+	}
+	return binary, nil
+}
+
+// execName returns the name go build gives the executable of pkg: the last
+// element of its import path, skipping a major version suffix, or for a
+// list of files the name of the first one.
+func execName(pkg string) (string, error) {
+	out, err := exec.Command("go", "list", "-f", "{{.ImportPath}} {{index .GoFiles 0}}", "--", pkg).Output()
+	if err != nil {
+		var ee *exec.ExitError
+		if errors.As(err, &ee) {
+			return "", fmt.Errorf("go list %s: %s", pkg, strings.TrimSpace(string(ee.Stderr)))
+		}
+		return "", err
+	}
+	importPath, firstFile, _ := strings.Cut(strings.TrimSpace(string(out)), " ")
+	var name string
+	if importPath == "command-line-arguments" {
+		name = strings.TrimSuffix(filepath.Base(firstFile), ".go")
+	} else {
+		name = path.Base(importPath)
+		if isMajorVersion(name) && name != importPath {
+			name = path.Base(path.Dir(importPath))
+		}
+	}
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	return name, nil
+}
+
+// isMajorVersion reports whether elem is a module major version suffix,
+// such as v2.
+func isMajorVersion(elem string) bool {
+	if len(elem) < 2 || elem[0] != 'v' || elem[1] == '0' || elem == "v1" {
+		return false
+	}
+	for _, c := range elem[1:] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// serverReachable reports whether a gococo server answers at host.
+func serverReachable(host string) bool {
+	client := http.Client{Timeout: 500 * time.Millisecond}
+	resp, err := client.Get(fmt.Sprintf("http://%s/api/agents", host))
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return true
+}
+
+// startLocalServer serves the gococo UI and API on host in the background,
+// using the current directory as the source root.
+func startLocalServer(host string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	root, _ := os.Getwd()
+	webFS, _ := fs.Sub(web.Dist, "dist")
+	s := server.New(host, http.FS(webFS), root)
+	go s.Serve(ln)
+	fmt.Fprintf(os.Stderr, "[gococo] started in-process server at http://%s\n", host)
+	return ln, nil
+}
+
+// execForwarding runs the program with the standard streams attached,
+// forwards interrupt and termination signals to it, unless the terminal
+// already sent them, and returns its exit code, or 128 plus the signal number
+// if a signal killed it.
+func execForwarding(binary string, args []string) int {
+	cmd := exec.Command(binary, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "run error: %v\n", err)
+		return 1
+	}
+	go func() {
+		for s := range sig {
+			if !sentToGroup(s) {
+				cmd.Process.Signal(s)
+			}
+		}
+	}()
+
+	err := cmd.Wait()
+	var ee *exec.ExitError
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &ee):
+		if ee.ExitCode() >= 0 {
+			return ee.ExitCode()
+		}
+		// Killed by a signal.
+		return signalExitCode(ee.ProcessState)
+	default:
+		fmt.Fprintf(os.Stderr, "run error: %v\n", err)
+		return 1
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package main
+
+import "os"
+
+// sentToGroup reports false: signals are always forwarded on this platform.
+func sentToGroup(s os.Signal) bool { return false }
+
+// signalExitCode returns 1: processes are not killed by signals here.
+func signalExitCode(ps *os.ProcessState) int { return 1 }
@@ -0,0 +1,30 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// sentToGroup reports whether s is SIGINT and gococo is in the foreground
+// process group of the terminal on stdin. Ctrl-C then signals the whole
+// group, the program included, so forwarding it would deliver it twice.
+func sentToGroup(s os.Signal) bool {
+	if s != os.Interrupt {
+		return false
+	}
+	var pgrp int32
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, os.Stdin.Fd(), syscall.TIOCGPGRP, uintptr(unsafe.Pointer(&pgrp)))
+	return errno == 0 && int(pgrp) == syscall.Getpgrp()
+}
+
+// signalExitCode returns 128 plus the number of the signal that killed the
+// process, as shells report it.
+func signalExitCode(ps *os.ProcessState) int {
+	if ws, ok := ps.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return 1
+}
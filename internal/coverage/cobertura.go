@@ -0,0 +1,113 @@
+package coverage
+
+import (
+	"encoding/xml"
+	"io"
+	"path"
+	"strconv"
+)
+
+const coberturaHeader = xml.Header +
+	`<!DOCTYPE coverage SYSTEM "http://cobertura.sourceforge.net/xml/coverage-04.dtd">` + "\n"
+
+type coberturaCoverage struct {
+	XMLName         xml.Name           `xml:"coverage"`
+	LineRate        string             `xml:"line-rate,attr"`
+	BranchRate      string             `xml:"branch-rate,attr"`
+	LinesCovered    int                `xml:"lines-covered,attr"`
+	LinesValid      int                `xml:"lines-valid,attr"`
+	BranchesCovered int                `xml:"branches-covered,attr"`
+	BranchesValid   int                `xml:"branches-valid,attr"`
+	Complexity      string             `xml:"complexity,attr"`
+	Version         string             `xml:"version,attr"`
+	Timestamp       int64              `xml:"timestamp,attr"`
+	Sources         []string           `xml:"sources>source"`
+	Packages        []coberturaPackage `xml:"packages>package"`
+}
+
+type coberturaPackage struct {
+	Name       string           `xml:"name,attr"`
+	LineRate   string           `xml:"line-rate,attr"`
+	BranchRate string           `xml:"branch-rate,attr"`
+	Complexity string           `xml:"complexity,attr"`
+	Classes    []coberturaClass `xml:"classes>class"`
+}
+
+type coberturaClass struct {
+	Name       string          `xml:"name,attr"`
+	Filename   string          `xml:"filename,attr"`
+	LineRate   string          `xml:"line-rate,attr"`
+	BranchRate string          `xml:"branch-rate,attr"`
+	Complexity string          `xml:"complexity,attr"`
+	Methods    struct{}        `xml:"methods"`
+	Lines      []coberturaLine `xml:"lines>line"`
+}
+
+type coberturaLine struct {
+	Number int    `xml:"number,attr"`
+	Hits   uint64 `xml:"hits,attr"`
+}
+
+// WriteCobertura writes s as a Cobertura XML report, with a package per
+// import path and a class per file. Line elements are derived from block
+// ranges; the line-rate of the report, packages and classes is the ratio of
+// covered statements, so that it matches the coverage summary. Branch data is
+// not collected and reported as zero. timestamp is in Unix milliseconds.
+func WriteCobertura(w io.Writer, s *Summary, opts ReportOptions, timestamp int64) error {
+	report := coberturaCoverage{
+		LineRate:   rate(s.HitStmts, s.TotalStmts),
+		BranchRate: "0",
+		Complexity: "0",
+		Version:    "gococo",
+		Timestamp:  timestamp,
+	}
+	if opts.SourceDir != "" {
+		report.Sources = []string{opts.SourceDir}
+	}
+
+	for _, ps := range s.Packages() {
+		pkg := coberturaPackage{
+			Name:       ps.ImportPath,
+			LineRate:   rate(ps.HitStmts, ps.TotalStmts),
+			BranchRate: "0",
+			Complexity: "0",
+		}
+		for _, fs := range ps.Files {
+			class := coberturaClass{
+				Name:       path.Base(fs.File),
+				Filename:   opts.path(fs.File),
+				LineRate:   rate(fs.HitStmts, fs.TotalStmts),
+				BranchRate: "0",
+				Complexity: "0",
+			}
+			for _, l := range fs.LineHits() {
+				class.Lines = append(class.Lines, coberturaLine{Number: l.Line, Hits: l.Hits})
+				report.LinesValid++
+				if l.Hits > 0 {
+					report.LinesCovered++
+				}
+			}
+			pkg.Classes = append(pkg.Classes, class)
+		}
+		report.Packages = append(report.Packages, pkg)
+	}
+
+	if _, err := io.WriteString(w, coberturaHeader); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// rate formats hit/total as a Cobertura rate between 0 and 1.
+func rate(hit, total int) string {
+	if total == 0 {
+		return "0"
+	}
+	return strconv.FormatFloat(float64(hit)/float64(total), 'f', 4, 64)
+}
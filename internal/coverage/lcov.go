@@ -0,0 +1,45 @@
+package coverage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// ReportOptions controls how files are named in LCOV and Cobertura reports,
+// whose consumers look files up on disk rather than by import path.
+type ReportOptions struct {
+	// SourceDir is the directory report paths are relative to. Cobertura
+	// records it as the report's source.
+	SourceDir string
+
+	// Path maps a block's "importpath/file.go" to the path written to the
+	// report. If nil, import paths are written unchanged.
+	Path func(file string) string
+}
+
+func (o *ReportOptions) path(file string) string {
+	if o.Path == nil {
+		return file
+	}
+	return o.Path(file)
+}
+
+// WriteLCOV writes s as an LCOV tracefile (.info), with one record per file
+// and line hits derived from block ranges.
+func WriteLCOV(w io.Writer, s *Summary, opts ReportOptions) error {
+	bw := bufio.NewWriter(w)
+	for _, fs := range s.Files {
+		lines := fs.LineHits()
+		hit := 0
+		fmt.Fprintf(bw, "TN:\nSF:%s\n", opts.path(fs.File))
+		for _, l := range lines {
+			fmt.Fprintf(bw, "DA:%d,%d\n", l.Line, l.Hits)
+			if l.Hits > 0 {
+				hit++
+			}
+		}
+		fmt.Fprintf(bw, "LF:%d\nLH:%d\nend_of_record\n", len(lines), hit)
+	}
+	return bw.Flush()
+}
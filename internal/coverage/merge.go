@@ -0,0 +1,174 @@
+package coverage
+
+import (
+	"fmt"
+	"slices"
+)
+
+// MergeConflict reports a file whose blocks in one snapshot of a merge do
+// not line up with those of an earlier snapshot, typically because the
+// snapshots were taken from builds of different source versions.
+type MergeConflict struct {
+	File   string `json:"file"`
+	Index  int    `json:"index"`  // snapshot whose blocks of File were skipped
+	Base   int    `json:"base"`   // snapshot whose layout of File was kept
+	Reason string `json:"reason"` // the first difference
+}
+
+func (c MergeConflict) String() string {
+	return fmt.Sprintf("%s: blocks of snapshot %d differ from snapshot %d (%s)", c.File, c.Index, c.Base, c.Reason)
+}
+
+// blockPos identifies a block within a file by its extent.
+type blockPos struct {
+	sl, sc, el, ec, stmts int
+}
+
+// Merge combines snapshots of runs of the same program, for example from
+// several test binaries, agents or machines. Hit counts of a block add up and
+// its last-hit time is the latest one.
+//
+// A file is merged only from snapshots with the same blocks as the first
+// snapshot containing it; the blocks of a file with a different layout are
+// left out and reported as a conflict. Blocks are matched by position, not
+// by index, so snapshots of builds with different sets of files still merge.
+// A block listed more than once in a snapshot counts as one block with the
+// hits of all its entries.
+//
+// The merged mode is the common mode of the snapshots, or "set" if any
+// snapshot only recorded whether blocks ran. Sources embedded in any snapshot
+// are kept.
+func Merge(snaps ...*Snapshot) (*Snapshot, []MergeConflict) {
+	out := &Snapshot{Version: SnapshotVersion}
+	var conflicts []MergeConflict
+
+	type fileState struct {
+		base   int // index of the snapshot that set the layout
+		layout []blockPos
+		blocks map[blockPos]*Block
+	}
+	files := make(map[string]*fileState)
+	var order []string
+
+	for i, snap := range snaps {
+		out.CreatedAt = max(out.CreatedAt, snap.CreatedAt)
+		out.Mode = mergeMode(out.Mode, snap.Mode)
+
+		// A block listed more than once, as in profiles concatenated from
+		// several test binaries, is merged into one first: its hits add up,
+		// or in set mode the highest is kept, as go tool covdata does.
+		byFile := make(map[string]map[blockPos]*Block)
+		var snapOrder []string
+		for _, b := range snap.Blocks {
+			blocks, ok := byFile[b.File]
+			if !ok {
+				blocks = make(map[blockPos]*Block)
+				byFile[b.File] = blocks
+				snapOrder = append(snapOrder, b.File)
+			}
+			pos := blockPos{b.StartLine, b.StartCol, b.EndLine, b.EndCol, b.NumStmts}
+			db, ok := blocks[pos]
+			if !ok {
+				nb := b
+				blocks[pos] = &nb
+				continue
+			}
+			if snap.Mode == ModeSet {
+				db.HitCount = max(db.HitCount, b.HitCount)
+			} else {
+				db.HitCount += b.HitCount
+			}
+			db.LastHitAt = max(db.LastHitAt, b.LastHitAt)
+		}
+
+		for _, file := range snapOrder {
+			blocks := byFile[file]
+			layout := make([]blockPos, 0, len(blocks))
+			for pos := range blocks {
+				layout = append(layout, pos)
+			}
+			slices.SortFunc(layout, comparePos)
+
+			fs, ok := files[file]
+			if !ok {
+				files[file] = &fileState{base: i, layout: layout, blocks: blocks}
+				order = append(order, file)
+				continue
+			}
+			if reason := layoutDiff(fs.layout, layout); reason != "" {
+				conflicts = append(conflicts, MergeConflict{File: file, Index: i, Base: fs.base, Reason: reason})
+				continue
+			}
+			for pos, b := range blocks {
+				mb := fs.blocks[pos]
+				mb.HitCount += b.HitCount
+				mb.LastHitAt = max(mb.LastHitAt, b.LastHitAt)
+			}
+		}
+
+		for file, src := range snap.Sources {
+			if out.Sources == nil {
+				out.Sources = make(map[string]string)
+			}
+			if _, ok := out.Sources[file]; !ok {
+				out.Sources[file] = src
+			}
+		}
+	}
+
+	for _, file := range order {
+		for _, pos := range files[file].layout {
+			out.Blocks = append(out.Blocks, *files[file].blocks[pos])
+		}
+	}
+	if out.Blocks == nil {
+		out.Blocks = []Block{}
+	}
+	SortBlocks(out.Blocks)
+	return out, conflicts
+}
+
+func comparePos(a, b blockPos) int {
+	switch {
+	case a.sl != b.sl:
+		return a.sl - b.sl
+	case a.sc != b.sc:
+		return a.sc - b.sc
+	case a.el != b.el:
+		return a.el - b.el
+	case a.ec != b.ec:
+		return a.ec - b.ec
+	}
+	return a.stmts - b.stmts
+}
+
+// layoutDiff describes how the sorted block layout got differs from want,
+// or returns "" if they are the same.
+func layoutDiff(want, got []blockPos) string {
+	if len(got) != len(want) {
+		return fmt.Sprintf("%d blocks, want %d", len(got), len(want))
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			g, w := got[i], want[i]
+			return fmt.Sprintf("block %d.%d,%d.%d with %d stmts, want %d.%d,%d.%d with %d stmts",
+				g.sl, g.sc, g.el, g.ec, g.stmts, w.sl, w.sc, w.el, w.ec, w.stmts)
+		}
+	}
+	return ""
+}
+
+// mergeMode returns the cover mode of merged coverage. Counts of count and
+// atomic mode agree, so they merge to count; hits merged with set mode only
+// tell whether a block ran.
+func mergeMode(a, b string) string {
+	switch {
+	case a == "" || a == b:
+		return b
+	case b == "":
+		return a
+	case a == ModeSet || b == ModeSet:
+		return ModeSet
+	}
+	return ModeCount
+}
@@ -0,0 +1,104 @@
+package coverage
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMerge(t *testing.T) {
+	a := &Snapshot{Version: SnapshotVersion, CreatedAt: 100, Mode: ModeCount, Blocks: []Block{
+		{File: "example.com/app/main.go", BlockIdx: 0, StartLine: 3, StartCol: 13, EndLine: 5, EndCol: 11, NumStmts: 2, HitCount: 4, LastHitAt: 50},
+		{File: "example.com/app/main.go", BlockIdx: 1, StartLine: 5, StartCol: 11, EndLine: 7, EndCol: 3, NumStmts: 1},
+	}, Sources: map[string]string{"example.com/app/main.go": "package main\n"}}
+	// Another build lists the blocks in another order and with other indices.
+	b := &Snapshot{Version: SnapshotVersion, CreatedAt: 200, Mode: ModeAtomic, Blocks: []Block{
+		{File: "example.com/app/main.go", BlockIdx: 7, StartLine: 5, StartCol: 11, EndLine: 7, EndCol: 3, NumStmts: 1, HitCount: 2, LastHitAt: 40},
+		{File: "example.com/app/main.go", BlockIdx: 6, StartLine: 3, StartCol: 13, EndLine: 5, EndCol: 11, NumStmts: 2, HitCount: 1, LastHitAt: 30},
+		{File: "example.com/app/util.go", BlockIdx: 0, StartLine: 3, StartCol: 20, EndLine: 4, EndCol: 2, NumStmts: 1, HitCount: 1, LastHitAt: 60},
+	}}
+	// Built from an edited util.go.
+	c := &Snapshot{Version: SnapshotVersion, CreatedAt: 150, Mode: ModeCount, Blocks: []Block{
+		{File: "example.com/app/util.go", BlockIdx: 0, StartLine: 3, StartCol: 20, EndLine: 6, EndCol: 2, NumStmts: 2, HitCount: 9, LastHitAt: 90},
+	}}
+
+	m, conflicts := Merge(a, b, c)
+	if m.Version != SnapshotVersion || m.CreatedAt != 200 || m.Mode != ModeCount {
+		t.Errorf("merged snapshot = version %d, created %d, mode %s", m.Version, m.CreatedAt, m.Mode)
+	}
+	want := []Block{
+		{File: "example.com/app/main.go", BlockIdx: 0, StartLine: 3, StartCol: 13, EndLine: 5, EndCol: 11, NumStmts: 2, HitCount: 5, LastHitAt: 50},
+		{File: "example.com/app/main.go", BlockIdx: 1, StartLine: 5, StartCol: 11, EndLine: 7, EndCol: 3, NumStmts: 1, HitCount: 2, LastHitAt: 40},
+		{File: "example.com/app/util.go", BlockIdx: 0, StartLine: 3, StartCol: 20, EndLine: 4, EndCol: 2, NumStmts: 1, HitCount: 1, LastHitAt: 60},
+	}
+	if len(m.Blocks) != len(want) {
+		t.Fatalf("merged blocks = %+v", m.Blocks)
+	}
+	for i := range want {
+		if m.Blocks[i] != want[i] {
+			t.Errorf("block %d = %+v, want %+v", i, m.Blocks[i], want[i])
+		}
+	}
+	if m.Sources["example.com/app/main.go"] != "package main\n" {
+		t.Errorf("sources not kept: %v", m.Sources)
+	}
+
+	if len(conflicts) != 1 {
+		t.Fatalf("conflicts = %v", conflicts)
+	}
+	conflict := conflicts[0]
+	if conflict.File != "example.com/app/util.go" || conflict.Index != 2 || conflict.Base != 1 ||
+		!strings.Contains(conflict.String(), "block 3.20,6.2 with 2 stmts, want 3.20,4.2 with 1 stmts") {
+		t.Errorf("conflict = %+v", conflict)
+	}
+
+	// Merging a snapshot with itself doubles its counts.
+	m, conflicts = Merge(a, a)
+	if len(conflicts) != 0 || m.Blocks[0].HitCount != 8 || m.Mode != ModeCount {
+		t.Errorf("self merge = %+v, %v", m, conflicts)
+	}
+	if m, _ := Merge(a, &Snapshot{Mode: ModeSet}); m.Mode != ModeSet {
+		t.Errorf("merge with set mode = %s, want set", m.Mode)
+	}
+}
+
+func TestMerge_DuplicateBlocks(t *testing.T) {
+	// A profile concatenated from two test binaries lists each block twice.
+	count := &Snapshot{Version: SnapshotVersion, Mode: ModeCount, Blocks: []Block{
+		{File: "example.com/app/main.go", BlockIdx: 0, StartLine: 3, StartCol: 13, EndLine: 5, EndCol: 11, NumStmts: 2, HitCount: 4, LastHitAt: 50},
+		{File: "example.com/app/main.go", BlockIdx: 1, StartLine: 5, StartCol: 11, EndLine: 7, EndCol: 3, NumStmts: 1},
+		{File: "example.com/app/main.go", BlockIdx: 2, StartLine: 3, StartCol: 13, EndLine: 5, EndCol: 11, NumStmts: 2, HitCount: 3, LastHitAt: 70},
+		{File: "example.com/app/main.go", BlockIdx: 3, StartLine: 5, StartCol: 11, EndLine: 7, EndCol: 3, NumStmts: 1, HitCount: 1, LastHitAt: 20},
+	}}
+	// The same file with each block once merges with it.
+	single := &Snapshot{Version: SnapshotVersion, Mode: ModeCount, Blocks: []Block{
+		{File: "example.com/app/main.go", BlockIdx: 0, StartLine: 3, StartCol: 13, EndLine: 5, EndCol: 11, NumStmts: 2, HitCount: 1, LastHitAt: 10},
+		{File: "example.com/app/main.go", BlockIdx: 1, StartLine: 5, StartCol: 11, EndLine: 7, EndCol: 3, NumStmts: 1},
+	}}
+
+	m, conflicts := Merge(count, single)
+	if len(conflicts) != 0 {
+		t.Fatalf("conflicts = %v", conflicts)
+	}
+	want := []Block{
+		{File: "example.com/app/main.go", BlockIdx: 0, StartLine: 3, StartCol: 13, EndLine: 5, EndCol: 11, NumStmts: 2, HitCount: 8, LastHitAt: 70},
+		{File: "example.com/app/main.go", BlockIdx: 1, StartLine: 5, StartCol: 11, EndLine: 7, EndCol: 3, NumStmts: 1, HitCount: 1, LastHitAt: 20},
+	}
+	if len(m.Blocks) != len(want) {
+		t.Fatalf("merged blocks = %+v", m.Blocks)
+	}
+	for i := range want {
+		if m.Blocks[i] != want[i] {
+			t.Errorf("block %d = %+v, want %+v", i, m.Blocks[i], want[i])
+		}
+	}
+
+	set := &Snapshot{Version: SnapshotVersion, Mode: ModeSet, Blocks: []Block{
+		{File: "example.com/app/main.go", StartLine: 3, StartCol: 13, EndLine: 5, EndCol: 11, NumStmts: 2, HitCount: 1},
+		{File: "example.com/app/main.go", StartLine: 3, StartCol: 13, EndLine: 5, EndCol: 11, NumStmts: 2, HitCount: 1},
+		{File: "example.com/app/main.go", StartLine: 3, StartCol: 13, EndLine: 5, EndCol: 11, NumStmts: 2},
+	}}
+	m, _ = Merge(set)
+	if len(m.Blocks) != 1 || m.Blocks[0].HitCount != 1 {
+		t.Errorf("set mode duplicates merged to %+v, want one block hit once", m.Blocks)
+	}
+}
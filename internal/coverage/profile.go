@@ -0,0 +1,142 @@
+// Package coverage holds block coverage independently of how it was
+// collected and writes it in the formats of other coverage tools.
+package coverage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Block is the coverage of one basic block of a source file.
+type Block struct {
+	File      string `json:"file"` // "importpath/file.go"
+	BlockIdx  int    `json:"block_idx"`
+	StartLine int    `json:"sl"`
+	StartCol  int    `json:"sc"`
+	EndLine   int    `json:"el"`
+	EndCol    int    `json:"ec"`
+	NumStmts  int    `json:"stmts"`
+	HitCount  uint64 `json:"hit_count"`
+	LastHitAt int64  `json:"last_hit_ts,omitempty"` // unix ms, 0 if never hit
+}
+
+// Cover modes, as for `go test -covermode`.
+const (
+	ModeSet    = "set"
+	ModeCount  = "count"
+	ModeAtomic = "atomic"
+)
+
+// SortBlocks orders blocks by file, then by position.
+func SortBlocks(blocks []Block) {
+	sort.Slice(blocks, func(i, j int) bool {
+		a, b := &blocks[i], &blocks[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.StartLine != b.StartLine {
+			return a.StartLine < b.StartLine
+		}
+		if a.StartCol != b.StartCol {
+			return a.StartCol < b.StartCol
+		}
+		return a.BlockIdx < b.BlockIdx
+	})
+}
+
+// WriteProfile writes blocks in the text format of `go test -coverprofile`:
+//
+//	mode: count
+//	example.com/app/main.go:10.13,12.2 1 5
+//
+// In set mode, hit counts are reported as 0 or 1. Blocks are written in the
+// order given; use SortBlocks for the order of `go test`.
+func WriteProfile(w io.Writer, mode string, blocks []Block) error {
+	switch mode {
+	case ModeSet, ModeCount, ModeAtomic:
+	default:
+		return fmt.Errorf("invalid cover mode %q: must be set, count or atomic", mode)
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "mode: %s\n", mode)
+	for _, b := range blocks {
+		count := b.HitCount
+		if mode == ModeSet && count > 1 {
+			count = 1
+		}
+		fmt.Fprintf(bw, "%s:%d.%d,%d.%d %d %d\n",
+			b.File, b.StartLine, b.StartCol, b.EndLine, b.EndCol, b.NumStmts, count)
+	}
+	return bw.Flush()
+}
+
+// ParseProfile reads a profile in the text format of `go test -coverprofile`
+// and returns its mode and blocks. BlockIdx is the block's index among the
+// blocks of its file in the profile. Profiles concatenated from several test
+// binaries may list a block more than once; such entries are returned as is
+// and combined by Merge.
+func ParseProfile(r io.Reader) (mode string, blocks []Block, err error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	perFile := make(map[string]int)
+	lineNo := 0
+	for sc.Scan() {
+		lineNo++
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		if m, ok := strings.CutPrefix(line, "mode: "); ok {
+			if mode != "" && m != mode {
+				return "", nil, fmt.Errorf("line %d: mode %s conflicts with %s", lineNo, m, mode)
+			}
+			mode = m
+			continue
+		}
+		if mode == "" {
+			return "", nil, fmt.Errorf("line %d: missing mode line", lineNo)
+		}
+		b, err := parseProfileLine(line)
+		if err != nil {
+			return "", nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		b.BlockIdx = perFile[b.File]
+		perFile[b.File]++
+		blocks = append(blocks, b)
+	}
+	if err := sc.Err(); err != nil {
+		return "", nil, err
+	}
+	if mode == "" {
+		return "", nil, fmt.Errorf("empty profile")
+	}
+	switch mode {
+	case ModeSet, ModeCount, ModeAtomic:
+	default:
+		return "", nil, fmt.Errorf("invalid cover mode %q", mode)
+	}
+	return mode, blocks, nil
+}
+
+// parseProfileLine parses "file:sl.sc,el.ec stmts count". The file name may
+// itself contain colons, so the position is taken after the last one.
+func parseProfileLine(line string) (Block, error) {
+	var b Block
+	i := strings.LastIndexByte(line, ':')
+	if i < 0 {
+		return b, fmt.Errorf("malformed block %q", line)
+	}
+	b.File = line[:i]
+	var count uint64
+	n, err := fmt.Sscanf(line[i+1:], "%d.%d,%d.%d %d %d",
+		&b.StartLine, &b.StartCol, &b.EndLine, &b.EndCol, &b.NumStmts, &count)
+	if err != nil || n != 6 {
+		return b, fmt.Errorf("malformed block %q", line)
+	}
+	b.HitCount = count
+	return b, nil
+}
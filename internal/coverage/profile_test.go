@@ -0,0 +1,90 @@
+package coverage
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWriteProfile(t *testing.T) {
+	blocks := []Block{
+		{File: "example.com/app/util.go", BlockIdx: 0, StartLine: 3, StartCol: 20, EndLine: 5, EndCol: 2, NumStmts: 1},
+		{File: "example.com/app/main.go", BlockIdx: 1, StartLine: 9, StartCol: 12, EndLine: 11, EndCol: 3, NumStmts: 1, HitCount: 7},
+		{File: "example.com/app/main.go", BlockIdx: 0, StartLine: 5, StartCol: 13, EndLine: 9, EndCol: 12, NumStmts: 2, HitCount: 1},
+	}
+	SortBlocks(blocks)
+
+	tests := []struct {
+		mode string
+		want string
+	}{
+		{ModeCount, `mode: count
+example.com/app/main.go:5.13,9.12 2 1
+example.com/app/main.go:9.12,11.3 1 7
+example.com/app/util.go:3.20,5.2 1 0
+`},
+		{ModeSet, `mode: set
+example.com/app/main.go:5.13,9.12 2 1
+example.com/app/main.go:9.12,11.3 1 1
+example.com/app/util.go:3.20,5.2 1 0
+`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			var sb strings.Builder
+			if err := WriteProfile(&sb, tt.mode, blocks); err != nil {
+				t.Fatal(err)
+			}
+			if sb.String() != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", sb.String(), tt.want)
+			}
+		})
+	}
+
+	if err := WriteProfile(&strings.Builder{}, "bogus", blocks); err == nil {
+		t.Error("WriteProfile accepted an invalid mode")
+	}
+}
+
+func TestParseProfile(t *testing.T) {
+	in := `mode: count
+example.com/app/main.go:5.13,9.12 2 1
+example.com/app/main.go:9.12,11.3 1 7
+C:/src/app/util.go:3.20,5.2 1 0
+mode: count
+example.com/app/main.go:5.13,9.12 2 3
+`
+	mode, blocks, err := ParseProfile(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode != ModeCount || len(blocks) != 4 {
+		t.Fatalf("mode=%s blocks=%+v", mode, blocks)
+	}
+	want := Block{File: "C:/src/app/util.go", StartLine: 3, StartCol: 20, EndLine: 5, EndCol: 2, NumStmts: 1}
+	if blocks[2] != want {
+		t.Errorf("block 2 = %+v, want %+v", blocks[2], want)
+	}
+	if blocks[1].BlockIdx != 1 || blocks[1].HitCount != 7 || blocks[3].BlockIdx != 2 {
+		t.Errorf("unexpected indices or counts: %+v", blocks)
+	}
+
+	// WriteProfile output parses back to the same blocks.
+	var sb strings.Builder
+	WriteProfile(&sb, ModeCount, blocks[:3])
+	_, again, err := ParseProfile(strings.NewReader(sb.String()))
+	if err != nil || len(again) != 3 || again[1] != blocks[1] {
+		t.Errorf("round trip = %+v, %v", again, err)
+	}
+
+	for _, bad := range []string{
+		"",
+		"example.com/app/main.go:5.13,9.12 2 1\n",
+		"mode: count\nexample.com/app/main.go 2 1\n",
+		"mode: set\nmode: count\n",
+		"mode: bogus\n",
+	} {
+		if _, _, err := ParseProfile(strings.NewReader(bad)); err == nil {
+			t.Errorf("ParseProfile(%q) succeeded", bad)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package coverage
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+// testBlocks covers two packages. In main.go the if statement on line 5 is
+// shared by the hit function body and the body of the if, which never ran.
+var testBlocks = []Block{
+	{File: "example.com/app/main.go", BlockIdx: 0, StartLine: 3, StartCol: 13, EndLine: 5, EndCol: 11, NumStmts: 2, HitCount: 4},
+	{File: "example.com/app/main.go", BlockIdx: 1, StartLine: 5, StartCol: 11, EndLine: 7, EndCol: 3, NumStmts: 1},
+	{File: "example.com/app/main.go", BlockIdx: 2, StartLine: 9, StartCol: 14, EndLine: 9, EndCol: 16, NumStmts: 0},
+	{File: "example.com/app/util/util.go", BlockIdx: 0, StartLine: 3, StartCol: 20, EndLine: 4, EndCol: 2, NumStmts: 1, HitCount: 1},
+}
+
+func TestSummarize(t *testing.T) {
+	s := Summarize(testBlocks)
+	if s.TotalStmts != 4 || s.HitStmts != 3 || s.Percentage() != 75 {
+		t.Errorf("total = %d/%d stmts (%.1f%%), want 3/4 (75%%)", s.HitStmts, s.TotalStmts, s.Percentage())
+	}
+	if len(s.Files) != 2 || s.Files[0].File != "example.com/app/main.go" {
+		t.Fatalf("files not grouped and sorted: %+v", s.Files)
+	}
+	main := s.Files[0]
+	if main.TotalBlocks != 3 || main.HitBlocks != 1 || main.TotalStmts != 3 || main.HitStmts != 2 {
+		t.Errorf("main.go = %+v", main)
+	}
+
+	pkgs := s.Packages()
+	if len(pkgs) != 2 || pkgs[0].ImportPath != "example.com/app" || pkgs[1].ImportPath != "example.com/app/util" {
+		t.Fatalf("packages = %+v", pkgs)
+	}
+	if pkgs[1].Percentage() != 100 {
+		t.Errorf("util package = %.1f%%, want 100%%", pkgs[1].Percentage())
+	}
+
+	want := []LineHits{{Line: 3, Hits: 4}, {Line: 4, Hits: 4}, {Line: 5, Hits: 4}, {Line: 6}, {Line: 7}}
+	got := main.LineHits()
+	if len(got) != len(want) {
+		t.Fatalf("line hits = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("line hits = %v, want %v", got, want)
+			break
+		}
+	}
+}
+
+func TestWriteLCOV(t *testing.T) {
+	var sb strings.Builder
+	opts := ReportOptions{Path: func(file string) string { return strings.TrimPrefix(file, "example.com/app/") }}
+	if err := WriteLCOV(&sb, Summarize(testBlocks), opts); err != nil {
+		t.Fatal(err)
+	}
+	want := `TN:
+SF:main.go
+DA:3,4
+DA:4,4
+DA:5,4
+DA:6,0
+DA:7,0
+LF:5
+LH:3
+end_of_record
+TN:
+SF:util/util.go
+DA:3,1
+DA:4,1
+LF:2
+LH:2
+end_of_record
+`
+	if sb.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", sb.String(), want)
+	}
+}
+
+func TestWriteCobertura(t *testing.T) {
+	var sb strings.Builder
+	opts := ReportOptions{SourceDir: "/src/app"}
+	if err := WriteCobertura(&sb, Summarize(testBlocks), opts, 1700000000000); err != nil {
+		t.Fatal(err)
+	}
+	out := sb.String()
+	if !strings.HasPrefix(out, `<?xml version="1.0" encoding="UTF-8"?>`+"\n<!DOCTYPE coverage") {
+		t.Errorf("missing XML header and doctype:\n%s", out)
+	}
+
+	var report coberturaCoverage
+	if err := xml.Unmarshal([]byte(out), &report); err != nil {
+		t.Fatalf("invalid XML: %v\n%s", err, out)
+	}
+	if report.LineRate != "0.7500" || report.LinesValid != 7 || report.LinesCovered != 5 {
+		t.Errorf("coverage line-rate=%s lines=%d/%d, want 0.7500 5/7",
+			report.LineRate, report.LinesCovered, report.LinesValid)
+	}
+	if report.Timestamp != 1700000000000 || len(report.Sources) != 1 || report.Sources[0] != "/src/app" {
+		t.Errorf("timestamp=%d sources=%v", report.Timestamp, report.Sources)
+	}
+	if len(report.Packages) != 2 {
+		t.Fatalf("packages = %+v", report.Packages)
+	}
+	pkg := report.Packages[0]
+	if pkg.Name != "example.com/app" || pkg.LineRate != "0.6667" || len(pkg.Classes) != 1 {
+		t.Fatalf("package = %+v", pkg)
+	}
+	class := pkg.Classes[0]
+	if class.Name != "main.go" || class.Filename != "example.com/app/main.go" || len(class.Lines) != 5 {
+		t.Errorf("class = %+v", class)
+	}
+}
@@ -0,0 +1,80 @@
+package coverage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// SnapshotVersion is the version of the snapshot format written by this
+// version of gococo.
+const SnapshotVersion = 1
+
+// Snapshot is a saved copy of the coverage held by a server, as returned by
+// /api/coverage/snapshot and written by `gococo export --format=json`.
+type Snapshot struct {
+	Version   int     `json:"version"`
+	CreatedAt int64   `json:"created_at"` // unix ms
+	Mode      string  `json:"mode"`
+	Blocks    []Block `json:"blocks"`
+
+	// Sources optionally embeds the content of the covered files, keyed by
+	// "importpath/file.go", so that reports can be rendered without access
+	// to the source tree.
+	Sources map[string]string `json:"sources,omitempty"`
+}
+
+// DecodeSnapshot reads a snapshot in JSON form.
+func DecodeSnapshot(r io.Reader) (*Snapshot, error) {
+	var s Snapshot
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return nil, fmt.Errorf("decode snapshot: %w", err)
+	}
+	if err := s.checkVersion(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// DecodeSnapshots reads a stream of one or more snapshots in JSON form, such
+// as several snapshot files concatenated.
+func DecodeSnapshots(r io.Reader) ([]*Snapshot, error) {
+	var snaps []*Snapshot
+	dec := json.NewDecoder(r)
+	for {
+		var s Snapshot
+		err := dec.Decode(&s)
+		if err == io.EOF && len(snaps) > 0 {
+			return snaps, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("decode snapshot %d: %w", len(snaps), err)
+		}
+		if err := s.checkVersion(); err != nil {
+			return nil, fmt.Errorf("snapshot %d: %w", len(snaps), err)
+		}
+		snaps = append(snaps, &s)
+	}
+}
+
+func (s *Snapshot) checkVersion() error {
+	if s.Version != SnapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d (want %d)", s.Version, SnapshotVersion)
+	}
+	return nil
+}
+
+// ReadSnapshot reads a snapshot file.
+func ReadSnapshot(path string) (*Snapshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s, err := DecodeSnapshot(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return s, nil
+}
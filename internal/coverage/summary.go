@@ -0,0 +1,131 @@
+package coverage
+
+import (
+	"path"
+	"sort"
+)
+
+// Summary aggregates block coverage per file, the way the server's
+// coverage summary and every report format count it: a statement is covered
+// when its block was hit at least once.
+type Summary struct {
+	Files      []*FileSummary // ordered by file
+	TotalStmts int
+	HitStmts   int
+}
+
+// FileSummary is the coverage of one source file.
+type FileSummary struct {
+	File        string // "importpath/file.go"
+	Blocks      []Block
+	TotalBlocks int
+	HitBlocks   int
+	TotalStmts  int
+	HitStmts    int
+}
+
+// PackageSummary is the coverage of the files of one package.
+type PackageSummary struct {
+	ImportPath string
+	Files      []*FileSummary
+	TotalStmts int
+	HitStmts   int
+}
+
+// LineHits is the execution count of one source line.
+type LineHits struct {
+	Line      int
+	Hits      uint64
+	LastHitAt int64 // unix ms
+}
+
+// Summarize groups blocks by file and counts their statements.
+func Summarize(blocks []Block) *Summary {
+	sorted := append([]Block(nil), blocks...)
+	SortBlocks(sorted)
+
+	s := &Summary{}
+	var fs *FileSummary
+	for _, b := range sorted {
+		if fs == nil || fs.File != b.File {
+			fs = &FileSummary{File: b.File}
+			s.Files = append(s.Files, fs)
+		}
+		fs.Blocks = append(fs.Blocks, b)
+		fs.TotalBlocks++
+		fs.TotalStmts += b.NumStmts
+		if b.HitCount > 0 {
+			fs.HitBlocks++
+			fs.HitStmts += b.NumStmts
+		}
+	}
+	for _, fs := range s.Files {
+		s.TotalStmts += fs.TotalStmts
+		s.HitStmts += fs.HitStmts
+	}
+	return s
+}
+
+// Percentage returns the percentage of covered statements.
+func (s *Summary) Percentage() float64 { return percent(s.HitStmts, s.TotalStmts) }
+
+// Percentage returns the percentage of covered statements.
+func (f *FileSummary) Percentage() float64 { return percent(f.HitStmts, f.TotalStmts) }
+
+// Percentage returns the percentage of covered statements.
+func (p *PackageSummary) Percentage() float64 { return percent(p.HitStmts, p.TotalStmts) }
+
+func percent(hit, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(hit) / float64(total) * 100
+}
+
+// Packages groups the files of s by import path, in import path order.
+func (s *Summary) Packages() []*PackageSummary {
+	var pkgs []*PackageSummary
+	byPath := make(map[string]*PackageSummary)
+	for _, fs := range s.Files {
+		importPath := path.Dir(fs.File)
+		ps, ok := byPath[importPath]
+		if !ok {
+			ps = &PackageSummary{ImportPath: importPath}
+			byPath[importPath] = ps
+			pkgs = append(pkgs, ps)
+		}
+		ps.Files = append(ps.Files, fs)
+		ps.TotalStmts += fs.TotalStmts
+		ps.HitStmts += fs.HitStmts
+	}
+	sort.Slice(pkgs, func(i, j int) bool { return pkgs[i].ImportPath < pkgs[j].ImportPath })
+	return pkgs
+}
+
+// LineHits returns the execution counts of the lines spanned by the file's
+// blocks, in line order. A line shared by several blocks, such as the line
+// of an if statement and the first line of its body, takes the highest count
+// and the latest hit time. Blocks without statements contribute no lines.
+func (f *FileSummary) LineHits() []LineHits {
+	hits := make(map[int]*LineHits)
+	for _, b := range f.Blocks {
+		if b.NumStmts == 0 {
+			continue
+		}
+		for line := b.StartLine; line <= b.EndLine; line++ {
+			l, ok := hits[line]
+			if !ok {
+				l = &LineHits{Line: line}
+				hits[line] = l
+			}
+			l.Hits = max(l.Hits, b.HitCount)
+			l.LastHitAt = max(l.LastHitAt, b.LastHitAt)
+		}
+	}
+	lines := make([]LineHits, 0, len(hits))
+	for _, l := range hits {
+		lines = append(lines, *l)
+	}
+	sort.Slice(lines, func(i, j int) bool { return lines[i].Line < lines[j].Line })
+	return lines
+}
@@ -0,0 +1,129 @@
+package coverage
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Threshold is a minimum statement coverage percentage for the packages or
+// files matching a pattern.
+type Threshold struct {
+	// Pattern matches import paths, for packages, or "importpath/file.go"
+	// paths, for files. It is a path.Match glob in which "..." also matches
+	// any string, as in `go list`; a trailing "/..." matches the path
+	// without it too. An empty pattern matches everything.
+	Pattern string
+	Min     float64
+}
+
+// ParseThreshold parses a threshold in the form "[PATTERN=]PERCENT", where
+// PERCENT may end with "%".
+func ParseThreshold(s string) (Threshold, error) {
+	pattern, value, ok := strings.Cut(s, "=")
+	if !ok {
+		pattern, value = "", s
+	}
+	min, err := ParsePercent(value)
+	if err != nil {
+		return Threshold{}, err
+	}
+	return Threshold{Pattern: pattern, Min: min}, nil
+}
+
+// ParsePercent parses a percentage between 0 and 100, which may end with "%".
+func ParsePercent(s string) (float64, error) {
+	v, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil || v < 0 || v > 100 {
+		return 0, fmt.Errorf("invalid percentage %q", s)
+	}
+	return v, nil
+}
+
+// Match reports whether the threshold applies to name.
+func (t Threshold) Match(name string) bool {
+	if t.Pattern == "" {
+		return true
+	}
+	if !strings.Contains(t.Pattern, "...") {
+		ok, _ := path.Match(t.Pattern, name)
+		return ok
+	}
+	re := regexp.QuoteMeta(t.Pattern)
+	re = strings.ReplaceAll(re, `\.\.\.`, `.*`)
+	if strings.HasSuffix(re, `/.*`) {
+		re = strings.TrimSuffix(re, `/.*`) + `(/.*)?`
+	}
+	ok, _ := regexp.MatchString(`^`+re+`$`, name)
+	return ok
+}
+
+// Thresholds are the coverage requirements checked by Check.
+type Thresholds struct {
+	Total float64 // minimum overall percentage; 0 for none
+
+	// Packages and Files apply to the packages and files they match. When
+	// several match, the last one applies, so that exceptions can follow a
+	// general requirement.
+	Packages []Threshold
+	Files    []Threshold
+}
+
+// Violation is a package, file or total whose coverage is below its
+// threshold.
+type Violation struct {
+	Scope      string // "total", "package" or "file"
+	Name       string // import path or "importpath/file.go"; "" for the total
+	HitStmts   int
+	TotalStmts int
+	Min        float64
+}
+
+// Percentage returns the percentage of covered statements.
+func (v Violation) Percentage() float64 { return percent(v.HitStmts, v.TotalStmts) }
+
+// Check returns the parts of s covered below their thresholds, the total
+// first, then packages and files in path order. Packages and files without
+// statements are never below a threshold. unmatched lists the package and
+// file thresholds that applied to nothing, which usually means a mistyped
+// pattern.
+func (t Thresholds) Check(s *Summary) (violations []Violation, unmatched []Threshold) {
+	if s.TotalStmts > 0 && s.Percentage() < t.Total {
+		violations = append(violations, Violation{Scope: "total", HitStmts: s.HitStmts, TotalStmts: s.TotalStmts, Min: t.Total})
+	}
+
+	check := func(scope string, thresholds []Threshold, used []bool, name string, hit, total int) {
+		applies := -1
+		for i, th := range thresholds {
+			if th.Match(name) {
+				used[i] = true
+				applies = i
+			}
+		}
+		if applies >= 0 && total > 0 && percent(hit, total) < thresholds[applies].Min {
+			violations = append(violations, Violation{Scope: scope, Name: name, HitStmts: hit, TotalStmts: total, Min: thresholds[applies].Min})
+		}
+	}
+	usedPkgs := make([]bool, len(t.Packages))
+	for _, p := range s.Packages() {
+		check("package", t.Packages, usedPkgs, p.ImportPath, p.HitStmts, p.TotalStmts)
+	}
+	usedFiles := make([]bool, len(t.Files))
+	for _, f := range s.Files {
+		check("file", t.Files, usedFiles, f.File, f.HitStmts, f.TotalStmts)
+	}
+
+	for i, used := range usedPkgs {
+		if !used {
+			unmatched = append(unmatched, t.Packages[i])
+		}
+	}
+	for i, used := range usedFiles {
+		if !used {
+			unmatched = append(unmatched, t.Files[i])
+		}
+	}
+	return violations, unmatched
+}
@@ -0,0 +1,76 @@
+package coverage
+
+import "testing"
+
+func TestParseThreshold(t *testing.T) {
+	for in, want := range map[string]Threshold{
+		"80":                         {Min: 80},
+		"example.com/app/...=90":     {Pattern: "example.com/app/...", Min: 90},
+		"example.com/app/*.go=62.5%": {Pattern: "example.com/app/*.go", Min: 62.5},
+	} {
+		got, err := ParseThreshold(in)
+		if err != nil || got != want {
+			t.Errorf("ParseThreshold(%q) = %+v, %v; want %+v", in, got, err, want)
+		}
+	}
+	for _, bad := range []string{"", "x=", "eighty", "101", "-1"} {
+		if _, err := ParseThreshold(bad); err == nil {
+			t.Errorf("ParseThreshold(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestThresholdMatch(t *testing.T) {
+	for _, tt := range []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"", "example.com/app", true},
+		{"example.com/app/...", "example.com/app", true},
+		{"example.com/app/...", "example.com/app/util", true},
+		{"example.com/app/...", "example.com/application", false},
+		{"example.com/app/.../x.go", "example.com/app/util/x.go", true},
+		{"example.com/app/*.go", "example.com/app/main.go", true},
+		{"example.com/app/*.go", "example.com/app/util/util.go", false},
+	} {
+		if got := (Threshold{Pattern: tt.pattern}).Match(tt.name); got != tt.want {
+			t.Errorf("%q matches %q = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestThresholdsCheck(t *testing.T) {
+	s := Summarize(testBlocks) // 75% total; main.go and its package 2/3, util 1/1
+
+	th := Thresholds{
+		Total: 80,
+		Packages: []Threshold{
+			{Min: 70},
+			{Pattern: "example.com/app/util", Min: 100},
+			{Pattern: "example.com/other/...", Min: 50},
+		},
+		Files: []Threshold{{Pattern: "example.com/.../main.go", Min: 60}},
+	}
+	violations, unmatched := th.Check(s)
+	want := []Violation{
+		{Scope: "total", HitStmts: 3, TotalStmts: 4, Min: 80},
+		{Scope: "package", Name: "example.com/app", HitStmts: 2, TotalStmts: 3, Min: 70},
+	}
+	if len(violations) != len(want) {
+		t.Fatalf("violations = %+v", violations)
+	}
+	for i := range want {
+		if violations[i] != want[i] {
+			t.Errorf("violation %d = %+v, want %+v", i, violations[i], want[i])
+		}
+	}
+	if len(unmatched) != 1 || unmatched[0].Pattern != "example.com/other/..." {
+		t.Errorf("unmatched = %+v", unmatched)
+	}
+
+	// A later threshold overrides an earlier one.
+	th = Thresholds{Packages: []Threshold{{Min: 70}, {Pattern: "example.com/app", Min: 60}}}
+	if violations, _ := th.Check(s); len(violations) != 0 {
+		t.Errorf("violations = %+v, want none", violations)
+	}
+}
@@ -0,0 +1,236 @@
+// Package diffcover computes the coverage of the statements changed since
+// a git revision, the patch coverage reviewers look at in pull requests.
+package diffcover
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gococo/gococo/internal/coverage"
+)
+
+// Options configures Compute.
+type Options struct {
+	// Dir is a directory of the git repository, usually the source root.
+	Dir string
+
+	// Base is the revision changes are taken relative to, such as
+	// "origin/main". Changes are counted from its merge base with HEAD.
+	Base string
+
+	// ImportPath maps an absolute directory to the import path of its
+	// package, reporting false for directories outside the covered modules.
+	ImportPath func(dir string) (string, bool)
+}
+
+// Result is the coverage of the changed statements of a repository.
+type Result struct {
+	Base       string        `json:"base"`
+	MergeBase  string        `json:"merge_base"`
+	TotalStmts int           `json:"total_stmts"`
+	HitStmts   int           `json:"hit_stmts"`
+	Files      []*FileResult `json:"files"`
+
+	// Unmeasured lists the changed Go files, relative to the repository
+	// root, that have no coverage data because their package was not
+	// instrumented or not run.
+	Unmeasured []string `json:"unmeasured"`
+}
+
+// FileResult is the coverage of the changed statements of a file.
+type FileResult struct {
+	File       string `json:"file"` // "importpath/file.go"
+	Path       string `json:"path"` // relative to the repository root
+	TotalStmts int    `json:"total_stmts"`
+	HitStmts   int    `json:"hit_stmts"`
+	Stmts      []Stmt `json:"stmts"` // in source order
+}
+
+// Stmt is a changed statement. Its lines are those of the statement itself,
+// up to the opening brace of a compound statement's body.
+type Stmt struct {
+	StartLine int  `json:"sl"`
+	EndLine   int  `json:"el"`
+	Hit       bool `json:"hit"`
+}
+
+// Percentage returns the percentage of changed statements covered.
+func (r *Result) Percentage() float64 { return percent(r.HitStmts, r.TotalStmts) }
+
+// Percentage returns the percentage of changed statements covered.
+func (f *FileResult) Percentage() float64 { return percent(f.HitStmts, f.TotalStmts) }
+
+func percent(hit, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(hit) / float64(total) * 100
+}
+
+// Uncovered returns the lines of the changed statements that never ran.
+func (f *FileResult) Uncovered() []LineRange {
+	var ranges []LineRange
+	for _, s := range f.Stmts {
+		if !s.Hit {
+			ranges = append(ranges, LineRange{s.StartLine, s.EndLine})
+		}
+	}
+	return mergeRanges(ranges)
+}
+
+// Compute intersects the lines changed in the working tree since opts.Base
+// with the statements of blocks, the coverage of the program built from it.
+// Statements are counted as in coverage.Summarize: a statement is covered
+// when its block ran. Test files are left out.
+func Compute(blocks []coverage.Block, opts Options) (*Result, error) {
+	changes, root, mergeBase, err := GitChanges(opts.Dir, opts.Base)
+	if err != nil {
+		return nil, err
+	}
+	byFile := make(map[string][]coverage.Block)
+	for _, b := range blocks {
+		byFile[b.File] = append(byFile[b.File], b)
+	}
+
+	res := &Result{Base: opts.Base, MergeBase: mergeBase, Files: []*FileResult{}, Unmeasured: []string{}}
+	paths := make([]string, 0, len(changes))
+	for p := range changes {
+		if strings.HasSuffix(p, ".go") && !strings.HasSuffix(p, "_test.go") {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		abs := filepath.Join(root, filepath.FromSlash(p))
+		importPath, ok := opts.ImportPath(filepath.Dir(abs))
+		name := importPath + "/" + path.Base(p)
+		src, err := os.ReadFile(abs)
+		if !ok || len(byFile[name]) == 0 || err != nil {
+			res.Unmeasured = append(res.Unmeasured, p)
+			continue
+		}
+		fr, err := fileResult(src, byFile[name], changes[p])
+		if err != nil {
+			res.Unmeasured = append(res.Unmeasured, p)
+			continue
+		}
+		if fr.TotalStmts == 0 {
+			continue
+		}
+		fr.File, fr.Path = name, p
+		res.Files = append(res.Files, fr)
+		res.TotalStmts += fr.TotalStmts
+		res.HitStmts += fr.HitStmts
+	}
+	return res, nil
+}
+
+// fileResult finds the statements of src on the changed lines and the
+// blocks they belong to.
+func fileResult(src []byte, blocks []coverage.Block, changed []LineRange) (*FileResult, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", src, parser.SkipObjectResolution)
+	if err != nil {
+		return nil, err
+	}
+
+	fr := &FileResult{Stmts: []Stmt{}}
+	addStmts := func(list []ast.Stmt) {
+		for _, s := range list {
+			start := fset.Position(s.Pos())
+			end := fset.Position(stmtHeaderEnd(s))
+			if !contains(changed, start.Line, end.Line) {
+				continue
+			}
+			b := blockAt(blocks, start.Line, start.Column)
+			if b == nil {
+				// Not instrumented, like statements marked //gococo:ignore.
+				continue
+			}
+			hit := b.HitCount > 0
+			fr.Stmts = append(fr.Stmts, Stmt{StartLine: start.Line, EndLine: end.Line, Hit: hit})
+			fr.TotalStmts++
+			if hit {
+				fr.HitStmts++
+			}
+		}
+	}
+	ast.Inspect(f, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.BlockStmt:
+			if len(n.List) > 0 {
+				switch n.List[0].(type) {
+				case *ast.CaseClause, *ast.CommClause:
+					return true
+				}
+			}
+			addStmts(n.List)
+		case *ast.CaseClause:
+			addStmts(n.Body)
+		case *ast.CommClause:
+			addStmts(n.Body)
+		}
+		return true
+	})
+	// Lists are visited before the lists nested in their statements.
+	sort.SliceStable(fr.Stmts, func(i, j int) bool { return fr.Stmts[i].StartLine < fr.Stmts[j].StartLine })
+	return fr, nil
+}
+
+// stmtHeaderEnd returns where the lines of s end that belong to s rather
+// than to the blocks nested in it: the opening brace of a compound
+// statement's body, or of the first function literal in a simple statement.
+func stmtHeaderEnd(s ast.Stmt) token.Pos {
+	switch s := s.(type) {
+	case *ast.BlockStmt:
+		return s.Lbrace
+	case *ast.IfStmt:
+		return s.Body.Lbrace
+	case *ast.ForStmt:
+		return s.Body.Lbrace
+	case *ast.RangeStmt:
+		return s.Body.Lbrace
+	case *ast.SwitchStmt:
+		return s.Body.Lbrace
+	case *ast.TypeSwitchStmt:
+		return s.Body.Lbrace
+	case *ast.SelectStmt:
+		return s.Body.Lbrace
+	case *ast.LabeledStmt:
+		return stmtHeaderEnd(s.Stmt)
+	}
+	end := s.End() - 1
+	ast.Inspect(s, func(n ast.Node) bool {
+		if fl, ok := n.(*ast.FuncLit); ok && fl.Body.Lbrace < end {
+			end = fl.Body.Lbrace
+		}
+		return true
+	})
+	return end
+}
+
+// blockAt returns the innermost block with statements that contains the
+// position, or nil.
+func blockAt(blocks []coverage.Block, line, col int) *coverage.Block {
+	var best *coverage.Block
+	for i := range blocks {
+		b := &blocks[i]
+		if b.NumStmts == 0 || before(line, col, b.StartLine, b.StartCol) || before(b.EndLine, b.EndCol, line, col) {
+			continue
+		}
+		if best == nil || before(best.StartLine, best.StartCol, b.StartLine, b.StartCol) {
+			best = b
+		}
+	}
+	return best
+}
+
+func before(l1, c1, l2, c2 int) bool {
+	return l1 < l2 || (l1 == l2 && c1 < c2)
+}
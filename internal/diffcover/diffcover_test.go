@@ -0,0 +1,110 @@
+package diffcover
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gococo/gococo/internal/coverage"
+	"github.com/gococo/gococo/internal/instrument"
+)
+
+func TestParseUnifiedDiff(t *testing.T) {
+	diff := `diff --git app/main.go app/main.go
+index 1111111..2222222 100644
+--- app/main.go
++++ app/main.go
+@@ -3,0 +4,2 @@ func main() {
++	x := 1
++++ y
+@@ -10 +12 @@ func f() {
+-	old()
++	new()
+@@ -20,2 +21,0 @@ func g() {
+-	a()
+-	b()
+@@ -30 +30,3 @@ func h() {
+-	c()
++	c()
++	d()
++	e()
+diff --git "app/sp ace.go" "app/sp ace.go"
+--- /dev/null
++++ "app/sp ace.go"
+@@ -0,0 +1 @@
++package app
+diff --git app/gone.go app/gone.go
+--- app/gone.go
++++ /dev/null
+@@ -1 +0,0 @@
+-package app
+`
+	got, err := ParseUnifiedDiff(strings.NewReader(diff))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Changes{
+		"app/main.go":   {{4, 5}, {12, 12}, {30, 32}},
+		"app/sp ace.go": {{1, 1}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if _, err := ParseUnifiedDiff(strings.NewReader("+++ a.go\n@@ -1 +x @@\n")); err == nil {
+		t.Error("invalid hunk header accepted")
+	}
+}
+
+func TestFileResult(t *testing.T) {
+	src := []byte(`package app
+
+func Sign(x int) int {
+	if x < 0 {
+		return -1
+	}
+	if x > 0 {
+		go func() {
+			println("positive")
+		}()
+		return 1
+	}
+	return 0
+}
+`)
+	_, inst, err := instrument.InstrumentFile(src, "app.go", "example.com/app", "v", "r", 0, instrument.ModeCount, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var blocks []coverage.Block
+	for _, b := range inst.Blocks {
+		blocks = append(blocks, coverage.Block{
+			StartLine: b.StartLine, StartCol: b.StartCol, EndLine: b.EndLine, EndCol: b.EndCol,
+			NumStmts: b.NumStmts,
+		})
+	}
+	// Sign ran with x == 0 only.
+	for i, b := range blocks {
+		if b.StartLine == 3 || b.StartLine == 7 || b.StartLine == 13 {
+			blocks[i].HitCount = 1
+		}
+	}
+
+	fr, err := fileResult(src, blocks, []LineRange{{5, 5}, {7, 9}, {13, 13}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Stmt{
+		{StartLine: 5, EndLine: 5},
+		{StartLine: 7, EndLine: 7, Hit: true},
+		{StartLine: 8, EndLine: 8},
+		{StartLine: 9, EndLine: 9},
+		{StartLine: 13, EndLine: 13, Hit: true},
+	}
+	if !reflect.DeepEqual(fr.Stmts, want) || fr.TotalStmts != 5 || fr.HitStmts != 2 {
+		t.Errorf("stmts = %+v (%d/%d)", fr.Stmts, fr.HitStmts, fr.TotalStmts)
+	}
+	if got := fr.Uncovered(); !reflect.DeepEqual(got, []LineRange{{5, 5}, {8, 9}}) {
+		t.Errorf("uncovered = %v", got)
+	}
+}
@@ -0,0 +1,187 @@
+package diffcover
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// LineRange is an inclusive range of line numbers.
+type LineRange struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// Changes are the lines changed since a base revision, keyed by the path of
+// the file relative to the repository root, in slash form. Ranges are sorted
+// and do not overlap.
+type Changes map[string][]LineRange
+
+// contains reports whether one of the ranges intersects [start, end].
+func contains(ranges []LineRange, start, end int) bool {
+	i := sort.Search(len(ranges), func(i int) bool { return ranges[i].End >= start })
+	return i < len(ranges) && ranges[i].Start <= end
+}
+
+// ParseUnifiedDiff returns the lines added or modified by a unified diff, as
+// written by `git diff --no-prefix`, in terms of the new files. Deleted
+// files and pure deletions contribute no lines.
+func ParseUnifiedDiff(r io.Reader) (Changes, error) {
+	changes := make(Changes)
+	file := ""
+	oldLeft, newLeft := 0, 0 // lines of the current hunk still to come
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for sc.Scan() {
+		line := sc.Text()
+		if oldLeft > 0 || newLeft > 0 {
+			switch {
+			case strings.HasPrefix(line, "+"):
+				newLeft--
+			case strings.HasPrefix(line, "-"):
+				oldLeft--
+			case strings.HasPrefix(line, " "):
+				oldLeft--
+				newLeft--
+			}
+			continue
+		}
+		switch {
+		case strings.HasPrefix(line, "+++ "):
+			file = strings.TrimPrefix(line, "+++ ")
+			if strings.HasPrefix(file, `"`) {
+				unq, err := strconv.Unquote(file)
+				if err != nil {
+					return nil, fmt.Errorf("invalid file name %s", file)
+				}
+				file = unq
+			}
+			if file == "/dev/null" {
+				file = ""
+			}
+		case strings.HasPrefix(line, "@@ "):
+			// @@ -l[,s] +l[,s] @@
+			fields := strings.Fields(line)
+			if len(fields) < 3 || !strings.HasPrefix(fields[1], "-") || !strings.HasPrefix(fields[2], "+") {
+				return nil, fmt.Errorf("invalid hunk header %q", line)
+			}
+			_, oldCount, err := parseHunkRange(fields[1][1:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid hunk header %q", line)
+			}
+			start, newCount, err := parseHunkRange(fields[2][1:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid hunk header %q", line)
+			}
+			oldLeft, newLeft = oldCount, newCount
+			if file != "" && newCount > 0 {
+				changes[file] = append(changes[file], LineRange{start, start + newCount - 1})
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	for file := range changes {
+		changes[file] = mergeRanges(changes[file])
+	}
+	return changes, nil
+}
+
+// parseHunkRange parses the "l[,s]" range of a hunk header.
+func parseHunkRange(s string) (start, count int, err error) {
+	startStr, countStr, hasCount := strings.Cut(s, ",")
+	start, err = strconv.Atoi(startStr)
+	count = 1
+	if err == nil && hasCount {
+		count, err = strconv.Atoi(countStr)
+	}
+	return start, count, err
+}
+
+// mergeRanges sorts ranges and joins overlapping and adjacent ones.
+func mergeRanges(ranges []LineRange) []LineRange {
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Start < ranges[j].Start })
+	var out []LineRange
+	for _, r := range ranges {
+		if n := len(out); n > 0 && r.Start <= out[n-1].End+1 {
+			out[n-1].End = max(out[n-1].End, r.End)
+			continue
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// GitChanges returns the lines of the working tree of the git repository
+// containing dir that changed since its merge base with base, like the
+// changes of a pull request into base plus uncommitted ones. Untracked
+// files count as changed entirely. It also returns the repository root and
+// the merge base.
+func GitChanges(dir, base string) (changes Changes, root, mergeBase string, err error) {
+	if base == "" || strings.HasPrefix(base, "-") {
+		return nil, "", "", fmt.Errorf("invalid base revision %q", base)
+	}
+	root, err = git(dir, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, "", "", err
+	}
+	mergeBase, err = git(dir, "merge-base", base, "HEAD")
+	if err != nil {
+		return nil, "", "", err
+	}
+	diff, err := git(root, "-c", "core.quotePath=false", "diff", "--no-color", "--no-ext-diff", "--no-prefix", "-U0", mergeBase)
+	if err != nil {
+		return nil, "", "", err
+	}
+	changes, err = ParseUnifiedDiff(strings.NewReader(diff))
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	untracked, err := git(root, "-c", "core.quotePath=false", "ls-files", "--others", "--exclude-standard")
+	if err != nil {
+		return nil, "", "", err
+	}
+	for _, file := range strings.Split(untracked, "\n") {
+		if file == "" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(file)))
+		if err != nil {
+			continue
+		}
+		n := bytes.Count(data, []byte("\n"))
+		if len(data) > 0 && data[len(data)-1] != '\n' {
+			n++
+		}
+		if n > 0 {
+			changes[file] = []LineRange{{1, n}}
+		}
+	}
+	return changes, root, mergeBase, nil
+}
+
+// git runs a git command in dir and returns its trimmed output.
+func git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		return "", fmt.Errorf("git %s: %s", strings.Join(args, " "), msg)
+	}
+	return strings.TrimRight(string(out), "\n"), nil
+}
@@ -14,6 +14,7 @@ type CoverEvent struct {
 	EndLine   int    `json:"el"`
 	EndCol    int    `json:"ec"`
 	NumStmts  int    `json:"stmts"`
+	Test      string `json:"test,omitempty"` // running test, from instrumented test binaries
 }
 
 // AgentInfo describes a connected instrumented process.
@@ -23,4 +24,7 @@ type AgentInfo struct {
 	PID      int    `json:"pid"`
 	CmdLine  string `json:"cmdline"`
 	RemoteIP string `json:"remote_ip"`
+
+	// CoverMode is the agent's counter mode: "set", "count" or "atomic".
+	CoverMode string `json:"cover_mode,omitempty"`
 }
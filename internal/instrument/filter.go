@@ -0,0 +1,70 @@
+package instrument
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path"
+	"strings"
+)
+
+// fileFilter decides which source files are instrumented.
+type fileFilter struct {
+	Include          []string
+	Exclude          []string
+	IncludeGenerated bool
+}
+
+// Reasons reported for files left uninstrumented.
+const (
+	skipGenerated   = "generated"
+	skipExcluded    = "excluded"
+	skipNotIncluded = "not included"
+)
+
+// skipReason returns why the file name in package importPath is not to be
+// instrumented, or "" if it is. src is the file's content.
+func (f *fileFilter) skipReason(importPath, name string, src []byte) string {
+	if len(f.Include) > 0 && !matchAny(f.Include, importPath, name) {
+		return skipNotIncluded
+	}
+	if matchAny(f.Exclude, importPath, name) {
+		return skipExcluded
+	}
+	if !f.IncludeGenerated && isGeneratedSource(src) {
+		return skipGenerated
+	}
+	return ""
+}
+
+// matchAny reports whether one of the patterns matches the package import
+// path, the file's base name or its "importpath/file.go" path. Patterns are
+// path.Match globs; "..." additionally matches any string, as in `go list`.
+func matchAny(patterns []string, importPath, name string) bool {
+	base := path.Base(name)
+	full := importPath + "/" + base
+	for _, p := range patterns {
+		if strings.Contains(p, "...") {
+			if matchPackagePattern(p, importPath) || matchPackagePattern(p, full) {
+				return true
+			}
+			continue
+		}
+		for _, s := range []string{importPath, base, full} {
+			if ok, _ := path.Match(p, s); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isGeneratedSource reports whether src carries the standard
+// "// Code generated ... DO NOT EDIT." header.
+func isGeneratedSource(src []byte) bool {
+	f, err := parser.ParseFile(token.NewFileSet(), "", src, parser.PackageClauseOnly|parser.ParseComments)
+	if err != nil {
+		return false
+	}
+	return ast.IsGenerated(f)
+}
@@ -0,0 +1,35 @@
+package instrument
+
+import "testing"
+
+func TestFileFilter(t *testing.T) {
+	plain := []byte("package p\n")
+	generated := []byte("// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage p\n")
+
+	tests := []struct {
+		name   string
+		filter fileFilter
+		pkg    string
+		file   string
+		src    []byte
+		want   string
+	}{
+		{"default", fileFilter{}, "example.com/app", "main.go", plain, ""},
+		{"generated", fileFilter{}, "example.com/app/pb", "app.pb.go", generated, skipGenerated},
+		{"include generated", fileFilter{IncludeGenerated: true}, "example.com/app/pb", "app.pb.go", generated, ""},
+		{"exclude file glob", fileFilter{Exclude: []string{"*_mock.go"}}, "example.com/app", "store_mock.go", plain, skipExcluded},
+		{"exclude package glob", fileFilter{Exclude: []string{"example.com/app/mocks"}}, "example.com/app/mocks", "store.go", plain, skipExcluded},
+		{"exclude package tree", fileFilter{Exclude: []string{"example.com/app/internal/..."}}, "example.com/app/internal/x", "x.go", plain, skipExcluded},
+		{"exclude full path", fileFilter{Exclude: []string{"example.com/app/debug.go"}}, "example.com/app", "debug.go", plain, skipExcluded},
+		{"include other package", fileFilter{Include: []string{"example.com/app/core"}}, "example.com/app", "main.go", plain, skipNotIncluded},
+		{"include package", fileFilter{Include: []string{"example.com/app/core"}}, "example.com/app/core", "core.go", plain, ""},
+		{"exclude wins", fileFilter{Include: []string{"example.com/app/..."}, Exclude: []string{"*_mock.go"}}, "example.com/app", "a_mock.go", plain, skipExcluded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.skipReason(tt.pkg, tt.file, tt.src); got != tt.want {
+				t.Errorf("skipReason(%q, %q) = %q, want %q", tt.pkg, tt.file, got, tt.want)
+			}
+		})
+	}
+}
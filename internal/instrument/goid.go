@@ -0,0 +1,126 @@
+package instrument
+
+import (
+	"debug/dwarf"
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// RuntimeOffsets locates the current goroutine's ID in the runtime's data
+// structures of a toolchain and target: the ID is the goid field of the
+// runtime.g pointed to by the curg field of the runtime.m returned by
+// runtime.getm. Reading it is what lets events carry the ID of the
+// goroutine that ran a block without the cost of runtime.Stack.
+type RuntimeOffsets struct {
+	Curg int64 // offset of curg in runtime.m
+	Goid int64 // offset of goid in runtime.g
+}
+
+// ProbeRuntimeOffsets builds an empty program for the target of the go
+// command in the current environment (GOOS, GOARCH, GOEXPERIMENT...) and
+// reads the offsets from its debug information, so that they are those of
+// the toolchain the project is built with.
+func ProbeRuntimeOffsets() (*RuntimeOffsets, error) {
+	dir, err := os.MkdirTemp("", "gococo-probe-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module gococoprobe\n"), 0o644); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n\nfunc main() {}\n"), 0o644); err != nil {
+		return nil, err
+	}
+
+	exe := filepath.Join(dir, "probe")
+	cmd := exec.Command("go", "build", "-o", exe, ".")
+	cmd.Dir = dir
+	// Flags such as -ldflags=-w would strip the debug information.
+	cmd.Env = append(os.Environ(), "GOFLAGS=", "GOWORK=off", "CGO_ENABLED=0")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("build probe: %v\n%s", err, out)
+	}
+	data, err := openDWARF(exe)
+	if err != nil {
+		return nil, err
+	}
+	return runtimeOffsets(data)
+}
+
+// openDWARF returns the debug information of an executable.
+func openDWARF(path string) (*dwarf.Data, error) {
+	if f, err := elf.Open(path); err == nil {
+		defer f.Close()
+		return f.DWARF()
+	}
+	if f, err := macho.Open(path); err == nil {
+		defer f.Close()
+		return f.DWARF()
+	}
+	if f, err := pe.Open(path); err == nil {
+		defer f.Close()
+		return f.DWARF()
+	}
+	return nil, fmt.Errorf("%s: unsupported executable format", path)
+}
+
+// runtimeOffsets finds the offsets of m.curg and g.goid in data.
+func runtimeOffsets(data *dwarf.Data) (*RuntimeOffsets, error) {
+	want := map[string]string{"runtime.m": "curg", "runtime.g": "goid"}
+	found := make(map[string]int64)
+	r := data.Reader()
+	for len(found) < len(want) {
+		e, err := r.Next()
+		if err != nil {
+			return nil, err
+		}
+		if e == nil {
+			break
+		}
+		if e.Tag == dwarf.TagCompileUnit {
+			continue
+		}
+		name, _ := e.Val(dwarf.AttrName).(string)
+		field, ok := want[name]
+		if e.Tag != dwarf.TagStructType || !ok || !e.Children {
+			if e.Children {
+				r.SkipChildren()
+			}
+			continue
+		}
+		for {
+			m, err := r.Next()
+			if err != nil {
+				return nil, err
+			}
+			if m == nil || m.Tag == 0 {
+				break
+			}
+			if m.Tag == dwarf.TagMember && m.Val(dwarf.AttrName) == field {
+				if off, ok := m.Val(dwarf.AttrDataMemberLoc).(int64); ok {
+					found[name] = off
+				}
+			}
+			if m.Children {
+				r.SkipChildren()
+			}
+		}
+	}
+	if len(found) < len(want) {
+		var missing []string
+		for name, field := range want {
+			if _, ok := found[name]; !ok {
+				missing = append(missing, name+"."+field)
+			}
+		}
+		return nil, fmt.Errorf("no %s in debug information", strings.Join(missing, ", "))
+	}
+	return &RuntimeOffsets{Curg: found["runtime.m"], Goid: found["runtime.g"]}, nil
+}
@@ -0,0 +1,49 @@
+package instrument
+
+import (
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+//go:linkname getm runtime.getm
+func getm() unsafe.Pointer
+
+// TestProbeRuntimeOffsets verifies that the probed offsets lead to the ID of
+// the running goroutine, as generated agents read it.
+func TestProbeRuntimeOffsets(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip probe build in short mode")
+	}
+	offs, err := ProbeRuntimeOffsets()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	goid := func() int64 {
+		g := *(*unsafe.Pointer)(unsafe.Add(getm(), offs.Curg))
+		return *(*int64)(unsafe.Add(g, offs.Goid))
+	}
+	stackGoid := func() int64 {
+		var buf [64]byte
+		s := string(buf[:runtime.Stack(buf[:], false)])
+		s = strings.TrimPrefix(s, "goroutine ")
+		id, _ := strconv.ParseInt(s[:strings.IndexByte(s, ' ')], 10, 64)
+		return id
+	}
+
+	for i := 0; i < 3; i++ {
+		done := make(chan [2]int64)
+		go func() {
+			// Stay on the M whose current goroutine is read.
+			runtime.LockOSThread()
+			defer runtime.UnlockOSThread()
+			done <- [2]int64{goid(), stackGoid()}
+		}()
+		if ids := <-done; ids[0] != ids[1] {
+			t.Errorf("goroutine ID at offsets %+v = %d, want %d", *offs, ids[0], ids[1])
+		}
+	}
+}
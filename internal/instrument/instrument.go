@@ -1,29 +1,94 @@
 // Package instrument implements the core build-time instrumentation for gococo.
 //
-// It copies a Go project to a temp directory, rewrites all source files to inject
-// coverage counters and event emitters, injects a runtime agent, and builds the
-// modified project.
+// It rewrites the source files of a Go project to inject coverage counters and
+// event emitters, generates a runtime agent, and builds (or tests) the project
+// with `go build -overlay`, so the original tree is never copied or modified.
 package instrument
 
 import (
+	"bytes"
 	"crypto/sha256"
+	"encoding/json"
 	"fmt"
 	"go/parser"
 	"go/token"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 	"text/template"
+
+	"github.com/gococo/gococo/internal/protocol"
 )
 
 // Options configures the instrumentation.
 type Options struct {
 	Host      string   // gococo server address (e.g. "127.0.0.1:7778")
 	Packages  []string // packages to build (e.g. "." or "./cmd/myapp")
-	GoFlags   []string // additional flags to pass to `go build`
+	GoFlags   []string // additional flags to pass to `go build` or `go test`
 	OutputDir string   // where to place the built binary (-o)
 	Debug     bool
+
+	// Test runs `go test` on the instrumented packages instead of `go build`.
+	// The packages under test and their project dependencies are instrumented,
+	// and the agent is linked into every test binary.
+	Test     bool
+	TestArgs []string // arguments passed to the test binaries after -args
+
+	// Toolexec builds with `-toolexec "gococo toolexec"` so that packages
+	// outside the main module, including standard library packages, can be
+	// instrumented at compile time. InstrumentPkgs holds the import path
+	// patterns selecting them ("..." is a wildcard, as in `go list`).
+	Toolexec       bool
+	InstrumentPkgs []string
+
+	// Include and Exclude select the files to instrument by glob patterns
+	// matched against package import paths, file names and
+	// "importpath/file.go" paths. With Include set, only matching files are
+	// instrumented. Files with a "// Code generated ... DO NOT EDIT." header
+	// are skipped unless IncludeGenerated is set. Skipped files are compiled
+	// unchanged.
+	Include          []string
+	Exclude          []string
+	IncludeGenerated bool
+
+	// CoverMode is "set", "count" or "atomic", as for `go test -covermode`.
+	// It defaults to "atomic" when building with -race and "count" otherwise.
+	CoverMode string
+
+	// AgentMode is the agent's startup policy when GOCOCO_MODE is not set
+	// at run time: "required" (the default), "optional" or "disabled".
+	AgentMode string
+
+	// NoEvents leaves the event call out of the injected statements. The
+	// agent then only reports counter deltas periodically, as it does when
+	// GOCOCO_EVENTS=off is set at run time.
+	NoEvents bool
+}
+
+// AgentMode selects how the agent starts in an instrumented binary.
+type AgentMode string
+
+const (
+	// AgentRequired blocks init until the server is reached, so that no
+	// event is missed, and falls back to offline mode if it is not.
+	AgentRequired AgentMode = "required"
+	// AgentOptional starts the program at once and connects to the server
+	// in the background, retrying with exponential backoff.
+	AgentOptional AgentMode = "optional"
+	// AgentDisabled never contacts a server or writes files. Counters are
+	// still updated, but nothing reads them.
+	AgentDisabled AgentMode = "disabled"
+)
+
+// ParseAgentMode validates an agent mode.
+func ParseAgentMode(s string) (AgentMode, error) {
+	switch m := AgentMode(s); m {
+	case AgentRequired, AgentOptional, AgentDisabled:
+		return m, nil
+	}
+	return "", fmt.Errorf("invalid agent mode %q: must be required, optional or disabled", s)
 }
 
 // Run performs the full instrument-and-build pipeline.
@@ -34,12 +99,39 @@ func Run(opts Options) error {
 		return fmt.Errorf("getwd: %w", err)
 	}
 
-	modPath, modDir, err := findModuleInfo(wd)
+	// In a go.work workspace every workspace module is part of the project.
+	// go list must see the same build tags, module flags and target
+	// platform as the build, or it selects different files.
+	listFlags := LoadFlags(opts.GoFlags)
+
+	modules, err := findModules(wd, listFlags)
 	if err != nil {
 		return fmt.Errorf("find module: %w", err)
 	}
+	projectModules := make(map[string]bool)
+	for _, m := range modules {
+		projectModules[m.Path] = true
+	}
 
-	fmt.Printf("[gococo] module: %s at %s\n", modPath, modDir)
+	if opts.Toolexec != (len(opts.InstrumentPkgs) > 0) {
+		return fmt.Errorf("--toolexec and --instrument-pkgs must be used together")
+	}
+
+	mode := ModeCount
+	if opts.CoverMode != "" {
+		if mode, err = ParseCoverMode(opts.CoverMode); err != nil {
+			return err
+		}
+	} else if hasFlag(opts.GoFlags, "-race") {
+		mode = ModeAtomic
+	}
+
+	agentMode := AgentRequired
+	if opts.AgentMode != "" {
+		if agentMode, err = ParseAgentMode(opts.AgentMode); err != nil {
+			return err
+		}
+	}
 
 	// 2. List packages
 	patterns := opts.Packages
@@ -47,12 +139,39 @@ func Run(opts Options) error {
 		patterns = []string{"."}
 	}
 
-	pkgs, err := ListPackages(wd, patterns)
+	var pkgs map[string]*Package
+	if opts.Test {
+		pkgs, err = ListTestPackages(wd, listFlags, patterns)
+	} else {
+		pkgs, err = ListPackages(wd, listFlags, patterns)
+	}
 	if err != nil {
 		return fmt.Errorf("list packages: %w", err)
 	}
 
-	// 3. Create temp directory
+	// Roots are the packages the agent is linked into: main packages
+	// for a build, packages under test for a test run.
+	var roots []*Package
+	if opts.Test {
+		roots = FindTestedPackages(pkgs)
+	} else {
+		roots = FindMainPackages(pkgs)
+	}
+
+	// The generated packages live in the module of the first root, so that
+	// they can be imported from every workspace module.
+	host := hostModule(modules, roots, wd)
+	modPath, modDir := host.Path, host.Dir
+	fmt.Printf("[gococo] module: %s at %s\n", modPath, modDir)
+	if len(modules) > 1 {
+		var paths []string
+		for _, m := range modules {
+			paths = append(paths, m.Path)
+		}
+		fmt.Printf("[gococo] workspace modules: %s\n", strings.Join(paths, ", "))
+	}
+
+	// 3. Create temp directory for the overlay
 	tmpDir, err := os.MkdirTemp("", "gococo-*")
 	if err != nil {
 		return fmt.Errorf("create temp dir: %w", err)
@@ -62,152 +181,309 @@ func Run(opts Options) error {
 	} else {
 		fmt.Printf("[gococo] temp dir: %s\n", tmpDir)
 	}
+	ov := newOverlay(tmpDir)
 
-	randomID := filepath.Base(tmpDir)
-	// Sanitize: replace hyphens for valid Go identifiers
-	randomID = strings.ReplaceAll(randomID, "-", "_")
-
-	// 4. Copy project to temp
-	tmpProject := filepath.Join(tmpDir, filepath.Base(modDir))
-	if err := copyDir(modDir, tmpProject); err != nil {
-		return fmt.Errorf("copy project: %w", err)
-	}
-	fmt.Println("[gococo] project copied to temp directory")
+	// The identifier suffix only has to be unique within the build. Deriving
+	// it from the module keeps rewritten files stable between builds, so
+	// unchanged packages are served from the build cache.
+	randomID := hashString(modPath)
 
-	// 5. Create the global coverage definition package
+	// 4. Locate the global coverage definition package
 	coverDefPkgName := "gococodef"
 	coverDefImportPath := modPath + "/" + coverDefPkgName
-	coverDefDir := filepath.Join(tmpProject, coverDefPkgName)
-	if err := os.MkdirAll(coverDefDir, 0o755); err != nil {
-		return fmt.Errorf("mkdir coverdef: %w", err)
-	}
+	coverDefDir := filepath.Join(modDir, coverDefPkgName)
 
-	// 6. Instrument all project source files
+	// 5. Instrument all project source files
 	var allInstrumentations []*FileInstrumentation
 	fileIdx := 0
 
-	mains := FindMainPackages(pkgs)
-	// Collect all project packages (main + deps)
+	// Collect all project packages (roots + deps)
 	projectPkgs := make(map[string]*Package)
-	for _, mp := range mains {
-		projectPkgs[mp.ImportPath] = mp
-		for _, dep := range mp.Deps {
-			if p, ok := pkgs[dep]; ok && IsProjectPackage(p, modPath) {
+	for _, rp := range roots {
+		projectPkgs[rp.ImportPath] = rp
+		for _, dep := range rp.Deps {
+			if p, ok := pkgs[dep]; ok && IsProjectPackage(p, projectModules) {
 				projectPkgs[p.ImportPath] = p
 			}
 		}
 	}
 
-	for _, pkg := range projectPkgs {
-		pkgTmpDir := translateDir(pkg.Dir, modDir, tmpProject)
+	filter := &fileFilter{
+		Include:          opts.Include,
+		Exclude:          opts.Exclude,
+		IncludeGenerated: opts.IncludeGenerated,
+	}
+	type skippedFile struct{ path, reason string }
+	var skipped []skippedFile
+
+	for _, pkg := range sortedPackages(projectPkgs) {
 		allFiles := append(pkg.GoFiles, pkg.CgoFiles...)
 
 		for _, goFile := range allFiles {
-			filePath := filepath.Join(pkgTmpDir, goFile)
+			filePath := filepath.Join(pkg.Dir, goFile)
 			src, err := os.ReadFile(filePath)
 			if err != nil {
 				return fmt.Errorf("read %s: %w", filePath, err)
 			}
+			rewritten, instrumented := src, false
+			if reason := filter.skipReason(pkg.ImportPath, goFile, src); reason != "" {
+				skipped = append(skipped, skippedFile{pkg.ImportPath + "/" + goFile, reason})
+			} else {
+				varName := GenerateCoverVarName(pkg.ImportPath, fileIdx)
+				var inst *FileInstrumentation
+				rewritten, inst, err = InstrumentFile(src, filePath, pkg.ImportPath, varName, randomID, fileIdx, mode, !opts.NoEvents)
+				if err != nil {
+					return fmt.Errorf("instrument %s: %w", filePath, err)
+				}
+				instrumented = len(inst.Blocks) > 0
+				allInstrumentations = append(allInstrumentations, inst)
+				fileIdx++
+			}
 
-			varName := GenerateCoverVarName(pkg.ImportPath, fileIdx)
-			rewritten, inst, err := InstrumentFile(src, filePath, pkg.ImportPath, varName, randomID, fileIdx)
+			// Let the agent flush before the process ends, also when it
+			// exits from a file without coverage.
+			rewritten, hooks, err := InstrumentExits(rewritten, filePath, randomID)
 			if err != nil {
 				return fmt.Errorf("instrument %s: %w", filePath, err)
 			}
+			if !instrumented && hooks == 0 {
+				continue
+			}
 
-			if len(inst.Blocks) > 0 {
-				// Add import for the coverdef package (dot import so counters are accessible)
-				fset := token.NewFileSet()
-				f, _ := parser.ParseFile(fset, filePath, rewritten, parser.ParseComments)
-				rewritten = addImport(rewritten, fset, f, coverDefImportPath, ".")
+			// Add import for the coverdef package (dot import so counters are accessible)
+			fset := token.NewFileSet()
+			f, _ := parser.ParseFile(fset, filePath, rewritten, parser.ParseComments)
+			rewritten = addImport(rewritten, fset, f, coverDefImportPath, ".")
 
-				// Add line directive
-				rewritten = append([]byte(lineDirective(filePath)), rewritten...)
-			}
+			// Add line directive
+			rewritten = append([]byte(lineDirective(filePath)), rewritten...)
 
-			if err := os.WriteFile(filePath, rewritten, 0o644); err != nil {
+			if err := ov.WriteFile(filePath, rewritten); err != nil {
 				return fmt.Errorf("write %s: %w", filePath, err)
 			}
-
-			allInstrumentations = append(allInstrumentations, inst)
-			fileIdx++
 		}
 	}
-	fmt.Printf("[gococo] instrumented %d files (%d blocks total)\n", fileIdx, countBlocks(allInstrumentations))
+	fmt.Printf("[gococo] instrumented %d files (%d blocks total, covermode=%s)\n", fileIdx, countBlocks(allInstrumentations), mode)
+	if len(skipped) > 0 {
+		fmt.Printf("[gococo] skipped %d files:\n", len(skipped))
+		for _, sf := range skipped {
+			fmt.Printf("[gococo]   %s (%s)\n", sf.path, sf.reason)
+		}
+	}
 
-	// 7. Write global coverage variable file
-	coverSrc := BuildGlobalCoverVarDecl(allInstrumentations, randomID)
-	if err := os.WriteFile(filepath.Join(coverDefDir, "coverdef.go"), []byte(coverSrc), 0o644); err != nil {
+	// 6. Write global coverage variable file
+	coverSrc := BuildGlobalCoverVarDecl(allInstrumentations, randomID, mode)
+	if err := ov.WriteFile(filepath.Join(coverDefDir, "coverdef.go"), []byte(coverSrc)); err != nil {
+		return fmt.Errorf("write coverdef: %w", err)
+	}
+	var offsets *RuntimeOffsets
+	if !opts.NoEvents {
+		if offsets, err = ProbeRuntimeOffsets(); err != nil {
+			fmt.Printf("[gococo] warning: cannot locate goroutine IDs, events will be slower to record: %v\n", err)
+		}
+	}
+	eventSrc := BuildEventSupportDecl(randomID, offsets)
+	if err := ov.WriteFile(filepath.Join(coverDefDir, "events.go"), []byte(eventSrc)); err != nil {
 		return fmt.Errorf("write coverdef: %w", err)
 	}
+	exitSrc := BuildExitSupportDecl(randomID)
+	if err := ov.WriteFile(filepath.Join(coverDefDir, "exit.go"), []byte(exitSrc)); err != nil {
+		return fmt.Errorf("write coverdef: %w", err)
+	}
+	if opts.Test {
+		testSrc := BuildTestSupportDecl(randomID)
+		if err := ov.WriteFile(filepath.Join(coverDefDir, "testing.go"), []byte(testSrc)); err != nil {
+			return fmt.Errorf("write coverdef: %w", err)
+		}
+	}
 
-	// 8. Inject agent into each main package
-	for _, mp := range mains {
-		mainTmpDir := translateDir(mp.Dir, modDir, tmpProject)
-		if err := injectAgent(mainTmpDir, mp.ImportPath, coverDefImportPath, randomID, opts.Host, allInstrumentations); err != nil {
+	// 7. Write the agent package and link it into each root package
+	agentPkgName := "gococo_agent_" + randomID
+	agentImportPath := modPath + "/" + agentPkgName
+	agentDir := filepath.Join(modDir, agentPkgName)
+	if err := writeAgent(ov, agentDir, agentPkgName, coverDefImportPath, randomID, opts.Host, mode, agentMode, !opts.NoEvents); err != nil {
+		return fmt.Errorf("write agent: %w", err)
+	}
+	for _, rp := range roots {
+		if opts.Test {
+			err = injectTestMain(ov, rp, coverDefImportPath, agentImportPath, randomID)
+		} else {
+			err = writeBridge(ov, rp.Dir, agentImportPath, randomID)
+		}
+		if err != nil {
 			return fmt.Errorf("inject agent: %w", err)
 		}
-		fmt.Printf("[gococo] injected agent into %s\n", mp.ImportPath)
+		fmt.Printf("[gococo] injected agent into %s\n", rp.ImportPath)
 	}
 
-	// 9. Build the instrumented project
-	return buildProject(tmpProject, wd, opts)
-}
+	overlayPath, err := ov.Save()
+	if err != nil {
+		return fmt.Errorf("write overlay: %w", err)
+	}
+	opts.GoFlags = append([]string{"-overlay", overlayPath}, opts.GoFlags...)
 
-func injectAgent(mainDir string, mainImportPath string, coverDefImportPath string, randomID string, host string, files []*FileInstrumentation) error {
-	agentPkgName := "gococo_agent_" + randomID
-	agentDir := filepath.Join(mainDir, agentPkgName)
-	if err := os.MkdirAll(agentDir, 0o755); err != nil {
-		return err
+	if opts.Toolexec {
+		skip := []string{coverDefImportPath, agentImportPath}
+		for _, p := range sortedPackages(projectPkgs) {
+			skip = append(skip, p.ImportPath)
+		}
+		toolexec, err := writeToolexecConfig(tmpDir, &toolexecConfig{
+			RandomID:           randomID,
+			CoverDefImportPath: coverDefImportPath,
+			CoverMode:          mode,
+			NoEvents:           opts.NoEvents,
+			Patterns:           opts.InstrumentPkgs,
+			Skip:               skip,
+			Filter:             *filter,
+			WorkDir:            filepath.Join(tmpDir, "toolexec"),
+		})
+		if err != nil {
+			return fmt.Errorf("write toolexec config: %w", err)
+		}
+		opts.GoFlags = append([]string{"-toolexec", toolexec}, opts.GoFlags...)
+		fmt.Printf("[gococo] instrumenting %s at compile time\n", strings.Join(opts.InstrumentPkgs, ", "))
 	}
 
-	// Write bridge file in main package
-	bridgeTmpl := template.Must(template.New("bridge").Parse(bridgeTemplate))
-	bridgePath := filepath.Join(mainDir, "gococo_bridge_"+randomID+".go")
-	bf, err := os.Create(bridgePath)
-	if err != nil {
-		return err
+	// 8. Build or test with the overlay applied
+	if opts.Test {
+		// Name the packages under test explicitly: patterns such as ./...
+		// would also match the generated gococo packages in the overlay.
+		opts.Packages = nil
+		for _, rp := range roots {
+			opts.Packages = append(opts.Packages, rp.ImportPath)
+		}
+		sort.Strings(opts.Packages)
+		return testProject(wd, opts)
+	}
+	return buildProject(wd, wd, opts)
+}
+
+// executeTemplate renders a source file template.
+func executeTemplate(name, text string, data interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := template.Must(template.New(name).Parse(text)).Execute(&buf, data); err != nil {
+		return nil, err
 	}
-	defer bf.Close()
+	return buf.Bytes(), nil
+}
 
-	agentImportPath := mainImportPath + "/" + agentPkgName
-	if err := bridgeTmpl.Execute(bf, map[string]string{
+// writeBridge adds a file to a main package that blank-imports the agent,
+// so the agent's init runs before main.
+func writeBridge(ov *overlay, mainDir string, agentImportPath string, randomID string) error {
+	src, err := executeTemplate("bridge", bridgeTemplate, map[string]string{
 		"AgentImportPath": agentImportPath,
-	}); err != nil {
+	})
+	if err != nil {
 		return err
 	}
+	return ov.WriteFile(filepath.Join(mainDir, "gococo_bridge_"+randomID+".go"), src)
+}
 
-	// Build file metadata for template
-	type fileMeta struct {
-		FileIdx    int
-		BlockCount int
-	}
-	var metas []fileMeta
-	for i, fi := range files {
-		if len(fi.Blocks) > 0 {
-			metas = append(metas, fileMeta{FileIdx: i, BlockCount: len(fi.Blocks)})
+// injectTestMain links the agent into the test binary of pkg through a
+// generated TestMain that flushes coverage once the tests have finished.
+// A TestMain already declared in the package's test files is renamed and
+// called from the generated one. Test functions are hooked so that events
+// are attributed to the running test.
+func injectTestMain(ov *overlay, pkg *Package, coverDefImportPath string, agentImportPath string, randomID string) error {
+	userMain := "gococoTestMain_" + randomID
+	pkgName := pkg.Name
+
+	found := false
+	for _, group := range []struct {
+		files []string
+		name  string
+	}{
+		{pkg.TestGoFiles, pkg.Name},
+		{pkg.XTestGoFiles, pkg.Name + "_test"},
+	} {
+		for _, name := range group.files {
+			filePath := filepath.Join(pkg.Dir, name)
+			src, err := os.ReadFile(filePath)
+			if err != nil {
+				return err
+			}
+			src, renamed, err := renameTestMain(src, filePath, userMain)
+			if err != nil {
+				return err
+			}
+			if renamed {
+				found = true
+				pkgName = group.name
+			}
+			src, hooks, err := InstrumentTestFile(src, filePath, randomID)
+			if err != nil {
+				return err
+			}
+			// A TestMain may end with os.Exit(m.Run()).
+			src, exits, err := InstrumentExits(src, filePath, randomID)
+			if err != nil {
+				return err
+			}
+			hooks += exits
+			if hooks > 0 {
+				fset := token.NewFileSet()
+				f, _ := parser.ParseFile(fset, filePath, src, parser.ParseComments)
+				src = addImport(src, fset, f, coverDefImportPath, ".")
+				src = append([]byte(lineDirective(filePath)), src...)
+			}
+			if !renamed && hooks == 0 {
+				continue
+			}
+			if err := ov.WriteFile(filePath, src); err != nil {
+				return err
+			}
 		}
 	}
+	if !found {
+		userMain = ""
+	}
 
-	// Write agent file
-	agentTmpl := template.Must(template.New("agent").Parse(agentTemplate))
-	agentPath := filepath.Join(agentDir, "agent.go")
-	af, err := os.Create(agentPath)
+	src, err := executeTemplate("testmain", testMainTemplate, map[string]string{
+		"PackageName":     pkgName,
+		"AgentImportPath": agentImportPath,
+		"UserMain":        userMain,
+	})
 	if err != nil {
 		return err
 	}
-	defer af.Close()
+	return ov.WriteFile(filepath.Join(pkg.Dir, "gococo_main_"+randomID+"_test.go"), src)
+}
 
-	return agentTmpl.Execute(af, map[string]interface{}{
+// writeAgent generates the runtime agent package in agentDir.
+func writeAgent(ov *overlay, agentDir string, agentPkgName string, coverDefImportPath string, randomID string, host string, mode CoverMode, agentMode AgentMode, events bool) error {
+	src, err := executeTemplate("agent", agentTemplate, map[string]interface{}{
 		"PackageName":        agentPkgName,
 		"CoverDefImportPath": coverDefImportPath,
 		"Host":               host,
 		"RandomID":           randomID,
-		"FileMetas":          metas,
+		"CoverMode":          string(mode),
+		"AgentMode":          string(agentMode),
+		"Events":             events,
+		"MaxFrameSize":       protocol.MaxFrameSize,
+		"MaxTestName":        protocol.MaxTestName,
 	})
+	if err != nil {
+		return err
+	}
+	if err := ov.WriteFile(filepath.Join(agentDir, "agent.go"), src); err != nil {
+		return err
+	}
+	for name, text := range map[string]string{
+		"signal_unix.go":  agentSignalUnixTemplate,
+		"signal_other.go": agentSignalOtherTemplate,
+	} {
+		src, err := executeTemplate(name, text, map[string]string{"PackageName": agentPkgName})
+		if err != nil {
+			return err
+		}
+		if err := ov.WriteFile(filepath.Join(agentDir, name), src); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func buildProject(tmpProject string, originalWd string, opts Options) error {
+func buildProject(buildDir string, originalWd string, opts Options) error {
 	goflags := make([]string, len(opts.GoFlags))
 	copy(goflags, opts.GoFlags)
 
@@ -234,7 +510,7 @@ func buildProject(tmpProject string, originalWd string, opts Options) error {
 
 	args := append([]string{"build"}, goflags...)
 	cmd := exec.Command("go", args...)
-	cmd.Dir = tmpProject
+	cmd.Dir = buildDir
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
@@ -247,42 +523,112 @@ func buildProject(tmpProject string, originalWd string, opts Options) error {
 	return nil
 }
 
-func findModuleInfo(dir string) (modPath string, modDir string, err error) {
-	cmd := exec.Command("go", "list", "-m", "-json")
+// testProject runs `go test` with the instrumented overlay.
+// A failing test run is returned as an *exec.ExitError so callers can
+// propagate the exit code.
+func testProject(buildDir string, opts Options) error {
+	packages := opts.Packages
+	if len(packages) == 0 {
+		packages = []string{"."}
+	}
+
+	args := []string{"test"}
+	// go test runs go vet in each package's directory, which does not exist
+	// for the agent and coverdef packages of the overlay, so vet fails the
+	// run. Vetting instrumented code is not useful anyway; the README tells
+	// users to run go vet separately. An explicit -vet flag is passed on.
+	if !hasFlag(opts.GoFlags, "-vet") {
+		args = append(args, "-vet=off")
+	}
+	args = append(args, opts.GoFlags...)
+	args = append(args, packages...)
+	if len(opts.TestArgs) > 0 {
+		args = append(args, "-args")
+		args = append(args, opts.TestArgs...)
+	}
+
+	cmd := exec.Command("go", args...)
+	cmd.Dir = buildDir
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	fmt.Printf("[gococo] go test %s\n", strings.Join(args[1:], " "))
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("go test failed: %w", err)
+	}
+	return nil
+}
+
+// findModules returns the main module, or every module of the go.work
+// workspace that dir belongs to.
+func findModules(dir string, flags []string) ([]*Module, error) {
+	args := append([]string{"list", "-m", "-json"}, flags...)
+	cmd := exec.Command("go", args...)
 	cmd.Dir = dir
+	cmd.Stderr = os.Stderr
 	out, err := cmd.Output()
 	if err != nil {
-		return "", "", fmt.Errorf("go list -m: %w", err)
+		return nil, fmt.Errorf("go list -m: %w", err)
 	}
 
-	// Simple parsing: find Path and Dir fields
-	for _, line := range strings.Split(string(out), "\n") {
-		line = strings.TrimSpace(line)
-		if strings.HasPrefix(line, `"Path":`) {
-			modPath = strings.Trim(strings.TrimPrefix(line, `"Path":`), ` ",`)
+	var modules []*Module
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for dec.More() {
+		var m Module
+		if err := dec.Decode(&m); err != nil {
+			return nil, fmt.Errorf("parse go list -m output: %w", err)
 		}
-		if strings.HasPrefix(line, `"Dir":`) {
-			modDir = strings.Trim(strings.TrimPrefix(line, `"Dir":`), ` ",`)
+		if m.Path != "" && m.Dir != "" {
+			modules = append(modules, &m)
 		}
 	}
-	if modPath == "" || modDir == "" {
-		return "", "", fmt.Errorf("could not determine module path/dir from go list -m output")
+	if len(modules) == 0 {
+		return nil, fmt.Errorf("could not determine module path/dir from go list -m output")
 	}
-	return modPath, modDir, nil
+	return modules, nil
 }
 
-func translateDir(pkgDir, origRoot, tmpRoot string) string {
-	rel, err := filepath.Rel(origRoot, pkgDir)
-	if err != nil {
-		return pkgDir
+// hostModule picks the module that the generated packages are placed in:
+// the module of the first root package, else the module containing dir.
+func hostModule(modules []*Module, roots []*Package, dir string) *Module {
+	if len(roots) > 0 && roots[0].Module != nil {
+		for _, m := range modules {
+			if m.Path == roots[0].Module.Path {
+				return m
+			}
+		}
 	}
-	return filepath.Join(tmpRoot, rel)
+	for _, m := range modules {
+		if rel, err := filepath.Rel(m.Dir, dir); err == nil && !strings.HasPrefix(rel, "..") {
+			return m
+		}
+	}
+	return modules[0]
 }
 
-func copyDir(src, dst string) error {
-	cmd := exec.Command("cp", "-a", src, dst)
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+// hasFlag reports whether flags set the named flag, as "-name", "--name"
+// or with an "=value" suffix.
+func hasFlag(flags []string, name string) bool {
+	name = strings.TrimLeft(name, "-")
+	for _, f := range flags {
+		f, _, _ = strings.Cut(strings.TrimLeft(f, "-"), "=")
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedPackages returns the packages ordered by import path, so that file
+// indices are assigned deterministically.
+func sortedPackages(pkgs map[string]*Package) []*Package {
+	out := make([]*Package, 0, len(pkgs))
+	for _, p := range pkgs {
+		out = append(out, p)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ImportPath < out[j].ImportPath })
+	return out
 }
 
 func countBlocks(files []*FileInstrumentation) int {
@@ -305,40 +651,383 @@ package main
 import _ "{{.AgentImportPath}}"
 `
 
+const testMainTemplate = `// Code generated by gococo. DO NOT EDIT.
+package {{.PackageName}}
+
+import (
+	"testing"
+
+	_agent "{{.AgentImportPath}}"
+)
+
+func TestMain(m *testing.M) {
+	defer _agent.Flush()
+	{{if .UserMain}}{{.UserMain}}(m){{else}}m.Run(){{end}}
+}
+`
+
+// The agent dumps coverage on SIGUSR1 and flushes it on SIGINT and SIGTERM
+// where these signals exist.
+const agentSignalUnixTemplate = `// Code generated by gococo. DO NOT EDIT.
+
+//go:build unix
+
+package {{.PackageName}}
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// notifyDump calls dump on every SIGUSR1.
+func notifyDump(dump func()) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+	go func() {
+		for range c {
+			dump()
+		}
+	}()
+}
+
+// notifyExit calls flush on SIGINT or SIGTERM and then raises the signal
+// again with its default action, which ends the process. Signals ignored at
+// startup, as SIGINT is for background jobs, are left alone. The returned
+// function stops handling the signals for which handled reports true, so
+// that signals the program handles itself are only delivered to it.
+func notifyExit(flush func(), handled func(os.Signal) bool) (release func()) {
+	var mu sync.Mutex
+	chans := make(map[os.Signal]chan os.Signal)
+	for _, sig := range []os.Signal{syscall.SIGINT, syscall.SIGTERM} {
+		if signal.Ignored(sig) {
+			continue
+		}
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, sig)
+		chans[sig] = c
+		go func() {
+			sig, ok := <-c
+			if !ok || handled(sig) {
+				return
+			}
+			flush()
+			signal.Stop(c)
+			syscall.Kill(os.Getpid(), sig.(syscall.Signal))
+		}()
+	}
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for sig, c := range chans {
+			if handled(sig) {
+				signal.Stop(c)
+				close(c)
+				delete(chans, sig)
+			}
+		}
+	}
+}
+`
+
+const agentSignalOtherTemplate = `// Code generated by gococo. DO NOT EDIT.
+
+//go:build !unix
+
+package {{.PackageName}}
+
+import "os"
+
+// notifyDump does nothing: there is no SIGUSR1 on this platform.
+func notifyDump(dump func()) {}
+
+// notifyExit does nothing: coverage is flushed when main returns and on
+// os.Exit only.
+func notifyExit(flush func(), handled func(os.Signal) bool) (release func()) {
+	return func() {}
+}
+`
+
 const agentTemplate = `// Code generated by gococo. DO NOT EDIT.
 package {{.PackageName}}
 
 import (
 	"bufio"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
-	"runtime"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	_cov "{{.CoverDefImportPath}}"
 )
 
+const (
+	// defaultFlushTimeout bounds how long Flush waits for the events to be
+	// sent, and then for the counters, unless GOCOCO_FLUSH_TIMEOUT is set.
+	defaultFlushTimeout = 2 * time.Second
+
+	// In required mode, registration is retried every retryInterval for up
+	// to defaultConnectTimeout, unless GOCOCO_CONNECT_TIMEOUT is set, before
+	// the agent falls back to offline mode.
+	defaultConnectTimeout = 3 * time.Second
+	retryInterval         = 500 * time.Millisecond
+
+	// offlineInterval is how often coverage is written in offline mode.
+	offlineInterval = 10 * time.Second
+
+	// defaultMode is the startup policy chosen at build time, used unless
+	// GOCOCO_MODE is set: "required", "optional" or "disabled".
+	defaultMode = "{{.AgentMode}}"
+
+	// In optional mode, the delay between connection attempts doubles from
+	// minBackoff up to maxBackoff.
+	minBackoff = 500 * time.Millisecond
+	maxBackoff = 30 * time.Second
+
+	// Recorded events are polled every minPoll while they keep coming, and
+	// up to every maxPoll when idle. They are sent every flushInterval.
+	minPoll       = time.Millisecond
+	maxPoll       = 64 * time.Millisecond
+	flushInterval = 100 * time.Millisecond
+
+	// buildEvents is false when blocks were instrumented without events.
+	buildEvents = {{.Events}}
+
+	// defaultCountersInterval is how often counter deltas are sent without
+	// events, unless GOCOCO_COUNTERS_INTERVAL is set.
+	defaultCountersInterval = 10 * time.Second
+)
+
+var (
+	host         string
+	agentID      string
+	disabled     bool
+	flushTimeout = defaultFlushTimeout
+
+	connectTimeout = defaultConnectTimeout
+
+	// Without events, the agent sends the hits counted since its previous
+	// report every countersInterval. sentCounts holds the counts reported
+	// so far, in CounterSnapshot order.
+	eventsOff        bool
+	countersInterval = defaultCountersInterval
+	sentCounts       []uint32
+	sentMu           sync.Mutex
+
+	// In offline mode, coverage is written to offlineBase+".cov" instead of
+	// a server, and events to offlineBase+".events" if offlineEvents is set.
+	offlineBase   string
+	offlineEvents bool
+	offlineMu     sync.Mutex
+
+	// eventVersion is the version of the event stream format sent to the
+	// server: the latest the server accepts, learned at register-blocks.
+	eventVersion = 1
+
+	// connected is closed once the agent has registered and streams events.
+	connected = make(chan struct{})
+
+	// flushReq asks the streaming goroutine to write pending events, and
+	// for the last request to close the stream. The goroutine closes the
+	// request's channel once the events are written, or for the last
+	// request once the server has consumed the stream.
+	flushReq  = make(chan flushRequest)
+	flushOnce sync.Once
+)
+
 func init() {
-	host := "{{.Host}}"
+	host = "{{.Host}}"
 	if env := os.Getenv("GOCOCO_HOST"); env != "" {
 		host = env
 	}
 
-	// Synchronous registration: block until connected or fail fast.
-	agentID := registerAgent(host)
+	mode := defaultMode
+	if env := os.Getenv("GOCOCO_MODE"); env != "" {
+		mode = env
+	}
+	switch mode {
+	case "required", "optional":
+	case "disabled":
+		// Counters keep counting; only events cost anything without a
+		// reader.
+		disabled = true
+		_cov.SetEnabled_{{.RandomID}}(false)
+		log.Printf("[gococo] agent disabled")
+		return
+	default:
+		log.Printf("[gococo] unknown GOCOCO_MODE %q, using %s", mode, defaultMode)
+		mode = defaultMode
+	}
+
+	flushTimeout = durationEnv("GOCOCO_FLUSH_TIMEOUT", flushTimeout)
+	connectTimeout = durationEnv("GOCOCO_CONNECT_TIMEOUT", connectTimeout)
+	countersInterval = durationEnv("GOCOCO_COUNTERS_INTERVAL", countersInterval)
+	eventsOff = !buildEvents || os.Getenv("GOCOCO_EVENTS") == "off"
+	if eventsOff {
+		_cov.SetEnabled_{{.RandomID}}(false)
+	}
+	// Flush when main returns or panics, on os.Exit, and on SIGINT and
+	// SIGTERM unless the program handles them itself: it then returns from
+	// main or exits when it is done.
+	_cov.SetFlush_{{.RandomID}}(Flush)
+	release := notifyExit(Flush, _cov.SignalHandled_{{.RandomID}})
+	_cov.SetNotifyHook_{{.RandomID}}(release)
+	release()
+
+	if dir := os.Getenv("GOCOCO_OUTPUT"); dir != "" {
+		startOffline(dir)
+		return
+	}
+
+	if mode == "optional" {
+		go connectInBackground(host)
+		return
+	}
+
+	// Synchronous registration: block until connected, else keep the
+	// coverage locally.
+	id, ok := registerAgent(host)
+	if !ok {
+		startOffline(filepath.Join(os.TempDir(), "gococo"))
+		return
+	}
+	startAgent(host, id)
+}
+
+// durationEnv returns the duration set in the environment variable name, or
+// def if it is unset or invalid.
+func durationEnv(name string, def time.Duration) time.Duration {
+	env := os.Getenv(name)
+	if env == "" {
+		return def
+	}
+	d, err := time.ParseDuration(env)
+	if err != nil || d <= 0 {
+		log.Printf("[gococo] invalid %s %q, using %v", name, env, def)
+		return def
+	}
+	return d
+}
+
+// startAgent sends the block metadata of a registered agent and starts
+// streaming events and counters.
+func startAgent(host, id string) {
+	agentID = id
 	registerBlocks(host, agentID)
+	close(connected)
+
+	if eventsOff {
+		log.Printf("[gococo] agent ready, sending counters every %v", countersInterval)
+		go runCounters(host, agentID)
+		return
+	}
 	log.Printf("[gococo] agent ready, streaming events")
 
 	// Start async event streaming and counter snapshot.
 	go runStreaming(host, agentID)
 }
 
-func registerAgent(host string) string {
+// connectInBackground registers with the server, retrying with exponential
+// backoff until it succeeds, and then starts the agent.
+func connectInBackground(host string) {
+	backoff := minBackoff
+	for {
+		id, err := register(host, connectTimeout)
+		if err == nil {
+			log.Printf("[gococo] registered as agent %s", id)
+			startAgent(host, id)
+			return
+		}
+		log.Printf("[gococo] register failed: %v; retrying in %v", err, backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// Flush sends all buffered events and a final counter snapshot to the
+// server, or in offline mode writes them to the output files. Sending the
+// events and the counters each take at most flushTimeout. It is called
+// before the process exits; only the first call has any effect.
+func Flush() {
+	flushOnce.Do(func() {
+		if disabled {
+			return
+		}
+		if offlineBase != "" && !offlineEvents {
+			writeOfflineProfile()
+			return
+		}
+		if offlineBase == "" {
+			select {
+			case <-connected:
+			default:
+				log.Printf("[gococo] not connected to a server; coverage is not sent")
+				return
+			}
+			if eventsOff {
+				sendCounterDeltas(host, agentID, flushTimeout)
+				return
+			}
+		}
+		// The stream sends the counters once it sent the events.
+		streaming := offlineBase == ""
+		wait := flushTimeout
+		if streaming {
+			wait *= 2
+		}
+		done := make(chan struct{})
+		timeout := time.After(wait)
+		select {
+		case flushReq <- flushRequest{done: done, last: true, snapshot: streaming}:
+			select {
+			case <-done:
+			case <-timeout:
+			}
+		case <-timeout:
+			// No stream is running, and no event is in flight.
+			if streaming {
+				sendCounterSnapshot(host, agentID, 0, flushTimeout)
+			}
+		}
+		if !streaming {
+			writeOfflineProfile()
+		}
+	})
+}
+
+// registerAgent registers with the server, retrying for up to
+// connectTimeout, and reports false if it cannot be reached by then.
+func registerAgent(host string) (string, bool) {
+	deadline := time.Now().Add(connectTimeout)
+	for attempt := 1; ; attempt++ {
+		id, err := register(host, time.Until(deadline))
+		if err == nil {
+			log.Printf("[gococo] registered as agent %s", id)
+			return id, true
+		}
+		if time.Until(deadline) < retryInterval {
+			log.Printf("[gococo] could not connect to server at %s within %v: %v", host, connectTimeout, err)
+			return "", false
+		}
+		log.Printf("[gococo] register failed (attempt %d): %v", attempt, err)
+		time.Sleep(retryInterval)
+	}
+}
+
+// register makes one registration attempt, giving up after timeout, and
+// returns the agent ID.
+func register(host string, timeout time.Duration) (string, error) {
 	hostname, _ := os.Hostname()
 	pid := os.Getpid()
 	cmdline := strings.Join(os.Args, " ")
@@ -347,57 +1036,173 @@ func registerAgent(host string) string {
 	v.Set("hostname", hostname)
 	v.Set("pid", fmt.Sprintf("%d", pid))
 	v.Set("cmdline", cmdline)
+	v.Set("covermode", "{{.CoverMode}}")
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(fmt.Sprintf("http://%s/api/internal/register?%s", host, v.Encode()))
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, 256)
+	n, _ := resp.Body.Read(buf)
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("register returned %d", resp.StatusCode)
+	}
+	return strings.TrimSpace(string(buf[:n])), nil
+}
+
+// startOffline keeps coverage in files in dir, named after the host and
+// process: a coverprofile with every block, rewritten every
+// offlineInterval, on SIGUSR1 and by Flush, and with GOCOCO_OUTPUT_EVENTS=1
+// the event stream in the format of /api/internal/events.
+func startOffline(dir string) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		log.Printf("[gococo] offline mode: %v; coverage is not recorded", err)
+		_cov.SetEnabled_{{.RandomID}}(false)
+		return
+	}
+	hostname, _ := os.Hostname()
+	offlineBase = filepath.Join(dir, fmt.Sprintf("gococo-%s-%d", hostname, os.Getpid()))
 
-	const maxRetries = 10
-	for i := 0; i < maxRetries; i++ {
-		resp, err := http.Get(fmt.Sprintf("http://%s/api/internal/register?%s", host, v.Encode()))
+	offlineEvents = os.Getenv("GOCOCO_OUTPUT_EVENTS") == "1" && !eventsOff
+	if offlineEvents {
+		f, err := os.Create(offlineBase + ".events")
 		if err != nil {
-			log.Printf("[gococo] register failed (attempt %d/%d): %v", i+1, maxRetries, err)
-			time.Sleep(1 * time.Second)
-			continue
+			log.Printf("[gococo] offline mode: %v; events are not recorded", err)
+			offlineEvents = false
+		} else {
+			go writeOfflineEvents(f)
 		}
-		buf := make([]byte, 256)
-		n, _ := resp.Body.Read(buf)
-		resp.Body.Close()
-		if resp.StatusCode == 200 {
-			agentID := strings.TrimSpace(string(buf[:n]))
-			log.Printf("[gococo] registered as agent %s", agentID)
-			return agentID
+	}
+	if !offlineEvents {
+		// Nobody reads the events.
+		_cov.SetEnabled_{{.RandomID}}(false)
+	}
+
+	writeOfflineProfile()
+	go func() {
+		for range time.Tick(offlineInterval) {
+			writeOfflineProfile()
+		}
+	}()
+	notifyDump(dumpOffline)
+	log.Printf("[gococo] offline mode: writing coverage to %s.cov", offlineBase)
+}
+
+// dumpOffline writes the pending events and the coverprofile, waiting at
+// most flushTimeout for the events.
+func dumpOffline() {
+	if offlineEvents {
+		done := make(chan struct{})
+		timeout := time.After(flushTimeout)
+		select {
+		case flushReq <- flushRequest{done: done}:
+			select {
+			case <-done:
+			case <-timeout:
+			}
+		case <-timeout:
 		}
-		log.Printf("[gococo] register returned %d (attempt %d/%d)", resp.StatusCode, i+1, maxRetries)
-		time.Sleep(1 * time.Second)
 	}
+	writeOfflineProfile()
+}
 
-	fmt.Fprintf(os.Stderr, "[gococo] fatal: could not connect to server at %s after %d attempts\n", host, maxRetries)
-	os.Exit(1)
-	return ""
+// writeOfflineProfile writes the counters as a coverprofile, replacing the
+// previous one atomically so that readers never see a partial file.
+func writeOfflineProfile() {
+	offlineMu.Lock()
+	defer offlineMu.Unlock()
+
+	var sb strings.Builder
+	sb.WriteString("mode: {{.CoverMode}}\n")
+	for _, e := range _cov.CounterSnapshot_{{.RandomID}}() {
+		count := e.Count{{if eq .CoverMode "set"}}
+		if count > 1 {
+			count = 1
+		}{{end}}
+		fmt.Fprintf(&sb, "%s:%d.%d,%d.%d %d %d\n", e.File, e.SL, e.SC, e.EL, e.EC, e.Stmts, count)
+	}
+	tmp := offlineBase + ".cov.tmp"
+	if err := os.WriteFile(tmp, []byte(sb.String()), 0o644); err != nil {
+		log.Printf("[gococo] offline mode: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, offlineBase+".cov"); err != nil {
+		log.Printf("[gococo] offline mode: %v", err)
+	}
+}
+
+// writeOfflineEvents writes the event stream to f, after a header line
+// describing the process for gococo import.
+func writeOfflineEvents(f *os.File) {
+	hostname, _ := os.Hostname()
+	v := url.Values{}
+	v.Set("hostname", hostname)
+	v.Set("pid", fmt.Sprintf("%d", os.Getpid()))
+	v.Set("cmdline", strings.Join(os.Args, " "))
+	v.Set("covermode", "{{.CoverMode}}")
+
+	bw := bufio.NewWriter(f)
+	fmt.Fprintf(bw, "# gococo events %s\n", v.Encode())
+	// The file must be readable without the blocks of the agent.
+	done := pumpEvents(bw, 1)
+	f.Close()
+	if done != nil {
+		close(done)
+	}
+}
+
+// flushRequest is a request to pumpEvents to write the pending events.
+type flushRequest struct {
+	done     chan struct{}
+	last     bool // end the stream
+	snapshot bool // then send a counter snapshot, before any later event
 }
 
 func runStreaming(host string, agentID string) {
 	// Wait briefly for main() and other init() to finish startup,
-	// then send a counter snapshot to capture their coverage.
-	time.Sleep(500 * time.Millisecond)
-	sendCounterSnapshot(host, agentID)
+	// then send a counter snapshot to capture their coverage. Nobody
+	// takes the request once the stream has ended.
+	stopped := make(chan struct{})
+	defer close(stopped)
+	time.AfterFunc(500*time.Millisecond, func() {
+		select {
+		case flushReq <- flushRequest{done: make(chan struct{}), snapshot: true}:
+		case <-stopped:
+		}
+	})
 
 	for {
-		err := streamEvents(host, agentID)
+		flushed, err := streamEvents(host, agentID)
+		if flushed != nil {
+			close(flushed)
+			return
+		}
 		if err != nil {
 			log.Printf("[gococo] stream error: %v, reconnecting...", err)
 		}
 		_cov.SetEnabled_{{.RandomID}}(false)
 		time.Sleep(2 * time.Second)
+		// A restarted server has lost the blocks that events refer to.
+		registerBlocks(host, agentID)
 		_cov.SetEnabled_{{.RandomID}}(true)
 	}
 }
 
 func registerBlocks(host string, agentID string) {
+	// The counter snapshot also covers files registered at init time by
+	// packages instrumented with gococo toolexec.
 	var sb strings.Builder
-	{{- range .FileMetas}}
-	for bi := 0; bi < {{.BlockCount}}; bi++ {
-		file, sl, sc, el, ec, stmts := _cov.BlockMeta_{{$.RandomID}}({{.FileIdx}}, bi)
-		fmt.Fprintf(&sb, "%s|%d|%d|%d|%d|%d|%d\n", file, bi, sl, sc, el, ec, stmts)
+	for _, e := range _cov.CounterSnapshot_{{.RandomID}}() {
+		fmt.Fprintf(&sb, "%s|%d|%d|%d|%d|%d|%d\n", e.File, e.BlockIdx, e.SL, e.SC, e.EL, e.EC, e.Stmts)
+	}
+	// Binary events identify their files by index.
+	for i := 0; i < _cov.NumFiles_{{.RandomID}}(); i++ {
+		if file := _cov.FileName_{{.RandomID}}(i); file != "" {
+			fmt.Fprintf(&sb, "#file|%d|%s\n", i, file)
+		}
 	}
-	{{- end}}
 
 	resp, err := http.Post(
 		fmt.Sprintf("http://%s/api/internal/register-blocks?agent_id=%s", host, agentID),
@@ -408,18 +1213,30 @@ func registerBlocks(host string, agentID string) {
 		return
 	}
 	resp.Body.Close()
+	// Servers that do not list versions only accept version 1.
+	eventVersion = 1
+	for _, v := range strings.Split(resp.Header.Get("Gococo-Event-Versions"), ",") {
+		if n, err := strconv.Atoi(strings.TrimSpace(v)); err == nil && n > eventVersion && n <= 3 {
+			eventVersion = n
+		}
+	}
 	log.Printf("[gococo] registered block metadata with server")
 }
 
-func sendCounterSnapshot(host string, agentID string) {
+// sendCounterSnapshot sends the counters to the server, giving up after
+// timeout. seq is the last event sent on the stream, if any: the server
+// counts the events up to it through the snapshot, so no later event may be
+// sent before the snapshot is.
+func sendCounterSnapshot(host string, agentID string, seq uint64, timeout time.Duration) {
 	entries := _cov.CounterSnapshot_{{.RandomID}}()
 	var sb strings.Builder
 	for _, e := range entries {
 		fmt.Fprintf(&sb, "%s|%d|%d|%d|%d|%d|%d|%d\n",
 			e.File, e.BlockIdx, e.Count, e.SL, e.SC, e.EL, e.EC, e.Stmts)
 	}
-	resp, err := http.Post(
-		fmt.Sprintf("http://%s/api/internal/counters?agent_id=%s", host, agentID),
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Post(
+		fmt.Sprintf("http://%s/api/internal/counters?agent_id=%s&seq=%d", host, agentID, seq),
 		"text/plain",
 		strings.NewReader(sb.String()))
 	if err != nil {
@@ -430,33 +1247,73 @@ func sendCounterSnapshot(host string, agentID string) {
 	log.Printf("[gococo] sent counter snapshot (%d blocks)", len(entries))
 }
 
-func streamEvents(host string, agentID string) error {
+// runCounters sends counter deltas every countersInterval, in place of
+// events, starting shortly after startup as runStreaming does.
+func runCounters(host string, agentID string) {
+	time.Sleep(500 * time.Millisecond)
+	for {
+		sendCounterDeltas(host, agentID, countersInterval)
+		time.Sleep(countersInterval)
+	}
+}
+
+// sendCounterDeltas sends the hits of the blocks that ran since the last
+// report the server accepted, giving up after timeout. Hits of a failed
+// report are sent with the next one.
+func sendCounterDeltas(host string, agentID string, timeout time.Duration) {
+	sentMu.Lock()
+	defer sentMu.Unlock()
+
+	entries := _cov.CounterSnapshot_{{.RandomID}}()
+	// Packages instrumented by gococo toolexec may register after the
+	// agent started; their blocks come last.
+	for len(sentCounts) < len(entries) {
+		sentCounts = append(sentCounts, 0)
+	}
+	var sb strings.Builder
+	n := 0
+	for i, e := range entries {
+		if e.Count == sentCounts[i] {
+			continue
+		}
+		fmt.Fprintf(&sb, "%s|%d|%d|%d|%d|%d|%d|%d\n",
+			e.File, e.BlockIdx, e.Count-sentCounts[i], e.SL, e.SC, e.EL, e.EC, e.Stmts)
+		n++
+	}
+	if n == 0 {
+		return
+	}
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Post(
+		fmt.Sprintf("http://%s/api/internal/counters?agent_id=%s&delta=1", host, agentID),
+		"text/plain",
+		strings.NewReader(sb.String()))
+	if err != nil {
+		log.Printf("[gococo] send counter deltas failed: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("[gococo] send counter deltas: server returned %d", resp.StatusCode)
+		return
+	}
+	for i, e := range entries {
+		sentCounts[i] = e.Count
+	}
+}
+
+// streamEvents streams events until the connection fails or a flush is
+// requested. In the latter case it returns the flush request's channel
+// once the server has consumed the stream.
+func streamEvents(host string, agentID string) (chan struct{}, error) {
+	version := eventVersion
 	pr, pw := io.Pipe()
+	flushed := make(chan chan struct{}, 1)
 
 	go func() {
 		defer pw.Close()
-		bw := bufio.NewWriter(pw)
-		var seq uint64
-		ticker := time.NewTicker(100 * time.Millisecond)
-		defer ticker.Stop()
-
-		for {
-			select {
-			case block := <-_cov.EventChan_{{.RandomID}}():
-				if block == nil {
-					return
-				}
-				seq++
-				gid := getGoroutineID()
-				ts := time.Now().UnixNano()
-				fi := block.FileIdx
-				bi := block.BlockIdx
-				file, sl, sc, el, ec, stmts := _cov.BlockMeta_{{.RandomID}}(fi, bi)
-				fmt.Fprintf(bw, "%d|%d|%d|%s|%d|%d|%d|%d|%d|%d\n",
-					seq, ts, gid, file, bi, sl, sc, el, ec, stmts)
-			case <-ticker.C:
-				bw.Flush()
-			}
+		if done := pumpEvents(bufio.NewWriter(pw), version); done != nil {
+			flushed <- done
 		}
 	}()
 
@@ -464,32 +1321,184 @@ func streamEvents(host string, agentID string) error {
 		fmt.Sprintf("http://%s/api/internal/events?agent_id=%s", host, agentID), pr)
 	if err != nil {
 		pw.Close()
-		return err
+		return nil, err
+	}
+	switch version {
+	case 3:
+		req.Header.Set("Content-Type", "application/x-gococo-events; version=3")
+	case 2:
+		req.Header.Set("Content-Type", "text/plain; version=2")
+	default:
+		req.Header.Set("Content-Type", "text/plain")
 	}
-	req.Header.Set("Content-Type", "text/plain")
 	req.Header.Set("Transfer-Encoding", "chunked")
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		pw.Close()
-		return err
+		return nil, err
 	}
 	defer resp.Body.Close()
-	return fmt.Errorf("server closed connection: %d", resp.StatusCode)
+	select {
+	case done := <-flushed:
+		return done, nil
+	default:
+	}
+	return nil, fmt.Errorf("server closed connection: %d", resp.StatusCode)
 }
 
-func getGoroutineID() int64 {
-	var buf [64]byte
-	n := runtime.Stack(buf[:], false)
-	s := string(buf[:n])
-	s = s[len("goroutine "):]
-	var id int64
-	for _, c := range s {
-		if c < '0' || c > '9' {
-			break
+// pumpEvents writes events to bw in the given version of the event stream
+// format until bw fails or the last flush is requested. In the latter case
+// it writes the pending events and returns the flush request's channel.
+// Other flush requests write the pending events and close their channel.
+// Version 1 events carry their block positions, version 2 events leave them
+// to the server, and version 3 is binary. Along with the events, it reports
+// the number of events dropped so far because the agent did not keep up.
+func pumpEvents(bw *bufio.Writer, version int) chan struct{} {
+	var seq, dropped uint64
+	events := make([]_cov.GococoEvent_{{.RandomID}}, 1024)
+	var line []byte
+
+	// In version 3, events are frames of varints, with deltas from the
+	// previous event, and tests are named once in test frames.
+	var prevTS, prevGID int64
+	tests := make(map[string]uint64)
+	var frame []byte
+	writeFrame := func(typ byte, payload []byte) {
+		if len(payload) >= {{.MaxFrameSize}} {
+			return
+		}
+		frame = appendUvarint(frame[:0], uint64(len(payload)+1))
+		frame = append(append(frame, typ), payload...)
+		bw.Write(frame)
+	}
+	if version == 3 {
+		bw.WriteString("GCEV\x03")
+	}
+
+	// write writes the recorded events and returns how many there were.
+	write := func() int {
+		total := 0
+		for {
+			n := _cov.ReadEvents_{{.RandomID}}(events)
+			for i := range events[:n] {
+				e := &events[i]
+				seq++
+				if version == 3 {
+					var test uint64
+					if e.Test != "" {
+						var ok bool
+						if test, ok = tests[e.Test]; !ok {
+							test = uint64(len(tests) + 1)
+							tests[e.Test] = test
+							// Longer names would not fit in a frame.
+							name := e.Test
+							if len(name) > {{.MaxTestName}} {
+								name = name[:{{.MaxTestName}}]
+							}
+							line = append(appendUvarint(line[:0], test), name...)
+							writeFrame(2, line)
+						}
+					}
+					line = appendUvarint(line[:0], 1) // seq counts the events
+					line = appendVarint(line, e.Timestamp-prevTS)
+					line = appendVarint(line, e.GID-prevGID)
+					line = appendUvarint(line, uint64(e.FileIdx))
+					line = appendUvarint(line, uint64(e.BlockIdx))
+					line = appendUvarint(line, test)
+					writeFrame(1, line)
+					prevTS, prevGID = e.Timestamp, e.GID
+					continue
+				}
+				line = strconv.AppendUint(line[:0], seq, 10)
+				line = append(line, '|')
+				line = strconv.AppendInt(line, e.Timestamp, 10)
+				line = append(line, '|')
+				line = strconv.AppendInt(line, e.GID, 10)
+				line = append(line, '|')
+				if version == 1 {
+					file, sl, sc, el, ec, stmts := _cov.BlockMeta_{{.RandomID}}(int(e.FileIdx), int(e.BlockIdx))
+					line = append(line, file...)
+					for _, v := range [...]int{int(e.BlockIdx), sl, sc, el, ec, stmts} {
+						line = append(line, '|')
+						line = strconv.AppendInt(line, int64(v), 10)
+					}
+				} else {
+					line = append(line, _cov.FileName_{{.RandomID}}(int(e.FileIdx))...)
+					line = append(line, '|')
+					line = strconv.AppendInt(line, int64(e.BlockIdx), 10)
+				}
+				if e.Test != "" {
+					line = append(line, '|')
+					line = append(line, strings.ReplaceAll(e.Test, "\n", " ")...)
+				}
+				line = append(line, '\n')
+				bw.Write(line)
+			}
+			total += n
+			if n < len(events) {
+				return total
+			}
+		}
+	}
+
+	reportDropped := func() {
+		if n := _cov.Dropped_{{.RandomID}}(); n != dropped {
+			dropped = n
+			if version == 3 {
+				writeFrame(3, appendUvarint(line[:0], n))
+			} else {
+				fmt.Fprintf(bw, "#dropped|%d\n", n)
+			}
 		}
-		id = id*10 + int64(c-'0')
 	}
-	return id
+
+	wait := minPoll
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	lastFlush := time.Now()
+	for {
+		select {
+		case <-timer.C:
+			if write() > 0 {
+				wait = minPoll
+			} else if wait < maxPoll {
+				wait *= 2
+			}
+			if time.Since(lastFlush) >= flushInterval {
+				reportDropped()
+				if err := bw.Flush(); err != nil {
+					return nil
+				}
+				lastFlush = time.Now()
+			}
+			timer.Reset(wait)
+		case req := <-flushReq:
+			write()
+			reportDropped()
+			err := bw.Flush()
+			if req.snapshot {
+				sendCounterSnapshot(host, agentID, seq, flushTimeout)
+			}
+			if req.last {
+				return req.done
+			}
+			close(req.done)
+			if err != nil {
+				return nil
+			}
+			lastFlush = time.Now()
+		}
+	}
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func appendVarint(b []byte, v int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutVarint(buf[:], v)]...)
 }
 `
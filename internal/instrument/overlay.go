@@ -0,0 +1,49 @@
+package instrument
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// overlay collects rewritten and generated source files for
+// `go build -overlay`. The go command compiles each file in Replace from the
+// stored content while reporting the original path, so the build runs in the
+// real module directory and keeps using the build cache.
+type overlay struct {
+	dir     string
+	Replace map[string]string `json:"Replace"` // original file path -> content path
+}
+
+func newOverlay(dir string) *overlay {
+	return &overlay{dir: dir, Replace: make(map[string]string)}
+}
+
+// WriteFile records data as the content of the file at path, which need
+// not exist on disk.
+func (o *overlay) WriteFile(path string, data []byte) error {
+	contentDir := filepath.Join(o.dir, "files", fmt.Sprintf("%d", len(o.Replace)))
+	if err := os.MkdirAll(contentDir, 0o755); err != nil {
+		return err
+	}
+	contentPath := filepath.Join(contentDir, filepath.Base(path))
+	if err := os.WriteFile(contentPath, data, 0o644); err != nil {
+		return err
+	}
+	o.Replace[path] = contentPath
+	return nil
+}
+
+// Save writes the overlay description and returns its path.
+func (o *overlay) Save() (string, error) {
+	data, err := json.MarshalIndent(o, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(o.dir, "overlay.json")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
@@ -17,6 +17,10 @@ type Package struct {
 	CgoFiles   []string `json:"CgoFiles,omitempty"`
 	Deps       []string `json:"Deps,omitempty"`
 
+	TestGoFiles  []string `json:"TestGoFiles,omitempty"`
+	XTestGoFiles []string `json:"XTestGoFiles,omitempty"`
+	ForTest      string   `json:"ForTest,omitempty"`
+
 	Module   *Module       `json:",omitempty"`
 	Goroot   bool          `json:"Goroot,omitempty"`
 	Standard bool          `json:"Standard,omitempty"`
@@ -39,9 +43,73 @@ type PackageError struct {
 	Err string
 }
 
-// ListPackages runs `go list -json` and returns all packages keyed by import path.
-func ListPackages(dir string, patterns []string) (map[string]*Package, error) {
-	args := append([]string{"list", "-json", "-deps"}, patterns...)
+// loadFlags are the go build flags that change which packages and files the
+// go command selects, mapped to whether they take a value.
+var loadFlags = map[string]bool{
+	"tags":     true,
+	"mod":      true,
+	"modfile":  true,
+	"compiler": true,
+	"race":     false, // adds the race build tag
+	"msan":     false,
+	"asan":     false,
+}
+
+// LoadFlags returns the flags in goFlags that affect package loading, so
+// that `go list` selects the same files as the build. The target platform and
+// GOFLAGS are taken from the environment, which `go list` inherits.
+func LoadFlags(goFlags []string) []string {
+	var out []string
+	for i := 0; i < len(goFlags); i++ {
+		name, _, hasValue := strings.Cut(strings.TrimLeft(goFlags[i], "-"), "=")
+		takesValue, ok := loadFlags[name]
+		if !ok || !strings.HasPrefix(goFlags[i], "-") {
+			continue
+		}
+		out = append(out, goFlags[i])
+		if takesValue && !hasValue && i+1 < len(goFlags) {
+			out = append(out, goFlags[i+1])
+			i++
+		}
+	}
+	return out
+}
+
+// ListPackages runs `go list -json` with the given build flags and returns
+// all packages keyed by import path.
+func ListPackages(dir string, flags []string, patterns []string) (map[string]*Package, error) {
+	args := append([]string{"list", "-json", "-deps"}, flags...)
+	return listPackages(dir, args, patterns)
+}
+
+// ListTestPackages is like ListPackages but also lists the test variants of
+// the matched packages, so that dependencies of test files are included.
+// Test variants are keyed by their full import path, e.g. "p [p.test]".
+func ListTestPackages(dir string, flags []string, patterns []string) (map[string]*Package, error) {
+	args := append([]string{"list", "-json", "-deps", "-test"}, flags...)
+	pkgs, err := listPackages(dir, args, patterns)
+	if err != nil {
+		return nil, err
+	}
+	// Fold the dependencies of test variants into the packages under test,
+	// using the plain import paths of recompiled dependencies.
+	for _, p := range pkgs {
+		if p.ForTest == "" || p.DepOnly {
+			continue
+		}
+		target, ok := pkgs[p.ForTest]
+		if !ok {
+			continue
+		}
+		for _, dep := range p.Deps {
+			target.Deps = append(target.Deps, stripTestSuffix(dep))
+		}
+	}
+	return pkgs, nil
+}
+
+func listPackages(dir string, args []string, patterns []string) (map[string]*Package, error) {
+	args = append(args, patterns...)
 	cmd := exec.Command("go", args...)
 	cmd.Dir = dir
 
@@ -76,13 +144,33 @@ func FindMainPackages(pkgs map[string]*Package) []*Package {
 	return mains
 }
 
-// IsProjectPackage returns true if the package belongs to the project (not stdlib, not third-party).
-func IsProjectPackage(p *Package, projectModule string) bool {
-	if p.Standard || p.Goroot {
-		return false
+// FindTestedPackages returns the packages matched by the patterns given to
+// ListTestPackages, excluding test variants and generated test mains.
+func FindTestedPackages(pkgs map[string]*Package) []*Package {
+	var tested []*Package
+	for _, p := range pkgs {
+		if p.DepOnly || p.ForTest != "" || strings.HasSuffix(p.ImportPath, ".test") {
+			continue
+		}
+		tested = append(tested, p)
 	}
-	if p.DepOnly && p.Module != nil && p.Module.Path != projectModule {
+	return tested
+}
+
+// stripTestSuffix turns "p [q.test]" into "p".
+func stripTestSuffix(importPath string) string {
+	if i := strings.Index(importPath, " ["); i >= 0 {
+		return importPath[:i]
+	}
+	return importPath
+}
+
+// IsProjectPackage reports whether the package belongs to the project: the
+// main module, or any module of a go.work workspace (not stdlib, not
+// third-party).
+func IsProjectPackage(p *Package, projectModules map[string]bool) bool {
+	if p.Standard || p.Goroot || p.Module == nil {
 		return false
 	}
-	return strings.HasPrefix(p.ImportPath, projectModule)
+	return projectModules[p.Module.Path]
 }
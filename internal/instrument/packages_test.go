@@ -0,0 +1,24 @@
+package instrument
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLoadFlags(t *testing.T) {
+	tests := []struct {
+		in   []string
+		want []string
+	}{
+		{nil, nil},
+		{[]string{"-tags", "integration", "-o", "out", "-v"}, []string{"-tags", "integration"}},
+		{[]string{"-tags=a,b", "-mod=vendor", "-modfile", "alt.mod"}, []string{"-tags=a,b", "-mod=vendor", "-modfile", "alt.mod"}},
+		{[]string{"--race", "-ldflags", "-s -w", "-trimpath"}, []string{"--race"}},
+		{[]string{"-asan=true", "-gcflags", "all=-N -l"}, []string{"-asan=true"}},
+	}
+	for _, tt := range tests {
+		if got := LoadFlags(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("LoadFlags(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
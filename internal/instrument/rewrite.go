@@ -22,6 +22,38 @@ type BlockInfo struct {
 	NumStmts  int
 }
 
+// CoverMode selects how block counters are updated, as `go test -covermode`
+// does.
+type CoverMode string
+
+const (
+	ModeSet    CoverMode = "set"    // counters record whether a block ran
+	ModeCount  CoverMode = "count"  // counters count executions
+	ModeAtomic CoverMode = "atomic" // like count, but safe for concurrent use
+)
+
+// ParseCoverMode validates a -covermode value.
+func ParseCoverMode(s string) (CoverMode, error) {
+	switch m := CoverMode(s); m {
+	case ModeSet, ModeCount, ModeAtomic:
+		return m, nil
+	}
+	return "", fmt.Errorf("invalid cover mode %q: must be set, count or atomic", s)
+}
+
+// counterStmt returns the statement that records an execution of a block.
+// In atomic mode the increment goes through GococoInc, declared next to the
+// counters by BuildGlobalCoverVarDecl and BuildExtRegisterDecl.
+func counterStmt(mode CoverMode, randomID string, fileIdx, blockIdx int) string {
+	switch mode {
+	case ModeSet:
+		return fmt.Sprintf("GococoCov_%s_%d[%d] = 1;", randomID, fileIdx, blockIdx)
+	case ModeAtomic:
+		return fmt.Sprintf("GococoInc_%s(&GococoCov_%s_%d[%d]);", randomID, randomID, fileIdx, blockIdx)
+	}
+	return fmt.Sprintf("GococoCov_%s_%d[%d]++;", randomID, fileIdx, blockIdx)
+}
+
 // FileInstrumentation holds the result of instrumenting a single file.
 type FileInstrumentation struct {
 	VarName  string      // e.g. "gococo_0_a1b2c3"
@@ -34,10 +66,12 @@ type FileInstrumentation struct {
 //
 // For each basic block, it injects:
 //
-//	gococo_cov.Count_RAND[i]++; gococo_cov.Emit_RAND(fileIdx, i)
+//	GococoCov_RAND_FILEIDX[i]++; GococoEmit_RAND(fileIdx, i)
 //
-// where RAND is a unique identifier derived from the temp directory name.
-func InstrumentFile(src []byte, filename string, importPath string, varName string, randomID string, fileIdx int) ([]byte, *FileInstrumentation, error) {
+// where RAND is a unique identifier derived from the module path. The
+// counter update depends on mode. Without events, the GococoEmit call is
+// left out and blocks are only counted.
+func InstrumentFile(src []byte, filename string, importPath string, varName string, randomID string, fileIdx int, mode CoverMode, events bool) ([]byte, *FileInstrumentation, error) {
 	fset := token.NewFileSet()
 	f, err := parser.ParseFile(fset, filename, src, parser.ParseComments)
 	if err != nil {
@@ -57,6 +91,11 @@ func InstrumentFile(src []byte, filename string, importPath string, varName stri
 		varName:  varName,
 		randomID: randomID,
 		fileIdx:  fileIdx,
+		mode:     mode,
+		events:   events,
+	}
+	if !rw.collectIgnores(f) {
+		return src, inst, nil
 	}
 
 	ast.Walk(rw, f)
@@ -96,9 +135,58 @@ type rewriter struct {
 	varName    string
 	randomID   string
 	fileIdx    int
+	mode       CoverMode
+	events     bool // whether blocks emit events
+
+	// ignoreLines holds the lines on which nodes marked //gococo:ignore
+	// start.
+	ignoreLines map[int]bool
+}
+
+// ignoreDirective excludes code from coverage. Placed before the package
+// clause it applies to the whole file. Otherwise it applies to the function,
+// declaration or statement (including blocks and case clauses) that starts
+// on the same line, when it trails code, or on the line after its comment
+// group, when it stands on its own lines.
+const ignoreDirective = "//gococo:ignore"
+
+// collectIgnores records the targets of the ignore directives in f. It
+// returns false if the whole file is ignored.
+func (rw *rewriter) collectIgnores(f *ast.File) bool {
+	rw.ignoreLines = make(map[int]bool)
+	for _, group := range f.Comments {
+		for _, c := range group.List {
+			if c.Text != ignoreDirective && !strings.HasPrefix(c.Text, ignoreDirective+" ") {
+				continue
+			}
+			if c.Pos() < f.Package {
+				return false
+			}
+			pos := rw.fset.Position(c.Pos())
+			lineStart := pos.Offset - (pos.Column - 1)
+			if len(bytes.TrimSpace(rw.src[lineStart:pos.Offset])) > 0 {
+				rw.ignoreLines[pos.Line] = true
+			} else {
+				rw.ignoreLines[rw.fset.Position(group.End()).Line+1] = true
+			}
+		}
+	}
+	return true
+}
+
+// ignored reports whether n is marked //gococo:ignore.
+func (rw *rewriter) ignored(n ast.Node) bool {
+	return len(rw.ignoreLines) > 0 && rw.ignoreLines[rw.fset.Position(n.Pos()).Line]
 }
 
 func (rw *rewriter) Visit(node ast.Node) ast.Visitor {
+	switch node.(type) {
+	case ast.Stmt, ast.Decl:
+		if rw.ignored(node) {
+			return nil
+		}
+	}
+
 	switch n := node.(type) {
 	case *ast.BlockStmt:
 		if len(n.List) > 0 {
@@ -106,13 +194,21 @@ func (rw *rewriter) Visit(node ast.Node) ast.Visitor {
 			case *ast.CaseClause:
 				for _, s := range n.List {
 					clause := s.(*ast.CaseClause)
+					if rw.ignored(clause) {
+						continue
+					}
 					rw.instrumentBlock(clause.Colon+1, clause.End(), clause.Body, false)
+					rw.walkStmts(clause.Body)
 				}
 				return nil
 			case *ast.CommClause:
 				for _, s := range n.List {
 					clause := s.(*ast.CommClause)
+					if rw.ignored(clause) {
+						continue
+					}
 					rw.instrumentBlock(clause.Colon+1, clause.End(), clause.Body, false)
+					rw.walkStmts(clause.Body)
 				}
 				return nil
 			}
@@ -158,18 +254,38 @@ func (rw *rewriter) Visit(node ast.Node) ast.Visitor {
 	return rw
 }
 
+// walkStmts instruments the blocks nested in stmts.
+func (rw *rewriter) walkStmts(stmts []ast.Stmt) {
+	for _, st := range stmts {
+		ast.Walk(rw, st)
+	}
+}
+
 func (rw *rewriter) instrumentBlock(insertPos token.Pos, blockEnd token.Pos, stmts []ast.Stmt, extendToEnd bool) {
 	if len(stmts) == 0 {
 		rw.addCounter(insertPos, blockEnd, insertPos, 0)
 		return
 	}
 
-	pos := stmts[0].Pos()
-	for i := 0; i < len(stmts); {
+	first := true
+	for len(stmts) > 0 {
+		// Ignored statements are left out of every block and end the
+		// block before them.
+		if rw.ignored(stmts[0]) {
+			stmts = stmts[1:]
+			first = false
+			continue
+		}
+
+		pos := stmts[0].Pos()
 		end := blockEnd
-		j := i
+		j := 0
 		for ; j < len(stmts); j++ {
 			s := stmts[j]
+			if rw.ignored(s) {
+				end = stmts[j-1].End()
+				break
+			}
 			if rw.breaksBlock(s) {
 				end = rw.stmtBoundary(s)
 				j++
@@ -178,21 +294,21 @@ func (rw *rewriter) instrumentBlock(insertPos token.Pos, blockEnd token.Pos, stm
 			}
 			end = s.End()
 		}
-		if extendToEnd {
+		if extendToEnd && j == len(stmts) {
 			end = blockEnd
 		}
 
+		// The first block's counter goes right after the opening brace or
+		// colon; later blocks are counted where they start, since control
+		// may leave the enclosing block before reaching them.
 		ipos := pos
-		if i == 0 {
+		if first {
 			ipos = insertPos
 		}
-		rw.addCounter(pos, end, ipos, j-i)
+		rw.addCounter(pos, end, ipos, j)
 
 		stmts = stmts[j:]
-		i = 0
-		if len(stmts) > 0 {
-			pos = stmts[0].Pos()
-		}
+		first = false
 	}
 }
 
@@ -209,8 +325,10 @@ func (rw *rewriter) addCounter(start, end, insertAt token.Pos, numStmts int) {
 		NumStmts:  numStmts,
 	})
 
-	counter := fmt.Sprintf("GococoCov_%s_%d[%d]++; GococoEmit_%s(%d, %d);",
-		rw.randomID, rw.fileIdx, idx, rw.randomID, rw.fileIdx, idx)
+	counter := counterStmt(rw.mode, rw.randomID, rw.fileIdx, idx)
+	if rw.events {
+		counter += fmt.Sprintf(" GococoEmit_%s(%d, %d);", rw.randomID, rw.fileIdx, idx)
+	}
 
 	offset := rw.fset.Position(insertAt).Offset
 	rw.insertions = append(rw.insertions, insertion{offset: offset, text: counter})
@@ -335,41 +453,262 @@ func addImport(src []byte, fset *token.FileSet, f *ast.File, importPath string,
 	return result
 }
 
+// InstrumentTestFile rewrites a _test.go file so that every function taking a
+// single named *testing.T parameter (top-level tests, helpers and subtest
+// closures passed to t.Run) reports itself as the running test:
+//
+//	defer GococoTestEnter_RAND(t)()
+//
+// It returns the rewritten source and the number of functions hooked.
+// Test files are not counted for coverage.
+func InstrumentTestFile(src []byte, filename string, randomID string) ([]byte, int, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, filename, src, parser.ParseComments)
+	if err != nil {
+		return nil, 0, fmt.Errorf("parse %s: %w", filename, err)
+	}
+
+	testingName := ""
+	for _, imp := range f.Imports {
+		if p, _ := strconv.Unquote(imp.Path.Value); p == "testing" {
+			testingName = "testing"
+			if imp.Name != nil {
+				testingName = imp.Name.Name
+			}
+		}
+	}
+	if testingName == "" || testingName == "_" || testingName == "." {
+		return src, 0, nil
+	}
+
+	var ins []insertion
+	hook := func(ft *ast.FuncType, body *ast.BlockStmt) {
+		if body == nil || ft.Params == nil || len(ft.Params.List) != 1 {
+			return
+		}
+		field := ft.Params.List[0]
+		if len(field.Names) != 1 || field.Names[0].Name == "_" || !isTestingT(field.Type, testingName) {
+			return
+		}
+		ins = append(ins, insertion{
+			offset: fset.Position(body.Lbrace + 1).Offset,
+			text:   fmt.Sprintf("defer GococoTestEnter_%s(%s)();", randomID, field.Names[0].Name),
+		})
+	}
+	ast.Inspect(f, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FuncDecl:
+			if n.Recv == nil {
+				hook(n.Type, n.Body)
+			}
+		case *ast.FuncLit:
+			hook(n.Type, n.Body)
+		}
+		return true
+	})
+
+	if len(ins) == 0 {
+		return src, 0, nil
+	}
+	return applyInsertions(src, ins), len(ins), nil
+}
+
+// InstrumentExits rewrites a file of the project so that the agent gets to
+// flush coverage before the process ends:
+//
+//	func main() { defer GococoFlush_RAND(); ... }
+//	os.Exit(GococoExit_RAND(code))
+//	GococoFatalf_RAND(log.Fatalf)(format, args...)
+//	signal.Notify(c, GococoNotify_RAND(sigs...)...)
+//
+// main.main flushes on return, including while a panic unwinds it. The
+// wrappers of log.Fatal, log.Fatalf and log.Fatalln log the message as the
+// function they wrap would, then flush and exit. Calls to signal.Notify and
+// signal.NotifyContext record the signals the program handles itself, which
+// the agent then leaves alone. The file must import
+// gococodef with a dot import. It returns the rewritten source and the
+// number of hooks added.
+func InstrumentExits(src []byte, filename string, randomID string) ([]byte, int, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, filename, src, parser.ParseComments)
+	if err != nil {
+		return nil, 0, fmt.Errorf("parse %s: %w", filename, err)
+	}
+
+	osName, logName, signalName := "", "", ""
+	for _, imp := range f.Imports {
+		name := ""
+		if imp.Name != nil {
+			name = imp.Name.Name
+		}
+		switch p, _ := strconv.Unquote(imp.Path.Value); {
+		case p == "os" && name == "":
+			osName = "os"
+		case p == "log" && name == "":
+			logName = "log"
+		case p == "os/signal" && name == "":
+			signalName = "signal"
+		case p == "os" && name != "_" && name != ".":
+			osName = name
+		case p == "log" && name != "_" && name != ".":
+			logName = name
+		case p == "os/signal" && name != "_" && name != ".":
+			signalName = name
+		}
+	}
+
+	var ins []insertion
+	insert := func(pos token.Pos, text string) {
+		ins = append(ins, insertion{offset: fset.Position(pos).Offset, text: text})
+	}
+	hooks := 0
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if ok && f.Name.Name == "main" && fn.Recv == nil && fn.Name.Name == "main" && fn.Body != nil {
+			insert(fn.Body.Lbrace+1, fmt.Sprintf("defer GococoFlush_%s();", randomID))
+			hooks++
+		}
+	}
+	ast.Inspect(f, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok {
+			return true
+		}
+		sel, ok := call.Fun.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		x, ok := sel.X.(*ast.Ident)
+		if !ok {
+			return true
+		}
+		switch {
+		case x.Name == osName && sel.Sel.Name == "Exit" && len(call.Args) == 1:
+			insert(call.Args[0].Pos(), fmt.Sprintf("GococoExit_%s(", randomID))
+			insert(call.Args[0].End(), ")")
+			hooks++
+		case x.Name == logName && (sel.Sel.Name == "Fatal" || sel.Sel.Name == "Fatalf" || sel.Sel.Name == "Fatalln"):
+			insert(sel.Pos(), fmt.Sprintf("Gococo%s_%s(", sel.Sel.Name, randomID))
+			insert(sel.End(), ")")
+			hooks++
+		case x.Name == signalName && (sel.Sel.Name == "Notify" || sel.Sel.Name == "NotifyContext") && len(call.Args) >= 1:
+			// The first argument is the channel or context; the signals
+			// follow, if any.
+			last := call.Args[len(call.Args)-1]
+			switch {
+			case len(call.Args) == 1:
+				insert(last.End(), fmt.Sprintf(", GococoNotify_%s()...", randomID))
+			case call.Ellipsis.IsValid():
+				insert(call.Args[1].Pos(), fmt.Sprintf("GococoNotify_%s(", randomID))
+				insert(call.Ellipsis+3, ")...")
+			default:
+				insert(call.Args[1].Pos(), fmt.Sprintf("GococoNotify_%s(", randomID))
+				insert(last.End(), ")...")
+			}
+			hooks++
+		}
+		return true
+	})
+
+	if hooks == 0 {
+		return src, 0, nil
+	}
+	return applyInsertions(src, ins), hooks, nil
+}
+
+// isTestingT reports whether expr is *testing.T, with testing imported as pkgName.
+func isTestingT(expr ast.Expr, pkgName string) bool {
+	star, ok := expr.(*ast.StarExpr)
+	if !ok {
+		return false
+	}
+	sel, ok := star.X.(*ast.SelectorExpr)
+	if !ok || sel.Sel.Name != "T" {
+		return false
+	}
+	x, ok := sel.X.(*ast.Ident)
+	return ok && x.Name == pkgName
+}
+
+// renameTestMain renames a top-level TestMain function declared in src to
+// newName. It reports whether the file declared one.
+func renameTestMain(src []byte, filename string, newName string) ([]byte, bool, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, filename, src, 0)
+	if err != nil {
+		return nil, false, fmt.Errorf("parse %s: %w", filename, err)
+	}
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Recv != nil || fn.Name.Name != "TestMain" {
+			continue
+		}
+		start := fset.Position(fn.Name.Pos()).Offset
+		end := fset.Position(fn.Name.End()).Offset
+
+		result := make([]byte, 0, len(src)+len(newName))
+		result = append(result, src[:start]...)
+		result = append(result, []byte(newName)...)
+		result = append(result, src[end:]...)
+		return result, true, nil
+	}
+	return src, false, nil
+}
+
 // lineDirective returns a //line directive to preserve original file positions.
 func lineDirective(filename string) string {
 	return fmt.Sprintf("//line %s:1\n", filename)
 }
 
 // BuildGlobalCoverVarDecl generates the Go source for global coverage variable declarations.
-// This produces counter arrays, block metadata, the event channel, emit function,
-// and accessor functions that the injected agent code calls.
-func BuildGlobalCoverVarDecl(files []*FileInstrumentation, randomID string) string {
+// This produces counter arrays, block metadata, the emit function, and
+// accessor functions that the injected agent code calls.
+// In atomic mode, counters and the enabled flag are accessed with sync/atomic.
+func BuildGlobalCoverVarDecl(files []*FileInstrumentation, randomID string, mode CoverMode) string {
 	var b strings.Builder
+	atomicMode := mode == ModeAtomic
 
 	b.WriteString("package gococodef\n\n")
+	if atomicMode {
+		b.WriteString("import \"sync/atomic\"\n\n")
+	}
 
-	// Block event type
-	b.WriteString(fmt.Sprintf("type GococoBlock_%s struct {\n", randomID))
-	b.WriteString("\tFileIdx  int\n")
-	b.WriteString("\tBlockIdx int\n")
-	b.WriteString("}\n\n")
+	// Enabled flag (unexported internal accessed via exported functions)
+	if atomicMode {
+		b.WriteString(fmt.Sprintf("var gococoEnabled_%s int32 = 1\n\n", randomID))
+	} else {
+		b.WriteString(fmt.Sprintf("var gococoEnabled_%s = true\n\n", randomID))
+	}
 
-	// Channel and enabled flag (unexported internals accessed via exported functions)
-	b.WriteString(fmt.Sprintf("var gococoCh_%s = make(chan *GococoBlock_%s, 8192)\n\n", randomID, randomID))
-	b.WriteString(fmt.Sprintf("var gococoEnabled_%s = true\n\n", randomID))
+	// Current test lookup, installed by the test support file in test binaries
+	b.WriteString(fmt.Sprintf("var gococoTestName_%s func() string\n\n", randomID))
 
-	// Emit function: called from instrumented code via dot import
+	// Emit function: called from instrumented code via dot import. Events
+	// are recorded by gococoPush, see BuildEventSupportDecl.
 	b.WriteString(fmt.Sprintf("func GococoEmit_%s(fileIdx int, blockIdx int) {\n", randomID))
-	b.WriteString(fmt.Sprintf("\tif !gococoEnabled_%s { return }\n", randomID))
-	b.WriteString("\tselect {\n")
-	b.WriteString(fmt.Sprintf("\tcase gococoCh_%s <- &GococoBlock_%s{FileIdx: fileIdx, BlockIdx: blockIdx}:\n", randomID, randomID))
-	b.WriteString("\tdefault:\n")
-	b.WriteString("\t}\n")
+	if atomicMode {
+		b.WriteString(fmt.Sprintf("\tif atomic.LoadInt32(&gococoEnabled_%s) == 0 { return }\n", randomID))
+	} else {
+		b.WriteString(fmt.Sprintf("\tif !gococoEnabled_%s { return }\n", randomID))
+	}
+	b.WriteString("\ttest := \"\"\n")
+	b.WriteString(fmt.Sprintf("\tif gococoTestName_%s != nil { test = gococoTestName_%s() }\n", randomID, randomID))
+	b.WriteString(fmt.Sprintf("\tgococoPush_%s(fileIdx, blockIdx, test)\n", randomID))
 	b.WriteString("}\n\n")
 
 	// Exported accessors for the agent package
-	b.WriteString(fmt.Sprintf("func SetEnabled_%s(v bool) { gococoEnabled_%s = v }\n\n", randomID, randomID))
-	b.WriteString(fmt.Sprintf("func EventChan_%s() <-chan *GococoBlock_%s { return gococoCh_%s }\n\n", randomID, randomID, randomID))
+	if atomicMode {
+		b.WriteString(fmt.Sprintf("func SetEnabled_%s(v bool) {\n", randomID))
+		b.WriteString("\tvar i int32\n")
+		b.WriteString("\tif v { i = 1 }\n")
+		b.WriteString(fmt.Sprintf("\tatomic.StoreInt32(&gococoEnabled_%s, i)\n", randomID))
+		b.WriteString("}\n\n")
+
+		// Counter increment used by instrumented code in atomic mode
+		b.WriteString(fmt.Sprintf("func GococoInc_%s(p *uint32) { atomic.AddUint32(p, 1) }\n\n", randomID))
+	} else {
+		b.WriteString(fmt.Sprintf("func SetEnabled_%s(v bool) { gococoEnabled_%s = v }\n\n", randomID, randomID))
+	}
 
 	// Per-file counter arrays and block metadata
 	for i, fi := range files {
@@ -401,6 +740,52 @@ func BuildGlobalCoverVarDecl(files []*FileInstrumentation, randomID string) stri
 		b.WriteString("}\n\n")
 	}
 
+	// Registry of files instrumented outside the module by `gococo toolexec`.
+	// Those packages cannot import gococodef, so they call GococoExtRegister
+	// through a linkname during their initialization and receive the index of
+	// their first file. Package initialization is sequential, so the registry
+	// needs no locking.
+	b.WriteString(fmt.Sprintf("const gococoNumFiles_%s = %d\n\n", randomID, len(files)))
+	b.WriteString(fmt.Sprintf("type gococoExtFile_%s struct {\n", randomID))
+	b.WriteString("\tFile     string\n")
+	b.WriteString("\tCounters []uint32\n")
+	b.WriteString("\tMeta     []int // StartLine, StartCol, EndLine, EndCol, NumStmts per block\n")
+	b.WriteString("}\n\n")
+	b.WriteString(fmt.Sprintf("var gococoExt_%s []gococoExtFile_%s\n\n", randomID, randomID))
+
+	b.WriteString(fmt.Sprintf("func GococoExtRegister_%s(files []string, counters [][]uint32, meta [][]int) int {\n", randomID))
+	b.WriteString(fmt.Sprintf("\tbase := gococoNumFiles_%s + len(gococoExt_%s)\n", randomID, randomID))
+	b.WriteString("\tfor i, f := range files {\n")
+	b.WriteString(fmt.Sprintf("\t\tgococoExt_%s = append(gococoExt_%s, gococoExtFile_%s{File: f, Counters: counters[i], Meta: meta[i]})\n", randomID, randomID, randomID))
+	b.WriteString("\t}\n")
+	b.WriteString("\treturn base\n")
+	b.WriteString("}\n\n")
+
+	// Exported accessor: FileName returns the path of a file by index, for
+	// events whose block positions the server looks up.
+	b.WriteString(fmt.Sprintf("var gococoFiles_%s = [%d]string{", randomID, len(files)))
+	for i, fi := range files {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		if len(fi.Blocks) > 0 {
+			b.WriteString(strconv.Quote(fi.FilePath))
+		} else {
+			b.WriteString(`""`)
+		}
+	}
+	b.WriteString("}\n\n")
+	b.WriteString(fmt.Sprintf("func FileName_%s(fileIdx int) string {\n", randomID))
+	b.WriteString(fmt.Sprintf("\tif fileIdx < len(gococoFiles_%s) {\n", randomID))
+	b.WriteString(fmt.Sprintf("\t\treturn gococoFiles_%s[fileIdx]\n", randomID))
+	b.WriteString("\t}\n")
+	b.WriteString(fmt.Sprintf("\tif i := fileIdx - gococoNumFiles_%s; i < len(gococoExt_%s) {\n", randomID, randomID))
+	b.WriteString(fmt.Sprintf("\t\treturn gococoExt_%s[i].File\n", randomID))
+	b.WriteString("\t}\n")
+	b.WriteString("\treturn \"\"\n")
+	b.WriteString("}\n\n")
+	b.WriteString(fmt.Sprintf("func NumFiles_%s() int { return gococoNumFiles_%s + len(gococoExt_%s) }\n\n", randomID, randomID, randomID))
+
 	// Exported accessor: BlockMeta returns metadata for a given file/block index
 	b.WriteString(fmt.Sprintf("func BlockMeta_%s(fileIdx int, blockIdx int) (file string, sl, sc, el, ec, stmts int) {\n", randomID))
 	b.WriteString("\tswitch fileIdx {\n")
@@ -413,6 +798,11 @@ func BuildGlobalCoverVarDecl(files []*FileInstrumentation, randomID string) stri
 		b.WriteString("\t\treturn m.File, m.StartLine[blockIdx], m.StartCol[blockIdx], m.EndLine[blockIdx], m.EndCol[blockIdx], m.NumStmts[blockIdx]\n")
 	}
 	b.WriteString("\t}\n")
+	b.WriteString(fmt.Sprintf("\tif i := fileIdx - gococoNumFiles_%s; i >= 0 && i < len(gococoExt_%s) {\n", randomID, randomID))
+	b.WriteString(fmt.Sprintf("\t\te := &gococoExt_%s[i]\n", randomID))
+	b.WriteString("\t\tm := e.Meta[blockIdx*5:]\n")
+	b.WriteString("\t\treturn e.File, m[0], m[1], m[2], m[3], m[4]\n")
+	b.WriteString("\t}\n")
 	b.WriteString("\treturn\n")
 	b.WriteString("}\n\n")
 
@@ -433,7 +823,11 @@ func BuildGlobalCoverVarDecl(files []*FileInstrumentation, randomID string) stri
 			continue
 		}
 		b.WriteString(fmt.Sprintf("\tfor j := 0; j < %d; j++ {\n", len(fi.Blocks)))
-		b.WriteString(fmt.Sprintf("\t\tc := GococoCov_%s_%d[j]\n", randomID, i))
+		if atomicMode {
+			b.WriteString(fmt.Sprintf("\t\tc := atomic.LoadUint32(&GococoCov_%s_%d[j])\n", randomID, i))
+		} else {
+			b.WriteString(fmt.Sprintf("\t\tc := GococoCov_%s_%d[j]\n", randomID, i))
+		}
 		b.WriteString(fmt.Sprintf("\t\tm := &gococoMeta_%s_%d\n", randomID, i))
 		b.WriteString(fmt.Sprintf("\t\tout = append(out, GococoCounterEntry_%s{\n", randomID))
 		b.WriteString("\t\t\tFile: m.File, BlockIdx: j, Count: c,\n")
@@ -442,12 +836,453 @@ func BuildGlobalCoverVarDecl(files []*FileInstrumentation, randomID string) stri
 		b.WriteString("\t\t})\n")
 		b.WriteString("\t}\n")
 	}
+	b.WriteString(fmt.Sprintf("\tfor _, e := range gococoExt_%s {\n", randomID))
+	b.WriteString("\t\tfor j := range e.Counters {\n")
+	if atomicMode {
+		b.WriteString("\t\t\tc := atomic.LoadUint32(&e.Counters[j])\n")
+	} else {
+		b.WriteString("\t\t\tc := e.Counters[j]\n")
+	}
+	b.WriteString("\t\t\tm := e.Meta[j*5:]\n")
+	b.WriteString(fmt.Sprintf("\t\t\tout = append(out, GococoCounterEntry_%s{\n", randomID))
+	b.WriteString("\t\t\t\tFile: e.File, BlockIdx: j, Count: c,\n")
+	b.WriteString("\t\t\t\tSL: m[0], SC: m[1], EL: m[2], EC: m[3], Stmts: m[4],\n")
+	b.WriteString("\t\t\t})\n")
+	b.WriteString("\t\t}\n")
+	b.WriteString("\t}\n")
 	b.WriteString("\treturn out\n")
 	b.WriteString("}\n")
 
 	return b.String()
 }
 
+// BuildEventSupportDecl generates the Go source of the gococodef file that
+// records events for the agent, without allocating or locking. Events are
+// packed records in bounded lock-free queues, one per P up to 16, which the
+// agent drains with ReadEvents; when a queue is full, events are dropped and
+// counted. Events carry the ID of the goroutine that ran the block. With
+// offsets, it is read from the runtime's data structures, which is checked
+// once at startup; otherwise, or if the check fails, it is parsed from
+// runtime.Stack, which is much slower.
+func BuildEventSupportDecl(randomID string, offsets *RuntimeOffsets) string {
+	var b strings.Builder
+
+	b.WriteString("package gococodef\n\n")
+	b.WriteString("import (\n\t\"runtime\"\n\t\"sync\"\n\t\"sync/atomic\"\n\t\"time\"\n")
+	if offsets != nil {
+		b.WriteString("\t\"unsafe\"\n")
+	} else {
+		b.WriteString("\t_ \"unsafe\"\n")
+	}
+	b.WriteString(")\n\n")
+
+	b.WriteString(fmt.Sprintf("const gococoRingSize_%s = 4096\n\n", randomID))
+
+	b.WriteString(fmt.Sprintf("type GococoEvent_%s struct {\n", randomID))
+	b.WriteString("\tFileIdx   int32\n")
+	b.WriteString("\tBlockIdx  int32\n")
+	b.WriteString("\tTimestamp int64 // Unix nanoseconds\n")
+	b.WriteString("\tGID       int64\n")
+	b.WriteString("\tTest      string // running test, set in test binaries only\n")
+	b.WriteString("}\n\n")
+
+	// A slot is free for the write at position pos when seq == pos, holds
+	// the event written at pos when seq == pos+1, and is free again for
+	// pos+size once read.
+	b.WriteString(fmt.Sprintf("type gococoSlot_%s struct {\n", randomID))
+	b.WriteString("\tseq uint64\n")
+	b.WriteString(fmt.Sprintf("\tev  GococoEvent_%s\n", randomID))
+	b.WriteString("}\n\n")
+
+	b.WriteString(fmt.Sprintf("type gococoRing_%s struct {\n", randomID))
+	b.WriteString("\thead  uint64\n")
+	b.WriteString("\t_     [56]byte\n")
+	b.WriteString("\ttail  uint64 // guarded by gococoReadMu\n")
+	b.WriteString("\t_     [56]byte\n")
+	b.WriteString(fmt.Sprintf("\tslots [gococoRingSize_%s]gococoSlot_%s\n", randomID, randomID))
+	b.WriteString("}\n\n")
+
+	// Timestamps are taken from the monotonic clock, which is half as
+	// costly to read as the wall clock, and rebased on the wall clock at
+	// startup. The bases are declared first so that they are set once the
+	// rings exist.
+	b.WriteString("var (\n")
+	b.WriteString(fmt.Sprintf("\tgococoWallBase_%s = time.Now().UnixNano()\n", randomID))
+	b.WriteString(fmt.Sprintf("\tgococoMonoBase_%s = gococoNanotime_%s()\n", randomID, randomID))
+	b.WriteString(fmt.Sprintf("\tgococoRings_%s   = gococoNewRings_%s()\n", randomID, randomID))
+	b.WriteString(fmt.Sprintf("\tgococoReadMu_%s  sync.Mutex\n", randomID))
+	b.WriteString(fmt.Sprintf("\tgococoDropped_%s uint64\n", randomID))
+	b.WriteString(")\n\n")
+
+	b.WriteString(fmt.Sprintf("//go:linkname gococoNanotime_%s runtime.nanotime\n", randomID))
+	b.WriteString(fmt.Sprintf("func gococoNanotime_%s() int64\n\n", randomID))
+	b.WriteString(fmt.Sprintf("//go:linkname gococoProcPin_%s runtime.procPin\n", randomID))
+	b.WriteString(fmt.Sprintf("func gococoProcPin_%s() int\n\n", randomID))
+	b.WriteString(fmt.Sprintf("//go:linkname gococoProcUnpin_%s runtime.procUnpin\n", randomID))
+	b.WriteString(fmt.Sprintf("func gococoProcUnpin_%s()\n\n", randomID))
+
+	b.WriteString(fmt.Sprintf("func gococoNewRings_%s() []*gococoRing_%s {\n", randomID, randomID))
+	b.WriteString("\tn := 1\n")
+	b.WriteString("\tfor n < runtime.GOMAXPROCS(0) && n < 16 {\n")
+	b.WriteString("\t\tn *= 2\n")
+	b.WriteString("\t}\n")
+	b.WriteString(fmt.Sprintf("\trings := make([]*gococoRing_%s, n)\n", randomID))
+	b.WriteString("\tfor i := range rings {\n")
+	b.WriteString(fmt.Sprintf("\t\tr := new(gococoRing_%s)\n", randomID))
+	b.WriteString("\t\tfor j := range r.slots {\n")
+	b.WriteString("\t\t\tr.slots[j].seq = uint64(j)\n")
+	b.WriteString("\t\t}\n")
+	b.WriteString("\t\trings[i] = r\n")
+	b.WriteString("\t}\n")
+	b.WriteString("\treturn rings\n")
+	b.WriteString("}\n\n")
+
+	// Packages instrumented by gococo toolexec may emit during their
+	// initialization, before the rings exist.
+	b.WriteString(fmt.Sprintf("func gococoPush_%s(fileIdx int, blockIdx int, test string) {\n", randomID))
+	b.WriteString(fmt.Sprintf("\trings := gococoRings_%s\n", randomID))
+	b.WriteString("\tif rings == nil {\n")
+	b.WriteString(fmt.Sprintf("\t\tatomic.AddUint64(&gococoDropped_%s, 1)\n", randomID))
+	b.WriteString("\t\treturn\n")
+	b.WriteString("\t}\n")
+	b.WriteString("\tvar gid int64\n")
+	b.WriteString(fmt.Sprintf("\tif !gococoFastGoid_%s {\n", randomID))
+	b.WriteString(fmt.Sprintf("\t\tgid = gococoStackGoid_%s()\n", randomID))
+	b.WriteString("\t}\n")
+	// Pinned, the goroutine stays on its M and P.
+	b.WriteString(fmt.Sprintf("\tr := rings[gococoProcPin_%s()&(len(rings)-1)]\n", randomID))
+	// The slot is claimed before the event is timestamped, so that events
+	// dropped because the ring is full cost little.
+	b.WriteString("\tfor {\n")
+	b.WriteString("\t\tpos := atomic.LoadUint64(&r.head)\n")
+	b.WriteString(fmt.Sprintf("\t\ts := &r.slots[pos&(gococoRingSize_%s-1)]\n", randomID))
+	b.WriteString("\t\tseq := atomic.LoadUint64(&s.seq)\n")
+	b.WriteString("\t\tif seq == pos {\n")
+	b.WriteString("\t\t\tif atomic.CompareAndSwapUint64(&r.head, pos, pos+1) {\n")
+	b.WriteString(fmt.Sprintf("\t\t\t\tif gococoFastGoid_%s {\n", randomID))
+	b.WriteString(fmt.Sprintf("\t\t\t\t\tgid = gococoGoid_%s()\n", randomID))
+	b.WriteString("\t\t\t\t}\n")
+	b.WriteString(fmt.Sprintf("\t\t\t\tts := gococoWallBase_%s + gococoNanotime_%s() - gococoMonoBase_%s\n", randomID, randomID, randomID))
+	b.WriteString(fmt.Sprintf("\t\t\t\ts.ev = GococoEvent_%s{int32(fileIdx), int32(blockIdx), ts, gid, test}\n", randomID))
+	b.WriteString("\t\t\t\tatomic.StoreUint64(&s.seq, pos+1)\n")
+	b.WriteString("\t\t\t\tbreak\n")
+	b.WriteString("\t\t\t}\n")
+	b.WriteString("\t\t} else if seq < pos {\n")
+	b.WriteString(fmt.Sprintf("\t\t\tatomic.AddUint64(&gococoDropped_%s, 1)\n", randomID))
+	b.WriteString("\t\t\tbreak\n")
+	b.WriteString("\t\t}\n")
+	b.WriteString("\t}\n")
+	b.WriteString(fmt.Sprintf("\tgococoProcUnpin_%s()\n", randomID))
+	b.WriteString("}\n\n")
+
+	b.WriteString(fmt.Sprintf("func ReadEvents_%s(buf []GococoEvent_%s) int {\n", randomID, randomID))
+	b.WriteString(fmt.Sprintf("\tgococoReadMu_%s.Lock()\n", randomID))
+	b.WriteString(fmt.Sprintf("\tdefer gococoReadMu_%s.Unlock()\n", randomID))
+	b.WriteString("\tn := 0\n")
+	b.WriteString(fmt.Sprintf("\tfor _, r := range gococoRings_%s {\n", randomID))
+	b.WriteString("\t\tfor n < len(buf) {\n")
+	b.WriteString(fmt.Sprintf("\t\t\ts := &r.slots[r.tail&(gococoRingSize_%s-1)]\n", randomID))
+	b.WriteString("\t\t\tif atomic.LoadUint64(&s.seq) != r.tail+1 {\n")
+	b.WriteString("\t\t\t\tbreak\n")
+	b.WriteString("\t\t\t}\n")
+	b.WriteString("\t\t\tbuf[n] = s.ev\n")
+	b.WriteString(fmt.Sprintf("\t\t\tatomic.StoreUint64(&s.seq, r.tail+gococoRingSize_%s)\n", randomID))
+	b.WriteString("\t\t\tr.tail++\n")
+	b.WriteString("\t\t\tn++\n")
+	b.WriteString("\t\t}\n")
+	b.WriteString("\t}\n")
+	b.WriteString("\treturn n\n")
+	b.WriteString("}\n\n")
+
+	b.WriteString(fmt.Sprintf("func Dropped_%s() uint64 { return atomic.LoadUint64(&gococoDropped_%s) }\n\n", randomID, randomID))
+
+	b.WriteString(fmt.Sprintf("func gococoStackGoid_%s() int64 {\n", randomID))
+	b.WriteString("\tvar buf [64]byte\n")
+	b.WriteString("\tn := runtime.Stack(buf[:], false)\n")
+	b.WriteString("\tvar id int64\n")
+	b.WriteString("\tfor _, c := range buf[len(\"goroutine \"):n] {\n")
+	b.WriteString("\t\tif c < '0' || c > '9' {\n")
+	b.WriteString("\t\t\tbreak\n")
+	b.WriteString("\t\t}\n")
+	b.WriteString("\t\tid = id*10 + int64(c-'0')\n")
+	b.WriteString("\t}\n")
+	b.WriteString("\treturn id\n")
+	b.WriteString("}\n\n")
+
+	if offsets == nil {
+		b.WriteString(fmt.Sprintf("const gococoFastGoid_%s = false\n\n", randomID))
+		b.WriteString(fmt.Sprintf("func gococoGoid_%s() int64 { return gococoStackGoid_%s() }\n", randomID, randomID))
+		return b.String()
+	}
+
+	// getm stays available to linknames for this very use, see
+	// go.dev/issue/67401. The goroutine must be pinned to its M.
+	b.WriteString(fmt.Sprintf("var gococoFastGoid_%s = gococoCheckGoid_%s()\n\n", randomID, randomID))
+	b.WriteString(fmt.Sprintf("//go:linkname gococoGetm_%s runtime.getm\n", randomID))
+	b.WriteString(fmt.Sprintf("func gococoGetm_%s() unsafe.Pointer\n\n", randomID))
+	b.WriteString(fmt.Sprintf("func gococoGoid_%s() int64 {\n", randomID))
+	b.WriteString(fmt.Sprintf("\tm := gococoGetm_%s()\n", randomID))
+	b.WriteString(fmt.Sprintf("\tg := *(*unsafe.Pointer)(unsafe.Pointer(uintptr(m) + %d)) // m.curg\n", offsets.Curg))
+	b.WriteString(fmt.Sprintf("\treturn *(*int64)(unsafe.Pointer(uintptr(g) + %d)) // g.goid\n", offsets.Goid))
+	b.WriteString("}\n\n")
+	b.WriteString(fmt.Sprintf("func gococoCheckGoid_%s() bool {\n", randomID))
+	b.WriteString(fmt.Sprintf("\tgococoProcPin_%s()\n", randomID))
+	b.WriteString(fmt.Sprintf("\tid := gococoGoid_%s()\n", randomID))
+	b.WriteString(fmt.Sprintf("\tgococoProcUnpin_%s()\n", randomID))
+	b.WriteString(fmt.Sprintf("\treturn id == gococoStackGoid_%s()\n", randomID))
+	b.WriteString("}\n")
+
+	return b.String()
+}
+
+// BuildTestSupportDecl generates the Go source of the gococodef file that
+// tracks the running tests in instrumented test binaries. Test functions call
+// GococoTestEnter with their *testing.T on entry and the returned function on
+// exit; events emitted in between are attributed to the innermost running
+// test. While tests run in parallel, events are attributed to the test
+// running on the emitting goroutine, and left unattributed on goroutines
+// the tests started.
+func BuildTestSupportDecl(randomID string) string {
+	var b strings.Builder
+
+	b.WriteString("package gococodef\n\n")
+	b.WriteString("import (\n\t\"strings\"\n\t\"sync\"\n\t\"sync/atomic\"\n)\n\n")
+
+	b.WriteString(fmt.Sprintf("type gococoTest_%s struct {\n", randomID))
+	b.WriteString("\tgid  int64\n")
+	b.WriteString("\tname string\n")
+	b.WriteString("}\n\n")
+
+	// The running tests as seen by gococoTestName: the innermost one if
+	// each runs the next, and otherwise the test of each goroutine.
+	b.WriteString(fmt.Sprintf("type gococoTests_%s struct {\n", randomID))
+	b.WriteString("\tinnermost string\n")
+	b.WriteString("\tbyGoid    map[int64]string\n")
+	b.WriteString("}\n\n")
+
+	b.WriteString("var (\n")
+	b.WriteString(fmt.Sprintf("\tgococoTestMu_%s    sync.Mutex\n", randomID))
+	b.WriteString(fmt.Sprintf("\tgococoTestStack_%s []gococoTest_%s\n", randomID, randomID))
+	b.WriteString(fmt.Sprintf("\tgococoCurTests_%s  atomic.Value // *gococoTests_%s\n", randomID, randomID))
+	b.WriteString(")\n\n")
+
+	b.WriteString("func init() {\n")
+	b.WriteString(fmt.Sprintf("\tgococoTestName_%s = func() string {\n", randomID))
+	b.WriteString(fmt.Sprintf("\t\tcur, _ := gococoCurTests_%s.Load().(*gococoTests_%s)\n", randomID, randomID))
+	b.WriteString("\t\tif cur == nil {\n")
+	b.WriteString("\t\t\treturn \"\"\n")
+	b.WriteString("\t\t}\n")
+	b.WriteString("\t\tif cur.byGoid == nil {\n")
+	b.WriteString("\t\t\treturn cur.innermost\n")
+	b.WriteString("\t\t}\n")
+	b.WriteString(fmt.Sprintf("\t\treturn cur.byGoid[gococoCurGoid_%s()]\n", randomID))
+	b.WriteString("\t}\n")
+	b.WriteString("}\n\n")
+
+	b.WriteString(fmt.Sprintf("func gococoCurGoid_%s() int64 {\n", randomID))
+	b.WriteString(fmt.Sprintf("\tif !gococoFastGoid_%s {\n", randomID))
+	b.WriteString(fmt.Sprintf("\t\treturn gococoStackGoid_%s()\n", randomID))
+	b.WriteString("\t}\n")
+	b.WriteString(fmt.Sprintf("\tgococoProcPin_%s()\n", randomID))
+	b.WriteString(fmt.Sprintf("\tid := gococoGoid_%s()\n", randomID))
+	b.WriteString(fmt.Sprintf("\tgococoProcUnpin_%s()\n", randomID))
+	b.WriteString("\treturn id\n")
+	b.WriteString("}\n\n")
+
+	// Called with gococoTestMu held.
+	b.WriteString(fmt.Sprintf("func gococoStoreTests_%s() {\n", randomID))
+	b.WriteString(fmt.Sprintf("\tstack := gococoTestStack_%s\n", randomID))
+	b.WriteString(fmt.Sprintf("\tcur := &gococoTests_%s{}\n", randomID))
+	b.WriteString("\tfor i, t := range stack {\n")
+	b.WriteString("\t\tif i > 0 && !strings.HasPrefix(t.name, stack[i-1].name+\"/\") {\n")
+	b.WriteString("\t\t\tcur.byGoid = make(map[int64]string, len(stack))\n")
+	b.WriteString("\t\t\tbreak\n")
+	b.WriteString("\t\t}\n")
+	b.WriteString("\t\tcur.innermost = t.name\n")
+	b.WriteString("\t}\n")
+	b.WriteString("\tif cur.byGoid != nil {\n")
+	b.WriteString("\t\tcur.innermost = \"\"\n")
+	b.WriteString("\t\tfor _, t := range stack {\n")
+	b.WriteString("\t\t\tcur.byGoid[t.gid] = t.name\n")
+	b.WriteString("\t\t}\n")
+	b.WriteString("\t}\n")
+	b.WriteString(fmt.Sprintf("\tgococoCurTests_%s.Store(cur)\n", randomID))
+	b.WriteString("}\n\n")
+
+	b.WriteString(fmt.Sprintf("func GococoTestEnter_%s(t interface{ Name() string }) func() {\n", randomID))
+	b.WriteString(fmt.Sprintf("\ttest := gococoTest_%s{gococoCurGoid_%s(), t.Name()}\n", randomID, randomID))
+	b.WriteString(fmt.Sprintf("\tgococoTestMu_%s.Lock()\n", randomID))
+	b.WriteString(fmt.Sprintf("\tgococoTestStack_%s = append(gococoTestStack_%s, test)\n", randomID, randomID))
+	b.WriteString(fmt.Sprintf("\tgococoStoreTests_%s()\n", randomID))
+	b.WriteString(fmt.Sprintf("\tgococoTestMu_%s.Unlock()\n", randomID))
+	b.WriteString("\treturn func() {\n")
+	b.WriteString(fmt.Sprintf("\t\tgococoTestMu_%s.Lock()\n", randomID))
+	b.WriteString(fmt.Sprintf("\t\tdefer gococoTestMu_%s.Unlock()\n", randomID))
+	b.WriteString(fmt.Sprintf("\t\tstack := gococoTestStack_%s\n", randomID))
+	b.WriteString("\t\tfor i := len(stack) - 1; i >= 0; i-- {\n")
+	b.WriteString("\t\t\tif stack[i] == test {\n")
+	b.WriteString("\t\t\t\tstack = append(stack[:i], stack[i+1:]...)\n")
+	b.WriteString("\t\t\t\tbreak\n")
+	b.WriteString("\t\t\t}\n")
+	b.WriteString("\t\t}\n")
+	b.WriteString(fmt.Sprintf("\t\tgococoTestStack_%s = stack\n", randomID))
+	b.WriteString(fmt.Sprintf("\t\tgococoStoreTests_%s()\n", randomID))
+	b.WriteString("\t}\n")
+	b.WriteString("}\n")
+
+	return b.String()
+}
+
+// BuildExitSupportDecl generates the Go source of the gococodef file with the
+// hooks added by InstrumentExits. GococoFlush and GococoExit run the flush
+// function installed by the agent with SetFlush. GococoNotify records the
+// signals the program handles, all of them when called without any, and
+// calls the function installed with SetNotifyHook.
+func BuildExitSupportDecl(randomID string) string {
+	var b strings.Builder
+
+	b.WriteString("package gococodef\n\n")
+	b.WriteString("import (\n\t\"fmt\"\n\t\"log\"\n\t\"os\"\n\t\"sync\"\n)\n\n")
+
+	b.WriteString("var (\n")
+	b.WriteString(fmt.Sprintf("\tgococoFlush_%s      func()\n", randomID))
+	b.WriteString(fmt.Sprintf("\tgococoSignalMu_%s   sync.Mutex\n", randomID))
+	b.WriteString(fmt.Sprintf("\tgococoHandled_%s    []os.Signal\n", randomID))
+	b.WriteString(fmt.Sprintf("\tgococoHandledAll_%s bool\n", randomID))
+	b.WriteString(fmt.Sprintf("\tgococoNotifyHook_%s func()\n", randomID))
+	b.WriteString(")\n\n")
+
+	b.WriteString(fmt.Sprintf("func SetFlush_%s(f func()) { gococoFlush_%s = f }\n\n", randomID, randomID))
+
+	b.WriteString(fmt.Sprintf("func GococoFlush_%s() {\n", randomID))
+	b.WriteString(fmt.Sprintf("\tif gococoFlush_%s != nil {\n", randomID))
+	b.WriteString(fmt.Sprintf("\t\tgococoFlush_%s()\n", randomID))
+	b.WriteString("\t}\n")
+	b.WriteString("}\n\n")
+
+	b.WriteString(fmt.Sprintf("func GococoExit_%s(code int) int {\n", randomID))
+	b.WriteString(fmt.Sprintf("\tGococoFlush_%s()\n", randomID))
+	b.WriteString("\treturn code\n")
+	b.WriteString("}\n\n")
+
+	// The wrapped log function is only taken to keep the log import of
+	// the calling file in use.
+	for _, fatal := range []struct{ name, params, args, sprint string }{
+		{"Fatal", "v ...any", "...any", "fmt.Sprint(v...)"},
+		{"Fatalf", "format string, v ...any", "string, ...any", "fmt.Sprintf(format, v...)"},
+		{"Fatalln", "v ...any", "...any", "fmt.Sprintln(v...)"},
+	} {
+		b.WriteString(fmt.Sprintf("func Gococo%s_%s(func(%s)) func(%s) {\n", fatal.name, randomID, fatal.args, fatal.args))
+		b.WriteString(fmt.Sprintf("\treturn func(%s) {\n", fatal.params))
+		b.WriteString(fmt.Sprintf("\t\tlog.Output(2, %s)\n", fatal.sprint))
+		b.WriteString(fmt.Sprintf("\t\tos.Exit(GococoExit_%s(1))\n", randomID))
+		b.WriteString("\t}\n")
+		b.WriteString("}\n\n")
+	}
+
+	b.WriteString(fmt.Sprintf("func GococoNotify_%s(sigs ...os.Signal) []os.Signal {\n", randomID))
+	b.WriteString(fmt.Sprintf("\tgococoSignalMu_%s.Lock()\n", randomID))
+	b.WriteString("\tif len(sigs) == 0 {\n")
+	b.WriteString(fmt.Sprintf("\t\tgococoHandledAll_%s = true\n", randomID))
+	b.WriteString("\t}\n")
+	b.WriteString(fmt.Sprintf("\tgococoHandled_%s = append(gococoHandled_%s, sigs...)\n", randomID, randomID))
+	b.WriteString(fmt.Sprintf("\thook := gococoNotifyHook_%s\n", randomID))
+	b.WriteString(fmt.Sprintf("\tgococoSignalMu_%s.Unlock()\n", randomID))
+	b.WriteString("\tif hook != nil {\n")
+	b.WriteString("\t\thook()\n")
+	b.WriteString("\t}\n")
+	b.WriteString("\treturn sigs\n")
+	b.WriteString("}\n\n")
+
+	b.WriteString(fmt.Sprintf("func SetNotifyHook_%s(f func()) {\n", randomID))
+	b.WriteString(fmt.Sprintf("\tgococoSignalMu_%s.Lock()\n", randomID))
+	b.WriteString(fmt.Sprintf("\tgococoNotifyHook_%s = f\n", randomID))
+	b.WriteString(fmt.Sprintf("\tgococoSignalMu_%s.Unlock()\n", randomID))
+	b.WriteString("}\n\n")
+
+	b.WriteString(fmt.Sprintf("func SignalHandled_%s(sig os.Signal) bool {\n", randomID))
+	b.WriteString(fmt.Sprintf("\tgococoSignalMu_%s.Lock()\n", randomID))
+	b.WriteString(fmt.Sprintf("\tdefer gococoSignalMu_%s.Unlock()\n", randomID))
+	b.WriteString(fmt.Sprintf("\tif gococoHandledAll_%s {\n", randomID))
+	b.WriteString("\t\treturn true\n")
+	b.WriteString("\t}\n")
+	b.WriteString(fmt.Sprintf("\tfor _, s := range gococoHandled_%s {\n", randomID))
+	b.WriteString("\t\tif s == sig {\n")
+	b.WriteString("\t\t\treturn true\n")
+	b.WriteString("\t\t}\n")
+	b.WriteString("\t}\n")
+	b.WriteString("\treturn false\n")
+	b.WriteString("}\n")
+
+	return b.String()
+}
+
+// BuildExtRegisterDecl generates the Go source of the file that `gococo
+// toolexec` adds to a package instrumented outside the module. The package
+// cannot import gococodef, so it declares its own counter arrays and reaches
+// the coverdef registry and emitter through linknames. The rewritten files
+// call the local GococoEmit with file indices relative to the package, which
+// are offset by the base index returned at registration.
+func BuildExtRegisterDecl(pkgName string, coverDefImportPath string, files []*FileInstrumentation, randomID string, mode CoverMode) string {
+	var b strings.Builder
+
+	b.WriteString("// Code generated by gococo. DO NOT EDIT.\n\n")
+	b.WriteString(fmt.Sprintf("package %s\n\n", pkgName))
+	b.WriteString("import _ \"unsafe\"\n\n")
+
+	b.WriteString(fmt.Sprintf("//go:linkname gococoRegister_%s %s.GococoExtRegister_%s\n", randomID, coverDefImportPath, randomID))
+	b.WriteString(fmt.Sprintf("func gococoRegister_%s(files []string, counters [][]uint32, meta [][]int) int\n\n", randomID))
+	b.WriteString(fmt.Sprintf("//go:linkname gococoEmit_%s %s.GococoEmit_%s\n", randomID, coverDefImportPath, randomID))
+	b.WriteString(fmt.Sprintf("func gococoEmit_%s(fileIdx int, blockIdx int)\n\n", randomID))
+	if mode == ModeAtomic {
+		b.WriteString(fmt.Sprintf("//go:linkname GococoInc_%s %s.GococoInc_%s\n", randomID, coverDefImportPath, randomID))
+		b.WriteString(fmt.Sprintf("func GococoInc_%s(p *uint32)\n\n", randomID))
+	}
+
+	for i, fi := range files {
+		if len(fi.Blocks) == 0 {
+			continue
+		}
+		b.WriteString(fmt.Sprintf("var GococoCov_%s_%d [%d]uint32 // %s\n", randomID, i, len(fi.Blocks), fi.FilePath))
+	}
+	b.WriteString("\n")
+
+	b.WriteString(fmt.Sprintf("var gococoBase_%s = gococoRegister_%s(\n", randomID, randomID))
+	b.WriteString("\t[]string{\n")
+	for _, fi := range files {
+		b.WriteString(fmt.Sprintf("\t\t%s,\n", strconv.Quote(fi.FilePath)))
+	}
+	b.WriteString("\t},\n")
+	b.WriteString("\t[][]uint32{\n")
+	for i, fi := range files {
+		if len(fi.Blocks) == 0 {
+			b.WriteString("\t\tnil,\n")
+			continue
+		}
+		b.WriteString(fmt.Sprintf("\t\tGococoCov_%s_%d[:],\n", randomID, i))
+	}
+	b.WriteString("\t},\n")
+	b.WriteString("\t[][]int{\n")
+	for _, fi := range files {
+		b.WriteString("\t\t{")
+		for j, blk := range fi.Blocks {
+			if j > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString(fmt.Sprintf("%d, %d, %d, %d, %d", blk.StartLine, blk.StartCol, blk.EndLine, blk.EndCol, blk.NumStmts))
+		}
+		b.WriteString("},\n")
+	}
+	b.WriteString("\t},\n")
+	b.WriteString(")\n\n")
+
+	b.WriteString(fmt.Sprintf("func GococoEmit_%s(fileIdx int, blockIdx int) {\n", randomID))
+	b.WriteString(fmt.Sprintf("\tgococoEmit_%s(gococoBase_%s+fileIdx, blockIdx)\n", randomID, randomID))
+	b.WriteString("}\n")
+
+	return b.String()
+}
+
 func writeIntArray(b *strings.Builder, name string, n int, val func(int) int) {
 	b.WriteString(fmt.Sprintf("\t%s: [%d]int{", name, n))
 	for i := 0; i < n; i++ {
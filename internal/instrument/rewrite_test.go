@@ -25,7 +25,7 @@ func instrumentTestFile(t *testing.T, filename string) ([]byte, *FileInstrumenta
 	if err != nil {
 		t.Fatalf("read %s: %v", path, err)
 	}
-	rewritten, inst, err := InstrumentFile(src, path, "test/pkg", "GoCov_0", testRandomID, 0)
+	rewritten, inst, err := InstrumentFile(src, path, "test/pkg", "GoCov_0", testRandomID, 0, ModeCount, true)
 	if err != nil {
 		t.Fatalf("instrument %s: %v", path, err)
 	}
@@ -141,7 +141,7 @@ func TestInstrument_AllTestdataFiles(t *testing.T) {
 				t.Fatal(err)
 			}
 
-			rewritten, inst, err := InstrumentFile(origSrc, f, "test/pkg", "GoCov_0", testRandomID, 0)
+			rewritten, inst, err := InstrumentFile(origSrc, f, "test/pkg", "GoCov_0", testRandomID, 0, ModeCount, true)
 			if err != nil {
 				t.Fatalf("instrument failed: %v", err)
 			}
@@ -179,7 +179,7 @@ func main() {
 	}
 }
 `)
-	rewritten, inst, err := InstrumentFile(src, "main.go", "test/pkg", "GoCov_0", testRandomID, 0)
+	rewritten, inst, err := InstrumentFile(src, "main.go", "test/pkg", "GoCov_0", testRandomID, 0, ModeCount, true)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -224,7 +224,7 @@ func classify(x int) string {
 	}
 }
 `)
-	_, inst, err := InstrumentFile(src, "main.go", "test/pkg", "GoCov_0", testRandomID, 0)
+	_, inst, err := InstrumentFile(src, "main.go", "test/pkg", "GoCov_0", testRandomID, 0, ModeCount, true)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -262,7 +262,7 @@ func check(x int) string {
 	}
 }
 `)
-	_, inst, err := InstrumentFile(src, "main.go", "test/pkg", "GoCov_0", testRandomID, 0)
+	_, inst, err := InstrumentFile(src, "main.go", "test/pkg", "GoCov_0", testRandomID, 0, ModeCount, true)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -284,7 +284,7 @@ func sum(s []int) int {
 	return total
 }
 `)
-	_, inst, err := InstrumentFile(src, "main.go", "test/pkg", "GoCov_0", testRandomID, 0)
+	_, inst, err := InstrumentFile(src, "main.go", "test/pkg", "GoCov_0", testRandomID, 0, ModeCount, true)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -317,7 +317,7 @@ func TestBlockCount_EmptyFunc(t *testing.T) {
 	src := []byte(`package main
 func empty() {}
 `)
-	_, inst, err := InstrumentFile(src, "main.go", "test/pkg", "GoCov_0", testRandomID, 0)
+	_, inst, err := InstrumentFile(src, "main.go", "test/pkg", "GoCov_0", testRandomID, 0, ModeCount, true)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -338,7 +338,7 @@ func f() {
 	_ = a + b
 }
 `)
-	_, inst, err := InstrumentFile(src, "main.go", "test/pkg", "GoCov_0", testRandomID, 0)
+	_, inst, err := InstrumentFile(src, "main.go", "test/pkg", "GoCov_0", testRandomID, 0, ModeCount, true)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -361,7 +361,7 @@ func f(x int) int {
 	}
 }
 `)
-	_, inst, err := InstrumentFile(src, "main.go", "test/pkg", "GoCov_0", testRandomID, 0)
+	_, inst, err := InstrumentFile(src, "main.go", "test/pkg", "GoCov_0", testRandomID, 0, ModeCount, true)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -385,7 +385,7 @@ func f(a, b <-chan int) int {
 	}
 }
 `)
-	_, inst, err := InstrumentFile(src, "main.go", "test/pkg", "GoCov_0", testRandomID, 0)
+	_, inst, err := InstrumentFile(src, "main.go", "test/pkg", "GoCov_0", testRandomID, 0, ModeCount, true)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -402,7 +402,7 @@ func f(x int) {
 	}
 }
 `)
-	_, inst, err := InstrumentFile(src, "main.go", "test/pkg", "GoCov_0", testRandomID, 0)
+	_, inst, err := InstrumentFile(src, "main.go", "test/pkg", "GoCov_0", testRandomID, 0, ModeCount, true)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -428,7 +428,7 @@ func f(n int) int {
 	return sum
 }
 `)
-	_, inst, err := InstrumentFile(src, "main.go", "test/pkg", "GoCov_0", testRandomID, 0)
+	_, inst, err := InstrumentFile(src, "main.go", "test/pkg", "GoCov_0", testRandomID, 0, ModeCount, true)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -450,7 +450,7 @@ func f() int {
 	return x
 }
 `)
-	rewritten, inst, err := InstrumentFile(src, "main.go", "test/pkg", "GoCov_0", testRandomID, 0)
+	rewritten, inst, err := InstrumentFile(src, "main.go", "test/pkg", "GoCov_0", testRandomID, 0, ModeCount, true)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -470,7 +470,7 @@ func f(x int) int {
 	return x
 }
 `)
-	_, inst, err := InstrumentFile(src, "main.go", "test/pkg", "GoCov_0", testRandomID, 0)
+	_, inst, err := InstrumentFile(src, "main.go", "test/pkg", "GoCov_0", testRandomID, 0, ModeCount, true)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -480,6 +480,155 @@ func f(x int) int {
 	}
 }
 
+// TestCounterPlacement_AfterEarlyReturn verifies that the counter of a block
+// following an early return is placed at that block, not at function entry.
+func TestCounterPlacement_AfterEarlyReturn(t *testing.T) {
+	src := []byte(`package main
+func f(x int) int {
+	if x < 0 {
+		return -1
+	}
+	return x
+}
+`)
+	out, inst, err := InstrumentFile(src, "main.go", "test/pkg", "GoCov_0", testRandomID, 0, ModeCount, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := -1
+	for i, b := range inst.Blocks {
+		if b.StartLine == 6 {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		t.Fatalf("no block for `return x`: %+v", inst.Blocks)
+	}
+	counter := fmt.Sprintf("GococoCov_%s_0[%d]++; GococoEmit_%s(0, %d);", testRandomID, idx, testRandomID, idx)
+	if !strings.Contains(string(out), counter+"return x") {
+		t.Errorf("counter %d not placed before `return x`:\n%s", idx, out)
+	}
+}
+
+// TestBlockCount_NestedInCase verifies that blocks nested in case and comm
+// clauses are instrumented.
+func TestBlockCount_NestedInCase(t *testing.T) {
+	src := []byte(`package main
+func f(x int, ch chan int) int {
+	switch x {
+	case 1:
+		if x > 0 {
+			return 1
+		}
+	}
+	select {
+	case v := <-ch:
+		for v > 0 {
+			v--
+		}
+	}
+	return 0
+}
+`)
+	_, inst, err := InstrumentFile(src, "main.go", "test/pkg", "GoCov_0", testRandomID, 0, ModeCount, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []int{6, 12} {
+		found := false
+		for _, b := range inst.Blocks {
+			if b.StartLine == line {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("expected a block starting on line %d, got %+v", line, inst.Blocks)
+		}
+	}
+}
+
+// =============================================================================
+// Layer 3b: //gococo:ignore directives
+// =============================================================================
+
+func TestIgnore_File(t *testing.T) {
+	src := []byte(`//gococo:ignore
+
+package main
+
+func f() int { return 1 }
+`)
+	out, inst, err := InstrumentFile(src, "main.go", "test/pkg", "GoCov_0", testRandomID, 0, ModeCount, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inst.Blocks) != 0 || string(out) != string(src) {
+		t.Errorf("ignored file was instrumented: %d blocks", len(inst.Blocks))
+	}
+}
+
+func TestIgnore_Function(t *testing.T) {
+	src := []byte(`package main
+
+// debugDump is only used while debugging.
+//
+//gococo:ignore
+func debugDump(x int) {
+	if x > 0 {
+		println(x)
+	}
+}
+
+func g() int { return 1 }
+`)
+	_, inst, err := InstrumentFile(src, "main.go", "test/pkg", "GoCov_0", testRandomID, 0, ModeCount, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inst.Blocks) != 1 || inst.Blocks[0].StartLine != 12 {
+		t.Errorf("expected only g to be instrumented, got %+v", inst.Blocks)
+	}
+}
+
+func TestIgnore_Statements(t *testing.T) {
+	src := []byte(`package main
+
+func f(x int) int {
+	a := x + 1
+	if a < 0 { //gococo:ignore unreachable
+		panic("unreachable")
+	}
+	b := a * 2
+	//gococo:ignore
+	println("debug", b)
+	switch b {
+	case 1:
+		return 1
+	default: //gococo:ignore
+		panic("unreachable")
+	}
+}
+`)
+	_, inst, err := InstrumentFile(src, "main.go", "test/pkg", "GoCov_0", testRandomID, 0, ModeCount, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	total := 0
+	for _, b := range inst.Blocks {
+		total += b.NumStmts
+		for _, line := range []int{5, 6, 10, 14, 15} {
+			if b.StartLine == line {
+				t.Errorf("block starting at ignored line %d: %+v", line, b)
+			}
+		}
+	}
+	// a := ..., b := ..., switch, return 1
+	if total != 4 {
+		t.Errorf("expected 4 counted statements, got %d: %+v", total, inst.Blocks)
+	}
+}
+
 // =============================================================================
 // Layer 4: Global coverage variable declaration
 // =============================================================================
@@ -503,7 +652,7 @@ func TestBuildGlobalCoverVarDecl(t *testing.T) {
 		},
 	}
 
-	decl := BuildGlobalCoverVarDecl(files, testRandomID)
+	decl := BuildGlobalCoverVarDecl(files, testRandomID, ModeCount)
 
 	// Must be valid Go
 	fset := token.NewFileSet()
@@ -515,11 +664,11 @@ func TestBuildGlobalCoverVarDecl(t *testing.T) {
 
 	// Must contain expected symbols
 	expectedSymbols := []string{
-		"GococoBlock_" + testRandomID,
 		"GococoEmit_" + testRandomID,
 		"GococoCov_" + testRandomID,
 		"SetEnabled_" + testRandomID,
-		"EventChan_" + testRandomID,
+		"FileName_" + testRandomID,
+		"NumFiles_" + testRandomID,
 		"BlockMeta_" + testRandomID,
 	}
 	for _, sym := range expectedSymbols {
@@ -537,6 +686,142 @@ func TestBuildGlobalCoverVarDecl(t *testing.T) {
 	}
 }
 
+// TestBuildEventSupportDecl verifies the event recording file, with and
+// without the runtime offsets that locate goroutine IDs.
+func TestBuildEventSupportDecl(t *testing.T) {
+	for _, offsets := range []*RuntimeOffsets{nil, {Curg: 192, Goid: 152}} {
+		decl := BuildEventSupportDecl(testRandomID, offsets)
+
+		fset := token.NewFileSet()
+		if _, err := parser.ParseFile(fset, "events.go", decl, parser.AllErrors); err != nil {
+			t.Logf("Generated code:\n%s", decl)
+			t.Fatalf("generated events file is not valid Go: %v", err)
+		}
+		for _, sym := range []string{
+			"GococoEvent_" + testRandomID,
+			"ReadEvents_" + testRandomID,
+			"Dropped_" + testRandomID,
+			"gococoPush_" + testRandomID,
+		} {
+			if !strings.Contains(decl, sym) {
+				t.Errorf("missing symbol %q in generated events file", sym)
+			}
+		}
+		if fast := strings.Contains(decl, "runtime.getm"); fast != (offsets != nil) {
+			t.Errorf("with offsets %v: uses runtime.getm = %v", offsets, fast)
+		}
+		if offsets != nil && !strings.Contains(decl, "+ 192))") {
+			t.Errorf("curg offset not used:\n%s", decl)
+		}
+	}
+}
+
+// TestBuildExtRegisterDecl verifies the registration file generated for
+// packages instrumented by gococo toolexec.
+func TestBuildExtRegisterDecl(t *testing.T) {
+	files := []*FileInstrumentation{
+		{
+			FilePath: "example.com/lib/a.go",
+			Blocks: []BlockInfo{
+				{StartLine: 3, StartCol: 2, EndLine: 5, EndCol: 2, NumStmts: 2},
+			},
+		},
+		{FilePath: "example.com/lib/empty.go"},
+	}
+
+	decl := BuildExtRegisterDecl("lib", "test/pkg/gococodef", files, testRandomID, ModeCount)
+
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "register.go", decl, parser.AllErrors)
+	if err != nil {
+		t.Logf("Generated code:\n%s", decl)
+		t.Fatalf("generated register file is not valid Go: %v", err)
+	}
+	if f.Name.Name != "lib" {
+		t.Errorf("package = %s, want lib", f.Name.Name)
+	}
+
+	for _, want := range []string{
+		"//go:linkname gococoRegister_" + testRandomID + " test/pkg/gococodef.GococoExtRegister_" + testRandomID,
+		"//go:linkname gococoEmit_" + testRandomID + " test/pkg/gococodef.GococoEmit_" + testRandomID,
+		"var GococoCov_" + testRandomID + "_0 [1]uint32",
+		"{3, 2, 5, 2, 2},",
+		"\t\tnil,\n",
+	} {
+		if !strings.Contains(decl, want) {
+			t.Errorf("missing %q in generated register file:\n%s", want, decl)
+		}
+	}
+	if strings.Contains(decl, "GococoCov_"+testRandomID+"_1") {
+		t.Error("counters declared for a file without blocks")
+	}
+}
+
+// TestCoverModes verifies the counter statements and runtime declarations
+// generated for each cover mode.
+func TestCoverModes(t *testing.T) {
+	src := []byte(`package main
+
+func f() int {
+	return 1
+}
+`)
+	files := []*FileInstrumentation{{
+		FilePath: "test/pkg/main.go",
+		Blocks:   []BlockInfo{{StartLine: 3, StartCol: 14, EndLine: 5, EndCol: 2, NumStmts: 1}},
+	}}
+	cov := "GococoCov_" + testRandomID + "_0[0]"
+
+	tests := []struct {
+		mode    CoverMode
+		counter string
+		decl    []string
+	}{
+		{ModeSet, cov + " = 1", nil},
+		{ModeCount, cov + "++", nil},
+		{ModeAtomic, "GococoInc_" + testRandomID + "(&" + cov + ")", []string{
+			`"sync/atomic"`,
+			"func GococoInc_" + testRandomID + "(p *uint32)",
+			"atomic.LoadInt32(&gococoEnabled_" + testRandomID + ")",
+			"atomic.LoadUint32(&",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			rewritten, _, err := InstrumentFile(src, "main.go", "test/pkg", "GoCov_0", testRandomID, 0, tt.mode, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(rewritten), tt.counter) {
+				t.Errorf("missing %q in:\n%s", tt.counter, rewritten)
+			}
+
+			decl := BuildGlobalCoverVarDecl(files, testRandomID, tt.mode)
+			if _, err := parser.ParseFile(token.NewFileSet(), "coverdef.go", decl, parser.AllErrors); err != nil {
+				t.Fatalf("generated coverdef is not valid Go: %v\n%s", err, decl)
+			}
+			for _, want := range tt.decl {
+				if !strings.Contains(decl, want) {
+					t.Errorf("missing %q in generated coverdef", want)
+				}
+			}
+			if tt.mode != ModeAtomic && strings.Contains(decl, "sync/atomic") {
+				t.Errorf("%s mode imports sync/atomic", tt.mode)
+			}
+
+			reg := BuildExtRegisterDecl("lib", "test/pkg/gococodef", files, testRandomID, tt.mode)
+			hasInc := strings.Contains(reg, "test/pkg/gococodef.GococoInc_"+testRandomID)
+			if hasInc != (tt.mode == ModeAtomic) {
+				t.Errorf("register file links GococoInc = %v, want %v", hasInc, tt.mode == ModeAtomic)
+			}
+		})
+	}
+
+	if _, err := ParseCoverMode("bogus"); err == nil {
+		t.Error("ParseCoverMode accepted an invalid mode")
+	}
+}
+
 // =============================================================================
 // Layer 5: Instrumented source preserves original AST structure
 // =============================================================================
@@ -564,7 +849,7 @@ func TestOriginalFunctionsPreserved(t *testing.T) {
 			}
 
 			// Instrument
-			rewritten, _, err := InstrumentFile(origSrc, f, "test/pkg", "GoCov_0", testRandomID, 0)
+			rewritten, _, err := InstrumentFile(origSrc, f, "test/pkg", "GoCov_0", testRandomID, 0, ModeCount, true)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -607,7 +892,7 @@ func main() {
 	}
 }
 `)
-	rewritten, inst, err := InstrumentFile(src, "main.go", "test/pkg", "GoCov_0", testRandomID, 0)
+	rewritten, inst, err := InstrumentFile(src, "main.go", "test/pkg", "GoCov_0", testRandomID, 0, ModeCount, true)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -630,3 +915,149 @@ func main() {
 		t.Fatalf("final instrumented code is not parseable: %v", err)
 	}
 }
+
+// TestRenameTestMain verifies that a user TestMain is renamed so the
+// generated one can wrap it, and that methods named TestMain are left alone.
+func TestRenameTestMain(t *testing.T) {
+	src := []byte(`package pkg_test
+
+import "testing"
+
+type suite struct{}
+
+func (suite) TestMain() {}
+
+func TestMain(m *testing.M) {
+	m.Run()
+}
+`)
+	renamed, ok, err := renameTestMain(src, "pkg_test.go", "gococoTestMain_x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("TestMain not found")
+	}
+	assertParseable(t, "pkg_test.go", renamed)
+	if !strings.Contains(string(renamed), "func gococoTestMain_x(m *testing.M)") {
+		t.Errorf("TestMain not renamed:\n%s", renamed)
+	}
+	if !strings.Contains(string(renamed), "func (suite) TestMain()") {
+		t.Errorf("method TestMain should not be renamed:\n%s", renamed)
+	}
+
+	_, ok, err = renameTestMain([]byte("package pkg\n\nfunc TestX() {}\n"), "x_test.go", "gococoTestMain_x")
+	if err != nil || ok {
+		t.Errorf("expected no TestMain, got ok=%v err=%v", ok, err)
+	}
+}
+
+// TestInstrumentTestFile verifies that tests, subtests and helpers taking a
+// single *testing.T are hooked, and that other functions are not.
+func TestInstrumentTestFile(t *testing.T) {
+	src := []byte(`package pkg
+
+import tst "testing"
+
+func TestA(t *tst.T) {
+	t.Run("sub", func(tt *tst.T) {})
+}
+
+func helper(t *tst.T, n int) {}
+
+func BenchmarkB(b *tst.B) {}
+
+func TestUnnamed(*tst.T) {}
+`)
+	rewritten, hooks, err := InstrumentTestFile(src, "a_test.go", testRandomID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertParseable(t, "a_test.go", rewritten)
+	if hooks != 2 {
+		t.Errorf("expected 2 hooks (TestA and its subtest), got %d:\n%s", hooks, rewritten)
+	}
+	for _, want := range []string{
+		"defer GococoTestEnter_" + testRandomID + "(t)()",
+		"defer GococoTestEnter_" + testRandomID + "(tt)()",
+	} {
+		if !strings.Contains(string(rewritten), want) {
+			t.Errorf("missing %q in:\n%s", want, rewritten)
+		}
+	}
+
+	decl := BuildTestSupportDecl(testRandomID)
+	if _, err := parser.ParseFile(token.NewFileSet(), "testing.go", decl, parser.AllErrors); err != nil {
+		t.Fatalf("generated test support is not valid Go: %v\n%s", err, decl)
+	}
+}
+
+func TestInstrumentExits(t *testing.T) {
+	src := []byte(`package main
+
+import (
+	"context"
+	stdlog "log"
+	sys "os"
+	"os/signal"
+)
+
+func main() {
+	defer stdlog.Fatalln("done")
+	c := make(chan sys.Signal, 1)
+	signal.Notify(c, sys.Interrupt)
+	signal.Notify(c)
+	sigs := []sys.Signal{sys.Interrupt}
+	ctx, stop := signal.NotifyContext(context.Background(), sigs...)
+	defer stop()
+	<-ctx.Done()
+	exit := sys.Exit
+	exit(0)
+	sys.Exit(1 +
+		1)
+	stdlog.Printf("%d", 2)
+	stdlog.Fatalf("%d", 2)
+}
+
+func (s server) main() {}
+`)
+	rewritten, hooks, err := InstrumentExits(src, "main.go", testRandomID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertParseable(t, "main.go", rewritten)
+	if hooks != 7 {
+		t.Errorf("expected 7 hooks, got %d:\n%s", hooks, rewritten)
+	}
+	for _, want := range []string{
+		"func main() {defer GococoFlush_" + testRandomID + "();",
+		"signal.Notify(c, GococoNotify_" + testRandomID + "(sys.Interrupt)...)",
+		"signal.Notify(c, GococoNotify_" + testRandomID + "()...)",
+		"signal.NotifyContext(context.Background(), GococoNotify_" + testRandomID + "(sigs...)...)",
+		"sys.Exit(GococoExit_" + testRandomID + "(1 +\n\t\t1))",
+		"exit := sys.Exit\n",
+		"defer GococoFatalln_" + testRandomID + "(stdlog.Fatalln)(\"done\")",
+		"stdlog.Printf(\"%d\", 2)",
+		"GococoFatalf_" + testRandomID + "(stdlog.Fatalf)(\"%d\", 2)",
+		"func (s server) main() {}",
+	} {
+		if !strings.Contains(string(rewritten), want) {
+			t.Errorf("missing %q in:\n%s", want, rewritten)
+		}
+	}
+
+	// Outside package main, only exits are hooked.
+	lib := []byte("package lib\n\nimport \"os\"\n\nfunc main() { os.Exit(3) }\n")
+	rewritten, hooks, err = InstrumentExits(lib, "lib.go", testRandomID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hooks != 1 || strings.Contains(string(rewritten), "GococoFlush_") {
+		t.Errorf("expected only os.Exit to be hooked, got %d hooks:\n%s", hooks, rewritten)
+	}
+
+	decl := BuildExitSupportDecl(testRandomID)
+	if _, err := parser.ParseFile(token.NewFileSet(), "exit.go", decl, parser.AllErrors); err != nil {
+		t.Fatalf("generated exit support is not valid Go: %v\n%s", err, decl)
+	}
+}
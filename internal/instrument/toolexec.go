@@ -0,0 +1,298 @@
+package instrument
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// toolexecConfig is written by Run and read by every `gococo toolexec`
+// invocation of the build.
+type toolexecConfig struct {
+	RandomID           string
+	CoverDefImportPath string
+	CoverMode          CoverMode
+	NoEvents           bool
+	Patterns           []string // import path patterns to instrument
+	Skip               []string // packages instrumented through the overlay
+	WorkDir            string   // where rewritten sources are written
+	Filter             fileFilter
+}
+
+// neverInstrument lists standard library packages that the coverage runtime
+// itself depends on, that cannot call back into ordinary Go code, or whose
+// code is checksummed at run time (the FIPS 140 module).
+var neverInstrument = []string{
+	"runtime", "runtime/...",
+	"internal/...", "vendor/...",
+	"unsafe", "sync", "sync/atomic", "syscall",
+	"crypto/internal/fips140/...",
+}
+
+// writeToolexecConfig saves the toolexec configuration for a build and
+// returns the value for `go build -toolexec`.
+func writeToolexecConfig(dir string, cfg *toolexecConfig) (string, error) {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	cfgPath := filepath.Join(dir, "toolexec.json")
+	if err := os.WriteFile(cfgPath, data, 0644); err != nil {
+		return "", err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return quoteToolexecArg(exe) + " toolexec " + quoteToolexecArg(cfgPath), nil
+}
+
+// quoteToolexecArg quotes s for the -toolexec flag, which the go command
+// splits on spaces but honours single and double quotes.
+func quoteToolexecArg(s string) string {
+	if !strings.ContainsAny(s, " \t\"'") {
+		return s
+	}
+	if !strings.Contains(s, "'") {
+		return "'" + s + "'"
+	}
+	return `"` + s + `"`
+}
+
+// Toolexec runs tool with args on behalf of the go command. It is the entry
+// point of `gococo toolexec CONFIG TOOL ARGS...`, which Run installs with
+// -toolexec when Options.Toolexec is set.
+//
+// Compilations of packages matching the configured patterns are given
+// rewritten sources plus a file that registers the package's counters with
+// the coverdef package of the build. All other tool invocations are passed
+// through unchanged. The tool's exit status is returned as an
+// *exec.ExitError.
+func Toolexec(cfgPath string, tool string, args []string) error {
+	data, err := os.ReadFile(cfgPath)
+	if err != nil {
+		return err
+	}
+	var cfg toolexecConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("parse %s: %w", cfgPath, err)
+	}
+
+	if strings.TrimSuffix(filepath.Base(tool), ".exe") != "compile" {
+		return runTool(tool, args)
+	}
+	if len(args) == 1 && args[0] == "-V=full" {
+		return printToolID(tool, &cfg)
+	}
+
+	importPath := flagValue(args, "-p")
+	if !cfg.shouldInstrument(importPath) {
+		return runTool(tool, args)
+	}
+	newArgs, err := instrumentCompile(&cfg, importPath, args)
+	if err != nil {
+		return fmt.Errorf("gococo: instrument %s: %w", importPath, err)
+	}
+	return runTool(tool, newArgs)
+}
+
+// printToolID prints the compiler's -V=full line with the configuration and
+// the gococo executable appended. The go command keys its build cache on this
+// line, so packages compiled with different instrumentation, or by a
+// different version of the rewriter, never share cache entries.
+func printToolID(tool string, cfg *toolexecConfig) error {
+	out, err := exec.Command(tool, "-V=full").Output()
+	if err != nil {
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	id, err := toolID(cfg, exe)
+	if err != nil {
+		return err
+	}
+
+	line := strings.TrimSpace(string(out))
+	if f := strings.Fields(line); strings.HasPrefix(f[len(f)-1], "buildID=") {
+		// Development toolchains are identified by the content ID at the
+		// end of the build ID.
+		line += "-" + id
+	} else {
+		line += " " + id
+	}
+	fmt.Println(line)
+	return nil
+}
+
+// toolID identifies the instrumentation of cfg by the gococo executable exe.
+// The executable is identified by its size and modification time, which
+// change whenever it is rebuilt, as reading it for every compilation would
+// be slow.
+func toolID(cfg *toolexecConfig, exe string) (string, error) {
+	fi, err := os.Stat(exe)
+	if err != nil {
+		return "", err
+	}
+	key := *cfg
+	key.WorkDir = ""
+	data, _ := json.Marshal(key)
+	self := fmt.Sprintf(" %d %d", fi.Size(), fi.ModTime().UnixNano())
+	return "gococo" + hashString(string(data)+self), nil
+}
+
+// shouldInstrument reports whether the package compiled with -p importPath
+// is to be rewritten.
+func (cfg *toolexecConfig) shouldInstrument(importPath string) bool {
+	if importPath == "" || importPath == "main" ||
+		strings.HasSuffix(importPath, "_test") || strings.HasSuffix(importPath, ".test") {
+		return false
+	}
+	for _, p := range neverInstrument {
+		if matchPackagePattern(p, importPath) {
+			return false
+		}
+	}
+	for _, p := range cfg.Skip {
+		if p == importPath {
+			return false
+		}
+	}
+	for _, p := range cfg.Patterns {
+		if matchPackagePattern(p, importPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// instrumentCompile rewrites the Go files of a compile command line and
+// returns the arguments to compile the instrumented package with.
+func instrumentCompile(cfg *toolexecConfig, importPath string, args []string) ([]string, error) {
+	if err := os.MkdirAll(cfg.WorkDir, 0755); err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp(cfg.WorkDir, "pkg-*")
+	if err != nil {
+		return nil, err
+	}
+
+	// The go command passes the package's source files last.
+	first := len(args)
+	for first > 0 && strings.HasSuffix(args[first-1], ".go") && !strings.HasPrefix(args[first-1], "-") {
+		first--
+	}
+
+	var files []*FileInstrumentation
+	var pkgName string
+	newArgs := make([]string, 0, len(args)+1)
+	for _, a := range args[:first] {
+		// The register file declares bodyless functions, which -complete
+		// would reject.
+		if a != "-complete" {
+			newArgs = append(newArgs, a)
+		}
+	}
+	for _, a := range args[first:] {
+		if isGeneratedByGo(a) {
+			newArgs = append(newArgs, a)
+			continue
+		}
+		a, err := filepath.Abs(a)
+		if err != nil {
+			return nil, err
+		}
+
+		src, err := os.ReadFile(a)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.Filter.skipReason(importPath, a, src) != "" {
+			newArgs = append(newArgs, a)
+			continue
+		}
+		if pkgName == "" {
+			f, err := parser.ParseFile(token.NewFileSet(), a, src, parser.PackageClauseOnly)
+			if err != nil {
+				return nil, err
+			}
+			pkgName = f.Name.Name
+		}
+
+		fileIdx := len(files)
+		varName := GenerateCoverVarName(importPath, fileIdx)
+		rewritten, inst, err := InstrumentFile(src, a, importPath, varName, cfg.RandomID, fileIdx, cfg.CoverMode, !cfg.NoEvents)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, inst)
+		if len(inst.Blocks) == 0 {
+			newArgs = append(newArgs, a)
+			continue
+		}
+
+		out := filepath.Join(dir, fmt.Sprintf("%d_%s", fileIdx, filepath.Base(a)))
+		rewritten = append([]byte(lineDirective(a)), rewritten...)
+		if err := os.WriteFile(out, rewritten, 0644); err != nil {
+			return nil, err
+		}
+		newArgs = append(newArgs, out)
+	}
+	if countBlocks(files) == 0 {
+		return args, nil
+	}
+
+	regPath := filepath.Join(dir, "gococo_register_"+cfg.RandomID+".go")
+	regSrc := BuildExtRegisterDecl(pkgName, cfg.CoverDefImportPath, files, cfg.RandomID, cfg.CoverMode)
+	if err := os.WriteFile(regPath, []byte(regSrc), 0644); err != nil {
+		return nil, err
+	}
+	return append(newArgs, regPath), nil
+}
+
+// isGeneratedByGo reports whether a source file was produced by the go
+// command itself (cgo output, test mains), which lives in its work directory.
+func isGeneratedByGo(file string) bool {
+	return strings.HasPrefix(filepath.Base(filepath.Dir(filepath.Dir(file))), "go-build")
+}
+
+// flagValue returns the value of a flag given as "-name value" or
+// "-name=value".
+func flagValue(args []string, name string) string {
+	for i, a := range args {
+		if a == name && i+1 < len(args) {
+			return args[i+1]
+		}
+		if v, ok := strings.CutPrefix(a, name+"="); ok {
+			return v
+		}
+	}
+	return ""
+}
+
+// matchPackagePattern reports whether importPath matches pattern, where
+// "..." matches any string as in `go list` patterns, and a trailing "/..."
+// also matches the path without it.
+func matchPackagePattern(pattern, importPath string) bool {
+	re := regexp.QuoteMeta(pattern)
+	re = strings.ReplaceAll(re, `\.\.\.`, `.*`)
+	if strings.HasSuffix(re, `/.*`) {
+		re = strings.TrimSuffix(re, `/.*`) + `(/.*)?`
+	}
+	return regexp.MustCompile(`^` + re + `$`).MatchString(importPath)
+}
+
+func runTool(tool string, args []string) error {
+	cmd := exec.Command(tool, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
@@ -0,0 +1,84 @@
+package instrument
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMatchPackagePattern(t *testing.T) {
+	tests := []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"net/http", "net/http", true},
+		{"net/http", "net/http/httptest", false},
+		{"net/...", "net", true},
+		{"net/...", "net/http", true},
+		{"net/...", "netip", false},
+		{"example.com/...", "example.com/lib/sub", true},
+		{"example.com/.../internal", "example.com/a/b/internal", true},
+		{"...", "strings", true},
+	}
+	for _, tt := range tests {
+		if got := matchPackagePattern(tt.pattern, tt.path); got != tt.want {
+			t.Errorf("matchPackagePattern(%q, %q) = %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestShouldInstrument(t *testing.T) {
+	cfg := &toolexecConfig{
+		Patterns: []string{"..."},
+		Skip:     []string{"example.com/app", "example.com/app/gococodef"},
+	}
+	for path, want := range map[string]bool{
+		"net/http":                  true,
+		"example.com/lib":           true,
+		"example.com/app":           false,
+		"example.com/app/gococodef": false,
+		"main":                      false,
+		"runtime":                   false,
+		"runtime/debug":             false,
+		"internal/abi":              false,
+		"sync/atomic":               false,
+		"example.com/lib_test":      false,
+		"":                          false,
+	} {
+		if got := cfg.shouldInstrument(path); got != want {
+			t.Errorf("shouldInstrument(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestToolID(t *testing.T) {
+	dir := t.TempDir()
+	exe := filepath.Join(dir, "gococo")
+	if err := os.WriteFile(exe, []byte("v1"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	id := func(cfg toolexecConfig) string {
+		t.Helper()
+		id, err := toolID(&cfg, exe)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+
+	base := id(toolexecConfig{RandomID: "abc", WorkDir: "/tmp/a"})
+	if got := id(toolexecConfig{RandomID: "abc", WorkDir: "/tmp/b"}); got != base {
+		t.Errorf("ID depends on the work directory: %s != %s", got, base)
+	}
+	if got := id(toolexecConfig{RandomID: "abd"}); got == base {
+		t.Errorf("ID does not depend on the configuration")
+	}
+	// A rebuilt executable has a new modification time.
+	if err := os.Chtimes(exe, time.Time{}, time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if got := id(toolexecConfig{RandomID: "abc"}); got == base {
+		t.Errorf("ID does not depend on the gococo executable")
+	}
+}
@@ -0,0 +1,281 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Version 3 event streams are binary, with the media type BinaryMediaType.
+// A stream starts with the magic bytes "GCEV" and the version as a uvarint,
+// followed by frames:
+//
+//	LENGTH TYPE PAYLOAD
+//
+// LENGTH is a uvarint counting the bytes of TYPE and PAYLOAD, at most
+// MaxFrameSize, and TYPE is a byte. Payloads are made of uvarints and, for
+// the deltas, zigzag varints, as in encoding/binary:
+//
+//	event:   SEQ_DELTA TIMESTAMP_DELTA GID_DELTA FILE BLOCK TEST
+//	test:    ID NAME
+//	dropped: COUNT
+//
+// The deltas of an event are relative to the previous event of the stream,
+// or to zero. FILE is the ID the agent gave to the event's file in a #file
+// line at register-blocks. TEST is zero, or the ID of the running test
+// named by an earlier test frame, whose NAME is the rest of the frame. Names
+// longer than MaxTestName bytes are cut to that length.
+// Dropped frames report the number of events the agent dropped so far.
+//
+// Frames of unknown types and payload bytes beyond the known fields are
+// skipped, for agents newer than the server.
+
+// BinaryMediaType is the media type of version 3 event streams.
+const BinaryMediaType = "application/x-gococo-events"
+
+// MaxFrameSize is the largest LENGTH of a binary frame.
+const MaxFrameSize = 1 << 16
+
+// MaxTestName is the length test names are cut to, so that test frames
+// stay within MaxFrameSize.
+const MaxTestName = 1 << 15
+
+const binaryMagic = "GCEV"
+
+// Binary frame types.
+const (
+	frameEvent   = 1
+	frameTest    = 2
+	frameDropped = 3
+)
+
+// BinaryEvent is an event of a version 3 stream, whose file is identified
+// by the ID registered for it.
+type BinaryEvent struct {
+	Seq       uint64
+	Timestamp int64
+	GID       int64
+	File      uint64
+	BlockIdx  int
+	Test      string
+}
+
+// Encoder writes a version 3 event stream.
+type Encoder struct {
+	w       io.Writer
+	started bool
+	prev    BinaryEvent
+	tests   map[string]uint64
+	frame   []byte
+	buf     []byte
+}
+
+// NewEncoder returns an Encoder writing to w. The stream header is written
+// with the first frame.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w, tests: make(map[string]uint64)}
+}
+
+// Encode writes an event, preceded by a test frame the first time its test
+// is seen. The test frame names at most MaxTestName bytes of the test.
+func (e *Encoder) Encode(ev *BinaryEvent) error {
+	var test uint64
+	if ev.Test != "" {
+		var ok bool
+		if test, ok = e.tests[ev.Test]; !ok {
+			test = uint64(len(e.tests) + 1)
+			e.tests[ev.Test] = test
+			name := ev.Test
+			if len(name) > MaxTestName {
+				name = name[:MaxTestName]
+			}
+			e.frame = append(binary.AppendUvarint(e.frame[:0], test), name...)
+			if err := e.writeFrame(frameTest); err != nil {
+				return err
+			}
+		}
+	}
+	p := binary.AppendUvarint(e.frame[:0], ev.Seq-e.prev.Seq)
+	p = binary.AppendVarint(p, ev.Timestamp-e.prev.Timestamp)
+	p = binary.AppendVarint(p, ev.GID-e.prev.GID)
+	p = binary.AppendUvarint(p, ev.File)
+	p = binary.AppendUvarint(p, uint64(ev.BlockIdx))
+	e.frame = binary.AppendUvarint(p, test)
+	e.prev = *ev
+	return e.writeFrame(frameEvent)
+}
+
+// EncodeDropped writes the number of events dropped so far.
+func (e *Encoder) EncodeDropped(n uint64) error {
+	e.frame = binary.AppendUvarint(e.frame[:0], n)
+	return e.writeFrame(frameDropped)
+}
+
+// writeFrame writes e.frame as the payload of a frame of type typ.
+func (e *Encoder) writeFrame(typ byte) error {
+	if len(e.frame)+1 > MaxFrameSize {
+		return fmt.Errorf("frame of %d bytes exceeds %d", len(e.frame)+1, MaxFrameSize)
+	}
+	e.buf = e.buf[:0]
+	if !e.started {
+		e.buf = binary.AppendUvarint(append(e.buf, binaryMagic...), VersionBinary)
+		e.started = true
+	}
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(e.frame)+1))
+	e.buf = append(append(e.buf, typ), e.frame...)
+	_, err := e.w.Write(e.buf)
+	return err
+}
+
+// Decoder reads a version 3 event stream.
+type Decoder struct {
+	r       *bufio.Reader
+	started bool
+	prev    BinaryEvent
+	tests   map[uint64]string
+	dropped uint64
+	frame   []byte
+}
+
+// NewDecoder returns a Decoder reading from r.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r), tests: make(map[uint64]string)}
+}
+
+// Next returns the next event of the stream. It returns io.EOF at the end
+// of the stream, and io.ErrUnexpectedEOF if the stream ends within a frame.
+// After any other error, the rest of the stream cannot be decoded.
+func (d *Decoder) Next() (BinaryEvent, error) {
+	if !d.started {
+		if err := d.readHeader(); err != nil {
+			return BinaryEvent{}, err
+		}
+		d.started = true
+	}
+	for {
+		typ, p, err := d.readFrame()
+		if err != nil {
+			return BinaryEvent{}, err
+		}
+		switch typ {
+		case frameEvent:
+			return d.decodeEvent(p)
+		case frameTest:
+			id, p, err := uvarint(p)
+			if err != nil {
+				return BinaryEvent{}, fmt.Errorf("invalid test frame: %w", err)
+			}
+			if id == 0 {
+				return BinaryEvent{}, errors.New("invalid test frame: test ID 0")
+			}
+			d.tests[id] = string(p)
+		case frameDropped:
+			n, _, err := uvarint(p)
+			if err != nil {
+				return BinaryEvent{}, fmt.Errorf("invalid dropped frame: %w", err)
+			}
+			d.dropped = n
+		}
+	}
+}
+
+// Dropped returns the number of dropped events last reported by the stream.
+func (d *Decoder) Dropped() uint64 {
+	return d.dropped
+}
+
+func (d *Decoder) readHeader() error {
+	var magic [len(binaryMagic)]byte
+	if _, err := io.ReadFull(d.r, magic[:]); err != nil {
+		if err == io.EOF {
+			return err
+		}
+		return fmt.Errorf("read stream header: %w", err)
+	}
+	if string(magic[:]) != binaryMagic {
+		return errors.New("not a binary event stream")
+	}
+	v, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return fmt.Errorf("read stream version: %w", noEOF(err))
+	}
+	if v != VersionBinary {
+		return fmt.Errorf("unsupported event stream version %d", v)
+	}
+	return nil
+}
+
+// readFrame returns the type and payload of the next frame. The payload is
+// only valid until the next call.
+func (d *Decoder) readFrame() (byte, []byte, error) {
+	n, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		if err == io.EOF {
+			return 0, nil, err
+		}
+		return 0, nil, fmt.Errorf("read frame length: %w", err)
+	}
+	if n == 0 || n > MaxFrameSize {
+		return 0, nil, fmt.Errorf("invalid frame length %d", n)
+	}
+	if cap(d.frame) < int(n) {
+		d.frame = make([]byte, n)
+	}
+	d.frame = d.frame[:n]
+	if _, err := io.ReadFull(d.r, d.frame); err != nil {
+		return 0, nil, noEOF(err)
+	}
+	return d.frame[0], d.frame[1:], nil
+}
+
+func (d *Decoder) decodeEvent(p []byte) (BinaryEvent, error) {
+	var fields [6]uint64
+	for i := range fields {
+		var err error
+		if fields[i], p, err = uvarint(p); err != nil {
+			return BinaryEvent{}, fmt.Errorf("invalid event frame: %w", err)
+		}
+	}
+	if fields[4] > math.MaxInt32 {
+		return BinaryEvent{}, fmt.Errorf("invalid event frame: block %d", fields[4])
+	}
+	ev := BinaryEvent{
+		Seq:       d.prev.Seq + fields[0],
+		Timestamp: d.prev.Timestamp + unzigzag(fields[1]),
+		GID:       d.prev.GID + unzigzag(fields[2]),
+		File:      fields[3],
+		BlockIdx:  int(fields[4]),
+	}
+	if id := fields[5]; id != 0 {
+		test, ok := d.tests[id]
+		if !ok {
+			return BinaryEvent{}, fmt.Errorf("invalid event frame: unknown test ID %d", id)
+		}
+		ev.Test = test
+	}
+	d.prev = ev
+	return ev, nil
+}
+
+func uvarint(p []byte) (uint64, []byte, error) {
+	v, n := binary.Uvarint(p)
+	if n <= 0 {
+		return 0, nil, errors.New("truncated or overlong varint")
+	}
+	return v, p[n:], nil
+}
+
+// unzigzag decodes a varint read as a uvarint.
+func unzigzag(u uint64) int64 {
+	return int64(u>>1) ^ -int64(u&1)
+}
+
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
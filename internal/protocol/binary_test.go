@@ -0,0 +1,267 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+var testEvents = []BinaryEvent{
+	{Seq: 1, Timestamp: 1700000000000000000, GID: 7, File: 0, BlockIdx: 3},
+	{Seq: 2, Timestamp: 1700000000000000100, GID: 7, File: 0, BlockIdx: 4, Test: "TestA"},
+	// Events of other Ps may be older.
+	{Seq: 3, Timestamp: 1699999999999999000, GID: 1, File: 12, BlockIdx: 0, Test: "TestA/sub|x"},
+	{Seq: 4, Timestamp: 1699999999999999001, GID: 9000, File: 1, BlockIdx: 1 << 20, Test: "TestA"},
+}
+
+func encodeEvents(t testing.TB, events []BinaryEvent, dropped uint64) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	for i := range events {
+		if err := enc.Encode(&events[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if dropped > 0 {
+		if err := enc.EncodeDropped(dropped); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func decodeEvents(data []byte) ([]BinaryEvent, uint64, error) {
+	dec := NewDecoder(bytes.NewReader(data))
+	var events []BinaryEvent
+	for {
+		ev, err := dec.Next()
+		if err == io.EOF {
+			return events, dec.Dropped(), nil
+		}
+		if err != nil {
+			return events, dec.Dropped(), err
+		}
+		events = append(events, ev)
+	}
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	data := encodeEvents(t, testEvents, 42)
+	got, dropped, err := decodeEvents(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(testEvents) {
+		t.Fatalf("decoded %d events, want %d", len(got), len(testEvents))
+	}
+	for i := range got {
+		if got[i] != testEvents[i] {
+			t.Errorf("event %d = %+v, want %+v", i, got[i], testEvents[i])
+		}
+	}
+	if dropped != 42 {
+		t.Errorf("dropped = %d, want 42", dropped)
+	}
+
+	// The test name is sent once, and consecutive events take a few bytes.
+	if n := strings.Count(string(data), "TestA/sub|x"); n != 1 {
+		t.Errorf("test name written %d times", n)
+	}
+	if len(data) > 80 {
+		t.Errorf("stream of %d bytes: %x", len(data), data)
+	}
+}
+
+func TestBinaryLongTestName(t *testing.T) {
+	long := "TestLong/" + strings.Repeat("x", MaxTestName)
+	events := []BinaryEvent{
+		{Seq: 1, Test: long},
+		{Seq: 2, Test: long + "y"},
+	}
+	got, _, err := decodeEvents(encodeEvents(t, events, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("decoded %d events, want 2", len(got))
+	}
+	for i, ev := range got {
+		if ev.Test != long[:MaxTestName] {
+			t.Errorf("event %d: test name of %d bytes, want the first %d", i, len(ev.Test), MaxTestName)
+		}
+	}
+}
+
+func TestBinaryDecodeErrors(t *testing.T) {
+	if _, err := NewDecoder(bytes.NewReader(nil)).Next(); err != io.EOF {
+		t.Errorf("empty stream: error = %v, want EOF", err)
+	}
+
+	valid := encodeEvents(t, testEvents[:2], 0)
+	header := []byte(binaryMagic + "\x03")
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want error // nil for any error
+	}{
+		{"magic", []byte("GCEX\x03"), nil},
+		{"version", []byte(binaryMagic + "\x04"), nil},
+		{"truncated header", []byte("GC"), io.ErrUnexpectedEOF},
+		{"truncated frame", valid[:len(valid)-1], io.ErrUnexpectedEOF},
+		{"frame length 0", append(header, 0), nil},
+		{"frame too long", append(header, 0x81, 0x80, 0x08), nil},
+		{"truncated event", append(header, 2, frameEvent, 1), nil},
+		{"unknown test", append(header, 7, frameEvent, 1, 2, 2, 0, 0, 5), nil},
+		{"test ID 0", append(header, 3, frameTest, 0, 'T'), nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := decodeEvents(tc.data)
+			if err == nil || (tc.want != nil && !errors.Is(err, tc.want)) {
+				t.Errorf("error = %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
+
+// TestBinarySkipsUnknown verifies that frames of unknown types and extra
+// fields in known frames are skipped.
+func TestBinarySkipsUnknown(t *testing.T) {
+	data := []byte(binaryMagic + "\x03")
+	data = append(data, 3, 99, 'x', 'y')
+	data = append(data, 8, frameEvent, 1, 2, 2, 0, 5, 0, 0xff)
+	got, _, err := decodeEvents(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := BinaryEvent{Seq: 1, Timestamp: 1, GID: 1, BlockIdx: 5}
+	if len(got) != 1 || got[0] != want {
+		t.Errorf("events = %+v, want [%+v]", got, want)
+	}
+}
+
+func TestStreamVersion(t *testing.T) {
+	for _, tc := range []struct {
+		contentType string
+		want        int
+	}{
+		{"", VersionFull},
+		{"text/plain", VersionFull},
+		{"text/plain; version=1", VersionFull},
+		{"text/plain; version=2", VersionCompact},
+		{"text/plain; version=3", 0},
+		{BinaryMediaType, VersionBinary},
+		{BinaryMediaType + "; version=3", VersionBinary},
+		{BinaryMediaType + "; version=2", 0},
+		{"text/plain; version", 0},
+	} {
+		got, err := StreamVersion(tc.contentType)
+		if got != tc.want || (err == nil) != (tc.want != 0) {
+			t.Errorf("StreamVersion(%q) = %d, %v; want %d", tc.contentType, got, err, tc.want)
+		}
+	}
+}
+
+func FuzzDecoder(f *testing.F) {
+	f.Add(encodeEvents(f, testEvents, 3))
+	f.Add([]byte(binaryMagic + "\x03\x03\x02\x01T\x07\x01\x01\x02\x02\x00\x00\x01"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		events, dropped, err := decodeEvents(data)
+		if err != nil {
+			return
+		}
+		// What decodes re-encodes to a stream that decodes the same.
+		again, droppedAgain, err := decodeEvents(encodeEvents(t, events, dropped))
+		if err != nil {
+			t.Fatalf("re-encoded stream: %v", err)
+		}
+		if len(again) != len(events) || droppedAgain != dropped {
+			t.Fatalf("re-encoded stream decodes to %d events and %d dropped, want %d and %d",
+				len(again), droppedAgain, len(events), dropped)
+		}
+		for i := range again {
+			if again[i] != events[i] {
+				t.Fatalf("event %d = %+v, want %+v", i, again[i], events[i])
+			}
+		}
+	})
+}
+
+func FuzzRoundTrip(f *testing.F) {
+	f.Add(uint64(1), int64(1700000000000000000), int64(7), uint64(0), uint32(3), "", uint64(0))
+	f.Add(uint64(1<<63), int64(-5), int64(-1<<63), uint64(1<<40), uint32(1<<31-1), "TestA/b", uint64(9))
+	f.Fuzz(func(t *testing.T, seq uint64, ts, gid int64, file uint64, block uint32, test string, dropped uint64) {
+		if block > 1<<31-1 {
+			block >>= 1
+		}
+		if len(test) > 1000 {
+			test = test[:1000]
+		}
+		events := []BinaryEvent{
+			{Seq: seq, Timestamp: ts, GID: gid, File: file, BlockIdx: int(block), Test: test},
+			{Seq: seq + 1, Timestamp: ts - 1, GID: -gid, File: file / 2, BlockIdx: int(block / 3)},
+		}
+		got, gotDropped, err := decodeEvents(encodeEvents(t, events, dropped))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dropped != 0 && gotDropped != dropped {
+			t.Errorf("dropped = %d, want %d", gotDropped, dropped)
+		}
+		if len(got) != len(events) {
+			t.Fatalf("decoded %d events, want %d", len(got), len(events))
+		}
+		for i := range got {
+			if got[i] != events[i] {
+				t.Errorf("event %d = %+v, want %+v", i, got[i], events[i])
+			}
+		}
+	})
+}
+
+// benchEvents returns events like those of a hot loop, in their text and
+// binary forms.
+func benchEvents() ([]byte, []byte) {
+	var text bytes.Buffer
+	var bin bytes.Buffer
+	enc := NewEncoder(&bin)
+	for i := 0; i < 1000; i++ {
+		ev := BinaryEvent{Seq: uint64(i + 1), Timestamp: 1700000000000000000 + int64(i*80), GID: 42, File: 3, BlockIdx: i % 3}
+		enc.Encode(&ev)
+		fmt.Fprintf(&text, "%d|%d|%d|example.com/project/internal/pkg/file.go|%d|%d|2|%d|3|1\n",
+			ev.Seq, ev.Timestamp, ev.GID, ev.BlockIdx, 10+ev.BlockIdx, 11+ev.BlockIdx)
+	}
+	return text.Bytes(), bin.Bytes()
+}
+
+func BenchmarkDecodeText(b *testing.B) {
+	text, _ := benchEvents()
+	b.SetBytes(int64(len(text)))
+	for i := 0; i < b.N; i++ {
+		sc := bufio.NewScanner(bytes.NewReader(text))
+		for sc.Scan() {
+			if _, err := DecodeCoverEvent(sc.Text()); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkDecodeBinary(b *testing.B) {
+	_, bin := benchEvents()
+	b.SetBytes(int64(len(bin)))
+	for i := 0; i < b.N; i++ {
+		dec := NewDecoder(bytes.NewReader(bin))
+		for {
+			if _, err := dec.Next(); err == io.EOF {
+				break
+			} else if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
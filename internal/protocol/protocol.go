@@ -2,11 +2,43 @@
 //
 // Each coverage event is encoded as a pipe-delimited line:
 //
-//	SEQ|TIMESTAMP|GID|FILE|BLOCK|START_LINE|START_COL|END_LINE|END_COL|NUM_STMTS
+//	SEQ|TIMESTAMP|GID|FILE|BLOCK|START_LINE|START_COL|END_LINE|END_COL|NUM_STMTS[|TEST]
+//
+// TEST is present only for events from instrumented test binaries and names
+// the running test. It is the last field and may itself contain '|'.
+//
+// That is version 1 of the format. In version 2, events leave out the
+// positions of their blocks, which the server knows from the blocks the
+// agent registered:
+//
+//	SEQ|TIMESTAMP|GID|FILE|BLOCK[|TEST]
+//
+// Version 3 is a binary format, described in binary.go.
+//
+// Agents announce the version of their event stream in its Content-Type,
+// as in "text/plain; version=2". Streams without a version are version 1.
+// The server lists the versions it accepts in the VersionsHeader of its
+// response to register-blocks; agents fall back to version 1 without it.
+//
+// Agents also send
+//
+//	#file|ID|FILE
+//
+// lines at register-blocks, giving the IDs that version 3 events identify
+// their files with.
+//
+// Lines starting with '#' are control lines rather than events. Agents
+// send
+//
+//	#dropped|COUNT
+//
+// with the number of events they dropped so far because the stream could
+// not keep up.
 package protocol
 
 import (
 	"fmt"
+	"mime"
 	"strconv"
 	"strings"
 
@@ -15,15 +47,19 @@ import (
 
 // EncodeCoverEvent encodes a CoverEvent to wire format.
 func EncodeCoverEvent(e *event.CoverEvent) string {
-	return fmt.Sprintf("%d|%d|%d|%s|%d|%d|%d|%d|%d|%d",
+	line := fmt.Sprintf("%d|%d|%d|%s|%d|%d|%d|%d|%d|%d",
 		e.Seq, e.Timestamp, e.GID, e.FileID, e.BlockIdx,
 		e.StartLine, e.StartCol, e.EndLine, e.EndCol, e.NumStmts)
+	if e.Test != "" {
+		line += "|" + e.Test
+	}
+	return line
 }
 
 // DecodeCoverEvent decodes a wire format line into a CoverEvent.
 func DecodeCoverEvent(line string) (event.CoverEvent, error) {
-	parts := strings.Split(line, "|")
-	if len(parts) != 10 {
+	parts := strings.SplitN(line, "|", 11)
+	if len(parts) < 10 {
 		return event.CoverEvent{}, fmt.Errorf("invalid event line: expected 10 fields, got %d", len(parts))
 	}
 
@@ -67,5 +103,145 @@ func DecodeCoverEvent(line string) (event.CoverEvent, error) {
 	if err != nil {
 		return e, fmt.Errorf("invalid num_stmts: %w", err)
 	}
+	if len(parts) == 11 {
+		e.Test = parts[10]
+	}
 	return e, nil
 }
+
+// Versions of the event stream format.
+const (
+	VersionFull    = 1 // events carry the positions of their blocks
+	VersionCompact = 2 // events carry the file and index of their blocks only
+	VersionBinary  = 3 // binary events with registered file IDs
+)
+
+// VersionsHeader is the response header of register-blocks in which the
+// server lists the event stream versions it accepts, Versions.
+const (
+	VersionsHeader = "Gococo-Event-Versions"
+	Versions       = "1,2,3"
+)
+
+// StreamVersion returns the format version of an event stream with the
+// given Content-Type.
+func StreamVersion(contentType string) (int, error) {
+	if contentType == "" {
+		return VersionFull, nil
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return 0, err
+	}
+	v, ok := params["version"]
+	if mediaType == BinaryMediaType {
+		if ok && v != "3" {
+			return 0, fmt.Errorf("unsupported binary event stream version %q", v)
+		}
+		return VersionBinary, nil
+	}
+	if !ok {
+		return VersionFull, nil
+	}
+	switch v {
+	case "1":
+		return VersionFull, nil
+	case "2":
+		return VersionCompact, nil
+	}
+	return 0, fmt.Errorf("unsupported event stream version %q", v)
+}
+
+// EncodeCompactEvent encodes a CoverEvent to the version 2 wire format.
+func EncodeCompactEvent(e *event.CoverEvent) string {
+	line := fmt.Sprintf("%d|%d|%d|%s|%d", e.Seq, e.Timestamp, e.GID, e.FileID, e.BlockIdx)
+	if e.Test != "" {
+		line += "|" + e.Test
+	}
+	return line
+}
+
+// DecodeCompactEvent decodes a version 2 wire format line into a CoverEvent
+// without the positions of its block.
+func DecodeCompactEvent(line string) (event.CoverEvent, error) {
+	parts := strings.SplitN(line, "|", 6)
+	if len(parts) < 5 {
+		return event.CoverEvent{}, fmt.Errorf("invalid event line: expected 5 fields, got %d", len(parts))
+	}
+
+	var e event.CoverEvent
+	var err error
+
+	e.Seq, err = strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return e, fmt.Errorf("invalid seq: %w", err)
+	}
+	e.Timestamp, err = strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return e, fmt.Errorf("invalid timestamp: %w", err)
+	}
+	e.GID, err = strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return e, fmt.Errorf("invalid gid: %w", err)
+	}
+	e.FileID = parts[3]
+	e.BlockIdx, err = strconv.Atoi(parts[4])
+	if err != nil {
+		return e, fmt.Errorf("invalid block: %w", err)
+	}
+	if len(parts) == 6 {
+		e.Test = parts[5]
+	}
+	return e, nil
+}
+
+// droppedPrefix starts the control lines reporting dropped events.
+const droppedPrefix = "#dropped|"
+
+// filePrefix starts the register-blocks lines giving the ID of a file.
+const filePrefix = "#file|"
+
+// IsControl reports whether a wire format line is a control line.
+func IsControl(line string) bool {
+	return strings.HasPrefix(line, "#")
+}
+
+// EncodeDropped encodes a report of the events an agent dropped so far.
+func EncodeDropped(n uint64) string {
+	return droppedPrefix + strconv.FormatUint(n, 10)
+}
+
+// DecodeDropped decodes a control line reporting dropped events. It reports
+// false if the line is another control line.
+func DecodeDropped(line string) (uint64, bool, error) {
+	if !strings.HasPrefix(line, droppedPrefix) {
+		return 0, false, nil
+	}
+	n, err := strconv.ParseUint(line[len(droppedPrefix):], 10, 64)
+	if err != nil {
+		return 0, true, fmt.Errorf("invalid dropped count: %w", err)
+	}
+	return n, true, nil
+}
+
+// EncodeFile encodes the ID of a file for register-blocks.
+func EncodeFile(id uint64, file string) string {
+	return filePrefix + strconv.FormatUint(id, 10) + "|" + file
+}
+
+// DecodeFile decodes a register-blocks line giving the ID of a file. It
+// reports false if the line is another control line.
+func DecodeFile(line string) (uint64, string, bool, error) {
+	if !strings.HasPrefix(line, filePrefix) {
+		return 0, "", false, nil
+	}
+	id, file, ok := strings.Cut(line[len(filePrefix):], "|")
+	if !ok {
+		return 0, "", true, fmt.Errorf("invalid file line: missing file")
+	}
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return 0, "", true, fmt.Errorf("invalid file ID: %w", err)
+	}
+	return n, file, true, nil
+}
@@ -0,0 +1,81 @@
+package report
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+)
+
+// funcSpan is the extent of a function declaration in a source file.
+type funcSpan struct {
+	Name                string // "F" or "T.M"
+	StartLine, StartCol int
+	EndLine, EndCol     int
+}
+
+// parseFuncs returns the function declarations of a Go source file, or nil
+// if it does not parse.
+func parseFuncs(src []byte) []funcSpan {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", src, parser.SkipObjectResolution)
+	if err != nil {
+		return nil
+	}
+	var spans []funcSpan
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Body == nil {
+			continue
+		}
+		name := fn.Name.Name
+		if fn.Recv != nil && len(fn.Recv.List) == 1 {
+			if recv := receiverName(fn.Recv.List[0].Type); recv != "" {
+				name = recv + "." + name
+			}
+		}
+		start, end := fset.Position(fn.Pos()), fset.Position(fn.End())
+		spans = append(spans, funcSpan{
+			Name:      name,
+			StartLine: start.Line, StartCol: start.Column,
+			EndLine: end.Line, EndCol: end.Column,
+		})
+	}
+	return spans
+}
+
+// receiverName returns the type name of a method receiver, without pointer
+// and type parameters.
+func receiverName(expr ast.Expr) string {
+	for {
+		switch e := expr.(type) {
+		case *ast.StarExpr:
+			expr = e.X
+		case *ast.ParenExpr:
+			expr = e.X
+		case *ast.IndexExpr:
+			expr = e.X
+		case *ast.IndexListExpr:
+			expr = e.X
+		case *ast.Ident:
+			return e.Name
+		default:
+			return ""
+		}
+	}
+}
+
+// funcAt returns the name of the function containing the position, or "".
+// Function literals belong to the declaration they appear in.
+func funcAt(spans []funcSpan, line, col int) string {
+	for _, s := range spans {
+		if before(line, col, s.StartLine, s.StartCol) || before(s.EndLine, s.EndCol, line, col) {
+			continue
+		}
+		return s.Name
+	}
+	return ""
+}
+
+func before(l1, c1, l2, c2 int) bool {
+	return l1 < l2 || (l1 == l2 && c1 < c2)
+}
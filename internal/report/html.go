@@ -0,0 +1,195 @@
+// Package report renders coverage snapshots as documents for people to read.
+package report
+
+import (
+	_ "embed"
+	"fmt"
+	"html/template"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gococo/gococo/internal/coverage"
+)
+
+//go:embed html.tmpl
+var htmlTemplate string
+
+var htmlTmpl = template.Must(template.New("report").Funcs(template.FuncMap{
+	"pct": func(p float64) string { return fmt.Sprintf("%.1f%%", p) },
+	"level": func(p float64) string {
+		switch {
+		case p >= 80:
+			return "high"
+		case p >= 50:
+			return "medium"
+		}
+		return "low"
+	},
+}).Parse(htmlTemplate))
+
+// HTMLOptions configures WriteHTML.
+type HTMLOptions struct {
+	Title string
+
+	// Source returns the content of a covered file, given as
+	// "importpath/file.go". Files whose source is unavailable are listed
+	// without annotated source. Sources embedded in the snapshot take
+	// precedence.
+	Source func(file string) ([]byte, error)
+}
+
+type htmlPage struct {
+	Title      string
+	CreatedAt  string
+	Mode       string
+	Percentage float64
+	HitStmts   int
+	TotalStmts int
+	Tree       *htmlDir
+	Files      []*htmlFile
+}
+
+// htmlDir is a directory of the file tree. Chains of directories holding
+// a single directory and no files are collapsed into one node, so that
+// "github.com/org/repo" is shown as one entry.
+type htmlDir struct {
+	Name       string
+	Dirs       []*htmlDir
+	Files      []*htmlFile
+	HitStmts   int
+	TotalStmts int
+}
+
+func (d *htmlDir) Percentage() float64 { return percent(d.HitStmts, d.TotalStmts) }
+
+type htmlFile struct {
+	ID         string
+	Name       string // base name
+	File       string // "importpath/file.go"
+	Percentage float64
+	HitStmts   int
+	TotalStmts int
+	Lines      []htmlLine // nil if the source is unavailable
+}
+
+type htmlLine struct {
+	Number  int
+	Text    string
+	Class   string // "hit", "miss" or "" for lines outside all blocks
+	Hits    string
+	LastHit string
+}
+
+// WriteHTML renders snap as a single self-contained HTML page: a directory
+// tree with per-directory and per-file coverage, and the source of every
+// file annotated with line hit counts and last-hit times.
+func WriteHTML(w io.Writer, snap *coverage.Snapshot, opts HTMLOptions) error {
+	summary := coverage.Summarize(snap.Blocks)
+	page := &htmlPage{
+		Title:      opts.Title,
+		CreatedAt:  formatTime(snap.CreatedAt),
+		Mode:       snap.Mode,
+		Percentage: summary.Percentage(),
+		HitStmts:   summary.HitStmts,
+		TotalStmts: summary.TotalStmts,
+		Tree:       &htmlDir{},
+	}
+	if page.Title == "" {
+		page.Title = "gococo coverage report"
+	}
+
+	for i, fs := range summary.Files {
+		f := &htmlFile{
+			ID:         fmt.Sprintf("file-%d", i),
+			Name:       path.Base(fs.File),
+			File:       fs.File,
+			Percentage: fs.Percentage(),
+			HitStmts:   fs.HitStmts,
+			TotalStmts: fs.TotalStmts,
+		}
+		if src, ok := snap.Sources[fs.File]; ok {
+			f.Lines = annotate(src, fs.LineHits())
+		} else if opts.Source != nil {
+			if data, err := opts.Source(fs.File); err == nil {
+				f.Lines = annotate(string(data), fs.LineHits())
+			}
+		}
+		page.Files = append(page.Files, f)
+		page.Tree.add(strings.Split(path.Dir(fs.File), "/"), f)
+	}
+	page.Tree.collapse()
+
+	return htmlTmpl.Execute(w, page)
+}
+
+// add inserts f into the tree under the directory elements dirs.
+func (d *htmlDir) add(dirs []string, f *htmlFile) {
+	d.HitStmts += f.HitStmts
+	d.TotalStmts += f.TotalStmts
+	if len(dirs) == 0 {
+		d.Files = append(d.Files, f)
+		return
+	}
+	for _, sub := range d.Dirs {
+		if sub.Name == dirs[0] {
+			sub.add(dirs[1:], f)
+			return
+		}
+	}
+	sub := &htmlDir{Name: dirs[0]}
+	d.Dirs = append(d.Dirs, sub)
+	sub.add(dirs[1:], f)
+}
+
+func (d *htmlDir) collapse() {
+	for _, sub := range d.Dirs {
+		for len(sub.Files) == 0 && len(sub.Dirs) == 1 {
+			only := sub.Dirs[0]
+			sub.Name += "/" + only.Name
+			sub.Dirs, sub.Files = only.Dirs, only.Files
+		}
+		sub.collapse()
+	}
+}
+
+// annotate splits src into lines and attaches the hits of each line.
+func annotate(src string, hits []coverage.LineHits) []htmlLine {
+	byLine := make(map[int]coverage.LineHits, len(hits))
+	for _, h := range hits {
+		byLine[h.Line] = h
+	}
+	texts := strings.Split(strings.TrimSuffix(src, "\n"), "\n")
+	lines := make([]htmlLine, len(texts))
+	for i, text := range texts {
+		l := htmlLine{Number: i + 1, Text: text}
+		if h, ok := byLine[l.Number]; ok {
+			l.Class = "miss"
+			l.Hits = "0"
+			if h.Hits > 0 {
+				l.Class = "hit"
+				l.Hits = fmt.Sprint(h.Hits)
+				l.LastHit = formatTime(h.LastHitAt)
+			}
+		}
+		lines[i] = l
+	}
+	return lines
+}
+
+// formatTime formats Unix milliseconds in UTC, so that reports read the
+// same wherever they are opened.
+func formatTime(ms int64) string {
+	if ms == 0 {
+		return ""
+	}
+	return time.UnixMilli(ms).UTC().Format("2006-01-02 15:04:05 MST")
+}
+
+func percent(hit, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(hit) / float64(total) * 100
+}
@@ -0,0 +1,58 @@
+package report
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/gococo/gococo/internal/coverage"
+)
+
+func TestWriteHTML(t *testing.T) {
+	snap := &coverage.Snapshot{
+		Version:   coverage.SnapshotVersion,
+		CreatedAt: 1700000000000,
+		Mode:      coverage.ModeCount,
+		Blocks: []coverage.Block{
+			{File: "example.com/app/main.go", StartLine: 3, StartCol: 13, EndLine: 5, EndCol: 2, NumStmts: 1, HitCount: 3, LastHitAt: 1700000000000},
+			{File: "example.com/app/main.go", BlockIdx: 1, StartLine: 7, StartCol: 14, EndLine: 9, EndCol: 2, NumStmts: 1},
+			{File: "example.com/app/internal/util/util.go", StartLine: 3, StartCol: 13, EndLine: 5, EndCol: 2, NumStmts: 2},
+		},
+		Sources: map[string]string{
+			"example.com/app/main.go": "package main\n\nfunc main() {\n\tprintln(\"<hi>\")\n}\n\nfunc unused() {\n\tprintln()\n}\n",
+		},
+	}
+
+	var sb strings.Builder
+	err := WriteHTML(&sb, snap, HTMLOptions{
+		Title:  "Release 1.2",
+		Source: func(file string) ([]byte, error) { return nil, errors.New("not found") },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := sb.String()
+
+	for _, want := range []string{
+		"<title>Release 1.2</title>",
+		"1 of 4 statements covered",
+		"snapshot taken 2023-11-14 22:13:20 UTC",
+		// The module path is collapsed into a single tree node.
+		`<span class="name">example.com/app/</span>`,
+		`<span class="name">internal/util/</span>`,
+		`<a class="name" href="#file-1">main.go</a>`,
+		`<span class="pct medium">50.0%</span><span class="name">example.com/app/main.go</span>`,
+		// Source is escaped and annotated per line.
+		`<tr class="hit"><td class="num">4</td><td class="hits">3</td><td class="last">2023-11-14 22:13:20 UTC</td><td class="code">	println(&#34;&lt;hi&gt;&#34;)</td></tr>`,
+		`<tr class="miss"><td class="num">8</td><td class="hits">0</td>`,
+		`<tr><td class="num">6</td>`,
+		"Source not available.",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("report missing %q", want)
+		}
+	}
+	if strings.Contains(out, "<script") || strings.Contains(out, "<link") {
+		t.Error("report must not load external resources")
+	}
+}
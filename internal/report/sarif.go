@@ -0,0 +1,260 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/gococo/gococo/internal/coverage"
+)
+
+// Defaults for SARIFOptions.
+const (
+	DefaultSARIFRuleID = "gococo/uncovered"
+	DefaultSARIFLevel  = "warning"
+)
+
+// SARIFOptions configures WriteSARIF.
+type SARIFOptions struct {
+	// RuleID identifies the results, so that code scanning tools can be
+	// configured to gate on them. Defaults to DefaultSARIFRuleID.
+	RuleID string
+
+	// Level is the severity of the results: "none", "note", "warning" or
+	// "error". Defaults to DefaultSARIFLevel.
+	Level string
+
+	// MinHits reports blocks executed fewer times than this. The default,
+	// 0, is treated as 1: only blocks that never ran are reported.
+	MinHits uint64
+
+	// SourceDir is the directory artifact URIs are relative to, recorded as
+	// the %SRCROOT% base.
+	SourceDir string
+
+	// Path maps "importpath/file.go" to the URI written to the report. If
+	// nil, import paths are written unchanged.
+	Path func(file string) string
+
+	// Source returns the content of a covered file. When available, results
+	// carry the function containing the block and are ordered by function.
+	Source func(file string) ([]byte, error)
+}
+
+// ValidSARIFLevel reports whether level is a SARIF result level.
+func ValidSARIFLevel(level string) bool {
+	switch level {
+	case "none", "note", "warning", "error":
+		return true
+	}
+	return false
+}
+
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool              sarifTool                        `json:"tool"`
+	OriginalURIBaseID map[string]sarifArtifactLocation `json:"originalUriBaseIds,omitempty"`
+	Results           []sarifResult                    `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID                   string         `json:"id"`
+	Name                 string         `json:"name"`
+	ShortDescription     sarifMessage   `json:"shortDescription"`
+	DefaultConfiguration sarifRuleLevel `json:"defaultConfiguration"`
+}
+
+type sarifRuleLevel struct {
+	Level string `json:"level"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID              string            `json:"ruleId"`
+	Level               string            `json:"level"`
+	Message             sarifMessage      `json:"message"`
+	Locations           []sarifLocation   `json:"locations"`
+	PartialFingerprints map[string]string `json:"partialFingerprints"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation  `json:"physicalLocation"`
+	LogicalLocations []sarifLogicalLocation `json:"logicalLocations,omitempty"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           sarifRegion           `json:"region"`
+}
+
+type sarifArtifactLocation struct {
+	URI       string `json:"uri"`
+	URIBaseID string `json:"uriBaseId,omitempty"`
+}
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn"`
+	EndLine     int `json:"endLine"`
+	EndColumn   int `json:"endColumn"`
+}
+
+type sarifLogicalLocation struct {
+	Name               string `json:"name"`
+	FullyQualifiedName string `json:"fullyQualifiedName"`
+	Kind               string `json:"kind"`
+}
+
+// WriteSARIF writes the blocks of snap executed fewer than opts.MinHits
+// times as a SARIF 2.1.0 log, with one result per block whose region is the
+// block's extent. Results are ordered by file and function, and name the
+// function as their logical location when the source is available.
+func WriteSARIF(w io.Writer, snap *coverage.Snapshot, opts SARIFOptions) error {
+	if opts.RuleID == "" {
+		opts.RuleID = DefaultSARIFRuleID
+	}
+	if opts.Level == "" {
+		opts.Level = DefaultSARIFLevel
+	}
+	if !ValidSARIFLevel(opts.Level) {
+		return fmt.Errorf("invalid SARIF level %q: must be none, note, warning or error", opts.Level)
+	}
+	minHits := max(opts.MinHits, 1)
+
+	run := sarifRun{
+		Tool: sarifTool{Driver: sarifDriver{
+			Name:           "gococo",
+			InformationURI: "https://github.com/gococo/gococo",
+			Rules: []sarifRule{{
+				ID:                   opts.RuleID,
+				Name:                 "UncoveredCode",
+				ShortDescription:     sarifMessage{Text: ruleDescription(minHits)},
+				DefaultConfiguration: sarifRuleLevel{Level: opts.Level},
+			}},
+		}},
+		Results: []sarifResult{},
+	}
+	baseID := ""
+	if opts.SourceDir != "" {
+		baseID = "%SRCROOT%"
+		run.OriginalURIBaseID = map[string]sarifArtifactLocation{
+			baseID: {URI: (&url.URL{Scheme: "file", Path: strings.TrimSuffix(opts.SourceDir, "/") + "/"}).String()},
+		}
+	}
+
+	for _, fs := range coverage.Summarize(snap.Blocks).Files {
+		var funcs []funcSpan
+		if src, ok := snap.Sources[fs.File]; ok {
+			funcs = parseFuncs([]byte(src))
+		} else if opts.Source != nil {
+			if src, err := opts.Source(fs.File); err == nil {
+				funcs = parseFuncs(src)
+			}
+		}
+		uri := fs.File
+		if opts.Path != nil {
+			uri = opts.Path(fs.File)
+		}
+
+		type finding struct {
+			block coverage.Block
+			fn    string
+		}
+		var findings []finding
+		for _, b := range fs.Blocks {
+			if b.NumStmts > 0 && b.HitCount < minHits {
+				findings = append(findings, finding{b, funcAt(funcs, b.StartLine, b.StartCol)})
+			}
+		}
+		// Keep the blocks of a function together, functions in source order.
+		first := make(map[string]int)
+		for i, f := range findings {
+			if _, ok := first[f.fn]; !ok {
+				first[f.fn] = i
+			}
+		}
+		sort.SliceStable(findings, func(i, j int) bool {
+			return first[findings[i].fn] < first[findings[j].fn]
+		})
+
+		for _, f := range findings {
+			b := f.block
+			loc := sarifLocation{
+				PhysicalLocation: sarifPhysicalLocation{
+					ArtifactLocation: sarifArtifactLocation{URI: uri, URIBaseID: baseID},
+					Region: sarifRegion{
+						StartLine: b.StartLine, StartColumn: b.StartCol,
+						EndLine: b.EndLine, EndColumn: b.EndCol,
+					},
+				},
+			}
+			if f.fn != "" {
+				loc.LogicalLocations = []sarifLogicalLocation{{
+					Name:               f.fn,
+					FullyQualifiedName: path.Dir(fs.File) + "." + f.fn,
+					Kind:               "function",
+				}}
+			}
+			run.Results = append(run.Results, sarifResult{
+				RuleID:    opts.RuleID,
+				Level:     opts.Level,
+				Message:   sarifMessage{Text: resultMessage(b, f.fn, minHits)},
+				Locations: []sarifLocation{loc},
+				PartialFingerprints: map[string]string{
+					"gococoBlock/v1": fmt.Sprintf("%s:%d.%d,%d.%d", fs.File, b.StartLine, b.StartCol, b.EndLine, b.EndCol),
+				},
+			})
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs:    []sarifRun{run},
+	})
+}
+
+func ruleDescription(minHits uint64) string {
+	if minHits == 1 {
+		return "Code not covered"
+	}
+	return fmt.Sprintf("Code executed fewer than %d times", minHits)
+}
+
+func resultMessage(b coverage.Block, fn string, minHits uint64) string {
+	stmts := "1 statement"
+	if b.NumStmts != 1 {
+		stmts = fmt.Sprintf("%d statements", b.NumStmts)
+	}
+	if fn != "" {
+		stmts += " in " + fn
+	}
+	if b.HitCount == 0 {
+		return "Not covered: " + stmts
+	}
+	return fmt.Sprintf("Executed %d times, fewer than %d: %s", b.HitCount, minHits, stmts)
+}
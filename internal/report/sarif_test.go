@@ -0,0 +1,116 @@
+package report
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/gococo/gococo/internal/coverage"
+)
+
+const sarifTestSource = `package app
+
+type T struct{}
+
+func (t *T) Method(x int) int {
+	if x > 0 {
+		return 1
+	}
+	return 0
+}
+
+func F(x int) {
+	if x > 0 {
+		go func() {
+			println(x)
+		}()
+	}
+}
+`
+
+func TestWriteSARIF(t *testing.T) {
+	snap := &coverage.Snapshot{
+		Blocks: []coverage.Block{
+			// F: the if body and the closure never ran.
+			{File: "example.com/app/app.go", BlockIdx: 3, StartLine: 12, StartCol: 15, EndLine: 13, EndCol: 11, NumStmts: 1, HitCount: 4},
+			{File: "example.com/app/app.go", BlockIdx: 4, StartLine: 13, StartCol: 11, EndLine: 14, EndCol: 13, NumStmts: 1},
+			{File: "example.com/app/app.go", BlockIdx: 5, StartLine: 14, StartCol: 13, EndLine: 16, EndCol: 4, NumStmts: 1},
+			// Method: ran twice, one branch never.
+			{File: "example.com/app/app.go", BlockIdx: 0, StartLine: 5, StartCol: 31, EndLine: 6, EndCol: 11, NumStmts: 1, HitCount: 2},
+			{File: "example.com/app/app.go", BlockIdx: 1, StartLine: 6, StartCol: 11, EndLine: 8, EndCol: 3, NumStmts: 1},
+			{File: "example.com/app/app.go", BlockIdx: 2, StartLine: 9, StartCol: 2, EndLine: 9, EndCol: 10, NumStmts: 1, HitCount: 2},
+		},
+		Sources: map[string]string{"example.com/app/app.go": sarifTestSource},
+	}
+
+	decode := func(opts SARIFOptions) sarifLog {
+		t.Helper()
+		var sb strings.Builder
+		if err := WriteSARIF(&sb, snap, opts); err != nil {
+			t.Fatal(err)
+		}
+		var log sarifLog
+		if err := json.Unmarshal([]byte(sb.String()), &log); err != nil {
+			t.Fatalf("invalid JSON: %v", err)
+		}
+		return log
+	}
+
+	log := decode(SARIFOptions{SourceDir: "/src/my app", Path: func(f string) string { return "app.go" }})
+	if log.Version != "2.1.0" || len(log.Runs) != 1 {
+		t.Fatalf("version=%s runs=%d", log.Version, len(log.Runs))
+	}
+	run := log.Runs[0]
+	if rule := run.Tool.Driver.Rules[0]; rule.ID != DefaultSARIFRuleID || rule.DefaultConfiguration.Level != "warning" {
+		t.Errorf("rule = %+v", rule)
+	}
+	if base := run.OriginalURIBaseID["%SRCROOT%"].URI; base != "file:///src/my%20app/" {
+		t.Errorf("%%SRCROOT%% = %s", base)
+	}
+
+	type got struct {
+		fn   string
+		line int
+		msg  string
+	}
+	var results []got
+	for _, r := range run.Results {
+		loc := r.Locations[0]
+		g := got{line: loc.PhysicalLocation.Region.StartLine, msg: r.Message.Text}
+		if len(loc.LogicalLocations) > 0 {
+			g.fn = loc.LogicalLocations[0].FullyQualifiedName
+		}
+		if loc.PhysicalLocation.ArtifactLocation.URI != "app.go" {
+			t.Errorf("uri = %s", loc.PhysicalLocation.ArtifactLocation.URI)
+		}
+		results = append(results, g)
+	}
+	want := []got{
+		{"example.com/app.T.Method", 6, "Not covered: 1 statement in T.Method"},
+		{"example.com/app.F", 13, "Not covered: 1 statement in F"},
+		{"example.com/app.F", 14, "Not covered: 1 statement in F"},
+	}
+	if len(results) != len(want) {
+		t.Fatalf("results = %+v, want %+v", results, want)
+	}
+	for i := range want {
+		if results[i] != want[i] {
+			t.Errorf("result %d = %+v, want %+v", i, results[i], want[i])
+		}
+	}
+
+	// A threshold also reports blocks that ran too rarely.
+	log = decode(SARIFOptions{RuleID: "coverage/hot-path", Level: "error", MinHits: 3})
+	run = log.Runs[0]
+	if len(run.Results) != 5 {
+		t.Fatalf("got %d results with MinHits 3, want 5", len(run.Results))
+	}
+	if r := run.Results[0]; r.RuleID != "coverage/hot-path" || r.Level != "error" ||
+		r.Message.Text != "Executed 2 times, fewer than 3: 1 statement in T.Method" {
+		t.Errorf("result = %+v", r)
+	}
+
+	if err := WriteSARIF(&strings.Builder{}, snap, SARIFOptions{Level: "fatal"}); err == nil {
+		t.Error("WriteSARIF accepted an invalid level")
+	}
+}
@@ -12,6 +12,9 @@ import (
 type AgentRegistry struct {
 	agents sync.Map // id -> *AgentState
 	nextID int64
+
+	// mu guards the fields of the states that change after registration.
+	mu sync.Mutex
 }
 
 // AgentState tracks the state of a connected agent.
@@ -19,6 +22,14 @@ type AgentState struct {
 	Info      event.AgentInfo
 	Connected bool
 	Since     time.Time
+
+	// DroppedEvents is the number of events the agent reported dropping
+	// because its stream to the server could not keep up.
+	DroppedEvents uint64
+
+	// EventVersion is the format version of the agent's last event stream,
+	// 0 if it never streamed events.
+	EventVersion int
 }
 
 // NewAgentRegistry creates a new agent registry.
@@ -27,17 +38,18 @@ func NewAgentRegistry() *AgentRegistry {
 }
 
 // Register adds a new agent and returns its ID.
-func (r *AgentRegistry) Register(hostname string, pid int, cmdline string, remoteIP string) string {
+func (r *AgentRegistry) Register(hostname string, pid int, cmdline string, remoteIP string, coverMode string) string {
 	id := atomic.AddInt64(&r.nextID, 1)
 	idStr := itoa(id)
 
 	state := &AgentState{
 		Info: event.AgentInfo{
-			ID:       idStr,
-			Hostname: hostname,
-			PID:      pid,
-			CmdLine:  cmdline,
-			RemoteIP: remoteIP,
+			ID:        idStr,
+			Hostname:  hostname,
+			PID:       pid,
+			CmdLine:   cmdline,
+			RemoteIP:  remoteIP,
+			CoverMode: coverMode,
 		},
 		Connected: true,
 		Since:     time.Now(),
@@ -48,15 +60,34 @@ func (r *AgentRegistry) Register(hostname string, pid int, cmdline string, remot
 
 // SetConnected updates the connection status of an agent.
 func (r *AgentRegistry) SetConnected(id string, connected bool) {
+	r.update(id, func(state *AgentState) { state.Connected = connected })
+}
+
+// SetDropped records the number of events an agent dropped so far.
+func (r *AgentRegistry) SetDropped(id string, n uint64) {
+	r.update(id, func(state *AgentState) { state.DroppedEvents = n })
+}
+
+// SetEventVersion records the format version of an agent's event stream.
+func (r *AgentRegistry) SetEventVersion(id string, version int) {
+	r.update(id, func(state *AgentState) { state.EventVersion = version })
+}
+
+// update calls f with the state of agent id, if it is registered, while
+// holding r.mu.
+func (r *AgentRegistry) update(id string, f func(*AgentState)) {
 	if raw, ok := r.agents.Load(id); ok {
-		state := raw.(*AgentState)
-		state.Connected = connected
+		r.mu.Lock()
+		f(raw.(*AgentState))
+		r.mu.Unlock()
 	}
 }
 
 // List returns all registered agents.
 func (r *AgentRegistry) List() []AgentState {
 	var result []AgentState
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	r.agents.Range(func(key, value interface{}) bool {
 		state := value.(*AgentState)
 		result = append(result, *state)
@@ -65,6 +96,29 @@ func (r *AgentRegistry) List() []AgentState {
 	return result
 }
 
+// CoverMode returns the cover mode shared by all registered agents, or
+// "count" if they differ or none reported one.
+func (r *AgentRegistry) CoverMode() string {
+	mode := ""
+	mixed := false
+	r.agents.Range(func(key, value interface{}) bool {
+		m := value.(*AgentState).Info.CoverMode
+		switch {
+		case m == "" || m == mode:
+		case mode == "":
+			mode = m
+		default:
+			mixed = true
+			return false
+		}
+		return true
+	})
+	if mode == "" || mixed {
+		return "count"
+	}
+	return mode
+}
+
 // Remove deletes an agent from the registry.
 func (r *AgentRegistry) Remove(id string) {
 	r.agents.Delete(id)
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gococo/gococo/internal/diffcover"
+)
+
+// handleCoverageDiff returns the coverage of the statements changed in the
+// source root since a git revision, as computed by diffcover.Compute, so
+// that new code that has not run yet can be pointed out.
+// Query param: base=<revision> (required), such as origin/main
+func (s *Server) handleCoverageDiff(w http.ResponseWriter, r *http.Request) {
+	setCORS(w)
+	base := r.URL.Query().Get("base")
+	if base == "" {
+		http.Error(w, "missing base", http.StatusBadRequest)
+		return
+	}
+	res, err := diffcover.Compute(s.coverageBlocks(), diffcover.Options{
+		Dir:  s.sourceRoot,
+		Base: base,
+		ImportPath: func(dir string) (string, bool) {
+			return importPath(s.modules, dir)
+		},
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gococo/gococo/internal/coverage"
+	"github.com/gococo/gococo/internal/report"
+)
+
+// coverageBlocks returns the current state of every known block, ordered by
+// file and position.
+func (s *Server) coverageBlocks() []coverage.Block {
+	s.mu.RLock()
+	blocks := make([]coverage.Block, 0, len(s.blockStates))
+	for _, bs := range s.blockStates {
+		blocks = append(blocks, coverage.Block{
+			File:      bs.File,
+			BlockIdx:  bs.BlockIdx,
+			StartLine: bs.StartLine,
+			StartCol:  bs.StartCol,
+			EndLine:   bs.EndLine,
+			EndCol:    bs.EndCol,
+			NumStmts:  bs.NumStmts,
+			HitCount:  bs.totalHits(),
+			LastHitAt: unixMilli(bs.LastHitAt),
+		})
+	}
+	s.mu.RUnlock()
+
+	coverage.SortBlocks(blocks)
+	return blocks
+}
+
+// unixMilli returns t in Unix milliseconds, or 0 for the zero time.
+func unixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+// snapshot returns the current coverage as a coverage.Snapshot, embedding
+// the covered source files it can read if withSources is set.
+func (s *Server) snapshot(withSources bool) *coverage.Snapshot {
+	snap := &coverage.Snapshot{
+		Version:   coverage.SnapshotVersion,
+		CreatedAt: time.Now().UnixMilli(),
+		Mode:      s.agents.CoverMode(),
+		Blocks:    s.coverageBlocks(),
+	}
+	if withSources {
+		snap.Sources = make(map[string]string)
+		for _, b := range snap.Blocks {
+			if _, ok := snap.Sources[b.File]; ok {
+				continue
+			}
+			if data, err := os.ReadFile(s.resolveSource(b.File)); err == nil {
+				snap.Sources[b.File] = string(data)
+			}
+		}
+	}
+	return snap
+}
+
+// handleCoverageSnapshot returns all coverage as a coverage.Snapshot, for
+// saving and later use by `gococo report`, `check` and `merge`.
+// Query param: sources=1 to embed the covered source files
+func (s *Server) handleCoverageSnapshot(w http.ResponseWriter, r *http.Request) {
+	setCORS(w)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.snapshot(r.URL.Query().Get("sources") == "1"))
+}
+
+// MergeResult is the response of /api/coverage/merge.
+type MergeResult struct {
+	Snapshot  *coverage.Snapshot       `json:"snapshot"`
+	Conflicts []coverage.MergeConflict `json:"conflicts"`
+}
+
+// handleCoverageMerge merges the snapshots posted as a stream of JSON
+// documents with coverage.Merge, as `gococo merge` does, and returns the
+// merged snapshot with the files whose block layouts conflicted. The
+// server's own coverage is not changed.
+// Query param: live=1 to merge the server's coverage first, as snapshot 0
+func (s *Server) handleCoverageMerge(w http.ResponseWriter, r *http.Request) {
+	setCORS(w)
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	snaps, err := coverage.DecodeSnapshots(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.URL.Query().Get("live") == "1" {
+		snaps = append([]*coverage.Snapshot{s.snapshot(false)}, snaps...)
+	}
+
+	merged, conflicts := coverage.Merge(snaps...)
+	if conflicts == nil {
+		conflicts = []coverage.MergeConflict{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(MergeResult{Snapshot: merged, Conflicts: conflicts})
+}
+
+// handleCoverageProfile returns coverage in the text format of
+// `go test -coverprofile`, as read by `go tool cover`.
+// Query param: mode=set|count|atomic (default: the agents' cover mode)
+func (s *Server) handleCoverageProfile(w http.ResponseWriter, r *http.Request) {
+	setCORS(w)
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = s.agents.CoverMode()
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err := coverage.WriteProfile(w, mode, s.coverageBlocks()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// reportOptions names files in LCOV and Cobertura reports by their path
+// relative to the source root, where CI tools look for them. Files outside
+// the source root keep their absolute path.
+func (s *Server) reportOptions() coverage.ReportOptions {
+	return coverage.ReportOptions{
+		SourceDir: s.sourceRoot,
+		Path: func(file string) string {
+			abs := s.resolveSource(file)
+			rel, err := filepath.Rel(s.sourceRoot, abs)
+			if err != nil || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				return abs
+			}
+			return filepath.ToSlash(rel)
+		},
+	}
+}
+
+// handleCoverageLCOV returns coverage as an LCOV tracefile.
+func (s *Server) handleCoverageLCOV(w http.ResponseWriter, r *http.Request) {
+	setCORS(w)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	summary := coverage.Summarize(s.coverageBlocks())
+	coverage.WriteLCOV(w, summary, s.reportOptions())
+}
+
+// handleCoverageCobertura returns coverage as a Cobertura XML report.
+func (s *Server) handleCoverageCobertura(w http.ResponseWriter, r *http.Request) {
+	setCORS(w)
+	w.Header().Set("Content-Type", "application/xml")
+	summary := coverage.Summarize(s.coverageBlocks())
+	coverage.WriteCobertura(w, summary, s.reportOptions(), time.Now().UnixMilli())
+}
+
+// handleCoverageSARIF returns the uncovered blocks as a SARIF 2.1.0 log for
+// code scanning tools.
+// Query params: rule=<rule ID>, level=none|note|warning|error,
+// min_hits=<n> to also report blocks executed fewer than n times
+func (s *Server) handleCoverageSARIF(w http.ResponseWriter, r *http.Request) {
+	setCORS(w)
+	q := r.URL.Query()
+	ro := s.reportOptions()
+	opts := report.SARIFOptions{
+		RuleID:    q.Get("rule"),
+		Level:     q.Get("level"),
+		SourceDir: ro.SourceDir,
+		Path:      ro.Path,
+		Source: func(file string) ([]byte, error) {
+			return os.ReadFile(s.resolveSource(file))
+		},
+	}
+	if opts.Level != "" && !report.ValidSARIFLevel(opts.Level) {
+		http.Error(w, "invalid level: must be none, note, warning or error", http.StatusBadRequest)
+		return
+	}
+	if v := q.Get("min_hits"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid min_hits", http.StatusBadRequest)
+			return
+		}
+		opts.MinHits = n
+	}
+
+	w.Header().Set("Content-Type", "application/sarif+json")
+	report.WriteSARIF(w, &coverage.Snapshot{Blocks: s.coverageBlocks()}, opts)
+}
@@ -1,8 +1,10 @@
 package server
 
 import (
+	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/gococo/gococo/internal/event"
 )
@@ -10,8 +12,33 @@ import (
 // Hub manages event broadcasting from agents to UI clients.
 type Hub struct {
 	ring    *event.RingBuffer
-	clients sync.Map // clientID -> chan event.CoverEvent
+	clients sync.Map // clientID -> *Subscription
 	nextID  int64
+	dropped uint64 // events dropped for slow clients, over all clients
+}
+
+// Subscription is a UI client's registration with a Hub.
+type Subscription struct {
+	ID    int64
+	Since time.Time
+
+	// Events receives new events. When it is full because the client does
+	// not keep up, events are dropped for the client and Missed is signaled.
+	Events <-chan event.CoverEvent
+	Missed <-chan struct{}
+
+	hub     *Hub
+	events  chan event.CoverEvent
+	missed  chan struct{}
+	dropped uint64
+}
+
+// ClientStats describes a UI client of a Hub.
+type ClientStats struct {
+	ID            int64     `json:"id"`
+	Since         time.Time `json:"since"`
+	DroppedEvents uint64    `json:"dropped_events"`
+	Pending       int       `json:"pending"` // events queued for the client
 }
 
 // NewHub creates a new event hub with the given history capacity.
@@ -25,26 +52,83 @@ func NewHub(historySize int) *Hub {
 func (h *Hub) Publish(e event.CoverEvent) {
 	h.ring.Push(e)
 	h.clients.Range(func(key, value interface{}) bool {
-		ch := value.(chan event.CoverEvent)
+		sub := value.(*Subscription)
 		select {
-		case ch <- e:
+		case sub.events <- e:
 		default:
 			// slow client, drop event
+			atomic.AddUint64(&sub.dropped, 1)
+			atomic.AddUint64(&h.dropped, 1)
+			select {
+			case sub.missed <- struct{}{}:
+			default:
+			}
 		}
 		return true
 	})
 }
 
-// Subscribe returns a channel that receives new events and a cancel function.
-func (h *Hub) Subscribe(bufSize int) (<-chan event.CoverEvent, func()) {
-	id := atomic.AddInt64(&h.nextID, 1)
-	ch := make(chan event.CoverEvent, bufSize)
-	h.clients.Store(id, ch)
-	cancel := func() {
-		h.clients.Delete(id)
-		close(ch)
+// Subscribe registers a client receiving new events, buffering up to
+// bufSize of them.
+func (h *Hub) Subscribe(bufSize int) *Subscription {
+	events := make(chan event.CoverEvent, bufSize)
+	missed := make(chan struct{}, 1)
+	sub := &Subscription{
+		ID:     atomic.AddInt64(&h.nextID, 1),
+		Since:  time.Now(),
+		Events: events,
+		Missed: missed,
+		hub:    h,
+		events: events,
+		missed: missed,
 	}
-	return ch, cancel
+	h.clients.Store(sub.ID, sub)
+	return sub
+}
+
+// Cancel unregisters the client. Its channels are not closed, as Publish
+// may still be sending to them.
+func (s *Subscription) Cancel() {
+	s.hub.clients.Delete(s.ID)
+}
+
+// Dropped returns the number of events dropped for the client.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Skip discards the events queued for the client.
+func (s *Subscription) Skip() {
+	for {
+		select {
+		case <-s.events:
+		default:
+			return
+		}
+	}
+}
+
+// Clients describes the connected clients, in subscription order.
+func (h *Hub) Clients() []ClientStats {
+	clients := []ClientStats{}
+	h.clients.Range(func(key, value interface{}) bool {
+		sub := value.(*Subscription)
+		clients = append(clients, ClientStats{
+			ID:            sub.ID,
+			Since:         sub.Since,
+			DroppedEvents: sub.Dropped(),
+			Pending:       len(sub.events),
+		})
+		return true
+	})
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ID < clients[j].ID })
+	return clients
+}
+
+// DroppedEvents returns the number of events dropped for slow clients, over
+// all clients ever connected.
+func (h *Hub) DroppedEvents() uint64 {
+	return atomic.LoadUint64(&h.dropped)
 }
 
 // History returns the most recent n events.
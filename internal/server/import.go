@@ -0,0 +1,125 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gococo/gococo/internal/coverage"
+)
+
+// liveLabel names the coverage reported by agents. It cannot be used as an
+// import label.
+const liveLabel = "live"
+
+// positionKey identifies a block by file and start position, which is how
+// coverprofile blocks are matched to the blocks registered by agents. End
+// positions are not compared: go test ends a block that is closed by a brace
+// before the brace, where gococo ends it after.
+func positionKey(file string, sl, sc int) string {
+	return fmt.Sprintf("%s:%d.%d", file, sl, sc)
+}
+
+// ImportResult describes the outcome of a coverage import.
+type ImportResult struct {
+	Label   string `json:"label"`
+	Mode    string `json:"mode"`
+	Blocks  int    `json:"blocks"`  // distinct blocks in the profile
+	Matched int    `json:"matched"` // blocks already known to the server
+	Created int    `json:"created"` // blocks only known from imports
+}
+
+// handleCoverageImport overlays a coverprofile, such as one written by
+// `go test -coverprofile`, on the server's coverage. Blocks are matched to
+// known blocks by file and start position, or created. The hits are recorded under
+// a label, separately from live hits; importing again with the same label
+// replaces that label's hits.
+// Query param: label=<name> (default "import")
+func (s *Server) handleCoverageImport(w http.ResponseWriter, r *http.Request) {
+	setCORS(w)
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	label := r.URL.Query().Get("label")
+	if label == "" {
+		label = "import"
+	}
+	if label == liveLabel {
+		http.Error(w, fmt.Sprintf("label %q is reserved for live coverage", liveLabel), http.StatusBadRequest)
+		return
+	}
+
+	mode, blocks, err := coverage.ParseProfile(r.Body)
+	if err != nil {
+		http.Error(w, "parse coverprofile: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// A profile concatenated from several test binaries lists blocks once
+	// per binary. Counts add up; in set mode a block is hit if any run hit it.
+	type profileBlock struct {
+		coverage.Block
+		hits uint64
+	}
+	var order []string
+	byPos := make(map[string]*profileBlock)
+	for _, b := range blocks {
+		pos := positionKey(b.File, b.StartLine, b.StartCol)
+		pb, ok := byPos[pos]
+		if !ok {
+			pb = &profileBlock{Block: b}
+			byPos[pos] = pb
+			order = append(order, pos)
+		}
+		if mode == coverage.ModeSet {
+			pb.hits = max(pb.hits, b.HitCount)
+		} else {
+			pb.hits += b.HitCount
+		}
+	}
+
+	res := ImportResult{Label: label, Mode: mode, Blocks: len(order)}
+	s.mu.Lock()
+	known := make(map[string]*blockState, len(s.blockStates))
+	for key, bs := range s.blockStates {
+		delete(bs.Imported, label)
+		if bs.BlockIdx < 0 && len(bs.Imported) == 0 && bs.HitCount == 0 {
+			// Created by an earlier import with this label only.
+			delete(s.blockStates, key)
+			delete(s.importedBlocks, positionKey(bs.File, bs.StartLine, bs.StartCol))
+			continue
+		}
+		known[positionKey(bs.File, bs.StartLine, bs.StartCol)] = bs
+	}
+	for _, pos := range order {
+		pb := byPos[pos]
+		bs, ok := known[pos]
+		if ok {
+			res.Matched++
+		} else {
+			s.importSeq++
+			bs = &blockState{
+				File:      pb.File,
+				BlockIdx:  -s.importSeq,
+				StartLine: pb.StartLine,
+				StartCol:  pb.StartCol,
+				EndLine:   pb.EndLine,
+				EndCol:    pb.EndCol,
+				NumStmts:  pb.NumStmts,
+			}
+			s.blockStates[fmt.Sprintf("%s:%d", bs.File, bs.BlockIdx)] = bs
+			s.importedBlocks[pos] = bs
+			res.Created++
+		}
+		if bs.Imported == nil {
+			bs.Imported = make(map[string]uint64)
+		}
+		bs.Imported[label] = pb.hits
+	}
+	s.mu.Unlock()
+
+	log.Printf("[gococo] imported %d blocks as %q (%d matched, %d new)", res.Blocks, label, res.Matched, res.Created)
+	json.NewEncoder(w).Encode(res)
+}
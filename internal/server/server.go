@@ -9,14 +9,18 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"maps"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/gococo/gococo/internal/coverage"
 	"github.com/gococo/gococo/internal/event"
 	"github.com/gococo/gococo/internal/protocol"
 )
@@ -29,13 +33,29 @@ type Server struct {
 	mux      *http.ServeMux
 	sourceFS http.FileSystem // for serving embedded web UI
 
-	// Source code root directory and module path
+	// Source code root directory and the modules found there (several in
+	// a go.work workspace)
 	sourceRoot string
-	modulePath string
+	modules    []sourceModule
 
 	// Coverage summary tracking
 	mu          sync.RWMutex
 	blockStates map[string]*blockState // "file:block" -> state
+
+	// importedBlocks holds the blocks created by coverage imports that no
+	// agent has registered yet, by position. They have negative indices,
+	// taken from importSeq.
+	importedBlocks map[string]*blockState
+	importSeq      int
+
+	// files holds the file IDs registered by each agent, which its version
+	// 3 events identify their files with: agent ID -> file ID -> file.
+	files map[string]map[uint64]string
+
+	// snapshotSeqs holds the sequence number of the last event counted by
+	// each agent's latest counter snapshot. Events up to it are in the
+	// snapshot and do not add hits when they arrive after it.
+	snapshotSeqs map[string]uint64
 }
 
 type blockState struct {
@@ -48,6 +68,36 @@ type blockState struct {
 	NumStmts  int
 	HitCount  uint64
 	LastHitAt time.Time
+
+	// AgentHits maps agent IDs to the hits each agent reported, through
+	// events and counters. HitCount is their sum.
+	AgentHits map[string]uint64
+
+	// Tests maps the names of tests that executed this block to their hit
+	// counts. Only events from instrumented test binaries carry test names.
+	Tests map[string]uint64
+
+	// Imported maps the labels of imported coverprofiles to the hits they
+	// recorded. HitCount counts live hits only.
+	Imported map[string]uint64
+}
+
+// addHits records n live hits of the block reported by an agent.
+func (bs *blockState) addHits(agentID string, n uint64) {
+	if bs.AgentHits == nil {
+		bs.AgentHits = make(map[string]uint64)
+	}
+	bs.AgentHits[agentID] += n
+	bs.HitCount += n
+}
+
+// totalHits returns the live and imported hits of the block.
+func (bs *blockState) totalHits() uint64 {
+	n := bs.HitCount
+	for _, hits := range bs.Imported {
+		n += hits
+	}
+	return n
 }
 
 // New creates a new gococo server.
@@ -60,8 +110,12 @@ func New(addr string, webFS http.FileSystem, sourceRoot string) *Server {
 		sourceFS:    webFS,
 		sourceRoot:  sourceRoot,
 		blockStates: make(map[string]*blockState),
+
+		importedBlocks: make(map[string]*blockState),
+		files:          make(map[string]map[uint64]string),
+		snapshotSeqs:   make(map[string]uint64),
 	}
-	s.modulePath = readModulePath(sourceRoot)
+	s.modules = findSourceModules(sourceRoot)
 	s.routes()
 	return s
 }
@@ -87,6 +141,13 @@ func (s *Server) Run() error {
 	return http.ListenAndServe(s.addr, s.mux)
 }
 
+// Serve accepts connections on an existing listener. It lets other
+// commands, such as `gococo run`, embed the server in-process.
+func (s *Server) Serve(ln net.Listener) error {
+	log.Printf("[gococo] server listening on %s", ln.Addr())
+	return http.Serve(ln, s.mux)
+}
+
 func (s *Server) routes() {
 	// Internal API (for instrumented binaries)
 	s.mux.HandleFunc("/api/internal/register", s.handleRegister)
@@ -96,10 +157,20 @@ func (s *Server) routes() {
 
 	// Public API (for UI)
 	s.mux.HandleFunc("/api/agents", s.handleListAgents)
+	s.mux.HandleFunc("/api/stats", s.handleStats)
 	s.mux.HandleFunc("/api/events/stream", s.handleEventStream)
 	s.mux.HandleFunc("/api/events/history", s.handleEventHistory)
 	s.mux.HandleFunc("/api/coverage/summary", s.handleCoverageSummary)
 	s.mux.HandleFunc("/api/coverage/blocks", s.handleCoverageBlocks)
+	s.mux.HandleFunc("/api/coverage/tests", s.handleCoverageTests)
+	s.mux.HandleFunc("/api/coverage/snapshot", s.handleCoverageSnapshot)
+	s.mux.HandleFunc("/api/coverage/profile", s.handleCoverageProfile)
+	s.mux.HandleFunc("/api/coverage/lcov", s.handleCoverageLCOV)
+	s.mux.HandleFunc("/api/coverage/cobertura", s.handleCoverageCobertura)
+	s.mux.HandleFunc("/api/coverage/sarif", s.handleCoverageSARIF)
+	s.mux.HandleFunc("/api/coverage/import", s.handleCoverageImport)
+	s.mux.HandleFunc("/api/coverage/merge", s.handleCoverageMerge)
+	s.mux.HandleFunc("/api/coverage/diff", s.handleCoverageDiff)
 	s.mux.HandleFunc("/api/source", s.handleSource)
 
 	// Web UI
@@ -113,6 +184,7 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 	hostname := r.URL.Query().Get("hostname")
 	pidStr := r.URL.Query().Get("pid")
 	cmdline := r.URL.Query().Get("cmdline")
+	coverMode := r.URL.Query().Get("covermode")
 
 	if hostname == "" || pidStr == "" {
 		http.Error(w, "missing hostname or pid", http.StatusBadRequest)
@@ -122,7 +194,7 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 	pid, _ := strconv.Atoi(pidStr)
 	remoteIP := r.RemoteAddr
 
-	id := s.agents.Register(hostname, pid, cmdline, remoteIP)
+	id := s.agents.Register(hostname, pid, cmdline, remoteIP, coverMode)
 	log.Printf("[gococo] agent registered: id=%s hostname=%s pid=%d cmdline=%s", id, hostname, pid, cmdline)
 
 	w.WriteHeader(http.StatusOK)
@@ -131,12 +203,15 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 
 // handleRegisterBlocks receives all block metadata from an agent at startup.
 // This allows the server to know about ALL blocks (including uncovered ones).
-// Format: file|blockIdx|startLine|startCol|endLine|endCol|numStmts per line.
+// Format: file|blockIdx|startLine|startCol|endLine|endCol|numStmts per line,
+// and #file|ID|file lines giving the IDs of the files. The response lists
+// the event stream versions the server accepts.
 func (s *Server) handleRegisterBlocks(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "POST required", http.StatusMethodNotAllowed)
 		return
 	}
+	agentID := r.URL.Query().Get("agent_id")
 
 	scanner := bufio.NewScanner(r.Body)
 	count := 0
@@ -146,6 +221,18 @@ func (s *Server) handleRegisterBlocks(w http.ResponseWriter, r *http.Request) {
 		if line == "" {
 			continue
 		}
+		if protocol.IsControl(line) {
+			id, file, ok, err := protocol.DecodeFile(line)
+			if err != nil {
+				log.Printf("[gococo] decode error from agent %s: %v", agentID, err)
+			} else if ok {
+				if s.files[agentID] == nil {
+					s.files[agentID] = make(map[uint64]string)
+				}
+				s.files[agentID][id] = file
+			}
+			continue
+		}
 		parts := strings.SplitN(line, "|", 7)
 		if len(parts) != 7 {
 			continue
@@ -158,39 +245,40 @@ func (s *Server) handleRegisterBlocks(w http.ResponseWriter, r *http.Request) {
 		ec, _ := strconv.Atoi(parts[5])
 		stmts, _ := strconv.Atoi(parts[6])
 
-		key := fmt.Sprintf("%s:%d", file, blockIdx)
-		if _, exists := s.blockStates[key]; !exists {
-			s.blockStates[key] = &blockState{
-				File:      file,
-				BlockIdx:  blockIdx,
-				StartLine: sl,
-				StartCol:  sc,
-				EndLine:   el,
-				EndCol:    ec,
-				NumStmts:  stmts,
-			}
+		if _, created := s.blockLocked(file, blockIdx, sl, sc, el, ec, stmts); created {
 			count++
 		}
 	}
 	s.mu.Unlock()
 
 	log.Printf("[gococo] registered %d blocks from agent", count)
+	w.Header().Set(protocol.VersionsHeader, protocol.Versions)
 	w.WriteHeader(http.StatusOK)
 }
 
-// handleCounters receives a full counter snapshot from an agent.
+// handleCounters receives counters from an agent.
 // Format: file|blockIdx|count|sl|sc|el|ec|stmts per line.
-// This provides accurate coverage data including init() and main() startup.
+// By default the counts are a full snapshot of the agent's counters, which
+// provides accurate coverage data including init() and main() startup:
+// hits the agent already reported through events are not counted again.
+// With delta=1 the counts are the hits since the agent's previous delta,
+// sent by agents without events, and add up.
 func (s *Server) handleCounters(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "POST required", http.StatusMethodNotAllowed)
 		return
 	}
 
+	agentID := r.URL.Query().Get("agent_id")
+	delta := r.URL.Query().Get("delta") == "1"
+	seq, _ := strconv.ParseUint(r.URL.Query().Get("seq"), 10, 64)
 	now := time.Now()
 	scanner := bufio.NewScanner(r.Body)
 	updated := 0
 	s.mu.Lock()
+	if !delta && seq > 0 {
+		s.snapshotSeqs[agentID] = seq
+	}
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
 		if line == "" {
@@ -209,23 +297,20 @@ func (s *Server) handleCounters(w http.ResponseWriter, r *http.Request) {
 		ec, _ := strconv.Atoi(parts[6])
 		stmts, _ := strconv.Atoi(parts[7])
 
-		key := fmt.Sprintf("%s:%d", file, blockIdx)
-		bs, ok := s.blockStates[key]
-		if !ok {
-			bs = &blockState{
-				File:      file,
-				BlockIdx:  blockIdx,
-				StartLine: sl,
-				StartCol:  sc,
-				EndLine:   el,
-				EndCol:    ec,
-				NumStmts:  stmts,
+		bs, _ := s.blockLocked(file, blockIdx, sl, sc, el, ec, stmts)
+		if delta {
+			if count > 0 {
+				bs.addHits(agentID, count)
+				bs.LastHitAt = now
+				updated++
 			}
-			s.blockStates[key] = bs
+			continue
 		}
-		// Counter is ground truth; update if larger
-		if count > bs.HitCount {
-			bs.HitCount = count
+		// The counter is ground truth for the agent; add what its events
+		// missed. The agent sends the events after seq only once the
+		// snapshot is applied, so reported only counts events it includes.
+		if reported := bs.AgentHits[agentID]; count > reported {
+			bs.addHits(agentID, count-reported)
 			if bs.LastHitAt.IsZero() {
 				bs.LastHitAt = now
 			}
@@ -234,7 +319,11 @@ func (s *Server) handleCounters(w http.ResponseWriter, r *http.Request) {
 	}
 	s.mu.Unlock()
 
-	log.Printf("[gococo] counter snapshot: %d blocks updated", updated)
+	if delta {
+		log.Printf("[gococo] counter deltas from agent %s: %d blocks updated", agentID, updated)
+	} else {
+		log.Printf("[gococo] counter snapshot: %d blocks updated", updated)
+	}
 
 	w.WriteHeader(http.StatusOK)
 }
@@ -252,10 +341,31 @@ func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	version, err := protocol.StreamVersion(r.Header.Get("Content-Type"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	decode := protocol.DecodeCoverEvent
+	if version == protocol.VersionCompact {
+		decode = protocol.DecodeCompactEvent
+	}
+
 	s.agents.SetConnected(agentID, true)
 	defer s.agents.SetConnected(agentID, false)
+	s.agents.SetEventVersion(agentID, version)
+	// Each stream numbers its events from 1.
+	s.mu.Lock()
+	delete(s.snapshotSeqs, agentID)
+	s.mu.Unlock()
 
 	log.Printf("[gococo] agent %s event stream connected", agentID)
+	defer log.Printf("[gococo] agent %s event stream disconnected", agentID)
+	if version == protocol.VersionBinary {
+		s.readBinaryEvents(agentID, r.Body)
+		return
+	}
+	unknown := make(map[string]bool) // unregistered blocks, logged once
 
 	scanner := bufio.NewScanner(r.Body)
 	scanner.Buffer(make([]byte, 4096), 64*1024)
@@ -266,44 +376,154 @@ func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 
-		ev, err := protocol.DecodeCoverEvent(line)
+		if protocol.IsControl(line) {
+			s.handleControl(agentID, line)
+			continue
+		}
+
+		ev, err := decode(line)
 		if err != nil {
 			log.Printf("[gococo] decode error from agent %s: %v", agentID, err)
 			continue
 		}
+		if version == protocol.VersionCompact && !s.resolveBlock(&ev) {
+			if key := fmt.Sprintf("%s:%d", ev.FileID, ev.BlockIdx); !unknown[key] {
+				unknown[key] = true
+				log.Printf("[gococo] agent %s sent events of unregistered block %s", agentID, key)
+			}
+			continue
+		}
 
 		s.hub.Publish(ev)
-		s.updateBlockState(&ev)
+		s.updateBlockState(agentID, &ev)
 	}
 
 	if err := scanner.Err(); err != nil && err != io.EOF {
 		log.Printf("[gococo] agent %s stream error: %v", agentID, err)
 	}
+}
 
-	log.Printf("[gococo] agent %s event stream disconnected", agentID)
+// readBinaryEvents reads a version 3 event stream until it ends or cannot
+// be decoded.
+func (s *Server) readBinaryEvents(agentID string, r io.Reader) {
+	dec := protocol.NewDecoder(r)
+	var dropped uint64
+	unknown := make(map[string]bool) // unregistered blocks, logged once
+	for {
+		bev, err := dec.Next()
+		if n := dec.Dropped(); n != dropped {
+			dropped = n
+			s.agents.SetDropped(agentID, n)
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			log.Printf("[gococo] agent %s stream error: %v", agentID, err)
+			return
+		}
+
+		ev := event.CoverEvent{
+			Seq:       bev.Seq,
+			Timestamp: bev.Timestamp,
+			GID:       bev.GID,
+			BlockIdx:  bev.BlockIdx,
+			Test:      bev.Test,
+		}
+		s.mu.RLock()
+		file, ok := s.files[agentID][bev.File]
+		s.mu.RUnlock()
+		ev.FileID = file
+		if !ok || !s.resolveBlock(&ev) {
+			if key := fmt.Sprintf("%d:%d", bev.File, bev.BlockIdx); !unknown[key] {
+				unknown[key] = true
+				log.Printf("[gococo] agent %s sent events of unregistered block %d of file ID %d", agentID, bev.BlockIdx, bev.File)
+			}
+			continue
+		}
+
+		s.hub.Publish(ev)
+		s.updateBlockState(agentID, &ev)
+	}
 }
 
-func (s *Server) updateBlockState(e *event.CoverEvent) {
-	key := fmt.Sprintf("%s:%d", e.FileID, e.BlockIdx)
-	s.mu.Lock()
-	bs, ok := s.blockStates[key]
+// resolveBlock fills in the positions of the block of a version 2 event
+// from the registered blocks. It reports false if the block is unknown.
+func (s *Server) resolveBlock(e *event.CoverEvent) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	bs, ok := s.blockStates[fmt.Sprintf("%s:%d", e.FileID, e.BlockIdx)]
 	if !ok {
-		bs = &blockState{
-			File:      e.FileID,
-			BlockIdx:  e.BlockIdx,
-			StartLine: e.StartLine,
-			StartCol:  e.StartCol,
-			EndLine:   e.EndLine,
-			EndCol:    e.EndCol,
-			NumStmts:  e.NumStmts,
-		}
-		s.blockStates[key] = bs
+		return false
+	}
+	e.StartLine, e.StartCol = bs.StartLine, bs.StartCol
+	e.EndLine, e.EndCol = bs.EndLine, bs.EndCol
+	e.NumStmts = bs.NumStmts
+	return true
+}
+
+// handleControl applies a control line from an agent's event stream.
+// Unknown control lines are ignored, for agents newer than the server.
+func (s *Server) handleControl(agentID, line string) {
+	n, ok, err := protocol.DecodeDropped(line)
+	if err != nil {
+		log.Printf("[gococo] decode error from agent %s: %v", agentID, err)
+		return
+	}
+	if ok {
+		s.agents.SetDropped(agentID, n)
+	}
+}
+
+// updateBlockState counts an event of an agent, unless the agent's latest
+// counter snapshot already did.
+func (s *Server) updateBlockState(agentID string, e *event.CoverEvent) {
+	s.mu.Lock()
+	bs, _ := s.blockLocked(e.FileID, e.BlockIdx, e.StartLine, e.StartCol, e.EndLine, e.EndCol, e.NumStmts)
+	if e.Seq > s.snapshotSeqs[agentID] {
+		bs.addHits(agentID, 1)
 	}
-	bs.HitCount++
 	bs.LastHitAt = time.Now()
+	if e.Test != "" {
+		if bs.Tests == nil {
+			bs.Tests = make(map[string]uint64)
+		}
+		bs.Tests[e.Test]++
+	}
 	s.mu.Unlock()
 }
 
+// blockLocked returns the state of block blockIdx of file, creating it with
+// the given position if it is new. A block created by a coverage import at
+// the same start position is taken over, so that imported and live hits of a
+// block are kept together. s.mu must be held.
+func (s *Server) blockLocked(file string, blockIdx, sl, sc, el, ec, stmts int) (bs *blockState, created bool) {
+	key := fmt.Sprintf("%s:%d", file, blockIdx)
+	if bs, ok := s.blockStates[key]; ok {
+		return bs, false
+	}
+	pos := positionKey(file, sl, sc)
+	if bs, ok := s.importedBlocks[pos]; ok {
+		delete(s.importedBlocks, pos)
+		delete(s.blockStates, fmt.Sprintf("%s:%d", file, bs.BlockIdx))
+		bs.BlockIdx = blockIdx
+		bs.EndLine, bs.EndCol = el, ec
+		s.blockStates[key] = bs
+		return bs, false
+	}
+	bs = &blockState{
+		File:      file,
+		BlockIdx:  blockIdx,
+		StartLine: sl,
+		StartCol:  sc,
+		EndLine:   el,
+		EndCol:    ec,
+		NumStmts:  stmts,
+	}
+	s.blockStates[key] = bs
+	return bs, true
+}
+
 // handleListAgents returns all registered agents.
 func (s *Server) handleListAgents(w http.ResponseWriter, r *http.Request) {
 	setCORS(w)
@@ -313,7 +533,9 @@ func (s *Server) handleListAgents(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// handleEventStream sends real-time events to UI clients via SSE.
+// handleEventStream sends real-time events to UI clients via SSE. When a
+// client does not keep up and misses events, it is sent a "resync" event,
+// upon which it should reload its coverage from /api/coverage/blocks.
 func (s *Server) handleEventStream(w http.ResponseWriter, r *http.Request) {
 	setCORS(w)
 	w.Header().Set("Content-Type", "text/event-stream")
@@ -326,18 +548,23 @@ func (s *Server) handleEventStream(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ch, cancel := s.hub.Subscribe(4096)
-	defer cancel()
+	sub := s.hub.Subscribe(4096)
+	defer sub.Cancel()
+	flusher.Flush()
 
 	ctx := r.Context()
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case ev, ok := <-ch:
-			if !ok {
-				return
-			}
+		case <-sub.Missed:
+			// The client missed events. The queued ones are already part
+			// of the coverage it reloads on a resync message.
+			sub.Skip()
+			data, _ := json.Marshal(map[string]uint64{"dropped_events": sub.Dropped()})
+			fmt.Fprintf(w, "event: resync\ndata: %s\n\n", data)
+			flusher.Flush()
+		case ev := <-sub.Events:
 			data, _ := json.Marshal(ev)
 			fmt.Fprintf(w, "data: %s\n\n", data)
 			flusher.Flush()
@@ -376,44 +603,24 @@ type CoverageSummaryEntry struct {
 func (s *Server) handleCoverageSummary(w http.ResponseWriter, r *http.Request) {
 	setCORS(w)
 
-	s.mu.RLock()
-	// Group by file
-	fileBlocks := make(map[string][]*blockState)
-	for _, bs := range s.blockStates {
-		fileBlocks[bs.File] = append(fileBlocks[bs.File], bs)
-	}
-	s.mu.RUnlock()
-
-	var entries []CoverageSummaryEntry
-	var totalStmts, hitStmts int
-
-	for file, blocks := range fileBlocks {
-		entry := CoverageSummaryEntry{File: file, TotalBlocks: len(blocks)}
-		for _, bs := range blocks {
-			entry.TotalStmts += bs.NumStmts
-			totalStmts += bs.NumStmts
-			if bs.HitCount > 0 {
-				entry.HitBlocks++
-				entry.HitStmts += bs.NumStmts
-				hitStmts += bs.NumStmts
-			}
-		}
-		if entry.TotalStmts > 0 {
-			entry.Percentage = float64(entry.HitStmts) / float64(entry.TotalStmts) * 100
-		}
-		entries = append(entries, entry)
-	}
-
-	var overallPct float64
-	if totalStmts > 0 {
-		overallPct = float64(hitStmts) / float64(totalStmts) * 100
+	summary := coverage.Summarize(s.coverageBlocks())
+	entries := make([]CoverageSummaryEntry, 0, len(summary.Files))
+	for _, fs := range summary.Files {
+		entries = append(entries, CoverageSummaryEntry{
+			File:        fs.File,
+			TotalBlocks: fs.TotalBlocks,
+			HitBlocks:   fs.HitBlocks,
+			TotalStmts:  fs.TotalStmts,
+			HitStmts:    fs.HitStmts,
+			Percentage:  fs.Percentage(),
+		})
 	}
 
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"files":        entries,
-		"total_stmts":  totalStmts,
-		"hit_stmts":    hitStmts,
-		"overall_pct":  overallPct,
+		"total_stmts":  summary.TotalStmts,
+		"hit_stmts":    summary.HitStmts,
+		"overall_pct":  summary.Percentage(),
 		"total_events": s.hub.TotalEvents(),
 	})
 }
@@ -428,6 +635,11 @@ type BlockDetail struct {
 	NumStmts  int    `json:"stmts"`
 	HitCount  uint64 `json:"hit_count"`
 	LastHitAt int64  `json:"last_hit_ts"` // unix ms
+
+	// LiveHits counts the hits reported by agents; HitCount also includes
+	// Imported, the hits of imported coverprofiles by label.
+	LiveHits uint64            `json:"live_hits"`
+	Imported map[string]uint64 `json:"imported,omitempty"`
 }
 
 // handleCoverageBlocks returns block-level coverage for a given file.
@@ -449,8 +661,10 @@ func (s *Server) handleCoverageBlocks(w http.ResponseWriter, r *http.Request) {
 			EndLine:   bs.EndLine,
 			EndCol:    bs.EndCol,
 			NumStmts:  bs.NumStmts,
-			HitCount:  bs.HitCount,
+			HitCount:  bs.totalHits(),
 			LastHitAt: bs.LastHitAt.UnixMilli(),
+			LiveHits:  bs.HitCount,
+			Imported:  maps.Clone(bs.Imported),
 		})
 	}
 	s.mu.RUnlock()
@@ -460,9 +674,97 @@ func (s *Server) handleCoverageBlocks(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// TestCoverage lists the blocks executed by a single test.
+type TestCoverage struct {
+	Name   string     `json:"name"`
+	Blocks []TestHits `json:"blocks"`
+	Stmts  int        `json:"stmts"` // statements covered by the test
+}
+
+// TestHits identifies a block executed by a test and how often it ran.
+type TestHits struct {
+	File     string `json:"file"`
+	BlockIdx int    `json:"block_idx"`
+	HitCount uint64 `json:"hit_count"`
+}
+
+// BlockTests lists the tests that executed a single block.
+type BlockTests struct {
+	File      string   `json:"file"`
+	BlockIdx  int      `json:"block_idx"`
+	StartLine int      `json:"sl"`
+	StartCol  int      `json:"sc"`
+	EndLine   int      `json:"el"`
+	EndCol    int      `json:"ec"`
+	Tests     []string `json:"tests"`
+}
+
+// handleCoverageTests returns per-test coverage attribution collected from
+// instrumented test binaries. It answers both "which tests cover this
+// block" (blocks) and "which blocks does this test cover" (tests).
+// Query param: file=<import_path/filename> (optional)
+func (s *Server) handleCoverageTests(w http.ResponseWriter, r *http.Request) {
+	setCORS(w)
+	fileQuery := r.URL.Query().Get("file")
+
+	byTest := make(map[string]*TestCoverage)
+	var blocks []BlockTests
+	s.mu.RLock()
+	for _, bs := range s.blockStates {
+		if len(bs.Tests) == 0 || (fileQuery != "" && bs.File != fileQuery) {
+			continue
+		}
+		bt := BlockTests{
+			File:      bs.File,
+			BlockIdx:  bs.BlockIdx,
+			StartLine: bs.StartLine,
+			StartCol:  bs.StartCol,
+			EndLine:   bs.EndLine,
+			EndCol:    bs.EndCol,
+		}
+		for name, hits := range bs.Tests {
+			bt.Tests = append(bt.Tests, name)
+			tc, ok := byTest[name]
+			if !ok {
+				tc = &TestCoverage{Name: name}
+				byTest[name] = tc
+			}
+			tc.Blocks = append(tc.Blocks, TestHits{File: bs.File, BlockIdx: bs.BlockIdx, HitCount: hits})
+			tc.Stmts += bs.NumStmts
+		}
+		sort.Strings(bt.Tests)
+		blocks = append(blocks, bt)
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(blocks, func(i, j int) bool {
+		if blocks[i].File != blocks[j].File {
+			return blocks[i].File < blocks[j].File
+		}
+		return blocks[i].BlockIdx < blocks[j].BlockIdx
+	})
+	tests := make([]*TestCoverage, 0, len(byTest))
+	for _, tc := range byTest {
+		sort.Slice(tc.Blocks, func(i, j int) bool {
+			if tc.Blocks[i].File != tc.Blocks[j].File {
+				return tc.Blocks[i].File < tc.Blocks[j].File
+			}
+			return tc.Blocks[i].BlockIdx < tc.Blocks[j].BlockIdx
+		})
+		tests = append(tests, tc)
+	}
+	sort.Slice(tests, func(i, j int) bool { return tests[i].Name < tests[j].Name })
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"tests":  tests,
+		"blocks": blocks,
+	})
+}
+
 // handleSource serves source code from disk.
 // The coverage file path is like "module/path/pkg/file.go".
-// We strip the module prefix to get the relative path on disk.
+// We strip the module prefix to get the path relative to that module's
+// directory.
 func (s *Server) handleSource(w http.ResponseWriter, r *http.Request) {
 	setCORS(w)
 	fileQuery := r.URL.Query().Get("file")
@@ -471,13 +773,7 @@ func (s *Server) handleSource(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Strip module path prefix to get relative path
-	rel := fileQuery
-	if s.modulePath != "" && strings.HasPrefix(rel, s.modulePath+"/") {
-		rel = strings.TrimPrefix(rel, s.modulePath+"/")
-	}
-
-	absPath := filepath.Join(s.sourceRoot, rel)
+	absPath := s.resolveSource(fileQuery)
 	data, err := os.ReadFile(absPath)
 	if err != nil {
 		http.Error(w, "file not found", http.StatusNotFound)
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// sourceModule maps a module path to the directory holding its sources.
+type sourceModule struct {
+	Path string
+	Dir  string
+}
+
+// findSourceModules returns the modules whose sources are served from root:
+// every module of the go.work workspace that root belongs to, plus the module
+// in root itself. They are ordered by decreasing path length, so that nested
+// modules are matched before their parents.
+func findSourceModules(root string) []sourceModule {
+	var mods []sourceModule
+	seen := make(map[string]bool)
+	add := func(dir string) {
+		if path := readModulePath(dir); path != "" && !seen[path] {
+			seen[path] = true
+			mods = append(mods, sourceModule{Path: path, Dir: dir})
+		}
+	}
+
+	add(root)
+	if work := findGoWork(root); work != "" {
+		for _, dir := range readGoWorkUses(work) {
+			add(dir)
+		}
+	}
+
+	sort.SliceStable(mods, func(i, j int) bool { return len(mods[i].Path) > len(mods[j].Path) })
+	return mods
+}
+
+// findGoWork locates the go.work file for dir the way the go command does:
+// $GOWORK if set (and not "off"), else the nearest go.work in dir or a parent.
+func findGoWork(dir string) string {
+	switch env := os.Getenv("GOWORK"); env {
+	case "off":
+		return ""
+	case "":
+	default:
+		return env
+	}
+	for {
+		path := filepath.Join(dir, "go.work")
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// readGoWorkUses returns the absolute module directories listed by the use
+// directives of a go.work file.
+func readGoWorkUses(path string) []string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	base := filepath.Dir(path)
+
+	var dirs []string
+	inBlock := false
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+
+		var arg string
+		switch {
+		case inBlock && line == ")":
+			inBlock = false
+			continue
+		case inBlock:
+			arg = line
+		case line == "use (" || line == "use(":
+			inBlock = true
+			continue
+		case strings.HasPrefix(line, "use "):
+			arg = strings.TrimSpace(strings.TrimPrefix(line, "use"))
+		default:
+			continue
+		}
+		if arg == "" {
+			continue
+		}
+		if unq, err := strconv.Unquote(arg); err == nil {
+			arg = unq
+		}
+		if !filepath.IsAbs(arg) {
+			arg = filepath.Join(base, arg)
+		}
+		dirs = append(dirs, arg)
+	}
+	return dirs
+}
+
+// resolveSource maps a coverage file path like "module/path/pkg/file.go" to
+// a file on disk, using the directory of the module that owns the path.
+// Paths outside all known modules are taken relative to the source root.
+func (s *Server) resolveSource(file string) string {
+	return resolveSource(s.modules, s.sourceRoot, file)
+}
+
+func resolveSource(modules []sourceModule, root, file string) string {
+	for _, m := range modules {
+		if rel, ok := strings.CutPrefix(file, m.Path+"/"); ok {
+			return filepath.Join(m.Dir, rel)
+		}
+	}
+	return filepath.Join(root, file)
+}
+
+// SourceResolver returns a function that maps coverage file paths to files
+// under root the way /api/source does, for commands that read sources
+// without a server.
+func SourceResolver(root string) func(file string) string {
+	modules := findSourceModules(root)
+	return func(file string) string {
+		return resolveSource(modules, root, file)
+	}
+}
+
+// ImportPathResolver returns a function that maps a directory to its import
+// path in the modules served from root, the inverse of SourceResolver, for
+// commands that take package patterns relative to a directory. It reports
+// false for directories outside those modules.
+func ImportPathResolver(root string) func(dir string) (string, bool) {
+	modules := findSourceModules(root)
+	return func(dir string) (string, bool) {
+		return importPath(modules, dir)
+	}
+}
+
+func importPath(modules []sourceModule, dir string) (string, bool) {
+	best := -1
+	rel := ""
+	for i, m := range modules {
+		r, err := filepath.Rel(m.Dir, dir)
+		if err != nil || r == ".." || strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if best < 0 || len(m.Dir) > len(modules[best].Dir) {
+			best, rel = i, r
+		}
+	}
+	if best < 0 {
+		return "", false
+	}
+	if rel == "." {
+		return modules[best].Path, true
+	}
+	return modules[best].Path + "/" + filepath.ToSlash(rel), true
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// Stats describes the events received by a server and those lost on the
+// way from agents to UI clients.
+type Stats struct {
+	TotalEvents int `json:"total_events"`
+
+	// AgentDroppedEvents is the number of events agents dropped because
+	// their stream to the server could not keep up. These are missing from
+	// the coverage until the agent's next counter snapshot.
+	AgentDroppedEvents uint64 `json:"agent_dropped_events"`
+
+	// ClientDroppedEvents is the number of events dropped for UI clients
+	// that did not keep up with the server. The coverage is complete.
+	ClientDroppedEvents uint64 `json:"client_dropped_events"`
+
+	Agents  []AgentStats  `json:"agents"`
+	Clients []ClientStats `json:"clients"`
+}
+
+// AgentStats describes the events of an agent.
+type AgentStats struct {
+	ID            string `json:"id"`
+	Connected     bool   `json:"connected"`
+	DroppedEvents uint64 `json:"dropped_events"`
+}
+
+// stats returns the current event statistics.
+func (s *Server) stats() *Stats {
+	st := &Stats{
+		TotalEvents:         s.hub.TotalEvents(),
+		ClientDroppedEvents: s.hub.DroppedEvents(),
+		Agents:              []AgentStats{},
+		Clients:             s.hub.Clients(),
+	}
+	for _, a := range s.agents.List() {
+		st.AgentDroppedEvents += a.DroppedEvents
+		st.Agents = append(st.Agents, AgentStats{
+			ID:            a.Info.ID,
+			Connected:     a.Connected,
+			DroppedEvents: a.DroppedEvents,
+		})
+	}
+	// IDs are assigned in registration order.
+	sort.Slice(st.Agents, func(i, j int) bool {
+		a, b := st.Agents[i].ID, st.Agents[j].ID
+		return len(a) < len(b) || (len(a) == len(b) && a < b)
+	})
+	return st
+}
+
+// handleStats returns the event statistics.
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	setCORS(w)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.stats())
+}
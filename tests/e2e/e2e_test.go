@@ -2,18 +2,32 @@ package e2e
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
+
+	"github.com/gococo/gococo/internal/coverage"
+	"github.com/gococo/gococo/internal/event"
+	"github.com/gococo/gococo/internal/protocol"
 )
 
 // =============================================================================
@@ -48,7 +62,7 @@ func TestMain(m *testing.M) {
 
 // testEnv manages a gococo server + instrumented app for one test.
 type testEnv struct {
-	t          *testing.T
+	t          testing.TB
 	serverAddr string
 	serverCmd  *exec.Cmd
 	appCmd     *exec.Cmd
@@ -56,7 +70,7 @@ type testEnv struct {
 	tmpDir     string
 }
 
-func newTestEnv(t *testing.T) *testEnv {
+func newTestEnv(t testing.TB) *testEnv {
 	t.Helper()
 	tmp, err := os.MkdirTemp("", "gococo-e2e-*")
 	if err != nil {
@@ -77,7 +91,7 @@ func (e *testEnv) cleanup() {
 	os.RemoveAll(e.tmpDir)
 }
 
-func freePort(t *testing.T) string {
+func freePort(t testing.TB) string {
 	t.Helper()
 	ln, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
@@ -88,12 +102,16 @@ func freePort(t *testing.T) string {
 	return addr
 }
 
-// startServer starts a gococo server on a random port.
-func (e *testEnv) startServer() {
+// startServer starts a gococo server on e.serverAddr, or a random port if
+// it is not set, passing flags to gococo server.
+func (e *testEnv) startServer(flags ...string) {
 	e.t.Helper()
-	e.serverAddr = freePort(e.t)
+	if e.serverAddr == "" {
+		e.serverAddr = freePort(e.t)
+	}
 
-	e.serverCmd = exec.Command(gococoBinary, "server", "--addr", e.serverAddr)
+	args := append([]string{"server", "--addr", e.serverAddr}, flags...)
+	e.serverCmd = exec.Command(gococoBinary, args...)
 	e.serverCmd.Stderr = os.Stderr
 	if err := e.serverCmd.Start(); err != nil {
 		e.t.Fatalf("start server: %v", err)
@@ -112,14 +130,16 @@ func (e *testEnv) startServer() {
 	e.t.Fatal("server did not start in time")
 }
 
-// instrumentAndBuild instruments a test project and builds it.
-func (e *testEnv) instrumentAndBuild(projectDir string) string {
+// instrumentAndBuild instruments a test project and builds it, passing
+// flags to gococo build.
+func (e *testEnv) instrumentAndBuild(projectDir string, flags ...string) string {
 	e.t.Helper()
 	absProject, _ := filepath.Abs(projectDir)
 	binaryName := filepath.Base(absProject) + "-instrumented"
 	outputPath := filepath.Join(e.tmpDir, binaryName)
 
-	cmd := exec.Command(gococoBinary, "build", "--host", e.serverAddr, "-o", outputPath, ".")
+	args := append([]string{"build", "--host", e.serverAddr, "-o", outputPath}, flags...)
+	cmd := exec.Command(gococoBinary, append(args, ".")...)
 	cmd.Dir = absProject
 	cmd.Stderr = os.Stderr
 	if err := cmd.Run(); err != nil {
@@ -128,11 +148,12 @@ func (e *testEnv) instrumentAndBuild(projectDir string) string {
 	return outputPath
 }
 
-// startApp starts the instrumented binary and waits for it to print its listen address.
-func (e *testEnv) startApp(binaryPath string) {
+// startApp starts the instrumented binary, with env added to its
+// environment, and waits for it to print its listen address.
+func (e *testEnv) startApp(binaryPath string, env ...string) {
 	e.t.Helper()
 	e.appCmd = exec.Command(binaryPath)
-	e.appCmd.Env = append(os.Environ(), "PORT=0")
+	e.appCmd.Env = append(append(os.Environ(), "PORT=0"), env...)
 
 	stdout, err := e.appCmd.StdoutPipe()
 	if err != nil {
@@ -429,3 +450,1920 @@ func TestE2E_InstrumentAndBuild_Compiles(t *testing.T) {
 		})
 	}
 }
+
+// TestE2E_Toolexec verifies that --toolexec instruments a dependency from
+// another module and that its blocks are reported by the same agent as the
+// main module's.
+func TestE2E_Toolexec(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip e2e in short mode")
+	}
+
+	env := newTestEnv(t)
+	defer env.cleanup()
+	env.startServer()
+
+	binary := env.instrumentAndBuild("testprojects/withdep", "--toolexec", "--instrument-pkgs", "testproject/extlib/...")
+	env.startApp(binary)
+
+	if body := env.hitEndpoint("/double"); body != "42" {
+		t.Fatalf("/double = %q, want 42", body)
+	}
+	env.waitForEvents(1, 5*time.Second)
+	time.Sleep(500 * time.Millisecond)
+
+	cs := env.getCoverageSummary()
+	lib := env.findFile(cs, "testproject/extlib/extlib.go")
+	if lib == nil {
+		t.Fatalf("extlib.go not in coverage: %+v", cs.Files)
+	}
+	if lib.HitBlocks == 0 || lib.HitBlocks == lib.TotalBlocks {
+		t.Errorf("extlib.go: %d/%d blocks hit, want partial coverage", lib.HitBlocks, lib.TotalBlocks)
+	}
+	if main := env.findFile(cs, "testproject/withdep/main.go"); main == nil || main.HitBlocks == 0 {
+		t.Errorf("main.go not covered: %+v", main)
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/api/agents", env.serverAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var agents struct {
+		Agents []json.RawMessage `json:"agents"`
+	}
+	json.NewDecoder(resp.Body).Decode(&agents)
+	if len(agents.Agents) != 1 {
+		t.Errorf("expected one agent for both modules, got %d", len(agents.Agents))
+	}
+}
+
+// TestE2E_Filters verifies that excluded packages and generated files are
+// compiled unchanged, reported in the build summary and absent from coverage.
+func TestE2E_Filters(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip e2e in short mode")
+	}
+
+	env := newTestEnv(t)
+	defer env.cleanup()
+	env.startServer()
+
+	binary := filepath.Join(env.tmpDir, "multipkg-filtered")
+	cmd := exec.Command(gococoBinary, "build", "--host", env.serverAddr, "-o", binary,
+		"--exclude", "testproject/multipkg/greeting", ".")
+	cmd.Dir = "testprojects/multipkg"
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("build: %v\n%s", err, out)
+	}
+	for _, want := range []string{
+		"testproject/multipkg/greeting/greeting.go (excluded)",
+		"testproject/multipkg/calc/op_string.go (generated)",
+	} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("build summary does not report %q:\n%s", want, out)
+		}
+	}
+
+	env.startApp(binary)
+	if body := env.hitEndpoint("/greet"); body != "Hello, world!" {
+		t.Errorf("excluded package misbehaves: /greet = %q", body)
+	}
+	env.hitEndpoint("/add")
+	env.waitForEvents(1, 5*time.Second)
+
+	cs := env.getCoverageSummary()
+	if env.findFile(cs, "calc/calc.go") == nil {
+		t.Error("calc.go missing from coverage")
+	}
+	for _, f := range []string{"greeting/greeting.go", "calc/op_string.go"} {
+		if env.findFile(cs, f) != nil {
+			t.Errorf("%s should not be instrumented", f)
+		}
+	}
+}
+
+// TestE2E_CrossCompile verifies that the files gococo instruments are the
+// ones the build compiles for the target platform and build tags, whether
+// they come from flags or from the environment.
+func TestE2E_CrossCompile(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip e2e in short mode")
+	}
+
+	tests := []struct {
+		name  string
+		env   []string
+		flags []string
+		want  []string
+	}{
+		{"windows tags flag", []string{"GOOS=windows", "GOARCH=amd64"}, []string{"-tags", "integration"},
+			[]string{"platform_windows.go", "variant_integration.go"}},
+		{"linux arm64 GOFLAGS", []string{"GOOS=linux", "GOARCH=arm64", "GOFLAGS=-tags=integration"}, nil,
+			[]string{"platform_linux.go", "variant_integration.go"}},
+		{"darwin default", []string{"GOOS=darwin", "GOARCH=arm64"}, nil,
+			[]string{"platform_other.go", "variant_default.go"}},
+	}
+	all := []string{
+		"platform_linux.go", "platform_windows.go", "platform_other.go",
+		"variant_integration.go", "variant_default.go",
+	}
+
+	env := newTestEnv(t)
+	defer env.cleanup()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"build", "--debug", "-o", filepath.Join(env.tmpDir, "crossbuild")}, tt.flags...)
+			cmd := exec.Command(gococoBinary, append(args, ".")...)
+			cmd.Dir = "testprojects/crossbuild"
+			cmd.Env = append(os.Environ(), append([]string{"GOFLAGS="}, tt.env...)...)
+			out, err := cmd.CombinedOutput()
+			if err != nil {
+				t.Fatalf("build: %v\n%s", err, out)
+			}
+
+			// --debug keeps the overlay, which lists the instrumented files.
+			var tmp string
+			for _, line := range strings.Split(string(out), "\n") {
+				if v, ok := strings.CutPrefix(line, "[gococo] temp dir: "); ok {
+					tmp = v
+				}
+			}
+			if tmp == "" {
+				t.Fatalf("no temp dir in output:\n%s", out)
+			}
+			defer os.RemoveAll(tmp)
+			data, err := os.ReadFile(filepath.Join(tmp, "overlay.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ov struct{ Replace map[string]string }
+			if err := json.Unmarshal(data, &ov); err != nil {
+				t.Fatal(err)
+			}
+			instrumented := make(map[string]bool)
+			for path := range ov.Replace {
+				instrumented[filepath.Base(path)] = true
+			}
+
+			for _, f := range all {
+				want := false
+				for _, w := range tt.want {
+					want = want || w == f
+				}
+				if instrumented[f] != want {
+					t.Errorf("%s instrumented = %v, want %v", f, instrumented[f], want)
+				}
+			}
+		})
+	}
+}
+
+// TestE2E_Workspace verifies that in a go.work workspace the modules the
+// main package depends on are instrumented, and that the server resolves
+// their sources against each module's directory.
+func TestE2E_Workspace(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip e2e in short mode")
+	}
+
+	workspace, _ := filepath.Abs("testprojects/workspace")
+	env := newTestEnv(t)
+	defer env.cleanup()
+	env.startServer("--root", workspace)
+
+	// Workspace mode rejects -mod=mod, which may be set in the environment.
+	t.Setenv("GOFLAGS", "")
+	binary := env.instrumentAndBuild("testprojects/workspace/app")
+	env.startApp(binary)
+
+	if body := env.hitEndpoint("/greet?name=gopher"); body != "hello, gopher" {
+		t.Fatalf("/greet = %q", body)
+	}
+	env.waitForEvents(1, 5*time.Second)
+	time.Sleep(500 * time.Millisecond)
+
+	cs := env.getCoverageSummary()
+	lib := env.findFile(cs, "testproject/workspace/lib/lib.go")
+	if lib == nil || lib.HitBlocks == 0 {
+		t.Fatalf("lib.go from the lib module not covered: %+v", cs.Files)
+	}
+
+	for file, want := range map[string]string{
+		"testproject/workspace/lib/lib.go":  "func Greet",
+		"testproject/workspace/app/main.go": "lib.Greet",
+	} {
+		resp, err := http.Get(fmt.Sprintf("http://%s/api/source?file=%s", env.serverAddr, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), want) {
+			t.Errorf("/api/source?file=%s: status %d, body %q", file, resp.StatusCode, body)
+		}
+	}
+}
+
+// TestE2E_TestMode verifies that `gococo test` runs a package's tests with
+// the agent linked in, including a package that declares its own TestMain,
+// and that coverage reaches the server before the test binary exits.
+func TestE2E_TestMode(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip e2e in short mode")
+	}
+
+	env := newTestEnv(t)
+	defer env.cleanup()
+	env.startServer()
+
+	absProject, _ := filepath.Abs("testprojects/withtests")
+	cmd := exec.Command(gococoBinary, "test", "--host", env.serverAddr, "-v", "./...")
+	cmd.Dir = absProject
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("gococo test: %v\n%s", err, out)
+	}
+	for _, want := range []string{"--- PASS: TestAbs", "--- PASS: TestClamp"} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("output missing %q:\n%s", want, out)
+		}
+	}
+
+	cs := env.getCoverageSummary()
+	mathFile := env.findFile(cs, "mathx/mathx.go")
+	if mathFile == nil {
+		t.Fatalf("mathx.go missing from coverage: %+v", cs.Files)
+	}
+	t.Logf("mathx.go: %d/%d stmts", mathFile.HitStmts, mathFile.TotalStmts)
+	if mathFile.HitStmts == 0 {
+		t.Error("mathx.go should be covered by its tests")
+	}
+	if mathFile.Percentage >= 100.0 {
+		t.Error("mathx.go should not be fully covered (Sign is untested)")
+	}
+
+	// Per-test attribution: subtests and tests in the external test
+	// package are reported by name.
+	resp, err := http.Get(fmt.Sprintf("http://%s/api/coverage/tests?file=%s", env.serverAddr, mathFile.File))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var tc struct {
+		Tests []struct {
+			Name   string `json:"name"`
+			Blocks []struct {
+				BlockIdx int `json:"block_idx"`
+			} `json:"blocks"`
+		} `json:"tests"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tc); err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]int)
+	for _, test := range tc.Tests {
+		names[test.Name] = len(test.Blocks)
+	}
+	t.Logf("tests: %v", names)
+	for _, want := range []string{"TestAbs/negative", "TestAbs/positive", "TestClamp"} {
+		if names[want] == 0 {
+			t.Errorf("no blocks attributed to %s", want)
+		}
+	}
+}
+
+// TestE2E_AgentBinaryStream verifies that the version 3 event stream the
+// agent sends decodes with protocol.Decoder: sequence numbers count the
+// events, files are those registered, and test names are cut to
+// protocol.MaxTestName.
+func TestE2E_AgentBinaryStream(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip e2e in short mode")
+	}
+
+	// A server that decodes the agent's streams as they come.
+	var mu sync.Mutex
+	files := make(map[uint64]string)
+	var streams [][]protocol.BinaryEvent
+	var streamErrs []error
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/internal/register", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "agent-1")
+	})
+	mux.HandleFunc("/api/internal/register-blocks", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		for _, line := range strings.Split(string(body), "\n") {
+			if rest, ok := strings.CutPrefix(line, "#file|"); ok {
+				id, file, _ := strings.Cut(rest, "|")
+				n, _ := strconv.ParseUint(id, 10, 64)
+				files[n] = file
+			}
+		}
+		w.Header().Set("Gococo-Event-Versions", "1,2,3")
+	})
+	mux.HandleFunc("/api/internal/counters", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/api/internal/events", func(w http.ResponseWriter, r *http.Request) {
+		var events []protocol.BinaryEvent
+		err := fmt.Errorf("content type %q", r.Header.Get("Content-Type"))
+		if strings.HasPrefix(r.Header.Get("Content-Type"), protocol.BinaryMediaType) {
+			dec := protocol.NewDecoder(r.Body)
+			for {
+				var ev protocol.BinaryEvent
+				if ev, err = dec.Next(); err != nil {
+					break
+				}
+				events = append(events, ev)
+			}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		streams = append(streams, events)
+		if err != io.EOF {
+			streamErrs = append(streamErrs, err)
+		}
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	absProject, _ := filepath.Abs("testprojects/testnames")
+	cmd := exec.Command(gococoBinary, "test", "--host", strings.TrimPrefix(srv.URL, "http://"), "./...")
+	cmd.Dir = absProject
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("gococo test: %v\n%s", err, out)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(streamErrs) > 0 {
+		t.Fatalf("streams did not decode: %v", streamErrs)
+	}
+	if len(streams) == 0 {
+		t.Fatal("the agent sent no event stream")
+	}
+	tests := make(map[string]bool)
+	for _, events := range streams {
+		for i, ev := range events {
+			if ev.Seq != uint64(i+1) {
+				t.Fatalf("event %d has seq %d", i, ev.Seq)
+			}
+			if _, ok := files[ev.File]; !ok {
+				t.Fatalf("event %d names unregistered file %d", i, ev.File)
+			}
+			tests[ev.Test] = true
+		}
+	}
+	long := ("TestLongName/" + strings.Repeat("x", 40000))[:protocol.MaxTestName]
+	if !tests["TestDouble"] || !tests[long] {
+		names := make([]string, 0, len(tests))
+		for name := range tests {
+			names = append(names, fmt.Sprintf("%.40s (%d bytes)", name, len(name)))
+		}
+		t.Errorf("expected events of TestDouble and of the cut long test, got %v", names)
+	}
+}
+
+// TestE2E_TestMode_Parallel verifies that the events of parallel subtests
+// are attributed to the subtest that emitted them.
+func TestE2E_TestMode_Parallel(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip e2e in short mode")
+	}
+
+	env := newTestEnv(t)
+	defer env.cleanup()
+	env.startServer()
+
+	absProject, _ := filepath.Abs("testprojects/withtests")
+	cmd := exec.Command(gococoBinary, "test", "--host", env.serverAddr, "-v", "-parallel", "2", "-run", "TestAbsParallel", "./mathx")
+	cmd.Dir = absProject
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("gococo test: %v\n%s", err, out)
+	}
+	for _, want := range []string{"--- PASS: TestAbsParallel/negative", "--- PASS: TestAbsParallel/positive"} {
+		if !strings.Contains(string(out), want) {
+			t.Fatalf("output missing %q:\n%s", want, out)
+		}
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/api/coverage/tests?file=testproject/withtests/mathx/mathx.go", env.serverAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var tc struct {
+		Blocks []struct {
+			StartLine int      `json:"sl"`
+			EndLine   int      `json:"el"`
+			Tests     []string `json:"tests"`
+		} `json:"blocks"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tc); err != nil {
+		t.Fatal(err)
+	}
+	// Line 6 is "return -x" and line 8 "return x" in Abs.
+	want := map[int]string{6: "TestAbsParallel/negative", 8: "TestAbsParallel/positive"}
+	for line, test := range want {
+		found := false
+		for _, b := range tc.Blocks {
+			if b.StartLine <= line && line <= b.EndLine && (line == 8 || b.EndLine < 8) {
+				found = true
+				if len(b.Tests) != 1 || b.Tests[0] != test {
+					t.Errorf("block %d-%d attributed to %v, want [%s]", b.StartLine, b.EndLine, b.Tests, test)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("no attributed block covers line %d: %+v", line, tc.Blocks)
+		}
+	}
+}
+
+// TestE2E_TestMode_ExitCode verifies that failing tests fail `gococo test`.
+func TestE2E_TestMode_ExitCode(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip e2e in short mode")
+	}
+
+	env := newTestEnv(t)
+	defer env.cleanup()
+	env.startServer()
+
+	absProject, _ := filepath.Abs("testprojects/withtests")
+	cmd := exec.Command(gococoBinary, "test", "--host", env.serverAddr, "-run", "TestFailOnRequest", "./...")
+	cmd.Dir = absProject
+	cmd.Env = append(os.Environ(), "WITHTESTS_FAIL=1")
+	err := cmd.Run()
+	var ee *exec.ExitError
+	if !errors.As(err, &ee) || ee.ExitCode() == 0 {
+		t.Fatalf("expected non-zero exit, got %v", err)
+	}
+}
+
+// TestE2E_CoverModeRace verifies that tests built with -race use atomic
+// counters by default, and that count mode is reported by the race detector.
+func TestE2E_CoverModeRace(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip e2e in short mode")
+	}
+
+	env := newTestEnv(t)
+	defer env.cleanup()
+	env.startServer()
+
+	absProject, _ := filepath.Abs("testprojects/withtests")
+	run := func(flags ...string) (string, error) {
+		args := append([]string{"test", "--host", env.serverAddr, "-race", "-run", "TestAbsConcurrent", "-count=1"}, flags...)
+		cmd := exec.Command(gococoBinary, append(args, "./...")...)
+		cmd.Dir = absProject
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+
+	out, err := run()
+	if err != nil {
+		t.Fatalf("gococo test -race: %v\n%s", err, out)
+	}
+	if !strings.Contains(out, "covermode=atomic") {
+		t.Errorf("-race should default to atomic mode:\n%s", out)
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/api/agents", env.serverAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var agents struct {
+		Agents []struct {
+			Info struct {
+				CoverMode string `json:"cover_mode"`
+			}
+		} `json:"agents"`
+	}
+	json.NewDecoder(resp.Body).Decode(&agents)
+	if len(agents.Agents) == 0 || agents.Agents[0].Info.CoverMode != "atomic" {
+		t.Errorf("agent should register with cover_mode atomic: %+v", agents.Agents)
+	}
+
+	out, err = run("--covermode=count")
+	if err == nil || !strings.Contains(out, "DATA RACE") {
+		t.Errorf("count mode under -race should report a data race, got %v:\n%s", err, out)
+	}
+}
+
+// TestE2E_ExportProfile verifies that `gococo export` writes a coverprofile
+// that `go tool cover` accepts and that agrees with the server's summary.
+func TestE2E_ExportProfile(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip e2e in short mode")
+	}
+
+	env := newTestEnv(t)
+	defer env.cleanup()
+	env.startServer()
+
+	absProject, _ := filepath.Abs("testprojects/withtests")
+	cmd := exec.Command(gococoBinary, "test", "--host", env.serverAddr, "-run", "TestAbs$|TestClamp", "./...")
+	cmd.Dir = absProject
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("gococo test: %v\n%s", err, out)
+	}
+
+	profile := filepath.Join(env.tmpDir, "cover.out")
+	cmd = exec.Command(gococoBinary, "export", "--server", env.serverAddr, "--format=coverprofile", "-o", profile)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("gococo export: %v\n%s", err, out)
+	}
+	data, _ := os.ReadFile(profile)
+	if !strings.HasPrefix(string(data), "mode: count\n") {
+		t.Errorf("profile should start with the count mode line:\n%s", data)
+	}
+
+	cmd = exec.Command("go", "tool", "cover", "-func", profile)
+	cmd.Dir = absProject
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("go tool cover: %v\n%s\nprofile:\n%s", err, out, data)
+	}
+	t.Logf("go tool cover -func:\n%s", out)
+
+	funcs := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if f := strings.Fields(line); len(f) == 3 {
+			funcs[f[1]] = f[2]
+		}
+	}
+	if funcs["Abs"] != "100.0%" {
+		t.Errorf("Abs coverage = %s, want 100.0%%", funcs["Abs"])
+	}
+	if funcs["Sign"] != "0.0%" {
+		t.Errorf("Sign coverage = %s, want 0.0%%", funcs["Sign"])
+	}
+	cs := env.getCoverageSummary()
+	if want := fmt.Sprintf("%.1f%%", cs.OverallPct); funcs["(statements)"] != want {
+		t.Errorf("total = %s, server summary says %s", funcs["(statements)"], want)
+	}
+}
+
+// TestE2E_ExportLCOVCobertura verifies the LCOV and Cobertura exports:
+// paths relative to the server's source root, line hits from block ranges and
+// rates matching the coverage summary.
+func TestE2E_ExportLCOVCobertura(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip e2e in short mode")
+	}
+
+	absProject, _ := filepath.Abs("testprojects/withtests")
+	env := newTestEnv(t)
+	defer env.cleanup()
+	env.startServer("--root", absProject)
+
+	cmd := exec.Command(gococoBinary, "test", "--host", env.serverAddr, "-run", "TestAbs$|TestClamp", "./...")
+	cmd.Dir = absProject
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("gococo test: %v\n%s", err, out)
+	}
+	export := func(format string) string {
+		out, err := exec.Command(gococoBinary, "export", "--server", env.serverAddr, "--format", format).Output()
+		if err != nil {
+			t.Fatalf("gococo export --format %s: %v", format, err)
+		}
+		return string(out)
+	}
+
+	// Abs runs fully, through both of its returns; Sign never runs.
+	lcov := export("lcov")
+	t.Logf("lcov:\n%s", lcov)
+	for _, want := range []string{"SF:mathx/mathx.go\n", "DA:5,", "DA:6,", "end_of_record\n"} {
+		if !strings.Contains(lcov, want) {
+			t.Errorf("lcov missing %q", want)
+		}
+	}
+	if strings.Contains(lcov, "DA:6,0") {
+		t.Error("line 6 (return -x) should be hit by TestAbs/negative")
+	}
+	if !strings.Contains(lcov, "DA:26,0") {
+		t.Error("line 26 (return -1 in Sign) should be uncovered")
+	}
+
+	var report struct {
+		LineRate string   `xml:"line-rate,attr"`
+		Sources  []string `xml:"sources>source"`
+		Packages []struct {
+			Name    string `xml:"name,attr"`
+			Classes []struct {
+				Filename string `xml:"filename,attr"`
+				LineRate string `xml:"line-rate,attr"`
+			} `xml:"classes>class"`
+		} `xml:"packages>package"`
+	}
+	cobertura := export("cobertura")
+	if err := xml.Unmarshal([]byte(cobertura), &report); err != nil {
+		t.Fatalf("invalid Cobertura XML: %v\n%s", err, cobertura)
+	}
+	if len(report.Sources) != 1 || report.Sources[0] != absProject {
+		t.Errorf("sources = %v, want [%s]", report.Sources, absProject)
+	}
+	if len(report.Packages) != 1 || report.Packages[0].Name != "testproject/withtests/mathx" ||
+		len(report.Packages[0].Classes) != 1 || report.Packages[0].Classes[0].Filename != "mathx/mathx.go" {
+		t.Fatalf("unexpected packages: %+v", report.Packages)
+	}
+	cs := env.getCoverageSummary()
+	if want := fmt.Sprintf("%.4f", cs.OverallPct/100); report.LineRate != want {
+		t.Errorf("line-rate = %s, summary says %s", report.LineRate, want)
+	}
+}
+
+// TestE2E_ExportSARIF verifies that uncovered blocks are exported as SARIF
+// results located in the source tree and attributed to their functions.
+func TestE2E_ExportSARIF(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip e2e in short mode")
+	}
+
+	absProject, _ := filepath.Abs("testprojects/withtests")
+	env := newTestEnv(t)
+	defer env.cleanup()
+	env.startServer("--root", absProject)
+
+	cmd := exec.Command(gococoBinary, "test", "--host", env.serverAddr, "-run", "TestAbs$|TestClamp", "./...")
+	cmd.Dir = absProject
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("gococo test: %v\n%s", err, out)
+	}
+	out, err := exec.Command(gococoBinary, "export", "--server", env.serverAddr,
+		"--format=sarif", "--rule-id", "coverage/uncovered", "--level", "error").Output()
+	if err != nil {
+		t.Fatalf("gococo export: %v", err)
+	}
+
+	var log struct {
+		Version string `json:"version"`
+		Runs    []struct {
+			Results []struct {
+				RuleID    string `json:"ruleId"`
+				Level     string `json:"level"`
+				Locations []struct {
+					PhysicalLocation struct {
+						ArtifactLocation struct {
+							URI string `json:"uri"`
+						} `json:"artifactLocation"`
+						Region struct {
+							StartLine int `json:"startLine"`
+						} `json:"region"`
+					} `json:"physicalLocation"`
+					LogicalLocations []struct {
+						FullyQualifiedName string `json:"fullyQualifiedName"`
+					} `json:"logicalLocations"`
+				} `json:"locations"`
+			} `json:"results"`
+		} `json:"runs"`
+	}
+	if err := json.Unmarshal(out, &log); err != nil {
+		t.Fatalf("invalid SARIF: %v\n%s", err, out)
+	}
+	if log.Version != "2.1.0" || len(log.Runs) != 1 {
+		t.Fatalf("unexpected SARIF log:\n%s", out)
+	}
+
+	// Clamp(15, 0, 10) leaves two of Clamp's returns uncovered; Sign never runs.
+	funcs := make(map[string][]int)
+	for _, r := range log.Runs[0].Results {
+		loc := r.Locations[0]
+		if r.RuleID != "coverage/uncovered" || r.Level != "error" || loc.PhysicalLocation.ArtifactLocation.URI != "mathx/mathx.go" {
+			t.Errorf("unexpected result: %+v", r)
+		}
+		if len(loc.LogicalLocations) != 1 {
+			t.Fatalf("result without function: %+v", r)
+		}
+		fn := loc.LogicalLocations[0].FullyQualifiedName
+		funcs[fn] = append(funcs[fn], loc.PhysicalLocation.Region.StartLine)
+	}
+	t.Logf("uncovered: %v", funcs)
+	if len(funcs) != 2 || len(funcs["testproject/withtests/mathx.Clamp"]) != 2 || len(funcs["testproject/withtests/mathx.Sign"]) == 0 {
+		t.Errorf("expected uncovered blocks in Clamp and Sign only, got %v", funcs)
+	}
+}
+
+// TestE2E_ImportProfile verifies that a coverprofile from plain
+// `go test -coverprofile` is overlaid on live coverage block by block and
+// kept apart under its label.
+func TestE2E_ImportProfile(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip e2e in short mode")
+	}
+
+	absProject, _ := filepath.Abs("testprojects/withtests")
+	env := newTestEnv(t)
+	defer env.cleanup()
+	env.startServer()
+
+	// Live coverage from TestAbs, unit test coverage from TestClamp.
+	cmd := exec.Command(gococoBinary, "test", "--host", env.serverAddr, "-run", "TestAbs$", "./...")
+	cmd.Dir = absProject
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("gococo test: %v\n%s", err, out)
+	}
+	before := env.getCoverageSummary()
+
+	profile := filepath.Join(env.tmpDir, "unit.out")
+	cmd = exec.Command("go", "test", "-count=1", "-run", "TestClamp", "-coverprofile", profile, "./...")
+	cmd.Dir = absProject
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go test -coverprofile: %v\n%s", err, out)
+	}
+	out, err := exec.Command(gococoBinary, "import", "--server", env.serverAddr, "--label", "unit", profile).CombinedOutput()
+	if err != nil {
+		t.Fatalf("gococo import: %v\n%s", err, out)
+	}
+	t.Logf("%s", out)
+	// The blocks of go test and of gococo have the same layout.
+	if !strings.Contains(string(out), "(12 matched live blocks, 0 new)") {
+		t.Errorf("expected every imported block to match a live block")
+	}
+
+	after := env.getCoverageSummary()
+	if after.TotalStmts != before.TotalStmts || after.HitStmts <= before.HitStmts {
+		t.Errorf("import should add hits without adding statements: before %d/%d, after %d/%d",
+			before.HitStmts, before.TotalStmts, after.HitStmts, after.TotalStmts)
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/api/coverage/blocks?file=testproject/withtests/mathx/mathx.go", env.serverAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var blocks struct {
+		Blocks []struct {
+			StartLine int               `json:"sl"`
+			HitCount  uint64            `json:"hit_count"`
+			LiveHits  uint64            `json:"live_hits"`
+			Imported  map[string]uint64 `json:"imported"`
+		} `json:"blocks"`
+	}
+	json.NewDecoder(resp.Body).Decode(&blocks)
+	sources := make(map[int]string)
+	for _, b := range blocks.Blocks {
+		switch live, unit := b.LiveHits > 0, b.Imported["unit"] > 0; {
+		case live && unit:
+			sources[b.StartLine] = "both"
+		case live:
+			sources[b.StartLine] = "live"
+		case unit:
+			sources[b.StartLine] = "unit"
+		}
+		if b.HitCount != b.LiveHits+b.Imported["unit"] {
+			t.Errorf("block at line %d: hit_count %d != live %d + imported %d", b.StartLine, b.HitCount, b.LiveHits, b.Imported["unit"])
+		}
+	}
+	t.Logf("sources by block start line: %v", sources)
+	// Abs (body from line 5) ran live only, Clamp (body from line 13) under
+	// go test only.
+	if sources[5] != "live" || sources[13] != "unit" {
+		t.Errorf("unexpected block sources: %v", sources)
+	}
+
+	// Importing again with the same label replaces its hits.
+	exec.Command(gococoBinary, "import", "--server", env.serverAddr, "--label", "unit", profile).Run()
+	if again := env.getCoverageSummary(); again.HitStmts != after.HitStmts {
+		t.Errorf("re-import changed coverage: %d -> %d hit stmts", after.HitStmts, again.HitStmts)
+	}
+}
+
+// TestE2E_ReportHTML verifies that `gococo report` renders the same HTML
+// report from a live server and from a saved snapshot.
+func TestE2E_ReportHTML(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip e2e in short mode")
+	}
+
+	absProject, _ := filepath.Abs("testprojects/withtests")
+	env := newTestEnv(t)
+	defer env.cleanup()
+	env.startServer("--root", absProject)
+
+	cmd := exec.Command(gococoBinary, "test", "--host", env.serverAddr, "-run", "TestAbs$", "./...")
+	cmd.Dir = absProject
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("gococo test: %v\n%s", err, out)
+	}
+	gococo := func(args ...string) {
+		t.Helper()
+		if out, err := exec.Command(gococoBinary, args...).CombinedOutput(); err != nil {
+			t.Fatalf("gococo %s: %v\n%s", strings.Join(args, " "), err, out)
+		}
+	}
+
+	snapshot := filepath.Join(env.tmpDir, "snap.json")
+	live := filepath.Join(env.tmpDir, "live.html")
+	offline := filepath.Join(env.tmpDir, "offline.html")
+	gococo("export", "--server", env.serverAddr, "--format", "json", "-o", snapshot)
+	gococo("report", "--server", env.serverAddr, "--html", live)
+	// Without embedded sources, the snapshot's sources are read from --root.
+	gococo("report", "--snapshot", snapshot, "--root", absProject, "--html", offline)
+
+	for _, path := range []string{live, offline} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		html := string(data)
+		for _, want := range []string{
+			`<span class="name">testproject/withtests/mathx/</span>`,
+			`<span class="name">testproject/withtests/mathx/mathx.go</span>`,
+			`<td class="code">	if x &lt; 0 {</td>`,
+			`<tr class="miss"><td class="num">26</td>`,
+		} {
+			if !strings.Contains(html, want) {
+				t.Errorf("%s missing %q", filepath.Base(path), want)
+			}
+		}
+		if !regexp.MustCompile(`<tr class="hit"><td class="num">6</td><td class="hits">1</td><td class="last">\d{4}-\d\d-\d\d `).MatchString(html) {
+			t.Errorf("%s: line 6 should be hit once, with a last-hit time", filepath.Base(path))
+		}
+	}
+}
+
+// TestE2E_Merge verifies that `gococo merge` and /api/coverage/merge sum the
+// hits of snapshots and report files whose blocks differ.
+func TestE2E_Merge(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip e2e in short mode")
+	}
+
+	absProject, _ := filepath.Abs("testprojects/withtests")
+	env := newTestEnv(t)
+	defer env.cleanup()
+	env.startServer()
+
+	// a.json holds the coverage of TestAbs, b.json that of TestAbs and
+	// TestClamp.
+	snapshot := func(name, run string) string {
+		t.Helper()
+		cmd := exec.Command(gococoBinary, "test", "--host", env.serverAddr, "-run", run, "./...")
+		cmd.Dir = absProject
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("gococo test: %v\n%s", err, out)
+		}
+		path := filepath.Join(env.tmpDir, name)
+		if out, err := exec.Command(gococoBinary, "export", "--server", env.serverAddr, "--format", "json", "-o", path).CombinedOutput(); err != nil {
+			t.Fatalf("gococo export: %v\n%s", err, out)
+		}
+		return path
+	}
+	a := snapshot("a.json", "TestAbs$")
+	b := snapshot("b.json", "TestClamp$")
+	merged := filepath.Join(env.tmpDir, "merged.json")
+	out, err := exec.Command(gococoBinary, "merge", "-o", merged, a, b).CombinedOutput()
+	if err != nil {
+		t.Fatalf("gococo merge: %v\n%s", err, out)
+	}
+	t.Logf("%s", out)
+
+	read := func(path string) *coverage.Snapshot {
+		t.Helper()
+		snap, err := coverage.ReadSnapshot(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return snap
+	}
+	snapA, snapB, snapM := read(a), read(b), read(merged)
+	if len(snapM.Blocks) != len(snapA.Blocks) || len(snapM.Blocks) != len(snapB.Blocks) {
+		t.Fatalf("merged %d blocks from %d and %d", len(snapM.Blocks), len(snapA.Blocks), len(snapB.Blocks))
+	}
+	for i, m := range snapM.Blocks {
+		if m.HitCount != snapA.Blocks[i].HitCount+snapB.Blocks[i].HitCount {
+			t.Errorf("%s:%d: merged %d hits from %d and %d", m.File, m.StartLine, m.HitCount, snapA.Blocks[i].HitCount, snapB.Blocks[i].HitCount)
+		}
+		if m.LastHitAt != max(snapA.Blocks[i].LastHitAt, snapB.Blocks[i].LastHitAt) {
+			t.Errorf("%s:%d: last hit %d is not the latest", m.File, m.StartLine, m.LastHitAt)
+		}
+	}
+
+	// The server merges the same way.
+	body := &bytes.Buffer{}
+	for _, path := range []string{a, b} {
+		data, _ := os.ReadFile(path)
+		body.Write(data)
+	}
+	resp, err := http.Post(fmt.Sprintf("http://%s/api/coverage/merge", env.serverAddr), "application/json", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result struct {
+		Snapshot  coverage.Snapshot        `json:"snapshot"`
+		Conflicts []coverage.MergeConflict `json:"conflicts"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	resp.Body.Close()
+	if len(result.Conflicts) != 0 || !slices.Equal(result.Snapshot.Blocks, snapM.Blocks) {
+		t.Errorf("server merge differs from gococo merge: %+v", result)
+	}
+
+	// A snapshot of an edited mathx.go conflicts with a.json, so the file is
+	// merged from a.json only.
+	for i, blk := range snapB.Blocks {
+		if strings.HasSuffix(blk.File, "/mathx.go") {
+			snapB.Blocks[i].EndLine++
+			break
+		}
+	}
+	edited := filepath.Join(env.tmpDir, "edited.json")
+	data, _ := json.Marshal(snapB)
+	os.WriteFile(edited, data, 0o644)
+	out, err = exec.Command(gococoBinary, "merge", "-o", merged, a, edited).CombinedOutput()
+	var ee *exec.ExitError
+	if !errors.As(err, &ee) || ee.ExitCode() != 1 {
+		t.Fatalf("expected exit code 1 on conflicts, got %v\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "merge conflict: testproject/withtests/mathx/mathx.go: blocks in "+edited+" differ from "+a) {
+		t.Errorf("conflict not reported:\n%s", out)
+	}
+	for i, m := range read(merged).Blocks {
+		want := snapA.Blocks[i].HitCount
+		if !strings.HasSuffix(m.File, "/mathx.go") {
+			want += snapB.Blocks[i].HitCount
+		}
+		if m.HitCount != want {
+			t.Errorf("%s:%d: merged %d hits, want %d", m.File, m.StartLine, m.HitCount, want)
+		}
+	}
+}
+
+// TestE2E_Check verifies that `gococo check` resolves package patterns
+// relative to the current directory and fails on coverage below thresholds.
+func TestE2E_Check(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip e2e in short mode")
+	}
+
+	absProject, _ := filepath.Abs("testprojects/withtests")
+	env := newTestEnv(t)
+	defer env.cleanup()
+	env.startServer()
+
+	cmd := exec.Command(gococoBinary, "test", "--host", env.serverAddr, "-run", "TestAbs$", "./...")
+	cmd.Dir = absProject
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("gococo test: %v\n%s", err, out)
+	}
+	check := func(args ...string) (string, int) {
+		t.Helper()
+		cmd := exec.Command(gococoBinary, append([]string{"check", "--server", env.serverAddr}, args...)...)
+		cmd.Dir = absProject
+		out, err := cmd.CombinedOutput()
+		var ee *exec.ExitError
+		if errors.As(err, &ee) {
+			return string(out), ee.ExitCode()
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		return string(out), 0
+	}
+
+	// TestAbs covers Abs, 3 of the 12 statements of mathx.go.
+	out, code := check("--min", "20", "--min-file", "./mathx/mathx.go=25")
+	if code != 0 || !strings.Contains(out, "coverage check passed: 25.0% (3/12 stmts)") {
+		t.Errorf("expected the check to pass, got exit code %d:\n%s", code, out)
+	}
+
+	out, code = check("--min", "30", "--min-pkg", "./...=20", "--min-pkg", "./mathx=90", "--min-pkg", "./nope/...=10")
+	t.Logf("%s", out)
+	if code != 1 {
+		t.Errorf("expected exit code 1, got %d", code)
+	}
+	for _, want := range []string{
+		"no package or file matches testproject/withtests/nope/...",
+		"coverage check failed: 25.0% (3/12 stmts), 2 below threshold",
+		"total    -",
+		"package  testproject/withtests/mathx  25.0%     3/12   90.0%",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output missing %q", want)
+		}
+	}
+}
+
+// TestE2E_Diffcover verifies that `gococo diffcover` and /api/coverage/diff
+// report the coverage of the statements changed since a git revision.
+func TestE2E_Diffcover(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip e2e in short mode")
+	}
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+
+	// A git repository holding a copy of the withtests project.
+	env := newTestEnv(t)
+	defer env.cleanup()
+	repo := filepath.Join(env.tmpDir, "repo")
+	if err := os.CopyFS(repo, os.DirFS("testprojects/withtests")); err != nil {
+		t.Fatal(err)
+	}
+	git := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-c", "user.name=e2e", "-c", "user.email=e2e@example.com"}, args...)...)
+		cmd.Dir = repo
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+		}
+	}
+	git("init", "-q")
+	git("add", ".")
+	git("commit", "-q", "-m", "base")
+
+	// Add a function, with `return 200` on line 36, and an uncommitted test
+	// running the rest of it.
+	f, err := os.OpenFile(filepath.Join(repo, "mathx", "mathx.go"), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`
+// Double returns 2*x, saturating at 200.
+func Double(x int) int {
+	if x > 100 {
+		return 200
+	}
+	return 2 * x
+}
+`)
+	f.Close()
+	os.WriteFile(filepath.Join(repo, "mathx", "double_test.go"), []byte(`package mathx
+
+import "testing"
+
+func TestDouble(t *testing.T) {
+	if Double(3) != 6 {
+		t.Fatal("Double(3) != 6")
+	}
+}
+`), 0o644)
+
+	env.startServer("--root", repo)
+	cmd := exec.Command(gococoBinary, "test", "--host", env.serverAddr, "-run", "TestDouble", "./...")
+	cmd.Dir = repo
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("gococo test: %v\n%s", err, out)
+	}
+
+	cmd = exec.Command(gococoBinary, "diffcover", "--server", env.serverAddr, "--base", "HEAD", "--min", "80")
+	cmd.Dir = repo
+	out, err := cmd.CombinedOutput()
+	t.Logf("%s", out)
+	var ee *exec.ExitError
+	if !errors.As(err, &ee) || ee.ExitCode() != 1 {
+		t.Errorf("expected exit code 1 below --min, got %v", err)
+	}
+	for _, want := range []string{
+		"66.7% (2/3 covered)",
+		"mathx/mathx.go  66.7%     2/3    36",
+		"below --min 80.0%",
+	} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("output missing %q", want)
+		}
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/api/coverage/diff?base=HEAD", env.serverAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var res struct {
+		TotalStmts int `json:"total_stmts"`
+		HitStmts   int `json:"hit_stmts"`
+		Files      []struct {
+			File  string `json:"file"`
+			Stmts []struct {
+				StartLine int  `json:"sl"`
+				Hit       bool `json:"hit"`
+			} `json:"stmts"`
+		} `json:"files"`
+	}
+	json.NewDecoder(resp.Body).Decode(&res)
+	if res.TotalStmts != 3 || res.HitStmts != 2 || len(res.Files) != 1 || res.Files[0].File != "testproject/withtests/mathx/mathx.go" {
+		t.Fatalf("unexpected diff coverage: %+v", res)
+	}
+	for _, s := range res.Files[0].Stmts {
+		if s.Hit != (s.StartLine != 36) {
+			t.Errorf("statement at line %d: hit = %v", s.StartLine, s.Hit)
+		}
+	}
+}
+
+// TestE2E_AgentModes verifies that an agent built with --agent-mode
+// optional does not delay startup and connects once a server appears, and
+// that GOCOCO_MODE=disabled keeps an agent from connecting.
+func TestE2E_AgentModes(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip e2e in short mode")
+	}
+
+	env := newTestEnv(t)
+	defer env.cleanup()
+	// The server starts on this address only after the app.
+	env.serverAddr = freePort(t)
+	bin := env.instrumentAndBuild("testprojects/singlefile", "--agent-mode", "optional")
+
+	start := time.Now()
+	env.startApp(bin)
+	// In required mode, registration would retry for 3 seconds first.
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("optional mode delayed startup by %v", d)
+	}
+	env.hitEndpoint("/branch-a")
+
+	env.startServer()
+	agents := func() int {
+		resp, err := http.Get(fmt.Sprintf("http://%s/api/agents", env.serverAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var list struct {
+			Agents []json.RawMessage `json:"agents"`
+		}
+		json.NewDecoder(resp.Body).Decode(&list)
+		return len(list.Agents)
+	}
+	// Hits before the connection arrive with the first counter snapshot.
+	deadline := time.Now().Add(15 * time.Second)
+	for {
+		if f := env.findFile(env.getCoverageSummary(), "main.go"); f != nil && f.HitStmts > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("optional agent did not report coverage (%d agents)", agents())
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	env.appCmd.Process.Kill()
+	env.appCmd.Wait()
+
+	// The same binary, disabled at run time.
+	env.startApp(bin, "GOCOCO_MODE=disabled")
+	env.hitEndpoint("/branch-b")
+	time.Sleep(time.Second)
+	if n := agents(); n != 1 {
+		t.Errorf("a disabled agent registered: %d agents", n)
+	}
+}
+
+// TestE2E_ConnectTimeout verifies that in required mode a program whose
+// server cannot be reached starts within the connect timeout, 3 seconds by
+// default or GOCOCO_CONNECT_TIMEOUT, keeping its coverage offline.
+func TestE2E_ConnectTimeout(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip e2e in short mode")
+	}
+
+	env := newTestEnv(t)
+	defer env.cleanup()
+	// No server listens on this address.
+	env.serverAddr = freePort(t)
+	bin := env.instrumentAndBuild("testprojects/cli")
+
+	for _, tc := range []struct {
+		env   string
+		limit time.Duration
+	}{
+		{"", 3 * time.Second},
+		{"GOCOCO_CONNECT_TIMEOUT=500ms", 500 * time.Millisecond},
+	} {
+		tmp := t.TempDir()
+		cmd := exec.Command(bin, "0")
+		cmd.Env = append(os.Environ(), "TMPDIR="+tmp, tc.env)
+		start := time.Now()
+		out, err := cmd.CombinedOutput()
+		elapsed := time.Since(start)
+		if err != nil {
+			t.Fatalf("%s: run cli: %v\n%s", tc.env, err, out)
+		}
+		// Allow for the program's start and the offline profile.
+		if elapsed > tc.limit+time.Second {
+			t.Errorf("%s: startup took %v, want at most %v", tc.env, elapsed, tc.limit)
+		}
+		if !strings.Contains(string(out), "could not connect to server") {
+			t.Errorf("%s: expected the agent to give up connecting:\n%s", tc.env, out)
+		}
+		if m, _ := filepath.Glob(filepath.Join(tmp, "gococo", "*.cov")); len(m) != 1 {
+			t.Errorf("%s: expected an offline profile, got %v", tc.env, m)
+		}
+	}
+}
+
+// runCLI runs the cli test project's binary and returns its exit code and
+// standard error.
+func runCLI(t *testing.T, bin string, args ...string) (int, string) {
+	t.Helper()
+	var stderr strings.Builder
+	cmd := exec.Command(bin, args...)
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	var ee *exec.ExitError
+	if err != nil && !errors.As(err, &ee) {
+		t.Fatalf("run cli: %v", err)
+	}
+	return cmd.ProcessState.ExitCode(), stderr.String()
+}
+
+// hitsByLine returns the server's hit counts of the blocks of file, by the
+// line each block starts on.
+func (e *testEnv) hitsByLine(file string) map[int]uint64 {
+	e.t.Helper()
+	resp, err := http.Get(fmt.Sprintf("http://%s/api/coverage/blocks?file=%s", e.serverAddr, file))
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var blocks struct {
+		Blocks []struct {
+			StartLine int    `json:"sl"`
+			HitCount  uint64 `json:"hit_count"`
+		} `json:"blocks"`
+	}
+	json.NewDecoder(resp.Body).Decode(&blocks)
+	hits := make(map[int]uint64)
+	for _, b := range blocks.Blocks {
+		hits[b.StartLine] += b.HitCount
+	}
+	return hits
+}
+
+// TestE2E_FinalFlush verifies that a program exiting right after startup,
+// before the agent's first counter snapshot, reports its coverage on
+// os.Exit and when main panics.
+func TestE2E_FinalFlush(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip e2e in short mode")
+	}
+
+	env := newTestEnv(t)
+	defer env.cleanup()
+	env.startServer()
+	bin := env.instrumentAndBuild("testprojects/cli")
+
+	if code, _ := runCLI(t, bin, "3", "quick"); code != 3 {
+		t.Errorf("expected exit code 3, got %d", code)
+	}
+	code, stderr := runCLI(t, bin, "panic", "boom")
+	if code != 2 || !strings.Contains(stderr, "panic: boom") {
+		t.Errorf("expected the panic to reach the runtime, got exit code %d:\n%s", code, stderr)
+	}
+
+	hits := env.hitsByLine("testproject/cli/main.go")
+	// Line 22 panics, line 37 starts the block ending in os.Exit(code).
+	if hits[22] == 0 || hits[37] == 0 {
+		t.Errorf("final flush missing: hits by block start line %v", hits)
+	}
+}
+
+// TestE2E_FinalFlush_LogFatal verifies that a program exiting through
+// log.Fatal logs its message and then reports its coverage.
+func TestE2E_FinalFlush_LogFatal(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip e2e in short mode")
+	}
+
+	env := newTestEnv(t)
+	defer env.cleanup()
+	env.startServer()
+	bin := env.instrumentAndBuild("testprojects/cli")
+
+	code, stderr := runCLI(t, bin, "fatal", "boom")
+	if code != 1 || !strings.Contains(stderr, "boom") {
+		t.Errorf("expected log.Fatal to log and exit with 1, got exit code %d:\n%s", code, stderr)
+	}
+	// Line 24 calls log.Fatal.
+	if hits := env.hitsByLine("testproject/cli/main.go"); hits[24] == 0 {
+		t.Errorf("final flush missing: hits by block start line %v", hits)
+	}
+}
+
+// TestE2E_FinalFlush_ExitWithoutBlocks verifies that a program calling
+// os.Exit from a file without coverage blocks reports its coverage.
+func TestE2E_FinalFlush_ExitWithoutBlocks(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip e2e in short mode")
+	}
+
+	env := newTestEnv(t)
+	defer env.cleanup()
+	env.startServer()
+	bin := env.instrumentAndBuild("testprojects/cli")
+
+	if code, _ := runCLI(t, bin, "exit"); code != 4 {
+		t.Errorf("expected exit code 4, got %d", code)
+	}
+	// Line 26 calls exit, whose file is ignored.
+	if hits := env.hitsByLine("testproject/cli/main.go"); hits[26] == 0 {
+		t.Errorf("final flush missing: hits by block start line %v", hits)
+	}
+}
+
+// TestE2E_CountersOnly verifies that without events, whether left out at
+// build time or turned off at run time, agents report exact hit counts
+// through periodic counter deltas, which the server adds up.
+func TestE2E_CountersOnly(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip e2e in short mode")
+	}
+
+	env := newTestEnv(t)
+	defer env.cleanup()
+	env.startServer()
+
+	branchAHits := func() uint64 {
+		resp, err := http.Get(fmt.Sprintf("http://%s/api/coverage/blocks?file=testproject/singlefile/main.go", env.serverAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var blocks struct {
+			Blocks []struct {
+				StartLine int    `json:"sl"`
+				HitCount  uint64 `json:"hit_count"`
+			} `json:"blocks"`
+		}
+		json.NewDecoder(resp.Body).Decode(&blocks)
+		for _, b := range blocks.Blocks {
+			if b.StartLine == 43 { // return n * 2
+				return b.HitCount
+			}
+		}
+		return 0
+	}
+	waitForHits := func(want uint64) {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for branchAHits() < want && time.Now().Before(deadline) {
+			time.Sleep(100 * time.Millisecond)
+		}
+		// Another interval must not add the same hits again.
+		time.Sleep(500 * time.Millisecond)
+		if got := branchAHits(); got != want {
+			t.Errorf("branchA hit count: got %d, want %d", got, want)
+		}
+	}
+
+	bin := env.instrumentAndBuild("testprojects/singlefile", "--no-events")
+	env.startApp(bin, "GOCOCO_COUNTERS_INTERVAL=100ms")
+	for range 3 {
+		env.hitEndpoint("/branch-a")
+	}
+	waitForHits(3)
+	env.appCmd.Process.Kill()
+	env.appCmd.Wait()
+
+	// Hits of another agent add up.
+	bin = env.instrumentAndBuild("testprojects/singlefile")
+	env.startApp(bin, "GOCOCO_EVENTS=off", "GOCOCO_COUNTERS_INTERVAL=100ms")
+	for range 2 {
+		env.hitEndpoint("/branch-a")
+	}
+	waitForHits(5)
+
+	if cs := env.getCoverageSummary(); cs.TotalEvents != 0 {
+		t.Errorf("expected no events, got %d", cs.TotalEvents)
+	}
+}
+
+// TestE2E_DroppedEvents verifies that the events agents report dropping and
+// those dropped for slow UI clients are counted, and that a client missing
+// events is told to resync.
+func TestE2E_DroppedEvents(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip e2e in short mode")
+	}
+
+	env := newTestEnv(t)
+	defer env.cleanup()
+	env.startServer()
+	base := "http://" + env.serverAddr
+
+	resp, err := http.Get(base + "/api/internal/register?hostname=test&pid=1&cmdline=test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	agentID := strings.TrimSpace(string(id))
+
+	type stats struct {
+		TotalEvents         int    `json:"total_events"`
+		AgentDroppedEvents  uint64 `json:"agent_dropped_events"`
+		ClientDroppedEvents uint64 `json:"client_dropped_events"`
+		Agents              []struct {
+			ID            string `json:"id"`
+			DroppedEvents uint64 `json:"dropped_events"`
+		} `json:"agents"`
+		Clients []struct {
+			DroppedEvents uint64 `json:"dropped_events"`
+		} `json:"clients"`
+	}
+	getStats := func() stats {
+		resp, err := http.Get(base + "/api/stats")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var st stats
+		if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+			t.Fatal(err)
+		}
+		return st
+	}
+
+	// A client that does not read its stream until the server gives up on
+	// sending it events.
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, base+"/api/events/stream", nil)
+	stream, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Body.Close()
+	for len(getStats().Clients) == 0 {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	const n = 200000
+	var body bytes.Buffer
+	body.WriteString("#dropped|7\n")
+	for i := 1; i <= n; i++ {
+		fmt.Fprintf(&body, "%d|%d|1|example.com/p/a.go|0|3|2|5|2|1\n", i, i)
+	}
+	resp, err = http.Post(base+"/api/internal/events?agent_id="+agentID, "text/plain", &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	st := getStats()
+	if st.TotalEvents != n {
+		t.Errorf("total_events = %d, want %d", st.TotalEvents, n)
+	}
+	if st.AgentDroppedEvents != 7 || len(st.Agents) != 1 || st.Agents[0].DroppedEvents != 7 {
+		t.Errorf("agent dropped events not reported: %+v", st)
+	}
+	if st.ClientDroppedEvents == 0 || len(st.Clients) != 1 || st.Clients[0].DroppedEvents != st.ClientDroppedEvents {
+		t.Errorf("client dropped events not counted: %+v", st)
+	}
+
+	resp, err = http.Get(base + "/api/agents")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var agents struct {
+		Agents []struct {
+			DroppedEvents uint64
+		} `json:"agents"`
+	}
+	json.NewDecoder(resp.Body).Decode(&agents)
+	if len(agents.Agents) != 1 || agents.Agents[0].DroppedEvents != 7 {
+		t.Errorf("/api/agents: %+v", agents)
+	}
+
+	sc := bufio.NewScanner(stream.Body)
+	for sc.Scan() {
+		if sc.Text() == "event: resync" {
+			return
+		}
+	}
+	t.Errorf("no resync event on the stream: %v", sc.Err())
+}
+
+// TestE2E_EventVersions verifies that the server accepts the event stream
+// formats of old and new agents, filling in the positions of version 2 and
+// 3 events from the registered blocks.
+func TestE2E_EventVersions(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip e2e in short mode")
+	}
+
+	env := newTestEnv(t)
+	defer env.cleanup()
+	env.startServer()
+	base := "http://" + env.serverAddr
+
+	resp, err := http.Get(base + "/api/internal/register?hostname=test&pid=1&cmdline=test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	agentID := strings.TrimSpace(string(id))
+
+	resp, err = http.Post(base+"/api/internal/register-blocks?agent_id="+agentID, "text/plain",
+		strings.NewReader("example.com/p/a.go|0|3|2|5|2|1\nexample.com/p/a.go|1|6|3|8|4|2\n#file|4|example.com/p/a.go\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if v := resp.Header.Get(protocol.VersionsHeader); v != protocol.Versions {
+		t.Errorf("register-blocks %s = %q, want %q", protocol.VersionsHeader, v, protocol.Versions)
+	}
+
+	post := func(contentType string, body io.Reader) int {
+		resp, err := http.Post(base+"/api/internal/events?agent_id="+agentID, contentType, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := post("text/plain; version=99", strings.NewReader("1|1|1|example.com/p/a.go|1\n")); code != http.StatusUnsupportedMediaType {
+		t.Errorf("unsupported version: status %d, want %d", code, http.StatusUnsupportedMediaType)
+	}
+	// The events of the unregistered block 7 and file ID 9 are skipped.
+	post("text/plain; version=2", strings.NewReader("1|100|5|example.com/p/a.go|1\n2|101|6|example.com/p/a.go|7\n3|102|5|example.com/p/a.go|1|TestX\n"))
+	var bin bytes.Buffer
+	enc := protocol.NewEncoder(&bin)
+	enc.Encode(&protocol.BinaryEvent{Seq: 4, Timestamp: 103, GID: 5, File: 4, BlockIdx: 0, Test: "TestY"})
+	enc.Encode(&protocol.BinaryEvent{Seq: 5, Timestamp: 104, GID: 5, File: 9, BlockIdx: 0})
+	enc.EncodeDropped(11)
+	post(protocol.BinaryMediaType+"; version=3", &bin)
+
+	resp, err = http.Get(base + "/api/events/history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var history struct {
+		Events []event.CoverEvent `json:"events"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&history); err != nil {
+		t.Fatal(err)
+	}
+	want := []event.CoverEvent{
+		{Seq: 1, Timestamp: 100, GID: 5, FileID: "example.com/p/a.go", BlockIdx: 1, StartLine: 6, StartCol: 3, EndLine: 8, EndCol: 4, NumStmts: 2},
+		{Seq: 3, Timestamp: 102, GID: 5, FileID: "example.com/p/a.go", BlockIdx: 1, StartLine: 6, StartCol: 3, EndLine: 8, EndCol: 4, NumStmts: 2, Test: "TestX"},
+		{Seq: 4, Timestamp: 103, GID: 5, FileID: "example.com/p/a.go", BlockIdx: 0, StartLine: 3, StartCol: 2, EndLine: 5, EndCol: 2, NumStmts: 1, Test: "TestY"},
+	}
+	if !slices.Equal(history.Events, want) {
+		t.Errorf("events = %+v, want %+v", history.Events, want)
+	}
+
+	resp, err = http.Get(base + "/api/agents")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var agents struct {
+		Agents []struct {
+			DroppedEvents uint64
+			EventVersion  int
+		} `json:"agents"`
+	}
+	json.NewDecoder(resp.Body).Decode(&agents)
+	if len(agents.Agents) != 1 || agents.Agents[0].DroppedEvents != 11 || agents.Agents[0].EventVersion != protocol.VersionBinary {
+		t.Errorf("/api/agents: %+v", agents)
+	}
+}
+
+// TestE2E_OldServer verifies that agents send version 1 events to servers
+// that do not list the versions they accept.
+func TestE2E_OldServer(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip e2e in short mode")
+	}
+
+	type stream struct {
+		contentType string
+		line        string
+	}
+	streams := make(chan stream, 10)
+	old := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/internal/register":
+			fmt.Fprint(w, "1")
+		case "/api/internal/events":
+			sc := bufio.NewScanner(r.Body)
+			for sc.Scan() {
+				if !strings.HasPrefix(sc.Text(), "#") {
+					streams <- stream{r.Header.Get("Content-Type"), sc.Text()}
+					break
+				}
+			}
+			io.Copy(io.Discard, r.Body)
+		default:
+			io.Copy(io.Discard, r.Body)
+		}
+	}))
+	defer old.Close()
+
+	env := newTestEnv(t)
+	defer env.cleanup()
+	env.serverAddr = strings.TrimPrefix(old.URL, "http://")
+	bin := env.instrumentAndBuild("testprojects/singlefile")
+	env.startApp(bin)
+	env.hitEndpoint("/branch-a")
+
+	select {
+	case s := <-streams:
+		if s.contentType != "text/plain" {
+			t.Errorf("Content-Type = %q, want text/plain", s.contentType)
+		}
+		if _, err := protocol.DecodeCoverEvent(s.line); err != nil {
+			t.Errorf("not a version 1 event: %q: %v", s.line, err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("no events")
+	}
+}
+
+// TestE2E_HotLoop verifies that events recorded from blocks in tight loops
+// reach the server with the IDs of the goroutines that ran them, and that
+// recording them is free of data races.
+func TestE2E_HotLoop(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip e2e in short mode")
+	}
+
+	env := newTestEnv(t)
+	defer env.cleanup()
+	env.startServer()
+
+	absProject, _ := filepath.Abs("testprojects/hotloop")
+	cmd := exec.Command(gococoBinary, "test", "--host", env.serverAddr, "-race",
+		"-run", "^$", "-bench", ".", "-benchtime", "50x", "-cpu", "1,4", "./...")
+	cmd.Dir = absProject
+	out, err := cmd.CombinedOutput()
+	if err != nil || strings.Contains(string(out), "DATA RACE") {
+		t.Fatalf("gococo test -race -bench: %v\n%s", err, out)
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/api/events/history?last=100000", env.serverAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var history struct {
+		Events []event.CoverEvent `json:"events"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&history); err != nil {
+		t.Fatal(err)
+	}
+	if len(history.Events) == 0 {
+		t.Fatal("no events")
+	}
+	gids := make(map[int64]bool)
+	for _, e := range history.Events {
+		if e.GID <= 0 || e.StartLine == 0 || !strings.HasSuffix(e.FileID, "hotloop.go") {
+			t.Fatalf("bad event %+v", e)
+		}
+		gids[e.GID] = true
+	}
+	// Each benchmark run and each RunParallel worker is its own goroutine.
+	if len(gids) < 2 {
+		t.Errorf("events from %d goroutines, want several", len(gids))
+	}
+
+	resp, err = http.Get(fmt.Sprintf("http://%s/api/agents", env.serverAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var agents struct {
+		Agents []struct {
+			EventVersion int
+		} `json:"agents"`
+	}
+	json.NewDecoder(resp.Body).Decode(&agents)
+	if len(agents.Agents) != 1 || agents.Agents[0].EventVersion != protocol.VersionBinary {
+		t.Errorf("agent should stream binary events: %+v", agents)
+	}
+}
+
+// TestE2E_SnapshotDuringEvents verifies that a counter snapshot taken while
+// events stream in does not count them twice.
+func TestE2E_SnapshotDuringEvents(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip e2e in short mode")
+	}
+
+	env := newTestEnv(t)
+	defer env.cleanup()
+	env.startServer()
+
+	// The startup snapshot is taken while the test emits events.
+	absProject, _ := filepath.Abs("testprojects/hotloop")
+	cmd := exec.Command(gococoBinary, "test", "--host", env.serverAddr, "-run", "TestCountEvenSteady", "./...")
+	cmd.Dir = absProject
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("gococo test: %v\n%s", err, out)
+	}
+
+	// Events and counter snapshots together count each run of a block
+	// once: CountEven runs its loop body 4 times and n++ twice.
+	resp, err := http.Get(fmt.Sprintf("http://%s/api/coverage/blocks?file=testproject/hotloop/hotloop.go", env.serverAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var blocks struct {
+		Blocks []struct {
+			StartLine int    `json:"sl"`
+			HitCount  uint64 `json:"hit_count"`
+		} `json:"blocks"`
+	}
+	json.NewDecoder(resp.Body).Decode(&blocks)
+	hits := make(map[int]uint64)
+	for _, b := range blocks.Blocks {
+		hits[b.StartLine] = b.HitCount
+	}
+	calls := hits[7]
+	if calls == 0 || hits[9] != 4*calls || hits[10] != 2*calls || hits[13] != calls {
+		t.Errorf("hits by line = %v, want 4x and 2x the %d calls on lines 9 and 10", hits, calls)
+	}
+}
+
+// BenchmarkE2E_HotLoop measures the overhead of instrumentation on a tight
+// loop: it reports the ns/op of the hotloop project's BenchmarkCountEven,
+// which runs 1500 blocks per op, built with go test, with gococo test
+// --no-events and with gococo test. With GOCOCO_BASELINE set to another
+// gococo binary, such as one built before a change to the agent, it also
+// reports the ns/op with that binary's gococo test.
+func BenchmarkE2E_HotLoop(b *testing.B) {
+	env := newTestEnv(b)
+	defer env.cleanup()
+	env.startServer()
+
+	absProject, _ := filepath.Abs("testprojects/hotloop")
+	nsPerOp := regexp.MustCompile(`\s([\d.]+) ns/op`)
+	type variant struct {
+		name string
+		cmd  []string
+	}
+	variants := []variant{
+		{"go", []string{"go", "test"}},
+		{"counters", []string{gococoBinary, "test", "--host", env.serverAddr, "--no-events"}},
+		{"events", []string{gococoBinary, "test", "--host", env.serverAddr}},
+	}
+	if baseline := os.Getenv("GOCOCO_BASELINE"); baseline != "" {
+		variants = append(variants, variant{"baseline", []string{baseline, "test", "--host", env.serverAddr}})
+	}
+	for _, bc := range variants {
+		b.Run(bc.name, func(b *testing.B) {
+			var total float64
+			for i := 0; i < b.N; i++ {
+				args := append(bc.cmd[1:], "-run", "^$", "-bench", "^BenchmarkCountEven$", "-benchtime", "2000x", "-count", "1", ".")
+				cmd := exec.Command(bc.cmd[0], args...)
+				cmd.Dir = absProject
+				out, err := cmd.CombinedOutput()
+				m := nsPerOp.FindSubmatch(out)
+				if err != nil || m == nil {
+					b.Fatalf("%s: %v\n%s", strings.Join(bc.cmd, " "), err, out)
+				}
+				var ns float64
+				fmt.Sscan(string(m[1]), &ns)
+				total += ns
+			}
+			b.ReportMetric(total/float64(b.N), "ns/op")
+		})
+	}
+}
+
+// TestE2E_Run verifies that `gococo run` builds and runs a program with
+// its arguments and propagates the program's exit code.
+func TestE2E_Run(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip e2e in short mode")
+	}
+
+	env := newTestEnv(t)
+	defer env.cleanup()
+	env.startServer()
+
+	absProject, _ := filepath.Abs("testprojects/cli")
+	cmd := exec.Command(gococoBinary, "run", "--host", env.serverAddr, ".", "--", "3", "hello", "world")
+	cmd.Dir = absProject
+	var stdout strings.Builder
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+
+	var ee *exec.ExitError
+	if !errors.As(err, &ee) || ee.ExitCode() != 3 {
+		t.Fatalf("expected exit code 3, got %v", err)
+	}
+	if !strings.Contains(stdout.String(), "ARGS hello world") {
+		t.Errorf("program output missing arguments:\n%s", stdout.String())
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/api/agents", env.serverAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var agents struct {
+		Agents []json.RawMessage `json:"agents"`
+	}
+	json.NewDecoder(resp.Body).Decode(&agents)
+	if len(agents.Agents) != 1 {
+		t.Errorf("expected the program to register one agent, got %d", len(agents.Agents))
+	}
+}
+
+// TestE2E_RunOutputDir verifies that gococo run -o DIR/ builds the program
+// into DIR, named as go build names it, whichever form the flag takes.
+func TestE2E_RunOutputDir(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip e2e in short mode")
+	}
+
+	env := newTestEnv(t)
+	defer env.cleanup()
+	env.startServer()
+
+	absProject, _ := filepath.Abs("testprojects/cli")
+	forms := []struct {
+		name string
+		flag func(dir string) []string
+	}{
+		{"separate", func(dir string) []string { return []string{"-o", dir} }},
+		{"equals", func(dir string) []string { return []string{"-o=" + dir} }},
+		{"double dash", func(dir string) []string { return []string{"--o=" + dir} }},
+	}
+	for i, form := range forms {
+		t.Run(form.name, func(t *testing.T) {
+			outDir := filepath.Join(env.tmpDir, fmt.Sprintf("bin%d", i)) + string(filepath.Separator)
+			args := append([]string{"run", "--host", env.serverAddr}, form.flag(outDir)...)
+			cmd := exec.Command(gococoBinary, append(args, ".", "--", "3")...)
+			cmd.Dir = absProject
+			out, err := cmd.CombinedOutput()
+			var ee *exec.ExitError
+			if !errors.As(err, &ee) || ee.ExitCode() != 3 {
+				t.Fatalf("expected exit code 3, got %v\n%s", err, out)
+			}
+			if _, err := os.Stat(filepath.Join(outDir, "cli")); err != nil {
+				t.Errorf("binary not built into %s: %v", outDir, err)
+			}
+		})
+	}
+}
+
+// TestE2E_RunSignalExit verifies that gococo run reports a program killed
+// by a signal with 128 plus the signal number, as shells do.
+func TestE2E_RunSignalExit(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip e2e in short mode")
+	}
+	if runtime.GOOS == "windows" {
+		t.Skip("no signals on windows")
+	}
+
+	env := newTestEnv(t)
+	defer env.cleanup()
+	env.startServer()
+
+	absProject, _ := filepath.Abs("testprojects/cli")
+	cmd := exec.Command(gococoBinary, "run", "--host", env.serverAddr, ".", "--", "kill")
+	cmd.Dir = absProject
+	out, err := cmd.CombinedOutput()
+	var ee *exec.ExitError
+	if want := 128 + int(syscall.SIGKILL); !errors.As(err, &ee) || ee.ExitCode() != want {
+		t.Fatalf("expected exit code %d, got %v\n%s", want, err, out)
+	}
+}
+
+// TestE2E_RunLocalServer verifies that gococo run exits with the program's
+// exit code when it started its own server, without waiting for Ctrl-C.
+func TestE2E_RunLocalServer(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip e2e in short mode")
+	}
+
+	absProject, _ := filepath.Abs("testprojects/cli")
+	cmd := exec.Command(gococoBinary, "run", "--host", freePort(t), ".", "--", "3")
+	cmd.Dir = absProject
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		var ee *exec.ExitError
+		if !errors.As(err, &ee) || ee.ExitCode() != 3 {
+			t.Fatalf("expected exit code 3, got %v\n%s", err, stderr.String())
+		}
+	case <-time.After(60 * time.Second):
+		cmd.Process.Kill()
+		t.Fatalf("gococo run did not exit after the program:\n%s", stderr.String())
+	}
+	if !strings.Contains(stderr.String(), "started in-process server") {
+		t.Errorf("expected an in-process server:\n%s", stderr.String())
+	}
+}
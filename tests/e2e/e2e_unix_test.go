@@ -0,0 +1,115 @@
+//go:build unix
+
+package e2e
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestE2E_OfflineMode verifies that with GOCOCO_OUTPUT an agent writes its
+// coverage and events to files, dumping them on SIGUSR1, and that gococo
+// import loads both into a server.
+func TestE2E_OfflineMode(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip e2e in short mode")
+	}
+
+	env := newTestEnv(t)
+	defer env.cleanup()
+	// The agent must not need the server it was built for.
+	env.serverAddr = freePort(t)
+	bin := env.instrumentAndBuild("testprojects/singlefile")
+
+	outDir := filepath.Join(env.tmpDir, "out")
+	env.startApp(bin, "GOCOCO_OUTPUT="+outDir, "GOCOCO_OUTPUT_EVENTS=1")
+	env.hitEndpoint("/branch-a")
+	if err := env.appCmd.Process.Signal(syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+
+	// branchA's "return n * 2" block runs on /branch-a, and the dump writes
+	// both files.
+	profile := ""
+	deadline := time.Now().Add(5 * time.Second)
+	for profile == "" && time.Now().Before(deadline) {
+		matches, _ := filepath.Glob(filepath.Join(outDir, "gococo-*.cov"))
+		if len(matches) == 1 {
+			data, _ := os.ReadFile(matches[0])
+			events, _ := os.ReadFile(strings.TrimSuffix(matches[0], ".cov") + ".events")
+			if strings.Contains(string(data), "/main.go:43.3,44.3 1 1\n") &&
+				strings.Contains(string(events), "|43|3|44|3|1") {
+				profile = matches[0]
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if profile == "" {
+		t.Fatalf("no coverprofile and event file with the /branch-a hits in %s", outDir)
+	}
+	data, _ := os.ReadFile(profile)
+	if !strings.HasPrefix(string(data), "mode: ") {
+		t.Errorf("profile does not start with a mode line:\n%s", data)
+	}
+	events := strings.TrimSuffix(profile, ".cov") + ".events"
+	env.appCmd.Process.Kill()
+	env.appCmd.Wait()
+
+	env.startServer()
+	out, err := exec.Command(gococoBinary, "import", "--server", env.serverAddr, "--label", "offline", profile).CombinedOutput()
+	if err != nil {
+		t.Fatalf("gococo import %s: %v\n%s", profile, err, out)
+	}
+	cs := env.getCoverageSummary()
+	if f := env.findFile(cs, "main.go"); f == nil || f.HitStmts == 0 {
+		t.Fatalf("imported offline profile has no hits: %+v", cs)
+	}
+
+	out, err = exec.Command(gococoBinary, "import", "--server", env.serverAddr, events).CombinedOutput()
+	if err != nil {
+		t.Fatalf("gococo import %s: %v\n%s", events, err, out)
+	}
+	t.Logf("%s", out)
+	if !strings.Contains(string(out), "replayed ") {
+		t.Errorf("expected the event file to be replayed, got: %s", out)
+	}
+	env.waitForEvents(1, 5*time.Second)
+}
+
+// TestE2E_FlushOnSignal verifies that an agent flushes coverage on SIGTERM
+// and that the program then still dies of the signal.
+func TestE2E_FlushOnSignal(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip e2e in short mode")
+	}
+
+	env := newTestEnv(t)
+	defer env.cleanup()
+	env.startServer()
+	bin := env.instrumentAndBuild("testprojects/singlefile")
+	env.startApp(bin)
+	env.hitEndpoint("/branch-b")
+
+	if err := env.appCmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	err := env.appCmd.Wait()
+	var ee *exec.ExitError
+	if !errors.As(err, &ee) {
+		t.Fatalf("expected the app to be killed, got %v", err)
+	}
+	if ws, ok := ee.Sys().(syscall.WaitStatus); !ok || !ws.Signaled() || ws.Signal() != syscall.SIGTERM {
+		t.Errorf("expected the app to die of SIGTERM, got %v", err)
+	}
+
+	cs := env.getCoverageSummary()
+	if f := env.findFile(cs, "main.go"); f == nil || f.HitStmts == 0 {
+		t.Errorf("no coverage after SIGTERM: %+v", cs)
+	}
+}
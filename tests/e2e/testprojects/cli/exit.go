@@ -0,0 +1,10 @@
+//gococo:ignore
+
+package main
+
+import "os"
+
+// exit ends the program from a file that has no coverage blocks.
+func exit(code int) {
+	os.Exit(code)
+}
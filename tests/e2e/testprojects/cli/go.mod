@@ -0,0 +1,3 @@
+module testproject/cli
+
+go 1.21
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// main echoes its arguments and exits with the code given as the first one.
+// Given "panic", it panics with them; "fatal" logs them with log.Fatal;
+// "exit" exits with code 4 from a file without coverage; "kill" kills the
+// program.
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Println("usage: cli CODE|panic|fatal|exit|kill [ARGS...]")
+		os.Exit(2)
+	}
+	switch os.Args[1] {
+	case "panic":
+		panic(strings.Join(os.Args[2:], " "))
+	case "fatal":
+		log.Fatal(strings.Join(os.Args[2:], " "))
+	case "exit":
+		exit(4)
+	case "kill":
+		p, _ := os.FindProcess(os.Getpid())
+		p.Kill()
+		select {}
+	}
+	code, err := strconv.Atoi(os.Args[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bad exit code: %v\n", err)
+		os.Exit(2)
+	}
+	fmt.Printf("ARGS %s\n", strings.Join(os.Args[2:], " "))
+	os.Exit(code)
+}
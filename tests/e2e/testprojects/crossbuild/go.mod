@@ -0,0 +1,3 @@
+module testproject/crossbuild
+
+go 1.21
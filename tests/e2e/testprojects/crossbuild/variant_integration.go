@@ -0,0 +1,5 @@
+//go:build integration
+
+package main
+
+func variant() string { return "integration" }
@@ -0,0 +1,3 @@
+module testproject/hotloop
+
+go 1.21
@@ -0,0 +1,14 @@
+// Package hotloop runs small blocks in tight loops, to measure the overhead
+// of instrumentation.
+package hotloop
+
+// CountEven returns the number of even values in xs.
+func CountEven(xs []int) int {
+	n := 0
+	for _, x := range xs {
+		if x%2 == 0 {
+			n++
+		}
+	}
+	return n
+}
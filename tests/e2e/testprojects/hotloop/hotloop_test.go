@@ -0,0 +1,49 @@
+package hotloop
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCountEven(t *testing.T) {
+	if got := CountEven([]int{1, 2, 3, 4}); got != 2 {
+		t.Fatalf("CountEven = %d, want 2", got)
+	}
+}
+
+func values() []int {
+	xs := make([]int, 1000)
+	for i := range xs {
+		xs[i] = i
+	}
+	return xs
+}
+
+// BenchmarkCountEven runs 1500 blocks per iteration.
+func BenchmarkCountEven(b *testing.B) {
+	xs := values()
+	for i := 0; i < b.N; i++ {
+		CountEven(xs)
+	}
+}
+
+// BenchmarkCountEvenParallel runs 1500 blocks per iteration, from
+// GOMAXPROCS goroutines.
+func BenchmarkCountEvenParallel(b *testing.B) {
+	xs := values()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			CountEven(xs)
+		}
+	})
+}
+
+// TestCountEvenSteady runs CountEven for a second at a pace the event
+// stream keeps up with.
+func TestCountEvenSteady(t *testing.T) {
+	xs := []int{1, 2, 3, 4}
+	for end := time.Now().Add(time.Second); time.Now().Before(end); {
+		CountEven(xs)
+		time.Sleep(100 * time.Microsecond)
+	}
+}
@@ -0,0 +1,3 @@
+module testproject/testnames
+
+go 1.21
@@ -0,0 +1,10 @@
+// Package names has tests with long names.
+package names
+
+// Double returns twice x.
+func Double(x int) int {
+	if x < 0 {
+		return -2 * -x
+	}
+	return 2 * x
+}
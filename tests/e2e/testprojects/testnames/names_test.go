@@ -0,0 +1,22 @@
+package names
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDouble(t *testing.T) {
+	if got := Double(-2); got != -4 {
+		t.Fatalf("Double(-2) = %d", got)
+	}
+}
+
+// TestLongName runs a subtest whose name is longer than a test frame of the
+// event stream may name.
+func TestLongName(t *testing.T) {
+	t.Run(strings.Repeat("x", 40000), func(t *testing.T) {
+		if got := Double(3); got != 6 {
+			t.Fatalf("Double(3) = %d", got)
+		}
+	})
+}
@@ -0,0 +1,15 @@
+// Package extlib is a separate module used by the withdep test project.
+package extlib
+
+// Double returns twice n.
+func Double(n int) int {
+	if n < 0 {
+		return -Double(-n)
+	}
+	return n * 2
+}
+
+// Unused is never called.
+func Unused() int {
+	return 42
+}
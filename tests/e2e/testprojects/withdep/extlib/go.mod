@@ -0,0 +1,3 @@
+module testproject/extlib
+
+go 1.21
@@ -0,0 +1,7 @@
+module testproject/withdep
+
+go 1.21
+
+require testproject/extlib v0.0.0
+
+replace testproject/extlib => ./extlib
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+
+	"testproject/extlib"
+)
+
+func main() {
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "0"
+	}
+
+	http.HandleFunc("/double", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%d", extlib.Double(21))
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "listen: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("LISTEN %s\n", ln.Addr().String())
+	http.Serve(ln, nil)
+}
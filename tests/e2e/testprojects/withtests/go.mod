@@ -0,0 +1,3 @@
+module testproject/withtests
+
+go 1.21
@@ -0,0 +1,23 @@
+package mathx_test
+
+import (
+	"testing"
+
+	"testproject/withtests/mathx"
+)
+
+var setupDone bool
+
+func TestMain(m *testing.M) {
+	setupDone = true
+	m.Run()
+}
+
+func TestClamp(t *testing.T) {
+	if !setupDone {
+		t.Fatal("TestMain did not run")
+	}
+	if got := mathx.Clamp(15, 0, 10); got != 10 {
+		t.Fatalf("Clamp(15, 0, 10) = %d", got)
+	}
+}
@@ -0,0 +1,74 @@
+package mathx
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAbs(t *testing.T) {
+	t.Run("negative", func(t *testing.T) {
+		if got := Abs(-3); got != 3 {
+			t.Fatalf("Abs(-3) = %d", got)
+		}
+	})
+	t.Run("positive", func(t *testing.T) {
+		if got := Abs(4); got != 4 {
+			t.Fatalf("Abs(4) = %d", got)
+		}
+	})
+}
+
+func TestFailOnRequest(t *testing.T) {
+	if os.Getenv("WITHTESTS_FAIL") != "" {
+		t.Fatal("failing as requested by WITHTESTS_FAIL")
+	}
+}
+
+// TestAbsConcurrent exercises the same blocks from many goroutines, which
+// races on the counters unless they are updated atomically.
+func TestAbsConcurrent(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := -100; j < 100; j++ {
+				Abs(j)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// TestAbsParallel runs Abs in two parallel subtests, which wait for each
+// other so that both are running when they call it.
+func TestAbsParallel(t *testing.T) {
+	var started sync.WaitGroup
+	started.Add(2)
+	both := make(chan struct{})
+	go func() {
+		started.Wait()
+		close(both)
+	}()
+	for _, x := range []int{-5, 5} {
+		name := "positive"
+		if x < 0 {
+			name = "negative"
+		}
+		x := x
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			started.Done()
+			select {
+			case <-both:
+			case <-time.After(10 * time.Second):
+				t.Skip("the other subtest did not start; run with -parallel 2 or more")
+			}
+			if got := Abs(x); got != 5 {
+				t.Fatalf("Abs(%d) = %d", x, got)
+			}
+		})
+	}
+}
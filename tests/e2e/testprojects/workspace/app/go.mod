@@ -0,0 +1,3 @@
+module testproject/workspace/app
+
+go 1.21
@@ -0,0 +1,3 @@
+module testproject/workspace/lib
+
+go 1.21
@@ -0,0 +1,10 @@
+// Package lib is a workspace module used by the app module.
+package lib
+
+// Greet returns a greeting for name.
+func Greet(name string) string {
+	if name == "" {
+		return "hello, stranger"
+	}
+	return "hello, " + name
+}
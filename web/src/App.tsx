@@ -101,7 +101,23 @@ export const App: React.FC = () => {
     [scheduleUpdate, ensureSource]
   );
 
-  const { connected } = useEventStream(handleEvent);
+  // Reload the coverage of every known file after missing events
+  const handleResync = useCallback(() => {
+    for (const f of store.getFiles()) {
+      fetch(`/api/coverage/blocks?file=${encodeURIComponent(f.path)}`)
+        .then((res) => res.json())
+        .then((data) => {
+          if (data.blocks) {
+            store.hydrateBlocks(f.path, data.blocks, true);
+            scheduleUpdate();
+          }
+        })
+        .catch(() => {});
+    }
+    fetchServerCoverage();
+  }, [scheduleUpdate, fetchServerCoverage]);
+
+  const { connected } = useEventStream(handleEvent, handleResync);
 
   // Periodic: refresh glow decay, time-ago, and server coverage
   useEffect(() => {
@@ -80,8 +80,16 @@ export const CodeView: React.FC<Props> = ({ fileState, isRecentlyHit }) => {
             const recent = lh && isRecentlyHit(lh.lastHitAt);
             const code = sourceLines[lineNumber - 1] ?? '';
 
+            // Lines hit only by imported coverprofiles are shown apart
+            // from live coverage, and imported hits are labelled.
+            const imports = lh
+              ? Array.from(lh.sources).filter((s) => s !== 'live')
+              : [];
+            const live = !!lh?.sources.has('live');
+
             let className = 'code-line';
             if (hit && recent) className += ' code-line-hot';
+            else if (hit && !live && imports.length > 0) className += ' code-line-imported';
             else if (hit) className += ' code-line-hit';
 
             return (
@@ -103,7 +111,17 @@ export const CodeView: React.FC<Props> = ({ fileState, isRecentlyHit }) => {
                 {hit && (
                   <span className="line-meta">
                     <span className="hit-count">x{lh!.hitCount}</span>
-                    <span className="hit-time">{formatTime(lh!.lastHitAt)}</span>
+                    {imports.length > 0 && (
+                      <span
+                        className="hit-source"
+                        title={live ? 'live and imported coverage' : 'imported coverage only'}
+                      >
+                        {(live ? ['live', ...imports] : imports).join(' + ')}
+                      </span>
+                    )}
+                    {lh!.lastHitAt > 0 && (
+                      <span className="hit-time">{formatTime(lh!.lastHitAt)}</span>
+                    )}
                   </span>
                 )}
               </div>
@@ -1,10 +1,14 @@
 import { useEffect, useRef, useCallback, useState } from 'react';
 import { CoverEvent } from '../types';
 
-export function useEventStream(onEvent: (event: CoverEvent) => void) {
+// onResync is called when the server dropped events for this client because
+// it did not keep up; the client should reload its coverage.
+export function useEventStream(onEvent: (event: CoverEvent) => void, onResync?: () => void) {
   const eventSourceRef = useRef<EventSource | null>(null);
   const onEventRef = useRef(onEvent);
   onEventRef.current = onEvent;
+  const onResyncRef = useRef(onResync);
+  onResyncRef.current = onResync;
   const [connected, setConnected] = useState(false);
 
   useEffect(() => {
@@ -24,6 +28,10 @@ export function useEventStream(onEvent: (event: CoverEvent) => void) {
       }
     };
 
+    es.addEventListener('resync', () => {
+      onResyncRef.current?.();
+    });
+
     es.onerror = () => {
       setConnected(false);
       // EventSource auto-reconnects
@@ -10,10 +10,14 @@ interface BlockData {
   el: number;
   ec: number;
   stmts: number;
-  hit_count: number;
+  hit_count: number; // live_hits plus imported hits
   last_hit_ts: number;
+  live_hits: number;
+  imported?: Record<string, number>; // import label -> hits
 }
 
+const LIVE_SOURCE = 'live';
+
 export class EventStore {
   private files = new Map<string, FileState>();
   private goroutines = new Set<number>();
@@ -60,12 +64,14 @@ export class EventStore {
           hitCount: 0,
           lastHitAt: 0,
           goroutineIds: new Set(),
+          sources: new Set(),
         };
         fileState.lines.set(line, lh);
       }
       lh.hitCount++;
       lh.lastHitAt = now;
       lh.goroutineIds.add(event.gid);
+      lh.sources.add(LIVE_SOURCE);
     }
 
     if (this.recentEvents.length >= this.maxRecent) {
@@ -75,8 +81,10 @@ export class EventStore {
     this.notify();
   }
 
-  // Hydrate from server block-level data (for blocks hit before page load)
-  hydrateBlocks(filePath: string, blocks: BlockData[]) {
+  // Hydrate from server block-level data (for blocks hit before page load).
+  // With overwrite, the server's hit counts replace the live ones, as after
+  // events were missed.
+  hydrateBlocks(filePath: string, blocks: BlockData[], overwrite = false) {
     let fileState = this.files.get(filePath);
     if (!fileState) {
       fileState = {
@@ -98,14 +106,19 @@ export class EventStore {
             hitCount: 0,
             lastHitAt: 0,
             goroutineIds: new Set(),
+            sources: new Set(),
           };
           fileState.lines.set(line, lh);
         }
         // Only set if not already updated by live events (don't overwrite fresher data)
-        if (lh.hitCount === 0) {
+        if (lh.hitCount === 0 || overwrite) {
           lh.hitCount = b.hit_count;
           lh.lastHitAt = b.last_hit_ts;
         }
+        if (b.live_hits > 0) lh.sources.add(LIVE_SOURCE);
+        for (const [label, hits] of Object.entries(b.imported ?? {})) {
+          if (hits > 0) lh.sources.add(label);
+        }
       }
     }
   }
@@ -9,6 +9,7 @@ export interface CoverEvent {
   el: number;
   ec: number;
   stmts: number;
+  test?: string; // running test, from `gococo test` binaries
 }
 
 export interface AgentInfo {
@@ -18,9 +19,12 @@ export interface AgentInfo {
     pid: number;
     cmdline: string;
     remote_ip: string;
+    cover_mode?: string;
   };
   Connected: boolean;
   Since: string;
+  DroppedEvents: number;
+  EventVersion: number;
 }
 
 export interface CoverageSummaryEntry {
@@ -45,6 +49,8 @@ export interface LineHighlight {
   hitCount: number;
   lastHitAt: number; // timestamp ms
   goroutineIds: Set<number>;
+  // "live" if agents hit the line, plus the labels of imported coverprofiles
+  sources: Set<string>;
 }
 
 export interface FileState {